@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// adminEnabled reports if any admin credentials are configured
+func adminEnabled() bool {
+	return os.Getenv("ADMIN_TOKEN") != "" || os.Getenv("ADMIN_PASSWORD") != ""
+}
+
+// adminHandler serves the admin route group. Paths are relative to `/admin`.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/overview", methodHandler(adminOverviewHandler, http.MethodGet))
+	mux.HandleFunc("/reload", methodHandler(adminReloadHandler, http.MethodPost))
+	mux.HandleFunc("/debug", methodHandler(adminDebugHandler, http.MethodGet))
+	mux.HandleFunc("/reports", methodHandler(adminReportsHandler, http.MethodGet))
+	mux.HandleFunc("/reports/", methodHandler(adminReportHandler, http.MethodPost))
+	mux.HandleFunc("/suspensions/", methodHandler(adminSuspensionHandler, http.MethodDelete))
+	mux.HandleFunc("/export/", methodHandler(adminExportHandler, http.MethodGet))
+	mux.HandleFunc("/kick", methodHandler(adminKickHandler, http.MethodPost))
+	mux.HandleFunc("/ice-servers", methodHandler(adminICEServersHandler, http.MethodGet, http.MethodPut))
+	mux.HandleFunc("/impairments", methodHandler(adminImpairmentsHandler, http.MethodGet, http.MethodPut))
+	mux.HandleFunc("/publish-token/", methodHandler(adminPublishTokenHandler, http.MethodGet))
+	mux.HandleFunc("/maintenance", methodHandler(adminMaintenanceHandler, http.MethodGet, http.MethodPut, http.MethodDelete))
+
+	// pprof.Index expects to be mounted at /debug/pprof/
+	mux.HandleFunc("/pprof/", func(res http.ResponseWriter, req *http.Request) {
+		req.URL.Path = "/debug" + req.URL.Path
+		pprof.Index(res, req)
+	})
+	mux.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/pprof/trace", pprof.Trace)
+
+	return http.HandlerFunc(adminAuthHandler(mux.ServeHTTP))
+}
+
+func adminOverviewHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(res).Encode(webrtc.GetAdminOverview()); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func adminDebugHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(res).Encode(webrtc.GetDebugDump()); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+type adminKickRequestJSON struct {
+	StreamKey     string `json:"streamKey"`
+	WHEPSessionID string `json:"whepSessionId"`
+}
+
+// adminKickHandler disconnects the viewer with `{"whepSessionId": ""}` or the
+// publisher with `{"streamKey": ""}`. They are told they were kicked
+func adminKickHandler(res http.ResponseWriter, req *http.Request) {
+	var r adminKickRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case r.WHEPSessionID != "":
+		err = webrtc.EndWHEP(r.WHEPSessionID, webrtc.StreamEndedKicked)
+	case r.StreamKey != "":
+		err = webrtc.EndWHIP(r.StreamKey, webrtc.StreamEndedKicked)
+	default:
+		logHTTPError(res, "streamKey or whepSessionId must be set", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case errors.Is(err, webrtc.ErrNoPublisher), errors.Is(err, webrtc.ErrWHEPSessionNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	default:
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminICEServersHandler rotates the STUN and TURN servers and credentials
+// with PUT, fields that are omitted are kept. New PeerConnections use them
+// until the next reload, the password is never returned
+func adminICEServersHandler(res http.ResponseWriter, req *http.Request) {
+	config := webrtc.GetICEServerConfig()
+	if req.Method == http.MethodPut {
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		webrtc.SetICEServerConfig(config)
+	}
+
+	config.TURNPassword = ""
+	writeJSON(res, http.StatusOK, config)
+}
+
+type adminImpairmentRequestJSON struct {
+	StreamKey     string `json:"streamKey"`
+	WHEPSessionID string `json:"whepSessionId"`
+	webrtc.Impairment
+}
+
+// adminImpairmentsHandler adds latency, jitter and loss to the video of every
+// viewer with PUT `{"streamKey": ""}` or of one with `{"whepSessionId": ""}`.
+// Zero values remove it. Only available with APP_ENV=development
+func adminImpairmentsHandler(res http.ResponseWriter, req *http.Request) {
+	if os.Getenv("APP_ENV") != "development" {
+		logHTTPError(res, "Network impairment is only available with APP_ENV=development", http.StatusForbidden)
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		writeJSON(res, http.StatusOK, webrtc.GetImpairments())
+		return
+	}
+
+	var r adminImpairmentRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case r.WHEPSessionID != "":
+		err = webrtc.SetWHEPImpairment(r.WHEPSessionID, r.Impairment)
+	case r.StreamKey != "":
+		err = webrtc.SetStreamImpairment(r.StreamKey, r.Impairment)
+	default:
+		logHTTPError(res, "streamKey or whepSessionId must be set", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case errors.Is(err, webrtc.ErrWHEPSessionNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	default:
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type adminMaintenanceRequestJSON struct {
+	StartsAt int64  `json:"startsAt"`
+	Message  string `json:"message"`
+}
+
+// adminMaintenanceHandler schedules the maintenance window with PUT
+// `{"startsAt": <unix>, "message": ""}` and cancels it with DELETE. Viewers
+// of every stream are counted down, new sessions are refused once it starts
+func adminMaintenanceHandler(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPut:
+		var r adminMaintenanceRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		maintenance, err := webrtc.ScheduleMaintenance(r.StartsAt, r.Message)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(res, http.StatusOK, maintenance)
+	case http.MethodDelete:
+		if !webrtc.CancelMaintenance() {
+			logHTTPError(res, "Maintenance not found", http.StatusNotFound)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		maintenance := webrtc.GetMaintenance()
+		if maintenance == nil {
+			logHTTPError(res, "Maintenance not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(res, http.StatusOK, maintenance)
+	}
+}
+
+// adminAuthorized accepts either `Authorization: Bearer <ADMIN_TOKEN>` or basic auth
+// with ADMIN_USERNAME and ADMIN_PASSWORD
+func adminAuthorized(req *http.Request) bool {
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		expectedUsername := os.Getenv("ADMIN_USERNAME")
+		if expectedUsername == "" {
+			expectedUsername = "admin"
+		}
+
+		username, givenPassword, ok := req.BasicAuth()
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(expectedUsername)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1
+		if ok && usernameMatch && passwordMatch {
+			return true
+		}
+	}
+
+	return false
+}
+
+func adminAuthHandler(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !adminAuthorized(req) {
+			if os.Getenv("ADMIN_PASSWORD") != "" {
+				res.Header().Set("WWW-Authenticate", `Basic realm="Broadcast Box Admin"`)
+			}
+			logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(res, req)
+	}
+}
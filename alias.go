@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const bearerPrefix = "Bearer "
+
+type aliasRequestJSON struct {
+	StreamKey string `json:"streamKey"`
+}
+
+// viewerStreamKey namespaces the stream key or alias a viewer asked for and
+// resolves the alias. Live stream keys match first, so an alias can't take
+// viewers from a stream. Both match with or without the Bearer prefix the
+// frontend sends
+func viewerStreamKey(req *http.Request, streamKeyOrAlias string) (string, error) {
+	t, err := viewingTenant(req)
+	if err != nil {
+		return "", err
+	}
+
+	streamKey, err := namespacedStreamKey(t, streamKeyOrAlias)
+	if err != nil {
+		return "", err
+	} else if webrtc.IsLive(streamKey) {
+		return streamKey, checkTenantQuota(t, streamKey, true)
+	}
+
+	// Stream keys are the raw Authorization of the publisher, so a viewer may
+	// have the key with or without the Bearer prefix the publisher used
+	if other, err := namespacedStreamKey(t, otherBearerForm(streamKeyOrAlias)); err == nil && webrtc.IsLive(other) {
+		return other, checkTenantQuota(t, other, true)
+	}
+
+	if alias := strings.TrimPrefix(streamKeyOrAlias, bearerPrefix); webrtc.ValidAlias(alias) {
+		if alias, err = namespacedStreamKey(t, alias); err == nil {
+			if aliased, ok := webrtc.ResolveAlias(alias); ok {
+				return aliased, checkTenantQuota(t, aliased, true)
+			}
+		}
+	}
+
+	return streamKey, checkTenantQuota(t, streamKey, true)
+}
+
+// otherBearerForm adds the Bearer prefix to a stream key, or removes it if it has one
+func otherBearerForm(streamKey string) string {
+	if strings.HasPrefix(streamKey, bearerPrefix) {
+		return strings.TrimPrefix(streamKey, bearerPrefix)
+	}
+	return bearerPrefix + streamKey
+}
+
+// aliasHandler points `/api/alias/{alias}` at a stream with PUT
+// `{"streamKey": ""}` and removes it with DELETE. If streamKey is omitted the
+// Authorization header is used as the stream key
+func aliasHandler(res http.ResponseWriter, req *http.Request) {
+	alias := path.Base(req.URL.Path)
+	if !webrtc.ValidAlias(alias) {
+		logHTTPError(res, webrtc.ErrInvalidAlias.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if alias, err = namespacedStreamKey(t, alias); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		streamKey, ok := webrtc.ResolveAlias(alias)
+		if !ok {
+			logHTTPError(res, "Alias not found", http.StatusNotFound)
+			return
+		} else if !publisherAuthorized(req, streamKey) {
+			logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		webrtc.DeleteAlias(alias)
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var r aliasRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.StreamKey == "" {
+		r.StreamKey = req.Header.Get("Authorization")
+	}
+
+	streamKey, err := namespacedStreamKey(t, r.StreamKey)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if !publisherAuthorized(req, streamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Viewers match stream keys with or without the Bearer prefix, so the alias
+	// may not be either form of another stream's key
+	if bearerAlias, err := namespacedStreamKey(t, otherBearerForm(path.Base(req.URL.Path))); err == nil && bearerAlias != streamKey && webrtc.StreamExists(bearerAlias) {
+		logHTTPError(res, webrtc.ErrAliasIsKey.Error(), http.StatusConflict)
+		return
+	}
+
+	err = webrtc.SetAlias(alias, streamKey)
+	switch {
+	case errors.Is(err, webrtc.ErrAliasTaken), errors.Is(err, webrtc.ErrAliasIsKey):
+		logHTTPError(res, err.Error(), http.StatusConflict)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	default:
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pion/stun/v2"
+	"github.com/pion/turn/v3"
+	pionwebrtc "github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/store"
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	checkPassedMessage = "\033[0;32m✓ %s\033[0m\n"
+	checkFailedMessage = "\033[0;31m✗ %s: %s\033[0m\n"
+)
+
+type configCheck struct {
+	name  string
+	check func() error
+}
+
+func checkAddress(env string) func() error {
+	return func() error {
+		val := os.Getenv(env)
+		if val == "" {
+			return nil
+		}
+
+		if _, _, err := net.SplitHostPort(val); err != nil {
+			return fmt.Errorf("%s=%q is not a valid host:port, %w", env, val, err)
+		}
+		return nil
+	}
+}
+
+// checkGRPCAddress validates GRPC_ADDRESS, every RPC needs the ADMIN_TOKEN
+func checkGRPCAddress() error {
+	if os.Getenv("GRPC_ADDRESS") == "" {
+		return nil
+	} else if os.Getenv("ADMIN_TOKEN") == "" {
+		return errGRPCNeedsAdminToken
+	}
+
+	address := os.Getenv("GRPC_ADDRESS")
+	if _, ok := unixSocketPath(address); ok {
+		return nil
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("GRPC_ADDRESS=%q is not a valid host:port or unix socket, %w", address, err)
+	}
+	return nil
+}
+
+func checkHTTPAddress(env string) func() error {
+	return func() error {
+		val := os.Getenv(env)
+		if val == "" {
+			return nil
+		}
+
+		for _, address := range strings.Split(val, "|") {
+			if _, ok := unixSocketPath(address); ok {
+				continue
+			} else if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("%s=%q is not a valid host:port or unix socket, %w", env, val, err)
+			}
+		}
+		return nil
+	}
+}
+
+func checkPort(env string) func() error {
+	return func() error {
+		val := os.Getenv(env)
+		if val == "" {
+			return nil
+		}
+
+		if port, err := strconv.Atoi(val); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%s=%q is not a port between 1 and 65535", env, val)
+		}
+		return nil
+	}
+}
+
+func checkInteger(env string) func() error {
+	return func() error {
+		val := os.Getenv(env)
+		if val == "" {
+			return nil
+		}
+
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return fmt.Errorf("%s=%q is not a positive integer", env, val)
+		}
+		return nil
+	}
+}
+
+func checkDuration(env string) func() error {
+	return func() error {
+		val := os.Getenv(env)
+		if val == "" {
+			return nil
+		}
+
+		if _, err := time.ParseDuration(val); err != nil {
+			return fmt.Errorf("%s=%q is not a duration like 30s, %w", env, val, err)
+		}
+		return nil
+	}
+}
+
+func checkOneOf(env string, values ...string) func() error {
+	return func() error {
+		val := os.Getenv(env)
+		if val == "" {
+			return nil
+		}
+
+		for _, v := range values {
+			if val == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s=%q must be one of %s", env, val, strings.Join(values, ", "))
+	}
+}
+
+func checkTLS() error {
+	tlsKey, tlsCert := os.Getenv("SSL_KEY"), os.Getenv("SSL_CERT")
+	if tlsKey == "" && tlsCert == "" {
+		return nil
+	} else if tlsKey == "" || tlsCert == "" {
+		return errors.New("SSL_KEY and SSL_CERT must be set together")
+	}
+
+	_, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	return err
+}
+
+func checkNAT1To1IP() error {
+	if val := os.Getenv("NAT_1_TO_1_IP"); val != "" && net.ParseIP(val) == nil {
+		return fmt.Errorf("NAT_1_TO_1_IP=%q is not an IP address", val)
+	}
+	return nil
+}
+
+func checkWebhookURLs() error {
+	if urls := os.Getenv("WEBHOOK_URLS"); urls != "" {
+		for _, u := range strings.Split(urls, "|") {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				return err
+			} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+				return fmt.Errorf("webhook %q must be a http or https URL", u)
+			}
+		}
+	}
+	return nil
+}
+
+func checkGeoIPDatabases() error {
+	for _, env := range []string{"GEOIP_COUNTRY_DATABASE", "GEOIP_ASN_DATABASE"} {
+		if path := os.Getenv(env); path != "" {
+			db, err := maxminddb.Open(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			_ = db.Close()
+		}
+	}
+	return nil
+}
+
+func checkTrustedProxies() error {
+	_, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	return err
+}
+
+func checkSimulcastRIDMap() error {
+	_, err := webrtc.ParseSimulcastRIDMap(os.Getenv("SIMULCAST_RID_MAP"))
+	return err
+}
+
+func checkSTUNServers() error {
+	stunServers := os.Getenv("STUN_SERVERS")
+	if stunServers == "" {
+		return nil
+	}
+
+	for _, stunServer := range strings.Split(stunServers, "|") {
+		client, err := stun.Dial("udp", stunServer)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stunServer, err)
+		}
+
+		var responseErr error
+		if err = client.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(e stun.Event) {
+			responseErr = e.Error
+		}); err == nil {
+			err = responseErr
+		}
+		_ = client.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s did not answer a binding request: %w", stunServer, err)
+		}
+	}
+	return nil
+}
+
+// checkTURNServers allocates a relay on every TURN server with TURN_USERNAME
+// and TURN_PASSWORD, which proves it is reachable and the credentials work
+func checkTURNServers() error {
+	turnServers := os.Getenv("TURN_SERVERS")
+	if turnServers == "" {
+		return nil
+	}
+
+	for _, turnServer := range strings.Split(turnServers, "|") {
+		if err := allocateTURNRelay(turnServer); err != nil {
+			return fmt.Errorf("%s did not allocate a relay: %w", turnServer, err)
+		}
+	}
+	return nil
+}
+
+func allocateTURNRelay(turnServer string) error {
+	conn, err := net.ListenPacket("udp", "0.0.0.0:0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: turnServer,
+		TURNServerAddr: turnServer,
+		Username:       os.Getenv("TURN_USERNAME"),
+		Password:       os.Getenv("TURN_PASSWORD"),
+		Conn:           conn,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Listen(); err != nil {
+		return err
+	}
+
+	relay, err := client.Allocate()
+	if err != nil {
+		return err
+	}
+	return relay.Close()
+}
+
+// checkCodecs registers the codecs and header extensions every PeerConnection
+// negotiates, so a codec the media engine rejects fails before the first offer
+func checkCodecs() error {
+	return webrtc.PopulateMediaEngine(&pionwebrtc.MediaEngine{})
+}
+
+// runConfigCheck validates the loaded configuration and returns the exit code
+func runConfigCheck() int {
+	checks := []configCheck{
+		{"HTTP_ADDRESS", checkHTTPAddress("HTTP_ADDRESS")},
+		{"INTERNAL_HTTP_ADDRESS", checkHTTPAddress("INTERNAL_HTTP_ADDRESS")},
+		{"GRPC_ADDRESS", checkGRPCAddress},
+		{"HTTP_READ_TIMEOUT", checkDuration("HTTP_READ_TIMEOUT")},
+		{"HTTP_WRITE_TIMEOUT", checkDuration("HTTP_WRITE_TIMEOUT")},
+		{"HTTP_IDLE_TIMEOUT", checkDuration("HTTP_IDLE_TIMEOUT")},
+		{"HTTP_MAX_BODY_SIZE", checkInteger("HTTP_MAX_BODY_SIZE")},
+		{"SHUTDOWN_GRACE_PERIOD", checkDuration("SHUTDOWN_GRACE_PERIOD")},
+		{"SSE_KEEPALIVE_INTERVAL", checkDuration("SSE_KEEPALIVE_INTERVAL")},
+		{"STATS_WS_INTERVAL", checkDuration("STATS_WS_INTERVAL")},
+		{"HTTPS_REDIRECT_PORT", checkPort("HTTPS_REDIRECT_PORT")},
+		{"UDP_MUX_PORT", checkPort("UDP_MUX_PORT")},
+		{"UDP_MUX_PORT_WHIP", checkPort("UDP_MUX_PORT_WHIP")},
+		{"UDP_MUX_PORT_WHEP", checkPort("UDP_MUX_PORT_WHEP")},
+		{"TCP_MUX_ADDRESS", checkAddress("TCP_MUX_ADDRESS")},
+		{"NAT_1_TO_1_IP", checkNAT1To1IP},
+		{"SSL_KEY/SSL_CERT", checkTLS},
+		{"WEBHOOK_URLS", checkWebhookURLs},
+		{"WEBHOOK_MAX_RETRIES", checkInteger("WEBHOOK_MAX_RETRIES")},
+		{"EVENT_LOG_FILE_MAX_SIZE", checkInteger("EVENT_LOG_FILE_MAX_SIZE")},
+		{"EVENT_LOG_FILE_MAX_BACKUPS", checkInteger("EVENT_LOG_FILE_MAX_BACKUPS")},
+		{"GEOIP databases", checkGeoIPDatabases},
+		{"TRUSTED_PROXIES", checkTrustedProxies},
+		{"SLOW_CONSUMER_LOSS_PERCENT", checkInteger("SLOW_CONSUMER_LOSS_PERCENT")},
+		{"SLOW_CONSUMER_POLICY", checkOneOf("SLOW_CONSUMER_POLICY", "downgrade", "disconnect")},
+		{"STUN_SERVERS", checkSTUNServers},
+		{"TURN_SERVERS", checkTURNServers},
+		{"Codecs", checkCodecs},
+		{"TENANTS_FILE", tenant.Configure},
+		{"STATE_FILE/DATABASE_URL", store.Configure},
+		{"REPORT_THRESHOLD", checkInteger("REPORT_THRESHOLD")},
+		{"REPORT_WINDOW", checkDuration("REPORT_WINDOW")},
+		{"RECORDING_REJOIN_WINDOW", checkDuration("RECORDING_REJOIN_WINDOW")},
+		{"RECORDING_HOOK_TIMEOUT", checkDuration("RECORDING_HOOK_TIMEOUT")},
+		{"WHEP_AUTH_TIMEOUT", checkDuration("WHEP_AUTH_TIMEOUT")},
+		{"RECORDING_MAX_AGE", checkDuration("RECORDING_MAX_AGE")},
+		{"RECORDING_SEGMENT_DURATION", checkDuration("RECORDING_SEGMENT_DURATION")},
+		{"RECORDING_MAX_BYTES", checkInteger("RECORDING_MAX_BYTES")},
+		{"RECORDING_MIN_FREE_BYTES", checkInteger("RECORDING_MIN_FREE_BYTES")},
+		{"INGEST_MAX_BITRATE", checkInteger("INGEST_MAX_BITRATE")},
+		{"INGEST_MAX_HEIGHT", checkInteger("INGEST_MAX_HEIGHT")},
+		{"INGEST_POLICY", checkOneOf("INGEST_POLICY", "warn", "terminate")},
+		{"UPLOAD_QUOTA_HOURLY", checkInteger("UPLOAD_QUOTA_HOURLY")},
+		{"UPLOAD_QUOTA_DAILY", checkInteger("UPLOAD_QUOTA_DAILY")},
+		{"KEYFRAME_INTERVAL", checkDuration("KEYFRAME_INTERVAL")},
+		{"SIMULCAST_RID_MAP", checkSimulcastRIDMap},
+		{"NODE_WEIGHT", checkInteger("NODE_WEIGHT")},
+		{"NODE_MAX_BANDWIDTH", checkInteger("NODE_MAX_BANDWIDTH")},
+		{"NODE_MAX_SESSIONS", checkInteger("NODE_MAX_SESSIONS")},
+	}
+
+	exitCode := 0
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			fmt.Printf(checkFailedMessage, c.name, err.Error())
+			exitCode = 1
+		} else {
+			fmt.Printf(checkPassedMessage, c.name)
+		}
+	}
+
+	return exitCode
+}
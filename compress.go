@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// compressResponseWriter compresses text and JSON bodies unless the response
+// is an event stream, a partial response or is already encoded
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	writer      io.WriteCloser
+	wroteHeader bool
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+
+	header := c.Header()
+	compress := status != http.StatusPartialContent &&
+		status != http.StatusNoContent &&
+		status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" &&
+		compressibleContentType(header.Get("Content-Type"))
+
+	if compress {
+		header.Set("Content-Encoding", c.encoding)
+		header.Add("Vary", "Accept-Encoding")
+		header.Del("Content-Length")
+
+		if c.encoding == encodingBrotli {
+			c.writer = brotli.NewWriter(c.ResponseWriter)
+		} else {
+			c.writer = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.writer != nil {
+		return c.writer.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressResponseWriter) Flush() {
+	if flusher, ok := c.writer.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection, nothing was
+// compressed yet if they still can
+func (c *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (c *compressResponseWriter) Close() error {
+	if c.writer != nil {
+		return c.writer.Close()
+	}
+	return nil
+}
+
+// compressibleContentType reports if a body is text or JSON. Media is already
+// compressed and event streams must be flushed as they are written
+func compressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/sdp", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func acceptedEncoding(req *http.Request) string {
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	switch {
+	case strings.Contains(acceptEncoding, encodingBrotli):
+		return encodingBrotli
+	case strings.Contains(acceptEncoding, encodingGzip):
+		return encodingGzip
+	}
+
+	return ""
+}
+
+// compressHandler compresses responses with brotli or gzip if the client
+// supports it. WebSocket upgrades are passed through untouched
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		encoding := acceptedEncoding(req)
+		if encoding == "" || req.Header.Get("Accept") == "text/event-stream" || strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		compressWriter := &compressResponseWriter{ResponseWriter: res, encoding: encoding}
+		defer compressWriter.Close()
+
+		next.ServeHTTP(compressWriter, req)
+	})
+}
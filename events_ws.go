@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/glimesh/broadcast-box/internal/metrics"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	eventsWSCommandLayer = "layer"
+	eventsWSCommandLeave = "leave"
+
+	eventsWSWriteTimeout = time.Second * 10
+)
+
+type (
+	// eventsWSMessageJSON carries the events the SSE extension sends that
+	// aren't viewer events, which are sent as they are
+	eventsWSMessageJSON struct {
+		Type string `json:"type"`
+		Data any    `json:"data"`
+	}
+
+	eventsWSCommandJSON struct {
+		Type string `json:"type"`
+		whepLayerRequestJSON
+	}
+)
+
+// roomEventsWebSocketHandler sends the events of the room in
+// `/api/ws/room/{streamKeyOrAlias}`, the same events as the SSE extension, for
+// clients and proxies that handle SSE poorly. With ?whepSessionId= of a viewer
+// in the room the layers and network quality of the session are sent too, and
+// clients can send `{"type": "layer", "encodingId": ""}` to change layers and
+// `{"type": "leave"}` to end the session. Events after ?lastEventId= are replayed
+func roomEventsWebSocketHandler(res http.ResponseWriter, req *http.Request) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		res.Header().Set("Upgrade", "websocket")
+		logHTTPError(res, "Expected a WebSocket upgrade", http.StatusUpgradeRequired)
+		return
+	}
+
+	// Rooms are matched like the stream key in the path of a WHEP request
+	room := path.Base(req.URL.Path)
+	if !strings.HasPrefix(room, bearerPrefix) {
+		room = bearerPrefix + room
+	}
+
+	streamKey, err := viewerStreamKey(req, room)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	whepSessionId := req.URL.Query().Get("whepSessionId")
+	if whepSessionId != "" {
+		if sessionStreamKey, ok := webrtc.WHEPStreamKey(whepSessionId); !ok || sessionStreamKey != streamKey {
+			logHTTPError(res, webrtc.ErrWHEPSessionNotFound.Error(), http.StatusNotFound)
+			return
+		}
+	} else if _, _, err = webrtc.RoomViewerEvents(streamKey, 0); err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if !webrtc.CheckPlaybackPassword(streamKey, req.URL.Query().Get("password")) {
+		// Viewers in the room already gave the password for their session
+		logHTTPError(res, "Playback password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	// New clients only receive events published after they connected
+	lastEventId, err := strconv.ParseUint(req.URL.Query().Get("lastEventId"), 10, 64)
+	if err != nil {
+		lastEventId = latestViewerEventId(streamKey, whepSessionId)
+	}
+
+	websocket.Server{
+		// CORS allows every origin, so does the WebSocket
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			// The connection keeps the deadlines of the HTTP server
+			if err := ws.SetDeadline(time.Time{}); err != nil {
+				return
+			}
+
+			metrics.SSEConnections.Inc(streamKey)
+			defer metrics.SSEConnections.Dec(streamKey)
+
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				for {
+					var command eventsWSCommandJSON
+					if err := websocket.JSON.Receive(ws, &command); err != nil {
+						return
+					} else if whepSessionId != "" {
+						handleEventsWSCommand(whepSessionId, command)
+					}
+				}
+			}()
+
+			writeViewerEvents(wsEventWriter{ws: ws, streamKey: streamKey}, streamKey, whepSessionId, lastEventId, closed)
+		},
+	}.ServeHTTP(res, req)
+}
+
+// wsEventWriter writes the events of writeViewerEvents as WebSocket messages.
+// Viewer events are sent as they are, the others as eventsWSMessageJSON
+type wsEventWriter struct {
+	ws        *websocket.Conn
+	streamKey string
+}
+
+func (w wsEventWriter) send(message any) bool {
+	if err := w.ws.SetWriteDeadline(time.Now().Add(eventsWSWriteTimeout)); err != nil {
+		return false
+	} else if err := websocket.JSON.Send(w.ws, message); err != nil {
+		metrics.SSEWriteErrors.Inc(w.streamKey)
+		metrics.SSEEventsDropped.Inc(w.streamKey)
+		return false
+	}
+	return true
+}
+
+func (w wsEventWriter) writeNetworkQuality(networkQuality *webrtc.NetworkQuality) bool {
+	return w.send(eventsWSMessageJSON{Type: "networkQuality", Data: networkQuality})
+}
+
+func (w wsEventWriter) writeLayers(layers []byte) bool {
+	return w.send(eventsWSMessageJSON{Type: "layers", Data: json.RawMessage(layers)})
+}
+
+func (w wsEventWriter) writeViewerEvent(event webrtc.ViewerEvent) bool {
+	return w.send(event)
+}
+
+func (w wsEventWriter) writeKeepalive() bool {
+	return w.send(eventsWSMessageJSON{Type: "keepalive"})
+}
+
+func (w wsEventWriter) writeClosing() {
+	w.send(eventsWSMessageJSON{Type: "closing", Data: "server closing"})
+}
+
+func (w wsEventWriter) writeDisconnected(reason string) {
+	w.send(eventsWSMessageJSON{Type: "disconnected", Data: disconnectedEventJSON{Reason: reason}})
+}
+
+// handleEventsWSCommand applies a command a client sent on the WebSocket,
+// unknown commands are ignored
+func handleEventsWSCommand(whepSessionId string, command eventsWSCommandJSON) {
+	switch command.Type {
+	case eventsWSCommandLayer:
+		if command.TemporalLayerId != nil {
+			if err := webrtc.WHEPChangeTemporalLayer(whepSessionId, *command.TemporalLayerId); err != nil {
+				return
+			}
+		}
+
+		// Only changing the temporal layer keeps the current encoding
+		if command.EncodingId != "" || command.TemporalLayerId == nil {
+			_ = webrtc.WHEPChangeLayer(whepSessionId, command.EncodingId)
+		}
+	case eventsWSCommandLeave:
+		_ = webrtc.EndWHEP(whepSessionId, webrtc.StreamEndedViewerLeft)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+
+	earliestAvailableHeader = "X-Earliest-Available"
+)
+
+// adminExportHandler writes the broadcast history or the ended viewer sessions
+// as CSV or NDJSON for BI tools. `/export/broadcasts` and `/export/sessions`
+// take the `?since=`, `?until=` and `?streamKey=` of /api/history and
+// `?format=csv` or `?format=ndjson`, CSV is the default. Without a database
+// X-Earliest-Available says from when on the export is complete
+func adminExportHandler(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter, err := historyTimeRange(query)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.StreamKey = query.Get("streamKey")
+
+	format := query.Get("format")
+	if format == "" {
+		format = exportFormatCSV
+	} else if format != exportFormatCSV && format != exportFormatNDJSON {
+		logHTTPError(res, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		header         []string
+		rows           [][]string
+		items          []any
+		availableSince int64
+	)
+	broadcastsSince, viewerSessionsSince := webrtc.HistoryAvailableSince()
+	switch req.URL.Path {
+	case "/export/broadcasts":
+		availableSince = broadcastsSince
+		header = []string{"id", "streamKey", "startedAt", "endedAt", "durationSeconds", "peakViewers", "endReason", "recordingId"}
+		for _, b := range webrtc.GetBroadcastHistory(filter) {
+			items = append(items, b)
+			rows = append(rows, []string{
+				b.ID, b.StreamKey, formatInt(b.StartedAt), formatInt(b.EndedAt), formatInt(b.DurationSeconds),
+				strconv.Itoa(b.PeakViewers), b.EndReason, b.RecordingID,
+			})
+		}
+	case "/export/sessions":
+		availableSince = viewerSessionsSince
+		header = []string{"id", "streamKey", "startedAt", "endedAt", "durationSeconds", "country", "asn", "layer", "bytesSent", "endReason", "packetLossPercent"}
+		for _, s := range webrtc.GetViewerSessions(filter) {
+			packetLossPercent := ""
+			if s.PacketLossPercent != nil {
+				packetLossPercent = strconv.FormatUint(uint64(*s.PacketLossPercent), 10)
+			}
+
+			items = append(items, s)
+			rows = append(rows, []string{
+				s.ID, s.StreamKey, formatInt(s.StartedAt), formatInt(s.EndedAt), formatInt(s.DurationSeconds),
+				s.Country, s.ASN, s.Layer, strconv.FormatUint(s.BytesSent, 10), s.EndReason, packetLossPercent,
+			})
+		}
+	default:
+		logHTTPError(res, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// Rows before it may be missing, so partial exports can be told apart
+	if availableSince != 0 {
+		res.Header().Set(earliestAvailableHeader, formatInt(availableSince))
+	}
+
+	if format == exportFormatNDJSON {
+		res.Header().Add("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(res)
+		for _, item := range items {
+			if err := encoder.Encode(item); err != nil {
+				logHTTPError(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		return
+	}
+
+	res.Header().Add("Content-Type", "text/csv")
+	w := csv.NewWriter(res)
+	if err := w.Write(header); err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	} else if err = w.WriteAll(rows); err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func formatInt(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
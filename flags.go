@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const flagsUsage = `Usage: broadcast-box [flags] [check]
+
+Every setting in the README can be passed as a flag instead, --http-address=:8080
+sets HTTP_ADDRESS. Unknown flags are refused. Flags take precedence over the environment and the env files.
+A flag without a value is set to "true".
+
+Commands:
+  check  Validate the configuration without starting the server
+`
+
+// configKeys are the environment variables that can be set with flags, a flag
+// for anything else is most likely a typo
+var configKeys = []string{
+	"ADMIN_PASSWORD",
+	"ADMIN_TOKEN",
+	"ADMIN_USERNAME",
+	"APP_ENV",
+	"AUTO_RECORD_ROOMS",
+	"BANDWIDTH_PROBING",
+	"DATABASE_URL",
+	"DISABLE_FRONTEND",
+	"DISABLE_SPA_FALLBACK",
+	"DISABLE_STATUS",
+	"ENABLE_H2C",
+	"ENABLE_HTTP_REDIRECT",
+	"ENABLE_METRICS",
+	"EVENT_LOG_FILE",
+	"EVENT_LOG_FILE_MAX_BACKUPS",
+	"EVENT_LOG_FILE_MAX_SIZE",
+	"EVENT_LOG_HTTP_URL",
+	"EVENT_LOG_SYSLOG",
+	"GEOIP_ASN_DATABASE",
+	"GEOIP_COUNTRY_DATABASE",
+	"GRPC_ADDRESS",
+	"HTTP2_MAX_CONCURRENT_STREAMS",
+	"HTTPS_REDIRECT_PORT",
+	"HTTP_ADDRESS",
+	"HTTP_IDLE_TIMEOUT",
+	"HTTP_MAX_BODY_SIZE",
+	"HTTP_READ_TIMEOUT",
+	"HTTP_WRITE_TIMEOUT",
+	"INCLUDE_PUBLIC_IP_IN_NAT_1_TO_1_IP",
+	"INGEST_MAX_BITRATE",
+	"INGEST_MAX_HEIGHT",
+	"INGEST_POLICY",
+	"INTERFACE_FILTER",
+	"INTERNAL_HTTP_ADDRESS",
+	"KEYFRAME_INTERVAL",
+	"NAT_1_TO_1_IP",
+	"NETWORK_TEST_ON_START",
+	"NODE_MAX_BANDWIDTH",
+	"NODE_MAX_SESSIONS",
+	"NODE_WEIGHT",
+	"PUBLISH_SECRET",
+	"RECORDING_DIRECTORY",
+	"RECORDING_HOOK_COMMAND",
+	"RECORDING_HOOK_TIMEOUT",
+	"RECORDING_HOOK_URL",
+	"RECORDING_MAX_AGE",
+	"RECORDING_MAX_BYTES",
+	"RECORDING_MIN_FREE_BYTES",
+	"RECORDING_REJOIN_WINDOW",
+	"RECORDING_SEGMENT_DURATION",
+	"REPORT_THRESHOLD",
+	"REPORT_WINDOW",
+	"SHUTDOWN_GRACE_PERIOD",
+	"SHUTDOWN_TIMEOUT",
+	"SIMULCAST_LAYERS",
+	"SIMULCAST_RID_MAP",
+	"SLOW_CONSUMER_LOSS_PERCENT",
+	"SLOW_CONSUMER_POLICY",
+	"SSE_KEEPALIVE_INTERVAL",
+	"SSL_CERT",
+	"SSL_KEY",
+	"STATE_FILE",
+	"STATS_WS_INTERVAL",
+	"STUN_SERVERS",
+	"TCP_MUX_ADDRESS",
+	"TCP_MUX_FORCE",
+	"TENANTS_FILE",
+	"TRUSTED_PROXIES",
+	"TURN_PASSWORD",
+	"TURN_SERVERS",
+	"TURN_USERNAME",
+	"UDP_MUX_PORT",
+	"UDP_MUX_PORT_WHEP",
+	"UDP_MUX_PORT_WHIP",
+	"UPLOAD_QUOTA_DAILY",
+	"UPLOAD_QUOTA_HOURLY",
+	"WEBHOOK_EVENTS",
+	"WEBHOOK_MAX_RETRIES",
+	"WEBHOOK_SECRET",
+	"WEBHOOK_URLS",
+	"WEB_BUILD_PATH",
+	"WHEP_AUTH_TIMEOUT",
+	"WHEP_AUTH_URL",
+}
+
+// Settings passed as flags, kept so a reload doesn't replace them with the env file
+var flagSettings = map[string]string{}
+
+// parseFlags stores `--name=value` and `--name value` flags as the environment
+// variable NAME and returns the remaining arguments
+func parseFlags(args []string) ([]string, error) {
+	positional := []string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-h" || arg == "--help" || arg == "-help" {
+			fmt.Print(flagsUsage)
+			os.Exit(0)
+		} else if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		} else if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == "" {
+			return nil, fmt.Errorf("invalid flag %q", arg)
+		}
+
+		if !hasValue {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") && args[i+1] != "check" {
+				value = args[i+1]
+				i++
+			} else {
+				value = "true"
+			}
+		}
+
+		env := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if !isConfigKey(env) {
+			return nil, fmt.Errorf("unknown flag %q", arg)
+		}
+		flagSettings[env] = value
+	}
+
+	return positional, applyFlags()
+}
+
+func isConfigKey(env string) bool {
+	for _, key := range configKeys {
+		if key == env {
+			return true
+		}
+	}
+	return false
+}
+
+func applyFlags() error {
+	for env, value := range flagSettings {
+		if err := os.Setenv(env, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	broadcastboxv1 "github.com/glimesh/broadcast-box/api/proto/broadcastbox/v1"
+	"github.com/glimesh/broadcast-box/internal/eventlog"
+	"github.com/glimesh/broadcast-box/internal/moderation"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var errGRPCNeedsAdminToken = errors.New("GRPC_ADDRESS requires ADMIN_TOKEN")
+
+// controlServer implements the gRPC ControlService on top of the same functions
+// the HTTP handlers use
+type controlServer struct {
+	broadcastboxv1.UnimplementedControlServiceServer
+}
+
+// serveGRPC starts the ControlService on address, with TLS if tlsConfig is set
+func serveGRPC(address string, tlsConfig *tls.Config) (*grpc.Server, error) {
+	if os.Getenv("ADMIN_TOKEN") == "" {
+		return nil, errGRPCNeedsAdminToken
+	}
+
+	listener, err := listen(address, tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []grpc.ServerOption{}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := newGRPCServer(opts...)
+	go func() {
+		log.Println("Running gRPC Server at `" + address + "`")
+		if err := server.Serve(listener); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	return server, nil
+}
+
+// newGRPCServer returns a gRPC server with the ControlService that requires the ADMIN_TOKEN
+func newGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.UnaryInterceptor(grpcUnaryAuth), grpc.StreamInterceptor(grpcStreamAuth))
+
+	server := grpc.NewServer(opts...)
+	broadcastboxv1.RegisterControlServiceServer(server, &controlServer{})
+	return server
+}
+
+// grpcAuthorized compares the `authorization` metadata with the ADMIN_TOKEN
+func grpcAuthorized(ctx context.Context) error {
+	token := os.Getenv("ADMIN_TOKEN")
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, val := range md.Get("authorization") {
+		bearer := strings.TrimPrefix(val, "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "Unauthorized")
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcAuthorized(ctx); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAuthorized(ss.Context()); err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
+
+func (*controlServer) ListStreams(_ context.Context, req *broadcastboxv1.ListStreamsRequest) (*broadcastboxv1.ListStreamsResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must be a positive integer")
+	} else if req.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must be a positive integer")
+	}
+
+	streams := []*broadcastboxv1.StreamStatus{}
+	for _, s := range webrtc.GetStreamStatuses() {
+		if req.StreamKey != "" && s.StreamKey != req.StreamKey {
+			continue
+		} else if req.StreamingOnly && !s.IsStreaming {
+			continue
+		}
+
+		streams = append(streams, streamStatusToProto(s))
+	}
+
+	offset := int(req.Offset)
+	if offset > len(streams) {
+		offset = len(streams)
+	}
+	streams = streams[offset:]
+	if req.Limit > 0 && int(req.Limit) < len(streams) {
+		streams = streams[:req.Limit]
+	}
+
+	return &broadcastboxv1.ListStreamsResponse{Streams: streams}, nil
+}
+
+func (*controlServer) GetStream(_ context.Context, req *broadcastboxv1.GetStreamRequest) (*broadcastboxv1.GetStreamResponse, error) {
+	detail, ok := webrtc.GetStreamDetail(req.StreamKey)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Stream not found")
+	}
+
+	out := &broadcastboxv1.GetStreamResponse{Stream: streamStatusToProto(detail.StreamStatus)}
+	for _, sample := range detail.BitrateHistory {
+		out.BitrateHistory = append(out.BitrateHistory, &broadcastboxv1.BitrateSample{
+			Epoch:        sample.Epoch,
+			AudioBitrate: sample.AudioBitrate,
+			VideoBitrate: sample.VideoBitrate,
+		})
+	}
+
+	return out, nil
+}
+
+func (*controlServer) GetOverview(context.Context, *broadcastboxv1.GetOverviewRequest) (*broadcastboxv1.GetOverviewResponse, error) {
+	overview := webrtc.GetAdminOverview()
+
+	out := &broadcastboxv1.GetOverviewResponse{
+		StreamCount: int32(overview.StreamCount),
+		ViewerCount: int32(overview.ViewerCount),
+	}
+	for _, s := range overview.Streams {
+		adminStream := &broadcastboxv1.AdminStream{
+			StreamKey:              s.StreamKey,
+			FirstSeenEpoch:         s.FirstSeenEpoch,
+			UptimeSeconds:          s.UptimeSeconds,
+			HasWhipClient:          s.HasWHIPClient,
+			WhipIceConnectionState: s.WHIPICEConnectionState,
+			VideoLayers:            s.VideoLayers,
+		}
+		for _, v := range s.Viewers {
+			adminStream.Viewers = append(adminStream.Viewers, &broadcastboxv1.AdminViewer{
+				Id:                   v.ID,
+				IceConnectionState:   v.ICEConnectionState,
+				CurrentLayer:         v.CurrentLayer,
+				WatchDurationSeconds: v.WatchDurationSeconds,
+			})
+		}
+		out.Streams = append(out.Streams, adminStream)
+	}
+
+	return out, nil
+}
+
+func (*controlServer) Reload(context.Context, *broadcastboxv1.ReloadRequest) (*broadcastboxv1.ReloadResponse, error) {
+	if err := reloadConfigs(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &broadcastboxv1.ReloadResponse{}, nil
+}
+
+func (*controlServer) GetRoomPolicy(_ context.Context, req *broadcastboxv1.GetRoomPolicyRequest) (*broadcastboxv1.RoomPolicy, error) {
+	return roomPolicyToProto(webrtc.GetRoomPolicy(req.StreamKey)), nil
+}
+
+func (*controlServer) SetRoomPolicy(_ context.Context, req *broadcastboxv1.SetRoomPolicyRequest) (*broadcastboxv1.RoomPolicy, error) {
+	if req.Policy == nil || req.Policy.StreamKey == "" {
+		return nil, status.Error(codes.InvalidArgument, "policy.stream_key must be set")
+	}
+
+	policy, err := roomPolicyFromRequest(req.Policy.StreamKey, roomPolicyRequestJSON{
+		AutoRecord:           req.Policy.AutoRecord,
+		MaxIngestBitrate:     req.Policy.MaxIngestBitrate,
+		MaxIngestHeight:      req.Policy.MaxIngestHeight,
+		IngestPolicy:         req.Policy.IngestPolicy,
+		MaxSessionsPerViewer: int(req.Policy.MaxSessionsPerViewer),
+		BlockedCountries:     req.Policy.BlockedCountries,
+		AudioOnly:            req.Policy.AudioOnly,
+		RelayOnly:            req.Policy.RelayOnly,
+		MaxPublishers:        int(req.Policy.MaxPublishers),
+		ViewerDataRelay:      req.Policy.ViewerDataRelay,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	webrtc.SetRoomPolicy(policy)
+
+	return roomPolicyToProto(webrtc.GetRoomPolicy(policy.StreamKey)), nil
+}
+
+func (*controlServer) Kick(_ context.Context, req *broadcastboxv1.KickRequest) (*broadcastboxv1.KickResponse, error) {
+	var err error
+	switch {
+	case req.WhepSessionId != "":
+		err = webrtc.EndWHEP(req.WhepSessionId, webrtc.StreamEndedKicked)
+	case req.StreamKey != "":
+		err = webrtc.EndWHIP(req.StreamKey, webrtc.StreamEndedKicked)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "stream_key or whep_session_id must be set")
+	}
+
+	switch {
+	case errors.Is(err, webrtc.ErrNoPublisher), errors.Is(err, webrtc.ErrWHEPSessionNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &broadcastboxv1.KickResponse{}, nil
+}
+
+func (*controlServer) ListReports(_ context.Context, req *broadcastboxv1.ListReportsRequest) (*broadcastboxv1.ListReportsResponse, error) {
+	out := &broadcastboxv1.ListReportsResponse{}
+	for _, r := range moderation.Reports(req.Status) {
+		out.Reports = append(out.Reports, reportToProto(r))
+	}
+
+	return out, nil
+}
+
+func (*controlServer) ResolveReport(_ context.Context, req *broadcastboxv1.ResolveReportRequest) (*broadcastboxv1.Report, error) {
+	report, err := moderation.Resolve(req.Id, req.Action)
+	switch {
+	case errors.Is(err, moderation.ErrReportNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, moderation.ErrReportResolved):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if req.Action == moderation.ActionUphold {
+		endSuspendedStream(report.StreamKey)
+	}
+
+	return reportToProto(report), nil
+}
+
+func (*controlServer) Unsuspend(_ context.Context, req *broadcastboxv1.UnsuspendRequest) (*broadcastboxv1.UnsuspendResponse, error) {
+	if !moderation.Unsuspend(req.StreamKey) {
+		return nil, status.Error(codes.NotFound, "Stream is not suspended")
+	}
+
+	return &broadcastboxv1.UnsuspendResponse{}, nil
+}
+
+// StreamEvents sends events until the client cancels or the server shuts down.
+// Events are dropped for clients that don't keep up
+func (*controlServer) StreamEvents(req *broadcastboxv1.StreamEventsRequest, stream broadcastboxv1.ControlService_StreamEventsServer) error {
+	types := map[string]bool{}
+	for _, t := range req.Types {
+		types[t] = true
+	}
+
+	events, cancel := eventlog.Subscribe()
+	defer cancel()
+
+	// Headers are sent once subscribed, so clients know no later event is missed
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-serverClosing:
+			return nil
+		case e := <-events:
+			if len(types) != 0 && !types[e.Type] {
+				continue
+			}
+
+			if err := stream.Send(&broadcastboxv1.Event{
+				Type:          e.Type,
+				Timestamp:     e.Timestamp,
+				StreamKey:     e.StreamKey,
+				WhepSessionId: e.WHEPSessionID,
+				Reason:        e.Reason,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func streamStatusToProto(s webrtc.StreamStatus) *broadcastboxv1.StreamStatus {
+	out := &broadcastboxv1.StreamStatus{
+		StreamKey:            s.StreamKey,
+		IsStreaming:          s.IsStreaming,
+		ViewerCount:          int32(s.ViewerCount),
+		FirstSeenEpoch:       s.FirstSeenEpoch,
+		UptimeSeconds:        s.UptimeSeconds,
+		WatchHours:           s.WatchHours,
+		AudioPacketsReceived: s.AudioPacketsReceived,
+		PublisherCount:       int32(s.PublisherCount),
+	}
+
+	for _, v := range s.VideoStreams {
+		out.VideoStreams = append(out.VideoStreams, &broadcastboxv1.VideoLayer{
+			Rid:              v.RID,
+			Codec:            v.Codec,
+			PacketsReceived:  v.PacketsReceived,
+			BytesReceived:    v.BytesReceived,
+			PacketsForwarded: v.PacketsForwarded,
+			BytesForwarded:   v.BytesForwarded,
+			Viewers:          int32(v.Viewers),
+		})
+	}
+
+	for _, w := range s.WHEPSessions {
+		out.WhepSessions = append(out.WhepSessions, &broadcastboxv1.WHEPSession{
+			Id:                   w.ID,
+			CurrentLayer:         w.CurrentLayer,
+			PacketsWritten:       w.PacketsWritten,
+			SlowConsumer:         w.SlowConsumer,
+			WatchDurationSeconds: w.WatchDurationSeconds,
+			NetworkQuality:       int32(w.NetworkQuality),
+		})
+	}
+
+	return out
+}
+
+func roomPolicyToProto(p webrtc.RoomPolicy) *broadcastboxv1.RoomPolicy {
+	return &broadcastboxv1.RoomPolicy{
+		StreamKey:            p.StreamKey,
+		AutoRecord:           p.AutoRecord,
+		MaxIngestBitrate:     p.MaxIngestBitrate,
+		MaxIngestHeight:      p.MaxIngestHeight,
+		IngestPolicy:         p.IngestPolicy,
+		MaxSessionsPerViewer: int32(p.MaxSessionsPerViewer),
+		BlockedCountries:     p.BlockedCountries,
+		AudioOnly:            p.AudioOnly,
+		RelayOnly:            p.RelayOnly,
+		MaxPublishers:        int32(p.MaxPublishers),
+		ViewerDataRelay:      p.ViewerDataRelay,
+	}
+}
+
+func reportToProto(r moderation.Report) *broadcastboxv1.Report {
+	return &broadcastboxv1.Report{
+		Id:         r.ID,
+		StreamKey:  r.StreamKey,
+		Reason:     r.Reason,
+		Reporter:   r.Reporter,
+		CreatedAt:  r.CreatedAt,
+		Status:     r.Status,
+		ResolvedAt: r.ResolvedAt,
+	}
+}
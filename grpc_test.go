@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	broadcastboxv1 "github.com/glimesh/broadcast-box/api/proto/broadcastbox/v1"
+	"github.com/glimesh/broadcast-box/internal/webhook"
+	"github.com/glimesh/broadcast-box/pkg/testclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestControlClient serves the ControlService over an in-memory connection
+func newTestControlClient(t *testing.T) broadcastboxv1.ControlServiceClient {
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer()
+	go server.Serve(listener) //nolint
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() }) //nolint
+
+	return broadcastboxv1.NewControlServiceClient(conn)
+}
+
+func TestGRPCRequiresAdminToken(t *testing.T) {
+	client := newTestControlClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, err := client.ListStreams(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong"), &broadcastboxv1.ListStreamsRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+
+	if _, err = client.ListStreams(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin-token"), &broadcastboxv1.ListStreamsRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGRPCStreamEvents(t *testing.T) {
+	client := newTestControlClient(t)
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin-token")
+
+	events, err := client.StreamEvents(ctx, &broadcastboxv1.StreamEventsRequest{Types: []string{webhook.EventStreamStarted}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Headers arrive once the server subscribed
+	if _, err = events.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher, err := testclient.Publish(ctx, server.URL+"/api/whip", "grpc-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close() //nolint
+
+	for {
+		event, err := events.Recv()
+		if err != nil {
+			t.Fatal(err)
+		} else if event.StreamKey == "Bearer grpc-events" {
+			break
+		}
+	}
+
+	resp, err := client.GetStream(ctx, &broadcastboxv1.GetStreamRequest{StreamKey: "Bearer grpc-events"})
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.Stream.PublisherCount != 1 {
+		t.Fatalf("expected one publisher, got %d", resp.Stream.PublisherCount)
+	}
+
+	if _, err = client.Kick(ctx, &broadcastboxv1.KickRequest{StreamKey: "Bearer grpc-events"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPReadTimeout = time.Second * 30
+	defaultHTTPIdleTimeout = time.Second * 120
+	defaultHTTPMaxBodySize = 1024 * 1024
+
+	// VOD downloads and CPU profiles take as long as they take, so responses
+	// aren't limited unless HTTP_WRITE_TIMEOUT is set
+	defaultHTTPWriteTimeout = 0
+
+	httpReadHeaderTimeout = time.Second * 10
+)
+
+func durationFromEnv(env string, fallback time.Duration) time.Duration {
+	val := os.Getenv(env)
+	if val == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+// configureHTTPTimeouts bounds how long a client can hold a connection
+func configureHTTPTimeouts(server *http.Server) {
+	server.ReadHeaderTimeout = httpReadHeaderTimeout
+	server.ReadTimeout = durationFromEnv("HTTP_READ_TIMEOUT", defaultHTTPReadTimeout)
+	server.WriteTimeout = durationFromEnv("HTTP_WRITE_TIMEOUT", defaultHTTPWriteTimeout)
+	server.IdleTimeout = durationFromEnv("HTTP_IDLE_TIMEOUT", defaultHTTPIdleTimeout)
+}
+
+// maxBodySizeHandler limits every request body, SDP offers are only a few kilobytes
+func maxBodySizeHandler(next http.Handler) http.Handler {
+	maxBodySize := int64(defaultHTTPMaxBodySize)
+	if val := os.Getenv("HTTP_MAX_BODY_SIZE"); val != "" {
+		var err error
+		if maxBodySize, err = strconv.ParseInt(val, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(res, req.Body, maxBodySize)
+		next.ServeHTTP(res, req)
+	})
+}
+
+// methodHandler rejects requests that don't use one of methods
+func methodHandler(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		for _, method := range methods {
+			if req.Method == method {
+				next(res, req)
+				return
+			}
+		}
+
+		res.Header().Set("Allow", strings.Join(methods, ", "))
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// historyHandler lists past broadcasts, newest first. `?streamKey=` only
+// returns one stream, `?since=` and `?until=` are unix times the broadcast
+// started in and `?limit=` caps how many are returned
+func historyHandler(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	filter, err := historyTimeRange(query)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if val := query.Get("limit"); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit < 0 {
+			logHTTPError(res, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	t, err := viewingTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if streamKey := query.Get("streamKey"); streamKey != "" {
+		if filter.StreamKey, err = namespacedStreamKey(t, streamKey); err != nil {
+			logHTTPError(res, err.Error(), tenantErrorStatus(err))
+			return
+		}
+	}
+
+	broadcasts := visibleBroadcasts(t, webrtc.GetBroadcastHistory(filter))
+	if limit != 0 && len(broadcasts) > limit {
+		broadcasts = broadcasts[:limit]
+	}
+
+	writeJSON(res, http.StatusOK, broadcasts)
+}
+
+// historyTimeRange reads the unix times in `?since=` and `?until=`
+func historyTimeRange(query url.Values) (webrtc.BroadcastHistoryFilter, error) {
+	filter := webrtc.BroadcastHistoryFilter{}
+	for name, dst := range map[string]*int64{"since": &filter.Since, "until": &filter.Until} {
+		if val := query.Get(name); val != "" {
+			var err error
+			if *dst, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return filter, errors.New(name + " must be a unix time")
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+// visibleBroadcasts is visibleStatuses for the broadcast history
+func visibleBroadcasts(t *tenant.Tenant, broadcasts []webrtc.Broadcast) []webrtc.Broadcast {
+	if !tenant.Enabled() {
+		return broadcasts
+	}
+
+	visible := []webrtc.Broadcast{}
+	for _, b := range broadcasts {
+		if t == nil && !tenant.IsNamespaced(b.StreamKey) {
+			visible = append(visible, b)
+		} else if t != nil && t.Owns(b.StreamKey) {
+			b.StreamKey = t.StripNamespace(b.StreamKey)
+			visible = append(visible, b)
+		}
+	}
+
+	return visible
+}
@@ -0,0 +1,172 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventQueueSize = 1024
+
+	// Events buffered for each subscriber before they are dropped for it
+	subscriberQueueSize = 256
+)
+
+type (
+	// Sink receives every event as a single line of JSON
+	Sink interface {
+		Write(line []byte) error
+		Close() error
+	}
+
+	Event struct {
+		Type          string `json:"type"`
+		Timestamp     int64  `json:"timestamp"`
+		StreamKey     string `json:"streamKey"`
+		WHEPSessionID string `json:"whepSessionId,omitempty"`
+
+		// Why the stream stopped or the viewer left
+		Reason string `json:"reason,omitempty"`
+	}
+)
+
+var (
+	sinks     []Sink
+	sinksLock sync.Mutex
+
+	eventQueue = make(chan []byte, eventQueueSize)
+
+	subscribers     = map[chan Event]struct{}{}
+	subscribersLock sync.Mutex
+)
+
+// Configure creates the sinks requested by the environment and starts
+// the goroutine that drains events to them.
+func Configure() {
+	if path := os.Getenv("EVENT_LOG_FILE"); path != "" {
+		maxSize := int64(defaultFileMaxSize)
+		if val := os.Getenv("EVENT_LOG_FILE_MAX_SIZE"); val != "" {
+			var err error
+			if maxSize, err = strconv.ParseInt(val, 10, 64); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		maxBackups := defaultFileMaxBackups
+		if val := os.Getenv("EVENT_LOG_FILE_MAX_BACKUPS"); val != "" {
+			var err error
+			if maxBackups, err = strconv.Atoi(val); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		fileSink, err := NewFileSink(path, maxSize, maxBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		AddSink(fileSink)
+	}
+
+	if address := os.Getenv("EVENT_LOG_SYSLOG"); address != "" {
+		syslogSink, err := NewSyslogSink(address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		AddSink(syslogSink)
+	}
+
+	if url := os.Getenv("EVENT_LOG_HTTP_URL"); url != "" {
+		AddSink(NewHTTPSink(url))
+	}
+
+	go func() {
+		for line := range eventQueue {
+			sinksLock.Lock()
+			for _, s := range sinks {
+				if err := s.Write(line); err != nil {
+					log.Println(err)
+				}
+			}
+			sinksLock.Unlock()
+		}
+	}()
+}
+
+// AddSink registers an additional destination for events
+func AddSink(s Sink) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	sinks = append(sinks, s)
+}
+
+// Subscribe returns a channel that receives every event until cancel is called.
+// Events are dropped for subscribers that don't keep up
+func Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, subscriberQueueSize)
+
+	subscribersLock.Lock()
+	subscribers[ch] = struct{}{}
+	subscribersLock.Unlock()
+
+	return ch, func() {
+		subscribersLock.Lock()
+		delete(subscribers, ch)
+		subscribersLock.Unlock()
+	}
+}
+
+func publish(event Event) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	for ch := range subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Println("Event subscriber is full, dropping event", event.Type)
+		}
+	}
+}
+
+// QueueDepth is how many events are waiting to be written to the sinks
+func QueueDepth() int {
+	return len(eventQueue)
+}
+
+// Write sends an event to the subscribers and queues it for export. Events are
+// dropped if the sinks can't keep up
+func Write(eventType, streamKey, whepSessionID, reason string) {
+	event := Event{
+		Type:          eventType,
+		Timestamp:     time.Now().Unix(),
+		StreamKey:     streamKey,
+		WHEPSessionID: whepSessionID,
+		Reason:        reason,
+	}
+	publish(event)
+
+	sinksLock.Lock()
+	hasSinks := len(sinks) != 0
+	sinksLock.Unlock()
+
+	if !hasSinks {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	select {
+	case eventQueue <- line:
+	default:
+		log.Println("Event log queue is full, dropping event", eventType)
+	}
+}
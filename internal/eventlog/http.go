@@ -0,0 +1,36 @@
+package eventlog
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSink POSTs each event as application/json to url
+func NewHTTPSink(url string) Sink {
+	return &httpSink{url: url, client: &http.Client{Timeout: time.Second * 5}}
+}
+
+func (h *httpSink) Write(line []byte) error {
+	res, err := h.client.Post(h.url, "application/json", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Unexpected HTTP StatusCode %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (h *httpSink) Close() error {
+	return nil
+}
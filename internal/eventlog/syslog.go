@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package eventlog
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink sends events to syslog. address is either "local" or
+// network://host:port, for example udp://127.0.0.1:514
+func NewSyslogSink(address string) (Sink, error) {
+	network, raddr := "", ""
+	if address != "local" {
+		if split := strings.SplitN(address, "://", 2); len(split) == 2 {
+			network, raddr = split[0], split[1]
+		} else {
+			network, raddr = "udp", address
+		}
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "broadcast-box")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.writer.Info(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
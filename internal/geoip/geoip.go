@@ -0,0 +1,79 @@
+package geoip
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const Unknown = "unknown"
+
+var countryDB, asnDB *maxminddb.Reader
+
+// Configure opens the MaxMind databases named in the environment. Lookup
+// returns Unknown for everything when no database is configured
+func Configure() {
+	var err error
+
+	if path := os.Getenv("GEOIP_COUNTRY_DATABASE"); path != "" {
+		if countryDB, err = maxminddb.Open(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if path := os.Getenv("GEOIP_ASN_DATABASE"); path != "" {
+		if asnDB, err = maxminddb.Open(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Enabled reports if any GeoIP database is loaded
+func Enabled() bool {
+	return countryDB != nil || asnDB != nil
+}
+
+// Lookup resolves an IP (with or without port) to an ISO country code and AS number
+func Lookup(address string) (country, asn string) {
+	country, asn = Unknown, Unknown
+
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return
+	}
+
+	if countryDB != nil {
+		record := struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}{}
+
+		if err := countryDB.Lookup(ip, &record); err != nil {
+			log.Println(err)
+		} else if record.Country.ISOCode != "" {
+			country = record.Country.ISOCode
+		}
+	}
+
+	if asnDB != nil {
+		record := struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}{}
+
+		if err := asnDB.Lookup(ip, &record); err != nil {
+			log.Println(err)
+		} else if record.ASN != 0 {
+			asn = "AS" + strconv.FormatUint(uint64(record.ASN), 10)
+		}
+	}
+
+	return
+}
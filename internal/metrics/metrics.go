@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+)
+
+// Vec is a counter or gauge partitioned by a single label
+type Vec struct {
+	name, help, kind, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var (
+	registry     []*Vec
+	registryLock sync.Mutex
+)
+
+func newVec(name, help, kind, label string) *Vec {
+	v := &Vec{name: name, help: help, kind: kind, label: label, values: map[string]float64{}}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, v)
+
+	return v
+}
+
+func NewCounterVec(name, help, label string) *Vec {
+	return newVec(name, help, kindCounter, label)
+}
+
+func NewGaugeVec(name, help, label string) *Vec {
+	return newVec(name, help, kindGauge, label)
+}
+
+func (v *Vec) Add(labelValue string, delta float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.values[labelValue] += delta
+}
+
+func (v *Vec) Inc(labelValue string) { v.Add(labelValue, 1) }
+func (v *Vec) Dec(labelValue string) { v.Add(labelValue, -1) }
+
+// Delete removes a label, used when a gauge no longer applies
+func (v *Vec) Delete(labelValue string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.values, labelValue)
+}
+
+func (v *Vec) write(sb *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	labelValues := make([]string, 0, len(v.values))
+	for labelValue := range v.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(sb, "%s{%s=%s} %s\n", v.name, v.label, strconv.Quote(labelValue), strconv.FormatFloat(v.values[labelValue], 'f', -1, 64))
+	}
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler(res http.ResponseWriter, req *http.Request) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	sb := &strings.Builder{}
+	for _, v := range registry {
+		v.write(sb)
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(res, sb.String())
+}
+
+var (
+	SSEConnections   = NewGaugeVec("broadcast_box_sse_connections", "Currently open Server-Sent Events connections", "stream_key")
+	SSEEventsDropped = NewCounterVec("broadcast_box_sse_events_dropped_total", "Server-Sent Events that were not delivered to a client", "stream_key")
+	SSEWriteErrors   = NewCounterVec("broadcast_box_sse_write_errors_total", "Failed writes to Server-Sent Events connections", "stream_key")
+)
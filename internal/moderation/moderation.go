@@ -0,0 +1,249 @@
+package moderation
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/store"
+	"github.com/google/uuid"
+)
+
+const (
+	StatusOpen      = "open"
+	StatusDismissed = "dismissed"
+	StatusUpheld    = "upheld"
+
+	ActionDismiss = "dismiss"
+	ActionUphold  = "uphold"
+
+	defaultReportWindow = time.Minute * 10
+
+	// Resolved reports, and open reports of streams that aren't suspended, are
+	// forgotten after this long
+	reportRetention = time.Hour * 24 * 7
+
+	// Open reports a stream can have, and all streams together, further
+	// reports are refused
+	maxOpenReportsPerStream = 100
+	maxOpenReports          = 10000
+
+	reportsStateKey     = "reports"
+	suspensionsStateKey = "suspensions"
+)
+
+var (
+	ErrReportNotFound      = errors.New("report not found")
+	ErrReportResolved      = errors.New("report is already resolved")
+	ErrInvalidAction       = errors.New("action must be " + ActionDismiss + " or " + ActionUphold)
+	ErrAlreadyReported     = errors.New("stream was already reported by this viewer")
+	ErrReportReasonMissing = errors.New("report needs a reason")
+	ErrTooManyReports      = errors.New("too many open reports")
+)
+
+type Report struct {
+	ID         string `json:"id"`
+	StreamKey  string `json:"streamKey"`
+	Reason     string `json:"reason"`
+	Reporter   string `json:"reporter"`
+	CreatedAt  int64  `json:"createdAt"`
+	Status     string `json:"status"`
+	ResolvedAt int64  `json:"resolvedAt,omitempty"`
+}
+
+var (
+	reports    = map[string]*Report{}
+	suspended  = map[string]bool{}
+	reportLock sync.Mutex
+
+	reportThreshold int
+	reportWindow    = defaultReportWindow
+)
+
+// Configure reads REPORT_THRESHOLD and REPORT_WINDOW. Without a threshold
+// reports are only collected for moderators. Configure can be called again to
+// reload the settings
+func Configure() error {
+	threshold, window := 0, defaultReportWindow
+
+	if val := os.Getenv("REPORT_THRESHOLD"); val != "" {
+		var err error
+		if threshold, err = strconv.Atoi(val); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("REPORT_WINDOW"); val != "" {
+		var err error
+		if window, err = time.ParseDuration(val); err != nil {
+			return err
+		}
+	}
+
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	reportThreshold, reportWindow = threshold, window
+	return nil
+}
+
+// Restore loads the reports and suspensions saved before the last restart. It
+// must be called after store.Configure
+func Restore() error {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	if err := store.Load(reportsStateKey, &reports); err != nil {
+		return err
+	}
+	return store.Load(suspensionsStateKey, &suspended)
+}
+
+// save must be called with reportLock held
+func save() {
+	if err := store.Save(reportsStateKey, reports); err != nil {
+		log.Println(err)
+	} else if err = store.Save(suspensionsStateKey, suspended); err != nil {
+		log.Println(err)
+	}
+}
+
+// Submit files a report against a stream. Each reporter can only have one open
+// report per stream. It returns true if the stream was suspended because
+// REPORT_THRESHOLD reporters flagged it within REPORT_WINDOW
+func Submit(streamKey, reporter, reason string) (Report, bool, error) {
+	if reason == "" {
+		return Report{}, false, ErrReportReasonMissing
+	}
+
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	now := time.Now()
+	recentReporters, openReports, allOpenReports := 1, 0, 0
+	for id, r := range reports {
+		if r.Status != StatusOpen && now.Sub(time.Unix(r.ResolvedAt, 0)) > reportRetention {
+			delete(reports, id)
+			continue
+		} else if r.Status == StatusOpen && !suspended[r.StreamKey] && now.Sub(time.Unix(r.CreatedAt, 0)) > reportRetention {
+			delete(reports, id)
+			continue
+		}
+
+		if r.Status == StatusOpen {
+			allOpenReports++
+		}
+
+		if r.StreamKey != streamKey || r.Status != StatusOpen {
+			continue
+		} else if r.Reporter == reporter {
+			return Report{}, false, ErrAlreadyReported
+		} else if now.Sub(time.Unix(r.CreatedAt, 0)) <= reportWindow {
+			recentReporters++
+		}
+		openReports++
+	}
+
+	if openReports >= maxOpenReportsPerStream || allOpenReports >= maxOpenReports {
+		return Report{}, false, ErrTooManyReports
+	}
+
+	r := &Report{
+		ID:        uuid.New().String(),
+		StreamKey: streamKey,
+		Reason:    reason,
+		Reporter:  reporter,
+		CreatedAt: now.Unix(),
+		Status:    StatusOpen,
+	}
+	reports[r.ID] = r
+
+	suspend := reportThreshold > 0 && recentReporters >= reportThreshold && !suspended[streamKey]
+	if suspend {
+		suspended[streamKey] = true
+	}
+
+	save()
+	return *r, suspend, nil
+}
+
+// Reports returns the reports with status, or every report if status is empty.
+// The oldest report is first
+func Reports(status string) []Report {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	out := []Report{}
+	for _, r := range reports {
+		if status == "" || r.Status == status {
+			out = append(out, *r)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt < out[j].CreatedAt
+	})
+	return out
+}
+
+// Resolve closes every open report of the stream the report is about.
+// Dismissing lifts the suspension of the stream, upholding keeps it suspended
+func Resolve(id, action string) (Report, error) {
+	if action != ActionDismiss && action != ActionUphold {
+		return Report{}, ErrInvalidAction
+	}
+
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	r, ok := reports[id]
+	if !ok {
+		return Report{}, ErrReportNotFound
+	} else if r.Status != StatusOpen {
+		return Report{}, ErrReportResolved
+	}
+
+	status := StatusDismissed
+	if action == ActionUphold {
+		status = StatusUpheld
+	}
+
+	now := time.Now().Unix()
+	for _, other := range reports {
+		if other.StreamKey == r.StreamKey && other.Status == StatusOpen {
+			other.Status, other.ResolvedAt = status, now
+		}
+	}
+
+	if action == ActionUphold {
+		suspended[r.StreamKey] = true
+	} else {
+		delete(suspended, r.StreamKey)
+	}
+
+	save()
+	return *r, nil
+}
+
+// IsSuspended reports if a stream may not be published
+func IsSuspended(streamKey string) bool {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	return suspended[streamKey]
+}
+
+// Unsuspend lets a stream publish again, for suspensions that were upheld
+func Unsuspend(streamKey string) bool {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	ok := suspended[streamKey]
+	delete(suspended, streamKey)
+	save()
+	return ok
+}
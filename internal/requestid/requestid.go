@@ -0,0 +1,37 @@
+package requestid
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+const Header = "X-Request-ID"
+
+type contextKey struct{}
+
+// New returns an ID to correlate the log lines of a single request
+func New() string {
+	return uuid.New().String()
+}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger returns a logger that prefixes every line with the request ID in ctx
+func Logger(ctx context.Context) *log.Logger {
+	id := FromContext(ctx)
+	if id == "" {
+		return log.Default()
+	}
+
+	return log.New(os.Stderr, "["+id+"] ", log.Default().Flags())
+}
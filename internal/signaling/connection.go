@@ -0,0 +1,147 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const defaultReconnectDelay = time.Second * 2
+
+var ErrClosed = errors.New("connection is closed")
+
+type ConnectionConfig struct {
+	Config
+
+	// ICE servers and other settings for the PeerConnection
+	WebRTC webrtc.Configuration
+
+	// Negotiate a new session when ICE fails, waiting ReconnectDelay between
+	// attempts. ReconnectDelay defaults to 2 seconds
+	Reconnect      bool
+	ReconnectDelay time.Duration
+
+	// Called with the ICE state of every PeerConnection, including the ones
+	// made to reconnect
+	OnICEConnectionStateChange func(webrtc.ICEConnectionState)
+}
+
+// Connection keeps a session negotiated. setup adds the tracks or transceivers
+// to each new PeerConnection before it is negotiated
+type Connection struct {
+	config ConnectionConfig
+	setup  func(*webrtc.PeerConnection) error
+
+	lock           sync.Mutex
+	closed         bool
+	peerConnection *webrtc.PeerConnection
+	session        *Session
+}
+
+// Connect negotiates the first session. It fails if that doesn't succeed,
+// Reconnect only applies once connected
+func Connect(ctx context.Context, config ConnectionConfig, setup func(*webrtc.PeerConnection) error) (*Connection, error) {
+	c := &Connection{config: config, setup: setup}
+	if c.config.ReconnectDelay == 0 {
+		c.config.ReconnectDelay = defaultReconnectDelay
+	}
+
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Connection) connect(ctx context.Context) error {
+	peerConnection, err := webrtc.NewPeerConnection(c.config.WebRTC)
+	if err != nil {
+		return err
+	}
+
+	if err = c.setup(peerConnection); err != nil {
+		return closeWithError(peerConnection, err)
+	}
+
+	peerConnection.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		if c.config.OnICEConnectionStateChange != nil {
+			c.config.OnICEConnectionStateChange(s)
+		}
+
+		if s == webrtc.ICEConnectionStateFailed && c.config.Reconnect {
+			go c.reconnect(peerConnection)
+		}
+	})
+
+	session, err := Negotiate(ctx, c.config.Config, peerConnection)
+	if err != nil {
+		return closeWithError(peerConnection, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		_ = session.Delete(context.Background())
+		return closeWithError(peerConnection, ErrClosed)
+	}
+
+	c.peerConnection, c.session = peerConnection, session
+	return nil
+}
+
+// reconnect replaces failed until a new session is negotiated, the connection
+// is closed or the server refuses it for good
+func (c *Connection) reconnect(failed *webrtc.PeerConnection) {
+	c.lock.Lock()
+	if c.closed || c.peerConnection != failed {
+		c.lock.Unlock()
+		return
+	}
+	session := c.session
+	c.lock.Unlock()
+
+	_ = session.Delete(context.Background())
+	_ = failed.Close()
+
+	for {
+		time.Sleep(c.config.ReconnectDelay)
+
+		c.lock.Lock()
+		closed := c.closed
+		c.lock.Unlock()
+		if closed {
+			return
+		}
+
+		err := c.connect(context.Background())
+		if err == nil || errors.Is(err, ErrClosed) {
+			return
+		}
+
+		// Retrying doesn't help once the server forbids the session
+		var responseErr *ResponseError
+		if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusForbidden {
+			return
+		}
+	}
+}
+
+// Close ends the session on the server and closes the PeerConnection. Servers
+// that don't implement DELETE notice the PeerConnection closing instead
+func (c *Connection) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	peerConnection, session := c.peerConnection, c.session
+	c.lock.Unlock()
+
+	_ = session.Delete(context.Background())
+	return peerConnection.Close()
+}
+
+func closeWithError(peerConnection *webrtc.PeerConnection, err error) error {
+	_ = peerConnection.Close()
+	return err
+}
@@ -0,0 +1,244 @@
+// Package signaling is the HTTP side of WHIP and WHEP shared by the clients in pkg
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	sdpContentType     = "application/sdp"
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+)
+
+type Config struct {
+	// Endpoint the offer is POSTed to
+	URL string
+
+	// Sent as a bearer token, Broadcast Box uses it as the stream key
+	Token string
+
+	// Added to every request, like X-API-Key for tenants
+	Header http.Header
+
+	// http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// Send the offer before gathering finished and PATCH candidates to the
+	// session as they are found. Servers that don't accept PATCH still connect
+	// through peer reflexive candidates
+	Trickle bool
+}
+
+// ResponseError is returned when the server refuses the offer
+type ResponseError struct {
+	URL        string
+	StatusCode int
+
+	// From X-Disconnect-Reason, like suspended or server_shutdown
+	Reason string
+	Body   string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s answered %d: %s", e.URL, e.StatusCode, e.Body)
+}
+
+// Session is a WHIP or WHEP session the server accepted
+type Session struct {
+	config      Config
+	resourceURL string
+
+	// Trickled candidates found before the server answered and whether the
+	// server accepts them
+	lock              sync.Mutex
+	answered          bool
+	trickleRejected   bool
+	pendingCandidates []webrtc.ICECandidateInit
+}
+
+// Negotiate creates an offer for peerConnection, POSTs it and applies the answer
+func Negotiate(ctx context.Context, config Config, peerConnection *webrtc.PeerConnection) (*Session, error) {
+	s := &Session{config: config}
+	if config.Trickle {
+		peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+			if c != nil {
+				s.trickle(peerConnection, c.ToJSON())
+			}
+		})
+	}
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+
+	if !config.Trickle {
+		select {
+		case <-gatherComplete:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	res, err := s.do(ctx, http.MethodPost, config.URL, sdpContentType, peerConnection.LocalDescription().SDP)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	answer, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode != http.StatusCreated {
+		return nil, &ResponseError{
+			URL:        config.URL,
+			StatusCode: res.StatusCode,
+			Reason:     res.Header.Get("X-Disconnect-Reason"),
+			Body:       string(bytes.TrimSpace(answer)),
+		}
+	}
+
+	if s.resourceURL, err = resolveLocation(config.URL, res.Header.Get("Location")); err != nil {
+		return nil, err
+	}
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	}); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.answered = true
+	pending := s.pendingCandidates
+	s.pendingCandidates = nil
+	s.lock.Unlock()
+
+	for _, c := range pending {
+		s.trickle(peerConnection, c)
+	}
+
+	return s, nil
+}
+
+// Delete ends the session on the server
+func (s *Session) Delete(ctx context.Context) error {
+	res, err := s.do(ctx, http.MethodDelete, s.resourceURL, "", "")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s answered %d to DELETE", s.resourceURL, res.StatusCode)
+	}
+	return nil
+}
+
+// trickle PATCHes a candidate to the session, or queues it until the server answered
+func (s *Session) trickle(peerConnection *webrtc.PeerConnection, candidate webrtc.ICECandidateInit) {
+	s.lock.Lock()
+	if s.trickleRejected {
+		s.lock.Unlock()
+		return
+	} else if !s.answered {
+		s.pendingCandidates = append(s.pendingCandidates, candidate)
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+
+	res, err := s.do(context.Background(), http.MethodPatch, s.resourceURL, sdpFragContentType, sdpFrag(peerConnection.LocalDescription(), candidate))
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented || res.StatusCode == http.StatusUnsupportedMediaType {
+		s.lock.Lock()
+		s.trickleRejected = true
+		s.lock.Unlock()
+	}
+}
+
+func (s *Session) do(ctx context.Context, method, url, contentType, body string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range s.config.Header {
+		req.Header[name] = values
+	}
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := s.config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// resolveLocation makes the Location of the session absolute, it is usually
+// relative to the endpoint. Servers that don't send one manage the session at
+// the endpoint
+func resolveLocation(endpoint, location string) (string, error) {
+	if location == "" {
+		return endpoint, nil
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// sdpFrag is the RFC 8840 fragment that carries one candidate
+func sdpFrag(local *webrtc.SessionDescription, candidate webrtc.ICECandidateInit) string {
+	frag := &strings.Builder{}
+	for _, line := range strings.Split(local.SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") || strings.HasPrefix(line, "a=ice-pwd:") {
+			frag.WriteString(line + "\r\n")
+		}
+
+		// Every media section shares the credentials of the first bundled one
+		if strings.HasPrefix(line, "a=ice-pwd:") {
+			break
+		}
+	}
+
+	mid := ""
+	if candidate.SDPMid != nil {
+		mid = *candidate.SDPMid
+	}
+	frag.WriteString("m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n")
+	frag.WriteString("a=mid:" + mid + "\r\n")
+	frag.WriteString("a=" + candidate.Candidate + "\r\n")
+	return frag.String()
+}
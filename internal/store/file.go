@@ -0,0 +1,75 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// memoryBackend is used without STATE_FILE, fileBackend builds on it
+type memoryBackend struct {
+	documents map[string]json.RawMessage
+	lock      sync.Mutex
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{documents: map[string]json.RawMessage{}}
+}
+
+func (m *memoryBackend) Get(key string) (json.RawMessage, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	raw, ok := m.documents[key]
+	return raw, ok, nil
+}
+
+func (m *memoryBackend) Put(key string, value json.RawMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.documents[key] = value
+	return nil
+}
+
+// fileBackend rewrites the whole file on every Put. State only changes when
+// admins and viewers use the API, so this is cheap enough
+type fileBackend struct {
+	memoryBackend
+	path string
+}
+
+func newFileBackend(path string) (*fileBackend, error) {
+	f := &fileBackend{memoryBackend: memoryBackend{documents: map[string]json.RawMessage{}}, path: path}
+
+	body, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return f, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err = json.Unmarshal(body, &f.documents); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileBackend) Put(key string, value json.RawMessage) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.documents[key] = value
+	body, err := json.MarshalIndent(f.documents, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file first so a crash never leaves a partial file
+	if err = os.WriteFile(f.path+".tmp", body, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(f.path+".tmp", f.path)
+}
@@ -0,0 +1,64 @@
+package store
+
+// Broadcast is one publish of a stream, from WHIP connecting to disconnecting
+type Broadcast struct {
+	ID              string `json:"id"`
+	StreamKey       string `json:"streamKey"`
+	StartedAt       int64  `json:"startedAt"`
+	EndedAt         int64  `json:"endedAt"`
+	DurationSeconds int64  `json:"durationSeconds"`
+	PeakViewers     int    `json:"peakViewers"`
+	EndReason       string `json:"endReason"`
+
+	// Recording that was active when the broadcast ended, empty if none was
+	RecordingID string `json:"recordingId,omitempty"`
+}
+
+// ViewerSession is a WHEP session that has ended
+type ViewerSession struct {
+	ID              string `json:"id"`
+	StreamKey       string `json:"streamKey"`
+	StartedAt       int64  `json:"startedAt"`
+	EndedAt         int64  `json:"endedAt"`
+	DurationSeconds int64  `json:"durationSeconds"`
+	Country         string `json:"country"`
+	ASN             string `json:"asn"`
+	Layer           string `json:"layer"`
+	BytesSent       uint64 `json:"bytesSent"`
+	EndReason       string `json:"endReason"`
+
+	// From the last Receiver Report of the viewer, nil if it never sent one
+	PacketLossPercent *uint32 `json:"packetLossPercent"`
+}
+
+// HistoryFilter narrows Broadcasts and ViewerSessions, zero values match everything
+type HistoryFilter struct {
+	StreamKey string
+
+	// Unix times the broadcast or session must have started in
+	Since, Until int64
+
+	// How many of the newest are returned
+	Limit int
+}
+
+// HistoryBackend is implemented by backends that keep every broadcast and
+// viewer session as rows. Without one only the latest are kept, viewer
+// sessions only in memory
+type HistoryBackend interface {
+	AddBroadcast(b Broadcast) error
+	AddViewerSession(s ViewerSession) error
+
+	// Newest first
+	Broadcasts(filter HistoryFilter) ([]Broadcast, error)
+	ViewerSessions(filter HistoryFilter) ([]ViewerSession, error)
+}
+
+// History returns the backend if it keeps the history, false otherwise
+func History() (HistoryBackend, bool) {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+
+	h, ok := backend.(HistoryBackend)
+	return h, ok
+}
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	// Registers the postgres driver
+	_ "github.com/lib/pq"
+
+	// Registers the sqlite driver
+	_ "modernc.org/sqlite"
+)
+
+var errUnsupportedDatabase = errors.New("DATABASE_URL must start with sqlite:// or postgres://")
+
+// The statements are valid in both SQLite and Postgres
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS documents (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS broadcasts (
+		id TEXT PRIMARY KEY,
+		stream_key TEXT NOT NULL,
+		started_at BIGINT NOT NULL,
+		ended_at BIGINT NOT NULL,
+		duration_seconds BIGINT NOT NULL,
+		peak_viewers INTEGER NOT NULL,
+		end_reason TEXT NOT NULL,
+		recording_id TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS broadcasts_started_at ON broadcasts (started_at)`,
+	`CREATE TABLE IF NOT EXISTS viewer_sessions (
+		id TEXT PRIMARY KEY,
+		stream_key TEXT NOT NULL,
+		started_at BIGINT NOT NULL,
+		ended_at BIGINT NOT NULL,
+		duration_seconds BIGINT NOT NULL,
+		country TEXT NOT NULL,
+		asn TEXT NOT NULL,
+		layer TEXT NOT NULL,
+		bytes_sent BIGINT NOT NULL,
+		end_reason TEXT NOT NULL,
+		packet_loss_percent INTEGER
+	)`,
+	`CREATE INDEX IF NOT EXISTS viewer_sessions_started_at ON viewer_sessions (started_at)`,
+}
+
+// sqlBackend keeps the documents in a table and the history as rows, so
+// analytics can query every broadcast and viewer session directly
+type sqlBackend struct {
+	db *sql.DB
+}
+
+// newSQLBackend opens `sqlite:///path/to/file.db` or a `postgres://` URL and
+// creates the tables that are missing
+func newSQLBackend(databaseURL string) (*sqlBackend, error) {
+	var (
+		db  *sql.DB
+		err error
+	)
+	switch {
+	case strings.HasPrefix(databaseURL, "sqlite://"):
+		dsn := strings.TrimPrefix(databaseURL, "sqlite://")
+		if !strings.Contains(dsn, "?") {
+			dsn += "?" + url.Values{"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)"}}.Encode()
+		}
+		if db, err = sql.Open("sqlite", dsn); err != nil {
+			return nil, err
+		}
+
+		// SQLite has one writer at a time
+		db.SetMaxOpenConns(1)
+	case strings.HasPrefix(databaseURL, "postgres://"), strings.HasPrefix(databaseURL, "postgresql://"):
+		if db, err = sql.Open("postgres", databaseURL); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnsupportedDatabase
+	}
+
+	for _, statement := range sqlSchema {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close() //nolint
+			return nil, err
+		}
+	}
+
+	return &sqlBackend{db: db}, nil
+}
+
+func (s *sqlBackend) Get(key string) (json.RawMessage, bool, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM documents WHERE key = $1`, key).Scan(&value)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+
+	return json.RawMessage(value), true, nil
+}
+
+func (s *sqlBackend) Put(key string, value json.RawMessage) error {
+	_, err := s.db.Exec(`INSERT INTO documents (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, string(value))
+	return err
+}
+
+func (s *sqlBackend) AddBroadcast(b Broadcast) error {
+	_, err := s.db.Exec(`INSERT INTO broadcasts
+		(id, stream_key, started_at, ended_at, duration_seconds, peak_viewers, end_reason, recording_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		b.ID, b.StreamKey, b.StartedAt, b.EndedAt, b.DurationSeconds, b.PeakViewers, b.EndReason, b.RecordingID)
+	return err
+}
+
+func (s *sqlBackend) AddViewerSession(v ViewerSession) error {
+	var packetLossPercent sql.NullInt64
+	if v.PacketLossPercent != nil {
+		packetLossPercent = sql.NullInt64{Int64: int64(*v.PacketLossPercent), Valid: true}
+	}
+
+	_, err := s.db.Exec(`INSERT INTO viewer_sessions
+		(id, stream_key, started_at, ended_at, duration_seconds, country, asn, layer, bytes_sent, end_reason, packet_loss_percent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		v.ID, v.StreamKey, v.StartedAt, v.EndedAt, v.DurationSeconds, v.Country, v.ASN, v.Layer, int64(v.BytesSent), v.EndReason, packetLossPercent)
+	return err
+}
+
+func (s *sqlBackend) Broadcasts(filter HistoryFilter) ([]Broadcast, error) {
+	where, args := filter.sqlWhere()
+	rows, err := s.db.Query(`SELECT id, stream_key, started_at, ended_at, duration_seconds, peak_viewers, end_reason, recording_id
+		FROM broadcasts`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint
+
+	out := []Broadcast{}
+	for rows.Next() {
+		var b Broadcast
+		if err = rows.Scan(&b.ID, &b.StreamKey, &b.StartedAt, &b.EndedAt, &b.DurationSeconds, &b.PeakViewers, &b.EndReason, &b.RecordingID); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *sqlBackend) ViewerSessions(filter HistoryFilter) ([]ViewerSession, error) {
+	where, args := filter.sqlWhere()
+	rows, err := s.db.Query(`SELECT id, stream_key, started_at, ended_at, duration_seconds, country, asn, layer, bytes_sent, end_reason, packet_loss_percent
+		FROM viewer_sessions`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint
+
+	out := []ViewerSession{}
+	for rows.Next() {
+		var (
+			v                 ViewerSession
+			bytesSent         int64
+			packetLossPercent sql.NullInt64
+		)
+		if err = rows.Scan(&v.ID, &v.StreamKey, &v.StartedAt, &v.EndedAt, &v.DurationSeconds, &v.Country, &v.ASN, &v.Layer, &bytesSent, &v.EndReason, &packetLossPercent); err != nil {
+			return nil, err
+		}
+
+		v.BytesSent = uint64(bytesSent)
+		if packetLossPercent.Valid {
+			p := uint32(packetLossPercent.Int64)
+			v.PacketLossPercent = &p
+		}
+		out = append(out, v)
+	}
+
+	return out, rows.Err()
+}
+
+// sqlWhere returns the WHERE, ORDER BY and LIMIT clauses of the filter, newest first
+func (f HistoryFilter) sqlWhere() (string, []any) {
+	conditions, args := []string{}, []any{}
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+" $"+strconv.Itoa(len(args)))
+	}
+
+	if f.StreamKey != "" {
+		add("stream_key =", f.StreamKey)
+	}
+	if f.Since != 0 {
+		add("started_at >=", f.Since)
+	}
+	if f.Until != 0 {
+		add("started_at <=", f.Until)
+	}
+
+	clauses := ""
+	if len(conditions) != 0 {
+		clauses = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	clauses += " ORDER BY started_at DESC, ended_at DESC"
+	if f.Limit > 0 {
+		clauses += " LIMIT " + strconv.Itoa(f.Limit)
+	}
+
+	return clauses, args
+}
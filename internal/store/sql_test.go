@@ -0,0 +1,68 @@
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteBackend(t *testing.T) {
+	databaseURL := "sqlite://" + filepath.Join(t.TempDir(), "state.db")
+
+	b, err := newSQLBackend(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Put("roomPolicies", json.RawMessage(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	} else if err = b.Put("roomPolicies", json.RawMessage(`{"a":2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	packetLossPercent := uint32(3)
+	for _, s := range []ViewerSession{
+		{ID: "old", StreamKey: "Bearer a", StartedAt: 100, EndedAt: 200},
+		{ID: "new", StreamKey: "Bearer a", StartedAt: 300, EndedAt: 400, BytesSent: 1 << 40, PacketLossPercent: &packetLossPercent},
+		{ID: "other", StreamKey: "Bearer b", StartedAt: 300, EndedAt: 400},
+	} {
+		if err = b.AddViewerSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.AddBroadcast(Broadcast{ID: "broadcast", StreamKey: "Bearer a", StartedAt: 100, EndedAt: 400, RecordingID: "recording"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is read back after reopening the database
+	if b, err = newSQLBackend(databaseURL); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, ok, err := b.Get("roomPolicies")
+	if err != nil || !ok || string(raw) != `{"a":2}` {
+		t.Fatalf("unexpected document %s %v %v", raw, ok, err)
+	}
+
+	sessions, err := b.ViewerSessions(HistoryFilter{StreamKey: "Bearer a"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 2 || sessions[0].ID != "new" || sessions[1].ID != "old" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	} else if sessions[0].BytesSent != 1<<40 || sessions[0].PacketLossPercent == nil || *sessions[0].PacketLossPercent != 3 || sessions[1].PacketLossPercent != nil {
+		t.Fatalf("unexpected session %+v", sessions[0])
+	}
+
+	if sessions, err = b.ViewerSessions(HistoryFilter{Since: 250, Limit: 1}); err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 1 || sessions[0].StartedAt != 300 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	broadcasts, err := b.Broadcasts(HistoryFilter{Until: 200})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(broadcasts) != 1 || broadcasts[0].RecordingID != "recording" {
+		t.Fatalf("unexpected broadcasts %+v", broadcasts)
+	}
+}
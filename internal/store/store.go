@@ -0,0 +1,87 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Backend keeps the documents of the store by key. Each document is the JSON
+// of one kind of state, like every room policy. Backends are the JSON file of
+// STATE_FILE and the database of DATABASE_URL, which implements HistoryBackend
+// as well
+type Backend interface {
+	Get(key string) (json.RawMessage, bool, error)
+	Put(key string, value json.RawMessage) error
+}
+
+var (
+	backend     Backend = newMemoryBackend()
+	backendLock sync.RWMutex
+)
+
+var errStateFileAndDatabase = errors.New("only one of STATE_FILE and DATABASE_URL can be set")
+
+// Configure opens the JSON document in STATE_FILE or the database in
+// DATABASE_URL that holds everything admins set up through the API, like room
+// policies and suspensions. Without either that state is lost on restart
+func Configure() error {
+	var (
+		b   Backend = newMemoryBackend()
+		err error
+	)
+	switch path, databaseURL := os.Getenv("STATE_FILE"), os.Getenv("DATABASE_URL"); {
+	case path != "" && databaseURL != "":
+		return errStateFileAndDatabase
+	case path != "":
+		if b, err = newFileBackend(path); err != nil {
+			return err
+		}
+	case databaseURL != "":
+		if b, err = newSQLBackend(databaseURL); err != nil {
+			return err
+		}
+	}
+
+	backendLock.Lock()
+	defer backendLock.Unlock()
+
+	backend = b
+	return nil
+}
+
+// Persistent reports if the state is kept across restarts
+func Persistent() bool {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+
+	_, inMemory := backend.(*memoryBackend)
+	return !inMemory
+}
+
+// Load decodes the value saved under key into v. v is left alone if nothing
+// was saved
+func Load(key string, v any) error {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+
+	raw, ok, err := backend.Get(key)
+	if err != nil || !ok {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Save replaces the value under key
+func Save(key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+
+	return backend.Put(key, raw)
+}
@@ -0,0 +1,62 @@
+package systemd
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a state string like READY=1 to systemd. It is a no-op when
+// not running under a Type=notify unit
+func Notify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells systemd that startup has finished
+func Ready() {
+	if err := Notify("READY=1"); err != nil {
+		log.Println(err)
+	}
+}
+
+// Watchdog pings systemd at half of WATCHDOG_USEC as long as isHealthy
+// returns true. If the process wedges the pings stop and systemd restarts it
+func Watchdog(isHealthy func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+
+	go func() {
+		for range time.Tick(interval) {
+			if !isHealthy() {
+				log.Println("Health check failed, not sending watchdog ping to systemd")
+				continue
+			}
+
+			if err := Notify("WATCHDOG=1"); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
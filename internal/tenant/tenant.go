@@ -0,0 +1,115 @@
+package tenant
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Separator joins the tenant id and stream key. Tenant ids can't contain it
+const Separator = "/"
+
+type Tenant struct {
+	ID     string `json:"id"`
+	APIKey string `json:"apiKey"`
+
+	// Quotas across every stream of the tenant, 0 is unlimited
+	MaxStreams int `json:"maxStreams"`
+	MaxViewers int `json:"maxViewers"`
+
+	// Bytes every stream of the tenant may upload together, 0 is unlimited
+	MaxUploadBytesPerHour uint64 `json:"maxUploadBytesPerHour"`
+	MaxUploadBytesPerDay  uint64 `json:"maxUploadBytesPerDay"`
+}
+
+var (
+	tenants    []Tenant
+	tenantLock sync.RWMutex
+)
+
+// Configure loads the tenants from the JSON array in TENANTS_FILE. Without it
+// every stream key shares one namespace. Configure can be called again to
+// reload the tenants
+func Configure() error {
+	loaded := []Tenant{}
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		f, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err = json.Unmarshal(f, &loaded); err != nil {
+			return err
+		}
+
+		for _, t := range loaded {
+			if t.ID == "" || t.APIKey == "" || strings.Contains(t.ID, Separator) {
+				return errors.New("every tenant needs an id without " + Separator + " and an apiKey")
+			}
+		}
+	}
+
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+
+	tenants = loaded
+	return nil
+}
+
+// Enabled reports if any tenant is configured
+func Enabled() bool {
+	tenantLock.RLock()
+	defer tenantLock.RUnlock()
+
+	return len(tenants) != 0
+}
+
+func ByAPIKey(apiKey string) (Tenant, bool) {
+	tenantLock.RLock()
+	defer tenantLock.RUnlock()
+
+	for _, t := range tenants {
+		if subtle.ConstantTimeCompare([]byte(t.APIKey), []byte(apiKey)) == 1 {
+			return t, true
+		}
+	}
+
+	return Tenant{}, false
+}
+
+func ByID(id string) (Tenant, bool) {
+	tenantLock.RLock()
+	defer tenantLock.RUnlock()
+
+	for _, t := range tenants {
+		if t.ID == id {
+			return t, true
+		}
+	}
+
+	return Tenant{}, false
+}
+
+// StreamKey namespaces a stream key of the tenant
+func (t Tenant) StreamKey(streamKey string) string {
+	return t.ID + Separator + streamKey
+}
+
+// Owns reports if a namespaced stream key belongs to the tenant
+func (t Tenant) Owns(namespacedStreamKey string) bool {
+	return strings.HasPrefix(namespacedStreamKey, t.ID+Separator)
+}
+
+// StripNamespace returns the stream key as the tenant knows it
+func (t Tenant) StripNamespace(namespacedStreamKey string) string {
+	return strings.TrimPrefix(namespacedStreamKey, t.ID+Separator)
+}
+
+// IsNamespaced reports if a stream key belongs to any tenant. Stream keys
+// outside a tenant can't contain Separator while tenants are enabled
+func IsNamespaced(streamKey string) bool {
+	return strings.Contains(streamKey, Separator)
+}
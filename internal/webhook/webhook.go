@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventStreamStarted = "stream.started"
+	EventStreamStopped = "stream.stopped"
+	EventViewerJoined  = "viewer.joined"
+	EventViewerLeft    = "viewer.left"
+	EventViewerSlow    = "viewer.slow"
+	EventRoomClosed    = "room.closed"
+
+	EventRoomSlotAvailable = "room.slot_available"
+
+	EventStreamIngestExceeded = "stream.ingest_exceeded"
+	EventStreamLayersChanged  = "stream.layers_changed"
+	EventStreamScheduled      = "stream.scheduled"
+	EventStreamStartingSoon   = "stream.starting_soon"
+
+	EventStreamUploadQuotaWarning  = "stream.upload_quota_warning"
+	EventStreamUploadQuotaExceeded = "stream.upload_quota_exceeded"
+
+	signatureHeader = "X-Broadcast-Box-Signature"
+
+	defaultMaxRetries = 3
+	requestTimeout    = time.Second * 5
+)
+
+type (
+	Event struct {
+		Type          string `json:"type"`
+		Timestamp     int64  `json:"timestamp"`
+		StreamKey     string `json:"streamKey"`
+		WHEPSessionID string `json:"whepSessionId,omitempty"`
+
+		// Why the stream stopped or the viewer left
+		Reason string `json:"reason,omitempty"`
+	}
+)
+
+var (
+	webhookURLs   []string
+	webhookEvents map[string]bool
+	webhookSecret []byte
+	maxRetries    = defaultMaxRetries
+	configLock    sync.RWMutex
+
+	httpClient = &http.Client{Timeout: requestTimeout}
+)
+
+// Configure reads the webhook environment variables. If WEBHOOK_URLS is unset
+// Send is a no-op. Configure can be called again to reload the settings.
+func Configure() error {
+	var (
+		urls    []string
+		events  map[string]bool
+		retries = defaultMaxRetries
+	)
+
+	if val := os.Getenv("WEBHOOK_URLS"); val != "" {
+		urls = strings.Split(val, "|")
+	}
+
+	if val := os.Getenv("WEBHOOK_EVENTS"); val != "" {
+		events = map[string]bool{}
+		for _, e := range strings.Split(val, "|") {
+			events[e] = true
+		}
+	}
+
+	if val := os.Getenv("WEBHOOK_MAX_RETRIES"); val != "" {
+		var err error
+		if retries, err = strconv.Atoi(val); err != nil {
+			return err
+		}
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	webhookURLs = urls
+	webhookEvents = events
+	webhookSecret = []byte(os.Getenv("WEBHOOK_SECRET"))
+	maxRetries = retries
+
+	return nil
+}
+
+// Send delivers the event to every configured webhook in the background
+func Send(eventType, streamKey, whepSessionID, reason string) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	if len(webhookURLs) == 0 || (webhookEvents != nil && !webhookEvents[eventType]) {
+		return
+	}
+
+	body, err := json.Marshal(Event{
+		Type:          eventType,
+		Timestamp:     time.Now().Unix(),
+		StreamKey:     streamKey,
+		WHEPSessionID: whepSessionID,
+		Reason:        reason,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, url := range webhookURLs {
+		go deliver(url, body, webhookSecret, maxRetries)
+	}
+}
+
+// Post delivers a JSON body to url once, signed with WEBHOOK_SECRET
+func Post(url string, body []byte) error {
+	configLock.RLock()
+	secret := webhookSecret
+	configLock.RUnlock()
+
+	return post(url, body, secret)
+}
+
+// Call POSTs a JSON body to url once, signed with WEBHOOK_SECRET, and returns
+// the response body. Responses outside 2xx are errors
+func Call(ctx context.Context, url string, body []byte) ([]byte, error) {
+	configLock.RLock()
+	secret := webhookSecret
+	configLock.RUnlock()
+
+	req, err := newRequest(ctx, url, body, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// ctx bounds the request instead of requestTimeout
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("Unexpected HTTP StatusCode %d", res.StatusCode)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func sign(body, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body) //nolint
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliver(url string, body, secret []byte, maxRetries int) {
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := post(url, body, secret)
+		if err == nil {
+			return
+		} else if attempt >= maxRetries {
+			log.Printf("Webhook to %s failed after %d attempts: %s\n", url, attempt+1, err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func newRequest(ctx context.Context, url string, body, secret []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) != 0 {
+		req.Header.Set(signatureHeader, sign(body, secret))
+	}
+	return req, nil
+}
+
+func post(url string, body, secret []byte) error {
+	req, err := newRequest(context.Background(), url, body, secret)
+	if err != nil {
+		return err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Unexpected HTTP StatusCode %d", res.StatusCode)
+	}
+
+	return nil
+}
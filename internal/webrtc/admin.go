@@ -0,0 +1,76 @@
+package webrtc
+
+import "time"
+
+type (
+	AdminOverview struct {
+		StreamCount int           `json:"streamCount"`
+		ViewerCount int           `json:"viewerCount"`
+		Streams     []AdminStream `json:"streams"`
+	}
+
+	AdminStream struct {
+		StreamKey              string        `json:"streamKey"`
+		FirstSeenEpoch         uint64        `json:"firstSeenEpoch"`
+		UptimeSeconds          int64         `json:"uptimeSeconds"`
+		HasWHIPClient          bool          `json:"hasWHIPClient"`
+		WHIPICEConnectionState string        `json:"whipICEConnectionState"`
+		VideoLayers            []string      `json:"videoLayers"`
+		Viewers                []AdminViewer `json:"viewers"`
+	}
+
+	AdminViewer struct {
+		ID                 string `json:"id"`
+		ICEConnectionState string `json:"iceConnectionState"`
+		CurrentLayer       string `json:"currentLayer"`
+
+		WatchDurationSeconds int64 `json:"watchDurationSeconds"`
+	}
+)
+
+// GetAdminOverview returns every stream and WHEP session with their connection states
+func GetAdminOverview() AdminOverview {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	out := AdminOverview{Streams: []AdminStream{}}
+
+	for streamKey, stream := range streamMap {
+		whipICEConnectionState, _ := stream.whipICEConnectionState.Load().(string)
+
+		adminStream := AdminStream{
+			StreamKey:              streamKey,
+			FirstSeenEpoch:         stream.firstSeenEpoch,
+			UptimeSeconds:          stream.uptimeSeconds(),
+			HasWHIPClient:          stream.hasWHIPClient.Load(),
+			WHIPICEConnectionState: whipICEConnectionState,
+			VideoLayers:            []string{},
+			Viewers:                []AdminViewer{},
+		}
+
+		for _, videoTrack := range stream.videoTracks {
+			adminStream.VideoLayers = append(adminStream.VideoLayers, videoTrack.rid)
+		}
+
+		stream.whepSessionsLock.RLock()
+		for id, whepSession := range stream.whepSessions {
+			iceConnectionState, _ := whepSession.iceConnectionState.Load().(string)
+			currentLayer, _ := whepSession.currentLayer.Load().(string)
+
+			adminStream.Viewers = append(adminStream.Viewers, AdminViewer{
+				ID:                 id,
+				ICEConnectionState: iceConnectionState,
+				CurrentLayer:       currentLayer,
+
+				WatchDurationSeconds: int64(time.Since(whepSession.startedAt).Seconds()),
+			})
+		}
+		stream.whepSessionsLock.RUnlock()
+
+		out.ViewerCount += len(adminStream.Viewers)
+		out.Streams = append(out.Streams, adminStream)
+	}
+	out.StreamCount = len(out.Streams)
+
+	return out
+}
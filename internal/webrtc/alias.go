@@ -0,0 +1,90 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+)
+
+const maxAliasLength = 64
+
+var (
+	ErrAliasTaken   = errors.New("alias belongs to another stream")
+	ErrAliasIsKey   = errors.New("alias is the stream key of another stream")
+	ErrInvalidAlias = errors.New("alias may only contain letters, digits, '-', '_' and '.'")
+
+	// Stream keys keyed by the alias viewers can use instead
+	aliases   = map[string]string{}
+	aliasLock sync.RWMutex
+)
+
+// ValidAlias keeps aliases usable as a path segment. It is checked before the
+// tenant namespace is added
+func ValidAlias(alias string) bool {
+	if alias == "" || len(alias) > maxAliasLength {
+		return false
+	}
+
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetAlias lets viewers watch streamKey as alias. An alias can only point at
+// one stream, it has to be deleted before another stream can use it. Stream
+// keys that are live or were broadcast before can't be taken as an alias
+func SetAlias(alias, streamKey string) error {
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	if existing, ok := aliases[alias]; ok && existing != streamKey {
+		return ErrAliasTaken
+	} else if alias != streamKey && StreamExists(alias) {
+		return ErrAliasIsKey
+	}
+
+	aliases[alias] = streamKey
+	saveState(aliasesStateKey, aliases)
+	return nil
+}
+
+func DeleteAlias(alias string) bool {
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+
+	if _, ok := aliases[alias]; !ok {
+		return false
+	}
+
+	delete(aliases, alias)
+	saveState(aliasesStateKey, aliases)
+	return true
+}
+
+// StreamExists reports if streamKey is live or was broadcast before. Rooms
+// only viewers opened don't count, anyone can open one
+func StreamExists(streamKey string) bool {
+	if IsLive(streamKey) {
+		return true
+	}
+
+	broadcastHistoryLock.Lock()
+	defer broadcastHistoryLock.Unlock()
+	for _, b := range broadcastHistory {
+		if b.StreamKey == streamKey {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveAlias returns the stream key alias points at
+func ResolveAlias(alias string) (string, bool) {
+	aliasLock.RLock()
+	defer aliasLock.RUnlock()
+
+	streamKey, ok := aliases[alias]
+	return streamKey, ok
+}
@@ -0,0 +1,132 @@
+package webrtc
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// How long padding is sent before a downgraded session is moved back up
+	bandwidthProbeDuration = time.Second * 5
+
+	rtpPaddingSize = 255
+
+	// Bounds the burst of padding written after a single frame
+	maxPaddingPacketsPerFrame = 50
+)
+
+var (
+	bandwidthProbing     bool
+	bandwidthProbingLock sync.RWMutex
+)
+
+func configureBandwidthProbing() {
+	bandwidthProbingLock.Lock()
+	defer bandwidthProbingLock.Unlock()
+
+	bandwidthProbing = os.Getenv("BANDWIDTH_PROBING") == "true"
+}
+
+func (w *whepSession) isProbing() bool {
+	return w.probeBitrate.Load() != 0
+}
+
+// bandwidthProbeFinished reports if padding was sent for the whole probe
+// without the viewer reporting loss
+func (w *whepSession) bandwidthProbeFinished() bool {
+	return w.isProbing() && time.Now().UnixNano() >= w.probeUntil.Load()
+}
+
+func (w *whepSession) stopBandwidthProbe() {
+	w.probeBitrate.Store(0)
+}
+
+// startBandwidthProbe pads the session by the bitrate it would gain from being
+// upgraded. It returns false if probing is disabled or the difference is
+// unknown, then the session should be upgraded right away
+func (w *whepSession) startBandwidthProbe(s *stream) bool {
+	bandwidthProbingLock.RLock()
+	enabled := bandwidthProbing
+	bandwidthProbingLock.RUnlock()
+	if !enabled {
+		return false
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if len(w.downgradedFrom) == 0 {
+		return false
+	}
+	previous := w.downgradedFrom[len(w.downgradedFrom)-1]
+	currentLayer, _ := w.currentLayer.Load().(string)
+
+	s.bitrateHistory.mu.Lock()
+	defer s.bitrateHistory.mu.Unlock()
+	if len(s.bitrateHistory.samples) == 0 {
+		return false
+	}
+	sample := s.bitrateHistory.samples[len(s.bitrateHistory.samples)-1]
+
+	// Restoring temporal layers roughly doubles the frame rate of the same layer
+	extraBitrate := sample.VideoBitrate[currentLayer] / 2
+	if previous.rid != currentLayer {
+		if sample.VideoBitrate[previous.rid] <= sample.VideoBitrate[currentLayer] {
+			return false
+		}
+		extraBitrate = sample.VideoBitrate[previous.rid] - sample.VideoBitrate[currentLayer]
+	}
+
+	if extraBitrate == 0 {
+		return false
+	}
+
+	w.probeUntil.Store(time.Now().Add(bandwidthProbeDuration).UnixNano())
+	w.probeBitrate.Store(extraBitrate)
+	return true
+}
+
+// sendProbePadding writes padding only packets after a frame while the session
+// is probing. It must be called with packetLock held
+func (w *whepSession) sendProbePadding(codec videoTrackCodec) {
+	probeBitrate := w.probeBitrate.Load()
+	if probeBitrate == 0 || time.Now().UnixNano() >= w.probeUntil.Load() {
+		w.lastPaddingAt, w.paddingBudget = time.Time{}, 0
+		return
+	}
+
+	now := time.Now()
+	if !w.lastPaddingAt.IsZero() {
+		w.paddingBudget += float64(probeBitrate) / 8 * now.Sub(w.lastPaddingAt).Seconds()
+	}
+	w.lastPaddingAt = now
+
+	payload := make([]byte, rtpPaddingSize)
+	payload[rtpPaddingSize-1] = rtpPaddingSize
+
+	for i := 0; i < maxPaddingPacketsPerFrame && w.paddingBudget >= rtpPaddingSize; i++ {
+		w.sequenceNumber++
+		if err := w.videoTrack.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Padding:        true,
+				SequenceNumber: w.sequenceNumber,
+				Timestamp:      w.timestamp,
+			},
+			Payload: payload,
+		}, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			w.logger.Println(err)
+		}
+		w.paddingBudget -= rtpPaddingSize
+	}
+
+	// Don't carry a backlog into the next frame
+	if w.paddingBudget > rtpPaddingSize {
+		w.paddingBudget = 0
+	}
+}
@@ -0,0 +1,130 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	bitrateSampleInterval = time.Second * 5
+
+	// Five minutes of history at bitrateSampleInterval
+	bitrateHistoryLength = 60
+)
+
+type (
+	BitrateSample struct {
+		Epoch        int64             `json:"epoch"`
+		AudioBitrate uint64            `json:"audioBitrate"`
+		VideoBitrate map[string]uint64 `json:"videoBitrate"`
+
+		// Video packets the publisher sent that never arrived, across every layer
+		VideoPacketLossPercent float64 `json:"videoPacketLossPercent"`
+	}
+
+	bitrateHistory struct {
+		mu sync.Mutex
+
+		samples []BitrateSample
+
+		lastAudioBytes uint64
+		lastVideoBytes map[string]uint64
+
+		lastVideoPackets, lastVideoPacketsLost uint64
+	}
+
+	StreamDetail struct {
+		StreamStatus
+		BitrateHistory []BitrateSample `json:"bitrateHistory"`
+	}
+)
+
+func bitsPerSecond(bytes uint64) uint64 {
+	return bytes * 8 / uint64(bitrateSampleInterval/time.Second)
+}
+
+// sampleBitrate must be called with streamMapLock held
+func (s *stream) sampleBitrate() BitrateSample {
+	s.bitrateHistory.mu.Lock()
+	defer s.bitrateHistory.mu.Unlock()
+
+	h := &s.bitrateHistory
+	if h.lastVideoBytes == nil {
+		h.lastVideoBytes = map[string]uint64{}
+	}
+
+	audioBytes := s.audioBytesReceived.Load()
+	sample := BitrateSample{
+		Epoch:        time.Now().Unix(),
+		AudioBitrate: bitsPerSecond(audioBytes - h.lastAudioBytes),
+		VideoBitrate: map[string]uint64{},
+	}
+	h.lastAudioBytes = audioBytes
+
+	videoPackets, videoPacketsLost := uint64(0), uint64(0)
+	for _, videoTrack := range s.videoTracks {
+		videoBytes := videoTrack.bytesReceived.Load()
+		sample.VideoBitrate[videoTrack.rid] = bitsPerSecond(videoBytes - h.lastVideoBytes[videoTrack.rid])
+		h.lastVideoBytes[videoTrack.rid] = videoBytes
+
+		videoPackets += videoTrack.packetsReceived.Load()
+		videoPacketsLost += videoTrack.packetsLost.Load()
+	}
+
+	// Tracks are never removed, so the totals only grow
+	if received, lost := videoPackets-h.lastVideoPackets, videoPacketsLost-h.lastVideoPacketsLost; received+lost != 0 {
+		sample.VideoPacketLossPercent = float64(lost) * 100 / float64(received+lost)
+	}
+	h.lastVideoPackets, h.lastVideoPacketsLost = videoPackets, videoPacketsLost
+
+	h.samples = append(h.samples, sample)
+	if len(h.samples) > bitrateHistoryLength {
+		h.samples = h.samples[len(h.samples)-bitrateHistoryLength:]
+	}
+
+	return sample
+}
+
+// videoBitrate is the bitrate of a layer in the last sample, 0 before the
+// first sample or if the layer sent nothing
+func (s *stream) videoBitrate(rid string) uint64 {
+	s.bitrateHistory.mu.Lock()
+	defer s.bitrateHistory.mu.Unlock()
+
+	if len(s.bitrateHistory.samples) == 0 {
+		return 0
+	}
+	return s.bitrateHistory.samples[len(s.bitrateHistory.samples)-1].VideoBitrate[rid]
+}
+
+func sampleBitrates() {
+	for range time.Tick(bitrateSampleInterval) {
+		streamMapLock.Lock()
+		for streamKey, stream := range streamMap {
+			sample := stream.sampleBitrate()
+			stream.enforceIngestPolicy(streamKey, sample)
+			stream.enforceUploadQuota(streamKey, sample)
+			stream.sendPublisherStats(streamKey)
+		}
+		streamMapLock.Unlock()
+	}
+}
+
+// GetStreamDetail returns the status of a single stream with its recent bitrates
+func GetStreamDetail(streamKey string) (StreamDetail, bool) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		return StreamDetail{}, false
+	}
+
+	stream.bitrateHistory.mu.Lock()
+	defer stream.bitrateHistory.mu.Unlock()
+
+	return StreamDetail{
+		StreamStatus:   stream.status(streamKey),
+		BitrateHistory: append([]BitrateSample{}, stream.bitrateHistory.samples...),
+	}, true
+}
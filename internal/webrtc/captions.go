@@ -0,0 +1,42 @@
+package webrtc
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	viewerEventCaption = "caption"
+
+	// How long a cue is shown if the caption didn't set a duration
+	defaultCaptionDurationMs = 4000
+)
+
+var ErrCaptionEmpty = errors.New("caption has no text")
+
+type Caption struct {
+	Text       string `json:"text"`
+	Language   string `json:"language,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// PublishCaption sends a caption cue to every viewer of a live stream
+func PublishCaption(streamKey string, caption Caption) (ViewerEvent, error) {
+	if caption.Text = strings.TrimSpace(caption.Text); caption.Text == "" {
+		return ViewerEvent{}, ErrCaptionEmpty
+	}
+
+	if caption.DurationMs <= 0 {
+		caption.DurationMs = defaultCaptionDurationMs
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.whipStartedEpochMs.Load() == 0 {
+		return ViewerEvent{}, ErrStreamNotActive
+	}
+
+	return stream.publishViewerEvent(viewerEventCaption, caption), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package webrtc
+
+import "time"
+
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,58 @@
+package webrtc
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Messages publishers send on a negotiated DataChannel with this label and
+	// id are passed on to every viewer that opened it as well. Viewers can
+	// send back to the publisher if the room allows it
+	relayChannelLabel = "broadcast-box-relay"
+	relayChannelId    = uint16(1)
+)
+
+// createRelayChannel must be called before the offer is applied, like createEventsChannel
+func createRelayChannel(peerConnection *webrtc.PeerConnection) (*webrtc.DataChannel, error) {
+	negotiated, id := true, relayChannelId
+	return peerConnection.CreateDataChannel(relayChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+}
+
+// relayMessage sends a message as text or binary, like it was received
+func relayMessage(channel *webrtc.DataChannel, msg webrtc.DataChannelMessage) error {
+	if channel == nil || channel.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	} else if msg.IsString {
+		return channel.SendText(string(msg.Data))
+	}
+	return channel.Send(msg.Data)
+}
+
+// relayToViewers passes a message of the publisher on to every viewer of the stream
+func (s *stream) relayToViewers(msg webrtc.DataChannelMessage) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for _, whepSession := range s.whepSessions {
+		if err := relayMessage(whepSession.relayChannel, msg); err != nil {
+			whepSession.logger.Println(err)
+		}
+	}
+}
+
+// relayToPublisher passes a message of a viewer on to the publisher, if the
+// room has ViewerDataRelay set
+func (s *stream) relayToPublisher(streamKey string, msg webrtc.DataChannelMessage) error {
+	if !GetRoomPolicy(streamKey).ViewerDataRelay {
+		return nil
+	}
+
+	streamMapLock.Lock()
+	channel := s.whipRelayChannel
+	streamMapLock.Unlock()
+
+	return relayMessage(channel, msg)
+}
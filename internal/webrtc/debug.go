@@ -0,0 +1,176 @@
+package webrtc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/eventlog"
+)
+
+const debugDumpLockTimeout = time.Second
+
+type (
+	// timedMutex records how long it is held so stuck locks can be diagnosed
+	timedMutex struct {
+		sync.Mutex
+
+		lockedAt    atomic.Int64
+		lastHoldNs  atomic.Int64
+		maxHoldNs   atomic.Int64
+		acquireWait atomic.Int64
+	}
+
+	DebugLockStats struct {
+		HeldForMs         float64 `json:"heldForMs"`
+		LastHoldMs        float64 `json:"lastHoldMs"`
+		MaxHoldMs         float64 `json:"maxHoldMs"`
+		LastAcquireWaitMs float64 `json:"lastAcquireWaitMs"`
+	}
+
+	DebugDump struct {
+		StreamMapLock      DebugLockStats `json:"streamMapLock"`
+		StreamMapLocked    bool           `json:"streamMapLocked"`
+		EventLogQueueDepth int            `json:"eventLogQueueDepth"`
+		Streams            []DebugStream  `json:"streams"`
+	}
+
+	DebugStream struct {
+		StreamKey          string              `json:"streamKey"`
+		HasWHIPClient      bool                `json:"hasWHIPClient"`
+		WHIPActive         bool                `json:"whipActive"`
+		PLIChanDepth       int                 `json:"pliChanDepth"`
+		PLIChanCapacity    int                 `json:"pliChanCapacity"`
+		AudioPackets       uint64              `json:"audioPacketsReceived"`
+		VideoTracks        []StreamStatusVideo `json:"videoTracks"`
+		WHEPSessionsLocked bool                `json:"whepSessionsLocked"`
+		WHEPSessions       []DebugWHEPSession  `json:"whepSessions"`
+	}
+
+	DebugWHEPSession struct {
+		ID                 string `json:"id"`
+		CurrentLayer       string `json:"currentLayer"`
+		ICEConnectionState string `json:"iceConnectionState"`
+		SequenceNumber     uint16 `json:"sequenceNumber"`
+		Timestamp          uint32 `json:"timestamp"`
+		PacketsWritten     uint64 `json:"packetsWritten"`
+		SlowConsumer       bool   `json:"slowConsumer"`
+		SlowReportCount    int    `json:"slowReportCount"`
+	}
+)
+
+func (m *timedMutex) Lock() {
+	start := time.Now()
+	m.Mutex.Lock()
+
+	m.acquireWait.Store(int64(time.Since(start)))
+	m.lockedAt.Store(time.Now().UnixNano())
+}
+
+func (m *timedMutex) Unlock() {
+	held := time.Now().UnixNano() - m.lockedAt.Swap(0)
+	m.lastHoldNs.Store(held)
+	if held > m.maxHoldNs.Load() {
+		m.maxHoldNs.Store(held)
+	}
+
+	m.Mutex.Unlock()
+}
+
+// tryLockFor attempts to take the lock until timeout passes
+func (m *timedMutex) tryLockFor(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if m.Mutex.TryLock() {
+			m.lockedAt.Store(time.Now().UnixNano())
+			return true
+		} else if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func (m *timedMutex) stats() DebugLockStats {
+	out := DebugLockStats{
+		LastHoldMs:        float64(m.lastHoldNs.Load()) / float64(time.Millisecond),
+		MaxHoldMs:         float64(m.maxHoldNs.Load()) / float64(time.Millisecond),
+		LastAcquireWaitMs: float64(m.acquireWait.Load()) / float64(time.Millisecond),
+	}
+
+	if lockedAt := m.lockedAt.Load(); lockedAt != 0 {
+		out.HeldForMs = float64(time.Now().UnixNano()-lockedAt) / float64(time.Millisecond)
+	}
+
+	return out
+}
+
+// GetDebugDump serializes all in-memory state. If a lock can't be taken within
+// a second that part of the dump is skipped and reported as locked instead of
+// blocking forever
+func GetDebugDump() DebugDump {
+	out := DebugDump{
+		StreamMapLock:      streamMapLock.stats(),
+		EventLogQueueDepth: eventlog.QueueDepth(),
+		Streams:            []DebugStream{},
+	}
+
+	if !streamMapLock.tryLockFor(debugDumpLockTimeout) {
+		out.StreamMapLocked = true
+		return out
+	}
+	defer streamMapLock.Unlock()
+
+	for streamKey, stream := range streamMap {
+		debugStream := DebugStream{
+			StreamKey:       streamKey,
+			HasWHIPClient:   stream.hasWHIPClient.Load(),
+			WHIPActive:      stream.whipActiveContext.Err() == nil,
+			PLIChanDepth:    len(stream.pliChan),
+			PLIChanCapacity: cap(stream.pliChan),
+			AudioPackets:    stream.audioPacketsReceived.Load(),
+			VideoTracks:     []StreamStatusVideo{},
+			WHEPSessions:    []DebugWHEPSession{},
+		}
+
+		for _, videoTrack := range stream.videoTracks {
+			codec, _ := videoTrack.codec.Load().(string)
+			debugStream.VideoTracks = append(debugStream.VideoTracks, StreamStatusVideo{
+				RID:              videoTrack.rid,
+				Codec:            codec,
+				PacketsReceived:  videoTrack.packetsReceived.Load(),
+				BytesReceived:    videoTrack.bytesReceived.Load(),
+				PacketsForwarded: videoTrack.packetsForwarded.Load(),
+				BytesForwarded:   videoTrack.bytesForwarded.Load(),
+			})
+		}
+
+		if !stream.whepSessionsLock.TryRLock() {
+			debugStream.WHEPSessionsLocked = true
+			out.Streams = append(out.Streams, debugStream)
+			continue
+		}
+
+		for id, whepSession := range stream.whepSessions {
+			currentLayer, _ := whepSession.currentLayer.Load().(string)
+			iceConnectionState, _ := whepSession.iceConnectionState.Load().(string)
+
+			debugStream.WHEPSessions = append(debugStream.WHEPSessions, DebugWHEPSession{
+				ID:                 id,
+				CurrentLayer:       currentLayer,
+				ICEConnectionState: iceConnectionState,
+				SequenceNumber:     whepSession.sequenceNumber,
+				Timestamp:          whepSession.timestamp,
+				PacketsWritten:     whepSession.packetsWritten,
+				SlowConsumer:       whepSession.isSlowConsumer.Load(),
+				SlowReportCount:    whepSession.slowReportCount,
+			})
+		}
+		stream.whepSessionsLock.RUnlock()
+
+		out.Streams = append(out.Streams, debugStream)
+	}
+
+	return out
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package webrtc
+
+import "syscall"
+
+// diskFreeBytes returns the space available to unprivileged users on the filesystem of path
+func diskFreeBytes(path string) (uint64, bool) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true
+}
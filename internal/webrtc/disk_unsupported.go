@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package webrtc
+
+func diskFreeBytes(path string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,250 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/store"
+	"github.com/google/uuid"
+)
+
+const (
+	broadcastHistoryStateKey = "broadcastHistory"
+
+	// Only the latest broadcasts and viewer sessions are kept, the oldest is
+	// forgotten first
+	broadcastHistoryLength     = 1000
+	viewerSessionHistoryLength = 10000
+)
+
+// Broadcast is one publish of a stream, from WHIP connecting to disconnecting
+type Broadcast = store.Broadcast
+
+// ViewerSession is a WHEP session that has ended
+type ViewerSession = store.ViewerSession
+
+// BroadcastHistoryFilter narrows GetBroadcastHistory and GetViewerSessions,
+// zero values match everything
+type BroadcastHistoryFilter struct {
+	StreamKey string
+
+	// Unix times the broadcast or session must have started in
+	Since, Until int64
+}
+
+func (f BroadcastHistoryFilter) matches(streamKey string, startedAt int64) bool {
+	switch {
+	case f.StreamKey != "" && streamKey != f.StreamKey:
+	case f.Since != 0 && startedAt < f.Since:
+	case f.Until != 0 && startedAt > f.Until:
+	default:
+		return true
+	}
+
+	return false
+}
+
+func (f BroadcastHistoryFilter) storeFilter() store.HistoryFilter {
+	return store.HistoryFilter{StreamKey: f.StreamKey, Since: f.Since, Until: f.Until}
+}
+
+var (
+	// Oldest first. Without a database viewer sessions are only kept in memory,
+	// a save for every viewer that leaves would rewrite STATE_FILE constantly.
+	// With one these are the latest rows of it
+	broadcastHistory     []Broadcast
+	viewerSessionHistory []ViewerSession
+	broadcastHistoryLock sync.Mutex
+
+	// Held while the broadcast history is saved, so saves aren't reordered
+	broadcastHistorySaveLock sync.Mutex
+
+	// When the newest broadcast and viewer session that were forgotten ended,
+	// guarded by broadcastHistoryLock
+	broadcastsForgottenUntil, viewerSessionsForgottenUntil int64
+
+	historyStartedAt = time.Now().Unix()
+)
+
+// recordBroadcast adds the publish that is ending to the history. It must be
+// called with streamMapLock held, before the recording is detached. The history
+// is saved in the background so WHIP and WHEP don't wait on the store
+func (s *stream) recordBroadcast(streamKey string) {
+	startedEpochMs := s.whipStartedEpochMs.Load()
+	if startedEpochMs == 0 {
+		return
+	}
+
+	now := time.Now()
+	b := Broadcast{
+		ID:              uuid.New().String(),
+		StreamKey:       streamKey,
+		StartedAt:       startedEpochMs / 1000,
+		EndedAt:         now.Unix(),
+		DurationSeconds: (now.UnixMilli() - startedEpochMs) / 1000,
+		EndReason:       s.currentEndReason(),
+	}
+
+	s.whepSessionsLock.RLock()
+	b.PeakViewers = s.peakViewerCount
+	s.whepSessionsLock.RUnlock()
+
+	if r := s.activeRecording.Load(); r != nil {
+		b.RecordingID = r.id
+	}
+
+	broadcastHistoryLock.Lock()
+	broadcastHistory = append(broadcastHistory, b)
+	if len(broadcastHistory) > broadcastHistoryLength {
+		broadcastsForgottenUntil = broadcastHistory[len(broadcastHistory)-broadcastHistoryLength-1].EndedAt
+		broadcastHistory = broadcastHistory[len(broadcastHistory)-broadcastHistoryLength:]
+	}
+	broadcastHistoryLock.Unlock()
+
+	if h, ok := store.History(); ok {
+		go func() {
+			if err := h.AddBroadcast(b); err != nil {
+				log.Println(err)
+			}
+		}()
+		return
+	}
+
+	go saveBroadcastHistory()
+}
+
+// saveBroadcastHistory writes a copy of the history, so broadcastHistoryLock
+// isn't held during the write either
+func saveBroadcastHistory() {
+	broadcastHistorySaveLock.Lock()
+	defer broadcastHistorySaveLock.Unlock()
+
+	broadcastHistoryLock.Lock()
+	snapshot := append([]Broadcast{}, broadcastHistory...)
+	broadcastHistoryLock.Unlock()
+
+	saveState(broadcastHistoryStateKey, snapshot)
+}
+
+// GetBroadcastHistory returns the broadcasts that match filter, newest first.
+// Only the latest are kept without a database
+func GetBroadcastHistory(filter BroadcastHistoryFilter) []Broadcast {
+	if h, ok := store.History(); ok {
+		broadcasts, err := h.Broadcasts(filter.storeFilter())
+		if err == nil {
+			return broadcasts
+		}
+		log.Println(err)
+	}
+
+	broadcastHistoryLock.Lock()
+	defer broadcastHistoryLock.Unlock()
+
+	out := []Broadcast{}
+	for i := len(broadcastHistory) - 1; i >= 0; i-- {
+		if b := broadcastHistory[i]; filter.matches(b.StreamKey, b.StartedAt) {
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// recordViewerSession must be called with whepSessionsLock held
+func recordViewerSession(streamKey, whepSessionId string, w *whepSession) {
+	now := time.Now()
+	session := ViewerSession{
+		ID:              whepSessionId,
+		StreamKey:       streamKey,
+		StartedAt:       w.startedAt.Unix(),
+		EndedAt:         now.Unix(),
+		DurationSeconds: int64(now.Sub(w.startedAt).Seconds()),
+		Country:         w.country,
+		ASN:             w.asn,
+		BytesSent:       w.octetsWritten,
+		EndReason:       w.currentEndReason(),
+	}
+	session.Layer, _ = w.currentLayer.Load().(string)
+	if w.receptionReported.Load() {
+		packetLossPercent := w.packetLossPercent.Load()
+		session.PacketLossPercent = &packetLossPercent
+	}
+
+	broadcastHistoryLock.Lock()
+	viewerSessionHistory = append(viewerSessionHistory, session)
+	if len(viewerSessionHistory) > viewerSessionHistoryLength {
+		viewerSessionsForgottenUntil = viewerSessionHistory[len(viewerSessionHistory)-viewerSessionHistoryLength-1].EndedAt
+		viewerSessionHistory = viewerSessionHistory[len(viewerSessionHistory)-viewerSessionHistoryLength:]
+	}
+	broadcastHistoryLock.Unlock()
+
+	if h, ok := store.History(); ok {
+		go func() {
+			if err := h.AddViewerSession(session); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+// GetViewerSessions returns the ended viewer sessions that match filter, newest
+// first. Only the latest are kept without a database, and only until a restart
+func GetViewerSessions(filter BroadcastHistoryFilter) []ViewerSession {
+	if h, ok := store.History(); ok {
+		sessions, err := h.ViewerSessions(filter.storeFilter())
+		if err == nil {
+			return sessions
+		}
+		log.Println(err)
+	}
+
+	broadcastHistoryLock.Lock()
+	defer broadcastHistoryLock.Unlock()
+
+	out := []ViewerSession{}
+	for i := len(viewerSessionHistory) - 1; i >= 0; i-- {
+		if s := viewerSessionHistory[i]; filter.matches(s.StreamKey, s.StartedAt) {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// HistoryAvailableSince returns the unix times before which broadcasts and
+// viewer sessions may be missing from GetBroadcastHistory and GetViewerSessions,
+// 0 if none are. Without a database the oldest are forgotten once the history is
+// full, viewer sessions and the broadcasts without STATE_FILE on every restart
+func HistoryAvailableSince() (broadcasts, viewerSessions int64) {
+	if _, ok := store.History(); ok {
+		return 0, 0
+	}
+
+	broadcastHistoryLock.Lock()
+	defer broadcastHistoryLock.Unlock()
+
+	broadcasts, viewerSessions = broadcastsForgottenUntil, viewerSessionsForgottenUntil
+	if !store.Persistent() && historyStartedAt > broadcasts {
+		broadcasts = historyStartedAt
+	}
+	if historyStartedAt > viewerSessions {
+		viewerSessions = historyStartedAt
+	}
+	return broadcasts, viewerSessions
+}
+
+// WHEPEndReason returns why a WHEP session ended, false if it hasn't or was
+// too long ago
+func WHEPEndReason(whepSessionId string) (string, bool) {
+	broadcastHistoryLock.Lock()
+	defer broadcastHistoryLock.Unlock()
+
+	for i := len(viewerSessionHistory) - 1; i >= 0; i-- {
+		if viewerSessionHistory[i].ID == whepSessionId {
+			return viewerSessionHistory[i].EndReason, true
+		}
+	}
+
+	return "", false
+}
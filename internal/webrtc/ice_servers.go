@@ -0,0 +1,90 @@
+package webrtc
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEServerConfig is what new PeerConnections and the ice-server Links of
+// relay only rooms are built from. Changing it doesn't affect connected sessions
+type ICEServerConfig struct {
+	STUNServers  []string `json:"stunServers"`
+	TURNServers  []string `json:"turnServers"`
+	TURNUsername string   `json:"turnUsername"`
+	TURNPassword string   `json:"turnPassword,omitempty"`
+}
+
+var (
+	iceServerConfig     ICEServerConfig
+	iceServerConfigLock sync.RWMutex
+)
+
+func splitServers(val string) []string {
+	if val == "" {
+		return []string{}
+	}
+	return strings.Split(val, "|")
+}
+
+// configureICEServers reads STUN_SERVERS, TURN_SERVERS, TURN_USERNAME and
+// TURN_PASSWORD, replacing what SetICEServerConfig set
+func configureICEServers() {
+	SetICEServerConfig(ICEServerConfig{
+		STUNServers:  splitServers(os.Getenv("STUN_SERVERS")),
+		TURNServers:  splitServers(os.Getenv("TURN_SERVERS")),
+		TURNUsername: os.Getenv("TURN_USERNAME"),
+		TURNPassword: os.Getenv("TURN_PASSWORD"),
+	})
+}
+
+// SetICEServerConfig rotates the STUN and TURN servers and credentials until
+// the next reload
+func SetICEServerConfig(config ICEServerConfig) {
+	iceServerConfigLock.Lock()
+	defer iceServerConfigLock.Unlock()
+
+	iceServerConfig = config
+}
+
+func GetICEServerConfig() ICEServerConfig {
+	iceServerConfigLock.RLock()
+	defer iceServerConfigLock.RUnlock()
+
+	config := iceServerConfig
+	config.STUNServers = append([]string{}, config.STUNServers...)
+	config.TURNServers = append([]string{}, config.TURNServers...)
+	return config
+}
+
+// TURNServers returns the TURN servers with their credentials. Only relay only
+// rooms use them
+func TURNServers() []webrtc.ICEServer {
+	config := GetICEServerConfig()
+	if len(config.TURNServers) == 0 {
+		return nil
+	}
+
+	iceServers := []webrtc.ICEServer{}
+	for _, turnServer := range config.TURNServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       []string{"turn:" + turnServer},
+			Username:   config.TURNUsername,
+			Credential: config.TURNPassword,
+		})
+	}
+	return iceServers
+}
+
+// stunServers returns the STUN servers every other PeerConnection uses
+func stunServers() []webrtc.ICEServer {
+	iceServers := []webrtc.ICEServer{}
+	for _, stunServer := range GetICEServerConfig().STUNServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs: []string{"stun:" + stunServer},
+		})
+	}
+	return iceServers
+}
@@ -0,0 +1,172 @@
+package webrtc
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const maxImpairmentDelay = time.Second * 10
+
+var ErrInvalidImpairment = errors.New("latencyMs and jitterMs must be between 0 and 10000, lossPercent between 0 and 100")
+
+// Impairment is artificial latency, jitter and loss added to the video a
+// viewer is sent. It is meant for testing players and layer switching
+type Impairment struct {
+	LatencyMs   int64   `json:"latencyMs"`
+	JitterMs    int64   `json:"jitterMs"`
+	LossPercent float64 `json:"lossPercent"`
+}
+
+type Impairments struct {
+	Streams      map[string]Impairment `json:"streams"`
+	WHEPSessions map[string]Impairment `json:"whepSessions"`
+}
+
+var (
+	// Impairments new viewers of a stream start with, keyed by stream key
+	streamImpairments    = map[string]Impairment{}
+	streamImpairmentLock sync.RWMutex
+)
+
+func (i Impairment) valid() bool {
+	maxMs := maxImpairmentDelay.Milliseconds()
+	return i.LatencyMs >= 0 && i.LatencyMs <= maxMs && i.JitterMs >= 0 && i.JitterMs <= maxMs && i.LossPercent >= 0 && i.LossPercent <= 100
+}
+
+// SetStreamImpairment impairs every current and future viewer of a stream,
+// replacing what SetWHEPImpairment set for them. The zero Impairment removes it
+func SetStreamImpairment(streamKey string, impairment Impairment) error {
+	if !impairment.valid() {
+		return ErrInvalidImpairment
+	}
+
+	streamImpairmentLock.Lock()
+	if impairment == (Impairment{}) {
+		delete(streamImpairments, streamKey)
+	} else {
+		streamImpairments[streamKey] = impairment
+	}
+	streamImpairmentLock.Unlock()
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if stream, ok := streamMap[streamKey]; ok {
+		stream.whepSessionsLock.RLock()
+		for _, whepSession := range stream.whepSessions {
+			whepSession.setImpairment(impairment)
+		}
+		stream.whepSessionsLock.RUnlock()
+	}
+	return nil
+}
+
+// SetWHEPImpairment impairs a single viewer. The zero Impairment removes it
+func SetWHEPImpairment(whepSessionId string, impairment Impairment) error {
+	if !impairment.valid() {
+		return ErrInvalidImpairment
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			whepSession.setImpairment(impairment)
+			return nil
+		}
+	}
+
+	return ErrWHEPSessionNotFound
+}
+
+// GetImpairments lists the impaired streams and viewers
+func GetImpairments() Impairments {
+	out := Impairments{
+		Streams:      map[string]Impairment{},
+		WHEPSessions: map[string]Impairment{},
+	}
+
+	streamImpairmentLock.RLock()
+	for streamKey, impairment := range streamImpairments {
+		out.Streams[streamKey] = impairment
+	}
+	streamImpairmentLock.RUnlock()
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		for id, whepSession := range stream.whepSessions {
+			if impairment := whepSession.impairment.Load(); impairment != nil {
+				out.WHEPSessions[id] = *impairment
+			}
+		}
+		stream.whepSessionsLock.RUnlock()
+	}
+
+	return out
+}
+
+// inheritImpairment starts a new viewer with the impairment of its stream
+func (w *whepSession) inheritImpairment(streamKey string) {
+	streamImpairmentLock.RLock()
+	defer streamImpairmentLock.RUnlock()
+
+	if impairment, ok := streamImpairments[streamKey]; ok {
+		w.setImpairment(impairment)
+	}
+}
+
+func (w *whepSession) setImpairment(impairment Impairment) {
+	if impairment == (Impairment{}) {
+		w.impairment.Store(nil)
+	} else {
+		w.impairment.Store(&impairment)
+	}
+}
+
+// writeVideoRTP drops or delays the packet if the session is impaired. Delayed
+// packets are copied, the buffer of rtpPkt is reused for the next one
+func (w *whepSession) writeVideoRTP(rtpPkt *rtp.Packet, codec videoTrackCodec) {
+	write := func(rtpPkt *rtp.Packet) {
+		if err := w.videoTrack.WriteRTP(rtpPkt, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			w.logger.Println(err)
+		}
+	}
+
+	impairment := w.impairment.Load()
+	if impairment == nil {
+		write(rtpPkt)
+		return
+	}
+
+	if impairment.LossPercent > 0 && rand.Float64()*100 < impairment.LossPercent {
+		return
+	}
+
+	// Jitter is spread evenly around the latency, so packets may arrive out of order
+	delayMs := impairment.LatencyMs
+	if impairment.JitterMs > 0 {
+		delayMs += rand.Int63n(2*impairment.JitterMs+1) - impairment.JitterMs
+	}
+	if delayMs <= 0 {
+		write(rtpPkt)
+		return
+	}
+
+	delayed := rtpPkt.Clone()
+	time.AfterFunc(time.Duration(delayMs)*time.Millisecond, func() {
+		write(delayed)
+	})
+}
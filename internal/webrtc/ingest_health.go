@@ -0,0 +1,86 @@
+package webrtc
+
+import (
+	"time"
+)
+
+const (
+	IngestHealthOffline  = "offline"
+	IngestHealthReady    = "ready"
+	IngestHealthDegraded = "degraded"
+
+	// Loss above this in the last bitrate sample marks the ingest degraded
+	ingestHealthMaxLossPercent = 2
+)
+
+// IngestHealth is what a publisher needs to judge its connection. Bitrates and
+// loss are from the last bitrate sample
+type IngestHealth struct {
+	Status                 string            `json:"status"`
+	Reasons                []string          `json:"reasons,omitempty"`
+	UptimeSeconds          int64             `json:"uptimeSeconds"`
+	AudioBitrate           uint64            `json:"audioBitrate"`
+	VideoBitrate           map[string]uint64 `json:"videoBitrate"`
+	VideoPacketLossPercent float64           `json:"videoPacketLossPercent"`
+	KeyframeIntervalMs     int64             `json:"keyframeIntervalMs"`
+}
+
+func (t *videoTrack) keyframeReceived() {
+	now := time.Now().UnixNano()
+	if last := t.lastKeyframeReceived.Swap(now); last != 0 {
+		t.keyframeInterval.Store(now - last)
+	}
+}
+
+// GetIngestHealth reports how well the publisher of a stream is being received.
+// A stream without a publisher is offline
+func GetIngestHealth(streamKey string) IngestHealth {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	health := IngestHealth{Status: IngestHealthOffline, VideoBitrate: map[string]uint64{}}
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.whipStartedEpochMs.Load() == 0 {
+		return health
+	}
+
+	health.Status = IngestHealthReady
+	health.UptimeSeconds = stream.uptimeSeconds()
+
+	stream.bitrateHistory.mu.Lock()
+	if samples := stream.bitrateHistory.samples; len(samples) != 0 {
+		sample := samples[len(samples)-1]
+		health.AudioBitrate = sample.AudioBitrate
+		health.VideoBitrate = sample.VideoBitrate
+		health.VideoPacketLossPercent = sample.VideoPacketLossPercent
+	}
+	stream.bitrateHistory.mu.Unlock()
+
+	for _, videoTrack := range stream.videoTracks {
+		if interval := time.Duration(videoTrack.keyframeInterval.Load()).Milliseconds(); interval > health.KeyframeIntervalMs {
+			health.KeyframeIntervalMs = interval
+		}
+	}
+
+	if len(stream.activeLayers) == 0 {
+		health.Reasons = append(health.Reasons, "no video is being received")
+	}
+
+	if health.VideoPacketLossPercent > ingestHealthMaxLossPercent {
+		health.Reasons = append(health.Reasons, "video packet loss is high")
+	}
+
+	// Without a configured interval publishers only send keyframes when asked,
+	// so the interval says nothing about the encoder
+	keyframeIntervalLock.RLock()
+	maxKeyframeInterval := 2 * keyframeInterval
+	keyframeIntervalLock.RUnlock()
+	if maxKeyframeInterval != 0 && time.Duration(health.KeyframeIntervalMs)*time.Millisecond > maxKeyframeInterval {
+		health.Reasons = append(health.Reasons, "keyframes are further apart than KEYFRAME_INTERVAL")
+	}
+
+	if len(health.Reasons) != 0 {
+		health.Status = IngestHealthDegraded
+	}
+	return health
+}
@@ -0,0 +1,137 @@
+package webrtc
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+const (
+	ingestPolicyWarn      = "warn"
+	ingestPolicyTerminate = "terminate"
+
+	// How many bitrate samples in a row must be over the limits before the
+	// publisher is reported, 30 seconds at bitrateSampleInterval
+	ingestViolationSampleCount = 6
+
+	// Measured bitrates include RTP headers and retransmissions, so allow some
+	// headroom over the REMB that was sent
+	ingestBitrateTolerancePercent = 20
+)
+
+var (
+	ingestMaxBitrate uint64
+	ingestMaxHeight  int32
+	ingestPolicy     = ingestPolicyWarn
+	ingestConfigLock sync.RWMutex
+)
+
+func configureIngestPolicy() error {
+	var (
+		maxBitrate uint64
+		maxHeight  int64
+		err        error
+	)
+
+	if val := os.Getenv("INGEST_MAX_BITRATE"); val != "" {
+		if maxBitrate, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("INGEST_MAX_HEIGHT"); val != "" {
+		if maxHeight, err = strconv.ParseInt(val, 10, 32); err != nil {
+			return err
+		}
+	}
+
+	policy := ingestPolicyWarn
+	if val := os.Getenv("INGEST_POLICY"); val != "" {
+		policy = val
+	}
+
+	ingestConfigLock.Lock()
+	defer ingestConfigLock.Unlock()
+
+	ingestMaxBitrate = maxBitrate
+	ingestMaxHeight = int32(maxHeight)
+	ingestPolicy = policy
+	return nil
+}
+
+// enforceIngestPolicy caps the video bitrate of the publisher with a REMB and
+// reports publishers that stay over the limits of their room. It must be
+// called with streamMapLock held
+func (s *stream) enforceIngestPolicy(streamKey string, sample BitrateSample) {
+	policy := GetRoomPolicy(streamKey)
+	if s.whipPeerConnection == nil || s.whipStartedEpochMs.Load() == 0 || (policy.MaxIngestBitrate == 0 && policy.MaxIngestHeight == 0) {
+		s.ingestViolationCount = 0
+		return
+	}
+
+	violated := false
+	if policy.MaxIngestBitrate != 0 {
+		videoBitrate := uint64(0)
+		for _, bitrate := range sample.VideoBitrate {
+			videoBitrate += bitrate
+		}
+		violated = videoBitrate > policy.MaxIngestBitrate*(100+ingestBitrateTolerancePercent)/100
+
+		// Sent on every sample so the cap survives the encoder resetting its estimate
+		ssrcs := []uint32{}
+		for _, videoTrack := range s.videoTracks {
+			if ssrc := videoTrack.ssrc.Load(); ssrc != 0 {
+				ssrcs = append(ssrcs, ssrc)
+			}
+		}
+
+		if len(ssrcs) != 0 {
+			if err := s.whipPeerConnection.WriteRTCP([]rtcp.Packet{
+				&rtcp.ReceiverEstimatedMaximumBitrate{
+					Bitrate: float32(policy.MaxIngestBitrate),
+					SSRCs:   ssrcs,
+				},
+			}); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	if policy.MaxIngestHeight != 0 {
+		for _, videoTrack := range s.videoTracks {
+			if videoTrack.height.Load() > policy.MaxIngestHeight {
+				violated = true
+			}
+		}
+	}
+
+	if !violated {
+		s.ingestViolationCount = 0
+		return
+	}
+
+	s.ingestViolationCount++
+	if s.ingestViolationCount != ingestViolationSampleCount {
+		return
+	}
+
+	log.Printf("Publisher of %s is over the ingest policy of its room", streamKey)
+	emitEvent(webhook.EventStreamIngestExceeded, streamKey, "")
+
+	if policy.IngestPolicy == ingestPolicyTerminate {
+		s.endReason = StreamEndedIngestPolicy
+
+		// Closing fires the ICE state callback, which takes streamMapLock
+		go func(peerConnection *webrtc.PeerConnection) {
+			if err := peerConnection.Close(); err != nil {
+				log.Println(err)
+			}
+		}(s.whipPeerConnection)
+	}
+}
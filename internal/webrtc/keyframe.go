@@ -0,0 +1,105 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	// How often publishers are checked against keyframeInterval
+	keyframeIntervalCheck = time.Second
+
+	h264NALUTypeIDR  = 5
+	h264NALUTypeFUA  = 28
+	h264FUStartBit   = 0x80
+	av1AggregationN  = 0b00001000
+	vp8InterframeBit = 0x01
+)
+
+var (
+	keyframeInterval     time.Duration
+	keyframeIntervalLock sync.RWMutex
+)
+
+func configureKeyframeInterval() error {
+	var interval time.Duration
+	if val := os.Getenv("KEYFRAME_INTERVAL"); val != "" {
+		var err error
+		if interval, err = time.ParseDuration(val); err != nil {
+			return err
+		}
+	}
+
+	keyframeIntervalLock.Lock()
+	defer keyframeIntervalLock.Unlock()
+
+	keyframeInterval = interval
+	return nil
+}
+
+// keyframeDue reports if a publisher should be sent a PLI because none was
+// sent within the keyframe interval
+func keyframeDue(lastKeyframeRequest time.Time) bool {
+	keyframeIntervalLock.RLock()
+	defer keyframeIntervalLock.RUnlock()
+
+	return keyframeInterval > 0 && time.Since(lastKeyframeRequest) >= keyframeInterval
+}
+
+// isKeyframeStart reports if the packet begins a frame that can be decoded
+// without the ones before it. For H264 a parameter set counts, it precedes the IDR
+func isKeyframeStart(codec videoTrackCodec, payload []byte) bool {
+	switch codec {
+	case videoTrackCodecH264:
+		return isH264KeyframeStart(payload)
+	case videoTrackCodecVP8:
+		vp8Packet := codecs.VP8Packet{}
+		if _, err := vp8Packet.Unmarshal(payload); err != nil || vp8Packet.S != 1 || vp8Packet.PID != 0 {
+			return false
+		}
+		return len(vp8Packet.Payload) != 0 && vp8Packet.Payload[0]&vp8InterframeBit == 0
+	case videoTrackCodecVP9:
+		vp9Packet := codecs.VP9Packet{}
+		if _, err := vp9Packet.Unmarshal(payload); err != nil {
+			return false
+		}
+		return vp9Packet.B && !vp9Packet.P
+	case videoTrackCodecAV1:
+		// N is set on the first packet of a coded video sequence
+		return len(payload) != 0 && payload[0]&av1AggregationN != 0
+	}
+
+	return false
+}
+
+func isH264KeyframeStart(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1f; naluType {
+	case h264NALUTypeSPS, h264NALUTypeIDR:
+		return true
+	case h264NALUTypeFUA:
+		return payload[1]&h264FUStartBit != 0 && payload[1]&0x1f == h264NALUTypeIDR
+	case h264NALUTypeSTAPA:
+		for offset := 1; offset+2 < len(payload); {
+			naluSize := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if naluSize == 0 || offset+naluSize > len(payload) {
+				return false
+			}
+
+			if t := payload[offset] & 0x1f; t == h264NALUTypeSPS || t == h264NALUTypeIDR {
+				return true
+			}
+			offset += naluSize
+		}
+	}
+
+	return false
+}
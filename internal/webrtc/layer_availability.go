@@ -0,0 +1,118 @@
+package webrtc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+const (
+	layerAvailabilityCheckInterval = time.Second
+
+	// A layer is gone once no packet arrived for this long, encoders stop
+	// sending a simulcast layer without signaling it
+	layerInactiveTimeout = time.Second * 2
+)
+
+var ErrWHEPSessionNotFound = errors.New("WHEP session not found")
+
+func (t *videoTrack) isActive() bool {
+	lastPacketReceived := t.lastPacketReceived.Load()
+	return lastPacketReceived != 0 && time.Since(time.Unix(0, lastPacketReceived)) < layerInactiveTimeout
+}
+
+// updateActiveLayers wakes everyone waiting on layersChanged if a layer
+// appeared or disappeared. Sessions watching a layer that disappeared are moved
+// to one that is still sent. It must be called with streamMapLock held
+func (s *stream) updateActiveLayers(streamKey string) {
+	activeLayers := []string{}
+	for _, videoTrack := range s.videoTracks {
+		if videoTrack.isActive() {
+			activeLayers = append(activeLayers, videoTrack.rid)
+		}
+	}
+	sortSimulcastLayers(activeLayers)
+
+	if len(activeLayers) == len(s.activeLayers) {
+		changed := false
+		for i := range activeLayers {
+			changed = changed || activeLayers[i] != s.activeLayers[i]
+		}
+
+		if !changed {
+			return
+		}
+	}
+
+	s.activeLayers = activeLayers
+	close(s.layersChanged)
+	s.layersChanged = make(chan struct{})
+	emitEvent(webhook.EventStreamLayersChanged, streamKey, "")
+
+	if len(activeLayers) == 0 {
+		return
+	}
+
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	movedSession := false
+	for _, whepSession := range s.whepSessions {
+		currentLayer, _ := whepSession.currentLayer.Load().(string)
+		if currentLayer == "" || s.isActiveLayer(currentLayer) {
+			continue
+		}
+
+		whepSession.downgradedFrom = nil
+		whepSession.currentLayer.Store(whepSession.allowedLayer(s, activeLayers[0]))
+		movedSession = true
+	}
+
+	if movedSession {
+		select {
+		case s.pliChan <- true:
+		default:
+		}
+	}
+}
+
+// isActiveLayer must be called with streamMapLock held
+func (s *stream) isActiveLayer(rid string) bool {
+	for _, activeLayer := range s.activeLayers {
+		if activeLayer == rid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func watchLayerAvailability() {
+	for range time.Tick(layerAvailabilityCheckInterval) {
+		streamMapLock.Lock()
+		for streamKey, stream := range streamMap {
+			stream.updateActiveLayers(streamKey)
+		}
+		streamMapLock.Unlock()
+	}
+}
+
+// WHEPLayersChanged returns a channel that is closed the next time the layers
+// of the stream a WHEP session is watching change, or the stream ends
+func WHEPLayersChanged(whepSessionId string) (<-chan struct{}, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		_, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			return stream.layersChanged, nil
+		}
+	}
+
+	return nil, ErrWHEPSessionNotFound
+}
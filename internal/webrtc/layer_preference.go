@@ -0,0 +1,58 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a viewer's layer selection is remembered after it was last made
+const layerPreferenceTTL = time.Minute * 10
+
+type layerPreference struct {
+	layerSelection
+	updatedAt time.Time
+}
+
+var (
+	// Keyed by stream key and viewer id so a WHEP session that reconnects
+	// after a blip resumes on the same quality
+	layerPreferences     = map[string]layerPreference{}
+	layerPreferencesLock sync.Mutex
+)
+
+func layerPreferenceKey(streamKey, viewerId string) string {
+	return streamKey + "\x00" + viewerId
+}
+
+func saveLayerPreference(streamKey, viewerId string, selection layerSelection) {
+	if viewerId == "" {
+		return
+	}
+
+	layerPreferencesLock.Lock()
+	defer layerPreferencesLock.Unlock()
+
+	for key, preference := range layerPreferences {
+		if time.Since(preference.updatedAt) > layerPreferenceTTL {
+			delete(layerPreferences, key)
+		}
+	}
+
+	layerPreferences[layerPreferenceKey(streamKey, viewerId)] = layerPreference{layerSelection: selection, updatedAt: time.Now()}
+}
+
+func loadLayerPreference(streamKey, viewerId string) (layerSelection, bool) {
+	if viewerId == "" {
+		return layerSelection{}, false
+	}
+
+	layerPreferencesLock.Lock()
+	defer layerPreferencesLock.Unlock()
+
+	preference, ok := layerPreferences[layerPreferenceKey(streamKey, viewerId)]
+	if !ok || time.Since(preference.updatedAt) > layerPreferenceTTL {
+		return layerSelection{}, false
+	}
+
+	return preference.layerSelection, true
+}
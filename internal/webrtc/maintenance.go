@@ -0,0 +1,146 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	viewerEventMaintenance = "maintenance"
+
+	maintenanceCheckInterval = time.Second
+)
+
+// Viewers of every stream are sent a maintenance event when the window is
+// scheduled, this long before it starts and once it started
+var maintenanceCountdown = []time.Duration{
+	time.Hour, time.Minute * 30, time.Minute * 15, time.Minute * 5, time.Minute, time.Second * 30, time.Second * 10,
+}
+
+var ErrMaintenanceInPast = errors.New("maintenance must start in the future")
+
+// Maintenance is a window the server stops accepting new sessions in
+type Maintenance struct {
+	StartsAt int64  `json:"startsAt"`
+	Message  string `json:"message"`
+
+	// The server refuses new sessions once the window started
+	Active           bool  `json:"active"`
+	SecondsRemaining int64 `json:"secondsRemaining"`
+
+	// Countdown steps that were already sent
+	countdownSent int
+}
+
+var (
+	maintenance     *Maintenance
+	maintenanceLock sync.Mutex
+)
+
+// snapshot must be called with maintenanceLock held
+func (m *Maintenance) snapshot(now time.Time) Maintenance {
+	out := *m
+	out.Active = now.Unix() >= m.StartsAt
+	if !out.Active {
+		out.SecondsRemaining = m.StartsAt - now.Unix()
+	}
+	return out
+}
+
+// ScheduleMaintenance replaces the maintenance window and tells every viewer
+func ScheduleMaintenance(startsAt int64, message string) (Maintenance, error) {
+	now := time.Now()
+	if startsAt <= now.Unix() {
+		return Maintenance{}, ErrMaintenanceInPast
+	}
+
+	m := &Maintenance{StartsAt: startsAt, Message: message}
+
+	// Steps that are already due when scheduling are covered by this event
+	for m.countdownSent < len(maintenanceCountdown) && now.Add(maintenanceCountdown[m.countdownSent]).Unix() >= startsAt {
+		m.countdownSent++
+	}
+
+	maintenanceLock.Lock()
+	maintenance = m
+	snapshot := m.snapshot(now)
+	maintenanceLock.Unlock()
+
+	publishMaintenance(snapshot)
+	return snapshot, nil
+}
+
+// CancelMaintenance removes the maintenance window, new sessions are accepted
+// again if it already started
+func CancelMaintenance() bool {
+	maintenanceLock.Lock()
+	m := maintenance
+	maintenance = nil
+	maintenanceLock.Unlock()
+
+	if m == nil {
+		return false
+	}
+
+	publishMaintenance(Maintenance{StartsAt: m.StartsAt, Message: m.Message})
+	return true
+}
+
+// GetMaintenance returns the maintenance window, nil if none is scheduled
+func GetMaintenance() *Maintenance {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	if maintenance == nil {
+		return nil
+	}
+
+	snapshot := maintenance.snapshot(time.Now())
+	return &snapshot
+}
+
+// InMaintenance reports if a maintenance window started
+func InMaintenance() bool {
+	m := GetMaintenance()
+	return m != nil && m.Active
+}
+
+// publishMaintenance sends a maintenance event to the viewers of every stream.
+// A cancelled window has no secondsRemaining and isn't active
+func publishMaintenance(m Maintenance) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.publishViewerEvent(viewerEventMaintenance, m)
+	}
+}
+
+// watchMaintenance sends the countdown and the event when the window starts
+func watchMaintenance() {
+	for now := range time.Tick(maintenanceCheckInterval) {
+		maintenanceLock.Lock()
+		m := maintenance
+		if m == nil {
+			maintenanceLock.Unlock()
+			continue
+		}
+
+		due := false
+		for m.countdownSent < len(maintenanceCountdown) && now.Add(maintenanceCountdown[m.countdownSent]).Unix() >= m.StartsAt {
+			m.countdownSent++
+			due = true
+		}
+		if m.countdownSent == len(maintenanceCountdown) && now.Unix() >= m.StartsAt {
+			m.countdownSent++
+			due = true
+		}
+		snapshot := m.snapshot(now)
+		maintenanceLock.Unlock()
+
+		if due {
+			publishMaintenance(snapshot)
+		}
+	}
+}
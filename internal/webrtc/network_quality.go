@@ -0,0 +1,144 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// The upper bound of each score, from 5 down to 2. Anything worse scores 1
+var (
+	networkQualityLossPercent = [4]float64{1, 3, 6, 12}
+	networkQualityJitterMs    = [4]float64{20, 40, 80, 150}
+	networkQualityRTTMs       = [4]float64{100, 200, 350, 600}
+	networkQualityQueuedBytes = [4]float64{16 << 10, 64 << 10, 256 << 10, 1 << 20}
+)
+
+// NetworkQuality is pushed to a WHEP session on the SSE extension every time its score changes
+type NetworkQuality struct {
+	// 5 is excellent, 1 is unusable
+	Score int `json:"score"`
+
+	PacketLossPercent uint32  `json:"packetLossPercent"`
+	JitterMs          float64 `json:"jitterMs"`
+
+	// nil until the viewer reports on a Sender Report it received
+	RoundTripTimeMs *int64 `json:"roundTripTimeMs,omitempty"`
+
+	// Sent on the DataChannel but not yet acknowledged by the viewer
+	QueuedBytes uint64 `json:"queuedBytes"`
+}
+
+// scoreBelow is 5 if val is below the first threshold, 4 if it is below the
+// second one and so on
+func scoreBelow(val float64, thresholds [4]float64) int {
+	for i, threshold := range thresholds {
+		if val < threshold {
+			return 5 - i
+		}
+	}
+	return 1
+}
+
+// jitterMs converts the jitter of the last Receiver Report from the clock rate of the track
+func (w *whepSession) jitterMs() float64 {
+	clockRate := videoClockRate
+	if w.audioOnly {
+		clockRate = audioClockRate
+	}
+	return float64(w.jitter.Load()) * 1000 / float64(clockRate)
+}
+
+// roundTripTime uses the Sender Report the Receiver Report refers to, it is
+// false if the report is for an older one or none
+func (w *whepSession) roundTripTime(report rtcp.ReceptionReport) (time.Duration, bool) {
+	sentAt := w.lastSenderReportAt.Load()
+	if report.LastSenderReport == 0 || sentAt == 0 || report.LastSenderReport != w.lastSenderReportNTP.Load() {
+		return 0, false
+	}
+
+	// The delay since the viewer received the Sender Report is in 1/65536 seconds
+	delay := time.Duration(report.Delay) * time.Second / 65536
+	rtt := time.Since(time.Unix(0, sentAt)) - delay
+	if rtt < 0 {
+		rtt = 0
+	}
+	return rtt, true
+}
+
+// updateNetworkQuality scores the session by the worst of its packet loss,
+// jitter, round trip time and DataChannel send queue, and wakes the SSE
+// connection of the session if the score changed
+func (w *whepSession) updateNetworkQuality(report rtcp.ReceptionReport) {
+	quality := &NetworkQuality{
+		PacketLossPercent: w.packetLossPercent.Load(),
+		JitterMs:          w.jitterMs(),
+	}
+	quality.Score = scoreBelow(float64(quality.PacketLossPercent), networkQualityLossPercent)
+	if score := scoreBelow(quality.JitterMs, networkQualityJitterMs); score < quality.Score {
+		quality.Score = score
+	}
+
+	if rtt, ok := w.roundTripTime(report); ok {
+		w.roundTripTimeMs.Store(rtt.Milliseconds())
+	}
+	if rttMs := w.roundTripTimeMs.Load(); rttMs != -1 {
+		quality.RoundTripTimeMs = &rttMs
+		if score := scoreBelow(float64(rttMs), networkQualityRTTMs); score < quality.Score {
+			quality.Score = score
+		}
+	}
+
+	if w.eventsChannel != nil {
+		quality.QueuedBytes = w.eventsChannel.BufferedAmount()
+		if score := scoreBelow(float64(quality.QueuedBytes), networkQualityQueuedBytes); score < quality.Score {
+			quality.Score = score
+		}
+	}
+
+	w.networkQualityLock.Lock()
+	defer w.networkQualityLock.Unlock()
+
+	previous := w.networkQuality.Swap(quality)
+	if w.ended || (previous != nil && previous.Score == quality.Score) {
+		return
+	}
+
+	close(w.networkQualityChanged)
+	w.networkQualityChanged = make(chan struct{})
+}
+
+// endNetworkQuality wakes the SSE connection of the session a last time
+func (w *whepSession) endNetworkQuality() {
+	w.networkQualityLock.Lock()
+	defer w.networkQualityLock.Unlock()
+
+	if !w.ended {
+		w.ended = true
+		close(w.networkQualityChanged)
+	}
+}
+
+// WHEPNetworkQuality returns the network quality of a WHEP session, nil until
+// the viewer sends its first Receiver Report, and a channel that is closed the
+// next time the score changes or the session ends
+func WHEPNetworkQuality(whepSessionId string) (*NetworkQuality, <-chan struct{}, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		whepSession.networkQualityLock.Lock()
+		defer whepSession.networkQualityLock.Unlock()
+		return whepSession.networkQuality.Load(), whepSession.networkQualityChanged, nil
+	}
+
+	return nil, nil, ErrWHEPSessionNotFound
+}
@@ -0,0 +1,187 @@
+package webrtc
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultNodeWeight = 100
+
+var (
+	nodeWeight       = defaultNodeWeight
+	nodeMaxBandwidth uint64
+	nodeMaxSessions  int
+	nodeConfigLock   sync.RWMutex
+
+	// Every byte received from publishers and sent to viewers
+	nodeBytesReceived, nodeBytesSent atomic.Uint64
+
+	// The last nodeLoad sampleNode took
+	lastNodeLoad atomic.Value
+)
+
+type nodeLoad struct {
+	cpuPercent   float64
+	cpuSupported bool
+
+	bitrateIn, bitrateOut uint64
+}
+
+// NodeStatus is what load balancers need to pick the least loaded instance
+type NodeStatus struct {
+	Weight int `json:"weight"`
+
+	// Weight scaled by headroomPercent, 0 while draining
+	EffectiveWeight int  `json:"effectiveWeight"`
+	Draining        bool `json:"draining"`
+
+	Publishers  int `json:"publishers"`
+	Viewers     int `json:"viewers"`
+	MaxSessions int `json:"maxSessions,omitempty"`
+
+	// CPU the process used over the last sample across every core, nil where
+	// it can't be measured
+	CPUPercent *float64 `json:"cpuPercent,omitempty"`
+	CPUCount   int      `json:"cpuCount"`
+
+	// In bits per second, audio sent to viewers is estimated from their count
+	BitrateIn    uint64 `json:"bitrateIn"`
+	BitrateOut   uint64 `json:"bitrateOut"`
+	MaxBandwidth uint64 `json:"maxBandwidth,omitempty"`
+
+	// The lowest of the CPU, bandwidth and session headroom
+	HeadroomPercent float64 `json:"headroomPercent"`
+}
+
+func configureNode() error {
+	var (
+		weight       = defaultNodeWeight
+		maxBandwidth uint64
+		maxSessions  int
+		err          error
+	)
+
+	if val := os.Getenv("NODE_WEIGHT"); val != "" {
+		if weight, err = strconv.Atoi(val); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("NODE_MAX_BANDWIDTH"); val != "" {
+		if maxBandwidth, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("NODE_MAX_SESSIONS"); val != "" {
+		if maxSessions, err = strconv.Atoi(val); err != nil {
+			return err
+		}
+	}
+
+	nodeConfigLock.Lock()
+	defer nodeConfigLock.Unlock()
+
+	nodeWeight = weight
+	nodeMaxBandwidth = maxBandwidth
+	nodeMaxSessions = maxSessions
+	return nil
+}
+
+// countAudioSent counts audio the stream forwarded once for every viewer
+func (s *stream) countAudioSent(bytes int) {
+	s.whepSessionsLock.RLock()
+	viewers := len(s.whepSessions)
+	s.whepSessionsLock.RUnlock()
+
+	nodeBytesSent.Add(uint64(bytes * viewers))
+}
+
+// sampleNode measures the CPU and bandwidth used since the last sample
+func sampleNode() {
+	lastCPU, cpuSupported := processCPUTime()
+	lastReceived, lastSent := nodeBytesReceived.Load(), nodeBytesSent.Load()
+	lastSampledAt := time.Now()
+
+	for now := range time.Tick(bitrateSampleInterval) {
+		elapsed := now.Sub(lastSampledAt)
+		load := nodeLoad{}
+
+		cpu, ok := processCPUTime()
+		if ok && cpuSupported {
+			load.cpuSupported = true
+			load.cpuPercent = float64(cpu-lastCPU) * 100 / float64(elapsed) / float64(runtime.NumCPU())
+		}
+		lastCPU, cpuSupported = cpu, ok
+
+		received, sent := nodeBytesReceived.Load(), nodeBytesSent.Load()
+		load.bitrateIn = uint64(float64((received-lastReceived)*8) / elapsed.Seconds())
+		load.bitrateOut = uint64(float64((sent-lastSent)*8) / elapsed.Seconds())
+		lastReceived, lastSent = received, sent
+
+		lastNodeLoad.Store(load)
+		lastSampledAt = now
+	}
+}
+
+// headroomPercent is how much of max is left, clamped to 0 when used is over it
+func headroomPercent(used, max float64) float64 {
+	if used >= max {
+		return 0
+	}
+	return 100 - used*100/max
+}
+
+// GetNodeStatus reports the sessions and the load of the server
+func GetNodeStatus(draining bool) NodeStatus {
+	nodeConfigLock.RLock()
+	status := NodeStatus{
+		Weight:       nodeWeight,
+		Draining:     draining,
+		MaxSessions:  nodeMaxSessions,
+		CPUCount:     runtime.NumCPU(),
+		MaxBandwidth: nodeMaxBandwidth,
+	}
+	nodeConfigLock.RUnlock()
+
+	streamMapLock.Lock()
+	for _, s := range streamMap {
+		status.Publishers += len(s.publishers)
+
+		s.whepSessionsLock.RLock()
+		status.Viewers += len(s.whepSessions)
+		s.whepSessionsLock.RUnlock()
+	}
+	streamMapLock.Unlock()
+
+	status.HeadroomPercent = 100
+	if load, ok := lastNodeLoad.Load().(nodeLoad); ok {
+		status.BitrateIn, status.BitrateOut = load.bitrateIn, load.bitrateOut
+		if load.cpuSupported {
+			cpuPercent := load.cpuPercent
+			status.CPUPercent = &cpuPercent
+			status.HeadroomPercent = headroomPercent(cpuPercent, 100)
+		}
+	}
+
+	if status.MaxBandwidth != 0 {
+		if headroom := headroomPercent(float64(status.BitrateIn+status.BitrateOut), float64(status.MaxBandwidth)); headroom < status.HeadroomPercent {
+			status.HeadroomPercent = headroom
+		}
+	}
+
+	if status.MaxSessions != 0 {
+		if headroom := headroomPercent(float64(status.Publishers+status.Viewers), float64(status.MaxSessions)); headroom < status.HeadroomPercent {
+			status.HeadroomPercent = headroom
+		}
+	}
+
+	if !draining {
+		status.EffectiveWeight = int(float64(status.Weight) * status.HeadroomPercent / 100)
+	}
+	return status
+}
@@ -0,0 +1,50 @@
+package webrtc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+)
+
+var (
+	// SHA-256 of the password viewers need to watch a stream, keyed by stream key
+	playbackPasswords    = map[string][32]byte{}
+	playbackPasswordLock sync.RWMutex
+)
+
+// SetPlaybackPassword gates WHEP for a stream behind a password. An empty
+// password lets everyone watch again
+func SetPlaybackPassword(streamKey, password string) {
+	playbackPasswordLock.Lock()
+	defer playbackPasswordLock.Unlock()
+
+	if password == "" {
+		delete(playbackPasswords, streamKey)
+	} else {
+		playbackPasswords[streamKey] = sha256.Sum256([]byte(password))
+	}
+	saveState(playbackPasswordsStateKey, playbackPasswords)
+}
+
+func HasPlaybackPassword(streamKey string) bool {
+	playbackPasswordLock.RLock()
+	defer playbackPasswordLock.RUnlock()
+
+	_, ok := playbackPasswords[streamKey]
+	return ok
+}
+
+// CheckPlaybackPassword reports if password may watch the stream. Streams
+// without a password accept anything
+func CheckPlaybackPassword(streamKey, password string) bool {
+	playbackPasswordLock.RLock()
+	defer playbackPasswordLock.RUnlock()
+
+	expected, ok := playbackPasswords[streamKey]
+	if !ok {
+		return true
+	}
+
+	actual := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
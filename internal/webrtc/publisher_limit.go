@@ -0,0 +1,49 @@
+package webrtc
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+var ErrRoomFull = errors.New("room already has as many publishers as it allows")
+
+// publisher is a WHIP PeerConnection of a stream with the id of its session
+// and its negotiated DataChannels
+type publisher struct {
+	whipSessionId string
+	statsChannel  *webrtc.DataChannel
+	relayChannel  *webrtc.DataChannel
+}
+
+// checkPublisherLimit must be called with streamMapLock held
+func (s *stream) checkPublisherLimit(policy RoomPolicy) error {
+	if policy.MaxPublishers > 0 && len(s.publishers) >= policy.MaxPublishers {
+		return ErrRoomFull
+	}
+	return nil
+}
+
+// removePublisher forgets a WHIP PeerConnection that disconnected and emits
+// room.slot_available if the room was full. If it was the current publisher
+// another one that is still connected takes its place. It must be called with
+// streamMapLock held
+func (s *stream) removePublisher(streamKey string, peerConnection *webrtc.PeerConnection) {
+	if _, ok := s.publishers[peerConnection]; !ok {
+		return
+	}
+	delete(s.publishers, peerConnection)
+
+	if s.whipPeerConnection == peerConnection {
+		for p, remaining := range s.publishers {
+			s.whipPeerConnection, s.whipStatsChannel, s.whipRelayChannel = p, remaining.statsChannel, remaining.relayChannel
+			break
+		}
+	}
+
+	if maxPublishers := GetRoomPolicy(streamKey).MaxPublishers; maxPublishers > 0 && len(s.publishers) == maxPublishers-1 {
+		emitEvent(webhook.EventRoomSlotAvailable, streamKey, "")
+	}
+}
@@ -0,0 +1,95 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	publisherStatsMessageType = "viewers"
+	streamHealthMessageType   = "streamHealth"
+)
+
+type (
+	publisherStats struct {
+		Type           string         `json:"type"`
+		ViewerCount    int            `json:"viewerCount"`
+		SlowConsumers  int            `json:"slowConsumers"`
+		ViewersByLayer map[string]int `json:"viewersByLayer"`
+		WatchHours     float64        `json:"watchHours"`
+	}
+
+	// StreamHealthEvent aggregates the Receiver Reports of every viewer, so
+	// publishers know when their audience is suffering
+	StreamHealthEvent struct {
+		Type                     string         `json:"type"`
+		ReportingViewers         int            `json:"reportingViewers"`
+		AveragePacketLossPercent float64        `json:"averagePacketLossPercent"`
+		MaxPacketLossPercent     uint32         `json:"maxPacketLossPercent"`
+		AverageJitterMs          float64        `json:"averageJitterMs"`
+		MaxJitterMs              float64        `json:"maxJitterMs"`
+		SlowConsumers            int            `json:"slowConsumers"`
+		ViewersByLayer           map[string]int `json:"viewersByLayer"`
+	}
+)
+
+// sendPublisherStats pushes the audience of the stream and how well it is
+// receiving the stream to the publisher. It must be called with streamMapLock held
+func (s *stream) sendPublisherStats(streamKey string) {
+	if s.whipStatsChannel == nil || s.whipStatsChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	status := s.status(streamKey)
+	stats := publisherStats{
+		Type:           publisherStatsMessageType,
+		ViewerCount:    status.ViewerCount,
+		ViewersByLayer: map[string]int{},
+		WatchHours:     status.WatchHours,
+	}
+	health := StreamHealthEvent{
+		Type:           streamHealthMessageType,
+		ViewersByLayer: stats.ViewersByLayer,
+	}
+	for _, whepSession := range status.WHEPSessions {
+		stats.ViewersByLayer[whepSession.CurrentLayer]++
+		if whepSession.SlowConsumer {
+			stats.SlowConsumers++
+		}
+
+		if whepSession.PacketLossPercent == nil {
+			continue
+		}
+
+		health.ReportingViewers++
+		health.AveragePacketLossPercent += float64(*whepSession.PacketLossPercent)
+		health.AverageJitterMs += *whepSession.JitterMs
+		if *whepSession.PacketLossPercent > health.MaxPacketLossPercent {
+			health.MaxPacketLossPercent = *whepSession.PacketLossPercent
+		}
+		if *whepSession.JitterMs > health.MaxJitterMs {
+			health.MaxJitterMs = *whepSession.JitterMs
+		}
+	}
+
+	health.SlowConsumers = stats.SlowConsumers
+	if health.ReportingViewers != 0 {
+		health.AveragePacketLossPercent /= float64(health.ReportingViewers)
+		health.AverageJitterMs /= float64(health.ReportingViewers)
+	}
+
+	for _, message := range []any{stats, health} {
+		msg, err := json.Marshal(message)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if err = s.whipStatsChannel.SendText(string(msg)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
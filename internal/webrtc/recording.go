@@ -0,0 +1,438 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+)
+
+const (
+	RecordingStatusRecording = "recording"
+	RecordingStatusStopped   = "stopped"
+	RecordingStatusFailed    = "failed"
+
+	defaultRecordingDirectory = "./recordings"
+)
+
+var (
+	ErrStreamNotActive   = errors.New("stream is not active")
+	ErrAlreadyRecording  = errors.New("stream is already being recorded")
+	ErrRecordingNotFound = errors.New("recording not found")
+	errRecordingCodecVP9 = errors.New("recording VP9 is not supported")
+	errRecordingNoCodec  = errors.New("recording has no video codec")
+	recordings           = map[string]*recording{}
+	recordingsLock       sync.Mutex
+)
+
+type (
+	// recording writes one video layer and the audio of a stream to disk.
+	// Packets are written from the WHIP track readers, so everything but the
+	// immutable fields is guarded by lock
+	recording struct {
+		id, streamKey, dir string
+		startedAt          time.Time
+		autoRecorded       bool
+
+		lock        sync.Mutex
+		layer       string
+		state       string
+		err         error
+		stoppedAt   time.Time
+		files       []string
+		videoWriter media.Writer
+		videoCodec  videoTrackCodec
+		audioWriter media.Writer
+
+		// Playable copy of the video and audio, nil for codecs WebM can't carry
+		webm *recordingWebM
+
+		participants []RecordingParticipant
+		events       []RecordingEvent
+
+		// Files are split into segments if RECORDING_SEGMENT_DURATION is set
+		segmentDuration  time.Duration
+		segmentStartedAt time.Time
+		segments         []RecordingSegment
+
+		// pliChan of the stream being recorded, used to request a keyframe for a new segment
+		pliChan chan any
+
+		// State of the post-recording hooks, empty if none are configured
+		processingState string
+		processingErr   error
+
+		// Set when a publisher rejoins so audio timestamps continue from
+		// where the previous publisher stopped
+		audioDiscontinuity bool
+		audioTimestampSet  bool
+		audioTimestamp     uint32
+		audioTimestampDiff uint32
+
+		// Fires if the publisher of an auto recorded room doesn't rejoin, guarded by streamMapLock
+		rejoinTimer *time.Timer
+	}
+
+	RecordingStatus struct {
+		ID           string   `json:"id"`
+		StreamKey    string   `json:"streamKey"`
+		Layer        string   `json:"layer"`
+		Status       string   `json:"status"`
+		AutoRecorded bool     `json:"autoRecorded"`
+		Error        string   `json:"error,omitempty"`
+		StartedAt    int64    `json:"startedAt"`
+		StoppedAt    int64    `json:"stoppedAt,omitempty"`
+		Files        []string `json:"files"`
+
+		Processing      string `json:"processing,omitempty"`
+		ProcessingError string `json:"processingError,omitempty"`
+	}
+)
+
+func recordingDirectory() string {
+	if dir := os.Getenv("RECORDING_DIRECTORY"); dir != "" {
+		return dir
+	}
+
+	return defaultRecordingDirectory
+}
+
+// StartRecording records a publishing stream. If layer is empty the first
+// layer that sends a packet is recorded
+func StartRecording(streamKey, layer string) (RecordingStatus, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.whipStartedEpochMs.Load() == 0 {
+		return RecordingStatus{}, ErrStreamNotActive
+	}
+
+	r, err := startRecording(stream, streamKey, layer, false)
+	if err != nil {
+		return RecordingStatus{}, err
+	}
+
+	return r.status(), nil
+}
+
+// startRecording must be called with streamMapLock held
+func startRecording(stream *stream, streamKey, layer string, autoRecorded bool) (*recording, error) {
+	if active := stream.activeRecording.Load(); active != nil && active.isRecording() {
+		return nil, ErrAlreadyRecording
+	}
+
+	dir := recordingDirectory()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	} else if !hasFreeDiskSpace(dir) {
+		return nil, ErrRecordingDiskFull
+	}
+
+	r := &recording{
+		id:              uuid.New().String(),
+		streamKey:       streamKey,
+		dir:             dir,
+		startedAt:       time.Now(),
+		autoRecorded:    autoRecorded,
+		layer:           layer,
+		state:           RecordingStatusRecording,
+		segmentDuration: getRecordingSegmentDuration(),
+	}
+
+	var err error
+	if r.segmentDuration > 0 {
+		err = r.startSegment()
+	} else {
+		err = r.openAudioWriter()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.participants = append(r.participants, RecordingParticipant{Role: recordingParticipantPublisher, JoinedAt: r.startedAt.Unix()})
+	stream.whepSessionsLock.RLock()
+	for whepSessionId, whepSession := range stream.whepSessions {
+		r.participants = append(r.participants, RecordingParticipant{
+			Role:          recordingParticipantViewer,
+			WHEPSessionID: whepSessionId,
+			Country:       whepSession.country,
+			JoinedAt:      r.startedAt.Unix(),
+		})
+	}
+	stream.whepSessionsLock.RUnlock()
+
+	if err = r.writeMetadata(); err != nil {
+		log.Println(err)
+	}
+
+	recordingsLock.Lock()
+	recordings[r.id] = r
+	recordingsLock.Unlock()
+
+	r.attach(stream)
+	return r, nil
+}
+
+// attach starts writing the packets of stream to the recording
+func (r *recording) attach(stream *stream) {
+	r.lock.Lock()
+	r.pliChan = stream.pliChan
+	r.lock.Unlock()
+
+	stream.activeRecording.Store(r)
+
+	// Video is dropped until the next keyframe
+	select {
+	case stream.pliChan <- true:
+	default:
+	}
+}
+
+// StopRecording closes the files of a recording. Stopping a recording that
+// has already finished is not an error
+func StopRecording(id string) (RecordingStatus, error) {
+	recordingsLock.Lock()
+	r, ok := recordings[id]
+	recordingsLock.Unlock()
+	if !ok {
+		return RecordingStatus{}, ErrRecordingNotFound
+	}
+
+	r.stop()
+
+	streamMapLock.Lock()
+	if stream, ok := streamMap[r.streamKey]; ok {
+		stream.activeRecording.CompareAndSwap(r, nil)
+	}
+	if pendingRecordings[r.streamKey] == r {
+		r.rejoinTimer.Stop()
+		delete(pendingRecordings, r.streamKey)
+	}
+	streamMapLock.Unlock()
+
+	return r.status(), nil
+}
+
+func GetRecording(id string) (RecordingStatus, bool) {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+
+	r, ok := recordings[id]
+	if !ok {
+		return RecordingStatus{}, false
+	}
+
+	return r.status(), true
+}
+
+func GetRecordings() []RecordingStatus {
+	recordingsLock.Lock()
+	out := []RecordingStatus{}
+	for _, r := range recordings {
+		out = append(out, r.status())
+	}
+	recordingsLock.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartedAt < out[j].StartedAt
+	})
+
+	return out
+}
+
+func (r *recording) isRecording() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.state == RecordingStatusRecording
+}
+
+func (r *recording) status() RecordingStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := RecordingStatus{
+		ID:           r.id,
+		StreamKey:    r.streamKey,
+		Layer:        r.layer,
+		Status:       r.state,
+		AutoRecorded: r.autoRecorded,
+		StartedAt:    r.startedAt.Unix(),
+		Files:        append([]string{}, r.files...),
+		Processing:   r.processingState,
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	if r.processingErr != nil {
+		status.ProcessingError = r.processingErr.Error()
+	}
+	if !r.stoppedAt.IsZero() {
+		status.StoppedAt = r.stoppedAt.Unix()
+	}
+
+	return status
+}
+
+func (r *recording) writeVideo(rtpPkt *rtp.Packet, layer string, codec videoTrackCodec) {
+	if recordingsPaused.Load() {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state != RecordingStatusRecording || !r.rotateSegmentIfDue() {
+		return
+	} else if r.layer == "" {
+		r.layer = layer
+	} else if r.layer != layer {
+		return
+	}
+
+	if r.videoWriter == nil {
+		videoPath := r.basePath() + recordingVideoExtension(codec)
+
+		videoWriter, err := newRecordingVideoWriter(videoPath, codec)
+		if err != nil {
+			r.finish(RecordingStatusFailed, err)
+			return
+		}
+		r.videoWriter = videoWriter
+		r.videoCodec = codec
+		r.addFile(videoPath)
+
+		if webm, err := newRecordingWebM(r.basePath()+".webm", codec); err == nil {
+			r.webm = webm
+		}
+	} else if r.videoCodec != codec {
+		// A rejoining publisher switched codecs, the video can't be continued
+		return
+	}
+
+	if err := r.videoWriter.WriteRTP(rtpPkt); err != nil {
+		r.finish(RecordingStatusFailed, err)
+		return
+	}
+
+	if r.webm != nil {
+		opened, err := r.webm.writeVideo(rtpPkt)
+		if err != nil {
+			r.finish(RecordingStatusFailed, err)
+		} else if opened {
+			r.addFile(r.webm.path)
+		}
+	}
+}
+
+func recordingVideoExtension(codec videoTrackCodec) string {
+	if codec == videoTrackCodecH264 {
+		return ".h264"
+	}
+
+	return ".ivf"
+}
+
+func newRecordingVideoWriter(videoPath string, codec videoTrackCodec) (media.Writer, error) {
+	switch codec {
+	case videoTrackCodecH264:
+		return h264writer.New(videoPath)
+	case videoTrackCodecVP8:
+		return ivfwriter.New(videoPath, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	case videoTrackCodecAV1:
+		return ivfwriter.New(videoPath, ivfwriter.WithCodec(webrtc.MimeTypeAV1))
+	case videoTrackCodecVP9:
+		return nil, errRecordingCodecVP9
+	}
+
+	return nil, errRecordingNoCodec
+}
+
+func (r *recording) writeAudio(rtpPkt *rtp.Packet) {
+	if recordingsPaused.Load() {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state != RecordingStatusRecording || !r.rotateSegmentIfDue() {
+		return
+	}
+
+	if r.audioDiscontinuity && r.audioTimestampSet {
+		// Continue one 20ms Opus frame after the last packet of the previous publisher
+		r.audioTimestampDiff = r.audioTimestamp + 960 - rtpPkt.Timestamp
+	}
+	r.audioDiscontinuity = false
+
+	rtpPkt.Timestamp += r.audioTimestampDiff
+	r.audioTimestamp = rtpPkt.Timestamp
+	r.audioTimestampSet = true
+
+	if err := r.audioWriter.WriteRTP(rtpPkt); err != nil {
+		r.finish(RecordingStatusFailed, err)
+	} else if r.webm != nil {
+		if err = r.webm.writeAudio(rtpPkt); err != nil {
+			r.finish(RecordingStatusFailed, err)
+		}
+	}
+}
+
+// resume continues a recording after its publisher rejoined
+func (r *recording) resume() {
+	r.participantJoined(recordingParticipantPublisher, "", "")
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.audioDiscontinuity = true
+	if r.webm != nil {
+		r.webm.resume()
+	}
+}
+
+func (r *recording) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state == RecordingStatusRecording {
+		r.finish(RecordingStatusStopped, nil)
+	}
+}
+
+// finish must be called with lock held
+func (r *recording) finish(state string, err error) {
+	r.state = state
+	r.err = err
+	r.stoppedAt = time.Now()
+	if len(r.segments) != 0 && r.segments[len(r.segments)-1].StoppedAt == 0 {
+		r.segments[len(r.segments)-1].StoppedAt = r.stoppedAt.Unix()
+	}
+
+	if closeErr := r.closeWriters(); closeErr != nil && r.err == nil {
+		r.state = RecordingStatusFailed
+		r.err = closeErr
+	}
+
+	for i := range r.participants {
+		if r.participants[i].LeftAt == 0 {
+			r.participants[i].LeftAt = r.stoppedAt.Unix()
+		}
+	}
+
+	r.startProcessing()
+	if err := r.writeMetadata(); err != nil {
+		log.Println(err)
+	}
+}
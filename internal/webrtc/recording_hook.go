@@ -0,0 +1,122 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+const (
+	RecordingProcessingRunning   = "running"
+	RecordingProcessingSucceeded = "succeeded"
+	RecordingProcessingFailed    = "failed"
+
+	defaultRecordingHookTimeout = time.Minute * 10
+)
+
+var (
+	recordingHookCommand string
+	recordingHookURL     string
+	recordingHookTimeout = defaultRecordingHookTimeout
+	recordingHookLock    sync.RWMutex
+)
+
+func configureRecordingHook() error {
+	timeout := defaultRecordingHookTimeout
+	if val := os.Getenv("RECORDING_HOOK_TIMEOUT"); val != "" {
+		var err error
+		if timeout, err = time.ParseDuration(val); err != nil {
+			return err
+		}
+	}
+
+	recordingHookLock.Lock()
+	defer recordingHookLock.Unlock()
+
+	recordingHookCommand = os.Getenv("RECORDING_HOOK_COMMAND")
+	recordingHookURL = os.Getenv("RECORDING_HOOK_URL")
+	recordingHookTimeout = timeout
+	return nil
+}
+
+// startProcessing runs the post-recording hooks in the background. It must be
+// called with lock held once the recording has finished
+func (r *recording) startProcessing() {
+	recordingHookLock.RLock()
+	command, url, timeout := recordingHookCommand, recordingHookURL, recordingHookTimeout
+	recordingHookLock.RUnlock()
+
+	if command == "" && url == "" {
+		return
+	}
+
+	metadata := r.metadata()
+	r.processingState = RecordingProcessingRunning
+
+	go func() {
+		err := runRecordingHooks(command, url, timeout, metadata, filepath.Join(r.dir, r.id+".json"))
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.processingState = RecordingProcessingSucceeded
+		r.processingErr = err
+		if err != nil {
+			r.processingState = RecordingProcessingFailed
+		}
+
+		if err = r.writeMetadata(); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// runRecordingHooks runs command with the sidecar path as its only argument and
+// the metadata on stdin, then POSTs the metadata to url
+func runRecordingHooks(command, url string, timeout time.Duration, metadata RecordingMetadata, metadataPath string) error {
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	var hookErrs []string
+	if command != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, command, metadataPath)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"RECORDING_ID="+metadata.ID,
+			"RECORDING_STREAM_KEY="+metadata.StreamKey,
+			"RECORDING_FILES="+strings.Join(metadata.Files, "|"),
+		)
+
+		if output, cmdErr := cmd.CombinedOutput(); cmdErr != nil {
+			hookErrs = append(hookErrs, fmt.Sprintf("%s: %s: %s", command, cmdErr, strings.TrimSpace(string(output))))
+		}
+	}
+
+	if url != "" {
+		if postErr := webhook.Post(url, body); postErr != nil {
+			hookErrs = append(hookErrs, postErr.Error())
+		}
+	}
+
+	if len(hookErrs) != 0 {
+		return errors.New(strings.Join(hookErrs, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	recordingParticipantPublisher = "publisher"
+	recordingParticipantViewer    = "viewer"
+)
+
+type (
+	RecordingParticipant struct {
+		Role          string `json:"role"`
+		WHEPSessionID string `json:"whepSessionId,omitempty"`
+		Country       string `json:"country,omitempty"`
+		JoinedAt      int64  `json:"joinedAt"`
+		LeftAt        int64  `json:"leftAt,omitempty"`
+	}
+
+	// RecordingEvent is a caption or timed metadata published while recording.
+	// OffsetMs is the time since the recording started
+	RecordingEvent struct {
+		OffsetMs int64  `json:"offsetMs"`
+		Type     string `json:"type"`
+		Data     any    `json:"data"`
+	}
+
+	// RecordingMetadata is written next to the media files as `<id>.json` so
+	// recordings can be indexed without probing them
+	RecordingMetadata struct {
+		ID           string                 `json:"id"`
+		StreamKey    string                 `json:"streamKey"`
+		Room         string                 `json:"room"`
+		Status       string                 `json:"status"`
+		Error        string                 `json:"error,omitempty"`
+		AutoRecorded bool                   `json:"autoRecorded"`
+		StartedAt    int64                  `json:"startedAt"`
+		StoppedAt    int64                  `json:"stoppedAt,omitempty"`
+		Layer        string                 `json:"layer"`
+		VideoCodec   string                 `json:"videoCodec,omitempty"`
+		AudioCodec   string                 `json:"audioCodec"`
+		Files        []string               `json:"files"`
+		Bytes        int64                  `json:"bytes"`
+		Participants []RecordingParticipant `json:"participants"`
+		Events       []RecordingEvent       `json:"events,omitempty"`
+		Segments     []RecordingSegment     `json:"segments,omitempty"`
+
+		Processing      string `json:"processing,omitempty"`
+		ProcessingError string `json:"processingError,omitempty"`
+	}
+)
+
+func videoTrackCodecMimeType(codec videoTrackCodec) string {
+	switch codec {
+	case videoTrackCodecH264:
+		return webrtc.MimeTypeH264
+	case videoTrackCodecVP8:
+		return webrtc.MimeTypeVP8
+	case videoTrackCodecVP9:
+		return webrtc.MimeTypeVP9
+	case videoTrackCodecAV1:
+		return webrtc.MimeTypeAV1
+	}
+
+	return ""
+}
+
+func (r *recording) participantJoined(role, whepSessionId, country string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state != RecordingStatusRecording {
+		return
+	}
+
+	r.participants = append(r.participants, RecordingParticipant{
+		Role:          role,
+		WHEPSessionID: whepSessionId,
+		Country:       country,
+		JoinedAt:      time.Now().Unix(),
+	})
+}
+
+func (r *recording) participantLeft(role, whepSessionId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range r.participants {
+		if r.participants[i].Role == role && r.participants[i].WHEPSessionID == whepSessionId && r.participants[i].LeftAt == 0 {
+			r.participants[i].LeftAt = time.Now().Unix()
+		}
+	}
+}
+
+func (r *recording) addEvent(event ViewerEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state != RecordingStatusRecording {
+		return
+	}
+
+	r.events = append(r.events, RecordingEvent{
+		OffsetMs: event.EpochMs - r.startedAt.UnixMilli(),
+		Type:     event.Type,
+		Data:     event.Data,
+	})
+}
+
+// metadata must be called with lock held
+func (r *recording) metadata() RecordingMetadata {
+	metadata := RecordingMetadata{
+		ID:           r.id,
+		StreamKey:    r.streamKey,
+		Room:         r.streamKey,
+		Status:       r.state,
+		AutoRecorded: r.autoRecorded,
+		StartedAt:    r.startedAt.Unix(),
+		Layer:        r.layer,
+		VideoCodec:   videoTrackCodecMimeType(r.videoCodec),
+		AudioCodec:   webrtc.MimeTypeOpus,
+		Files:        append([]string{}, r.files...),
+		Participants: append([]RecordingParticipant{}, r.participants...),
+		Events:       append([]RecordingEvent{}, r.events...),
+		Processing:   r.processingState,
+	}
+	for _, segment := range r.segments {
+		segment.Files = append([]string{}, segment.Files...)
+		metadata.Segments = append(metadata.Segments, segment)
+	}
+	if r.err != nil {
+		metadata.Error = r.err.Error()
+	}
+	if r.processingErr != nil {
+		metadata.ProcessingError = r.processingErr.Error()
+	}
+	if !r.stoppedAt.IsZero() {
+		metadata.StoppedAt = r.stoppedAt.Unix()
+	}
+
+	for _, file := range r.files {
+		if info, err := os.Stat(file); err == nil {
+			metadata.Bytes += info.Size()
+		}
+	}
+
+	return metadata
+}
+
+// writeMetadata must be called with lock held. It is written when the
+// recording starts so that a crash still leaves a sidecar behind, and again
+// once it has finished or been processed
+func (r *recording) writeMetadata() error {
+	body, err := json.MarshalIndent(r.metadata(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file first so readers never see a partial sidecar
+	metadataPath := filepath.Join(r.dir, r.id+".json")
+	if err = os.WriteFile(metadataPath+".tmp", body, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(metadataPath+".tmp", metadataPath)
+}
+
+// GetRecordingMetadata reads the sidecar of a recording, so recordings made
+// before a restart can still be found
+func GetRecordingMetadata(id string) (RecordingMetadata, error) {
+	// Only accept IDs we generated, anything else could traverse out of the recording directory
+	if _, err := uuid.Parse(id); err != nil {
+		return RecordingMetadata{}, ErrRecordingNotFound
+	}
+
+	body, err := os.ReadFile(filepath.Join(recordingDirectory(), id+".json"))
+	if os.IsNotExist(err) {
+		return RecordingMetadata{}, ErrRecordingNotFound
+	} else if err != nil {
+		return RecordingMetadata{}, err
+	}
+
+	metadata := RecordingMetadata{}
+	if err = json.Unmarshal(body, &metadata); err != nil {
+		return RecordingMetadata{}, err
+	}
+
+	return metadata, nil
+}
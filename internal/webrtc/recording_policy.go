@@ -0,0 +1,171 @@
+package webrtc
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecordingRejoinWindow = time.Second * 30
+
+	autoRecordAllRooms = "*"
+)
+
+type RoomPolicy struct {
+	StreamKey  string `json:"streamKey"`
+	AutoRecord bool   `json:"autoRecord"`
+
+	// Limits for the publisher, 0 is unlimited
+	MaxIngestBitrate uint64 `json:"maxIngestBitrate"`
+	MaxIngestHeight  int32  `json:"maxIngestHeight"`
+
+	// What happens to a publisher that stays over the limits, `warn` or `terminate`
+	IngestPolicy string `json:"ingestPolicy"`
+
+	// Limits for new viewers, 0 and empty are unlimited. Countries are ISO codes
+	// and need GEOIP_COUNTRY_DATABASE
+	MaxSessionsPerViewer int      `json:"maxSessionsPerViewer"`
+	BlockedCountries     []string `json:"blockedCountries"`
+
+	// Voice rooms only negotiate Opus, with DTX so silent publishers send
+	// almost nothing. Publishers and viewers that offer video get none
+	AudioOnly bool `json:"audioOnly"`
+
+	// Media of relay only rooms only flows through TURN_SERVERS and host and
+	// server reflexive candidates are removed from the offers and answers
+	RelayOnly bool `json:"relayOnly"`
+
+	// How many publishers may be connected at once, 0 is unlimited
+	MaxPublishers int `json:"maxPublishers"`
+
+	// Viewers' messages on the relay DataChannel are passed on to the publisher
+	ViewerDataRelay bool `json:"viewerDataRelay"`
+}
+
+var (
+	// Rooms from AUTO_RECORD_ROOMS, replaced on reload
+	autoRecordRoomsFromEnv map[string]bool
+
+	// Set through the API, these take precedence over AUTO_RECORD_ROOMS
+	roomPolicies = map[string]RoomPolicy{}
+
+	recordingRejoinWindow = defaultRecordingRejoinWindow
+	recordingPolicyLock   sync.RWMutex
+
+	// Auto recordings whose publisher disconnected, guarded by streamMapLock.
+	// If the publisher rejoins within recordingRejoinWindow the same files are
+	// continued instead of starting a new recording
+	pendingRecordings = map[string]*recording{}
+)
+
+func configureRecordingPolicy() error {
+	rejoinWindow := defaultRecordingRejoinWindow
+	if val := os.Getenv("RECORDING_REJOIN_WINDOW"); val != "" {
+		var err error
+		if rejoinWindow, err = time.ParseDuration(val); err != nil {
+			return err
+		}
+	}
+
+	autoRecordRooms := map[string]bool{}
+	if val := os.Getenv("AUTO_RECORD_ROOMS"); val != "" {
+		for _, streamKey := range strings.Split(val, "|") {
+			autoRecordRooms[streamKey] = true
+		}
+	}
+
+	recordingPolicyLock.Lock()
+	defer recordingPolicyLock.Unlock()
+
+	recordingRejoinWindow = rejoinWindow
+	autoRecordRoomsFromEnv = autoRecordRooms
+	return nil
+}
+
+func GetRoomPolicy(streamKey string) RoomPolicy {
+	recordingPolicyLock.RLock()
+	defer recordingPolicyLock.RUnlock()
+
+	if policy, ok := roomPolicies[streamKey]; ok {
+		return policy
+	}
+
+	ingestConfigLock.RLock()
+	defer ingestConfigLock.RUnlock()
+
+	return RoomPolicy{
+		StreamKey:        streamKey,
+		AutoRecord:       autoRecordRoomsFromEnv[streamKey] || autoRecordRoomsFromEnv[autoRecordAllRooms],
+		MaxIngestBitrate: ingestMaxBitrate,
+		MaxIngestHeight:  ingestMaxHeight,
+		IngestPolicy:     ingestPolicy,
+		BlockedCountries: []string{},
+	}
+}
+
+// SetRoomPolicy applies to the next time the room starts publishing
+func SetRoomPolicy(policy RoomPolicy) {
+	recordingPolicyLock.Lock()
+	defer recordingPolicyLock.Unlock()
+
+	roomPolicies[policy.StreamKey] = policy
+	saveState(roomPoliciesStateKey, roomPolicies)
+}
+
+// autoRecordOnPublish continues a pending recording of the room or starts a new
+// one if the room is auto recorded. It must be called with streamMapLock held
+func autoRecordOnPublish(stream *stream, streamKey string) error {
+	if r, ok := pendingRecordings[streamKey]; ok {
+		r.rejoinTimer.Stop()
+		delete(pendingRecordings, streamKey)
+
+		if r.isRecording() {
+			r.resume()
+			r.attach(stream)
+			return nil
+		}
+	}
+
+	if !GetRoomPolicy(streamKey).AutoRecord {
+		return nil
+	}
+
+	_, err := startRecording(stream, streamKey, "", true)
+	return err
+}
+
+// stopRecordingOnUnpublish stops the recording of a stream whose publisher
+// disconnected. Auto recordings are kept open in case the publisher rejoins.
+// It must be called with streamMapLock held
+func stopRecordingOnUnpublish(stream *stream, streamKey string) {
+	r := stream.activeRecording.Swap(nil)
+	if r == nil {
+		return
+	}
+	r.participantLeft(recordingParticipantPublisher, "")
+
+	recordingPolicyLock.RLock()
+	rejoinWindow := recordingRejoinWindow
+	recordingPolicyLock.RUnlock()
+
+	if !r.autoRecorded || rejoinWindow <= 0 || !r.isRecording() {
+		r.stop()
+		return
+	}
+
+	pendingRecordings[streamKey] = r
+	r.rejoinTimer = time.AfterFunc(rejoinWindow, func() {
+		streamMapLock.Lock()
+		defer streamMapLock.Unlock()
+
+		// The publisher rejoined or the recording was stopped while the timer fired
+		if pendingRecordings[streamKey] != r {
+			return
+		}
+
+		delete(pendingRecordings, streamKey)
+		r.stop()
+	})
+}
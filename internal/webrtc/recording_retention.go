@@ -0,0 +1,217 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordingJanitorInterval = time.Minute
+
+	defaultRecordingMinFreeBytes = 1024 * 1024 * 1024
+)
+
+var (
+	ErrRecordingDiskFull = errors.New("not enough free disk space to record")
+
+	recordingMaxAge        time.Duration
+	recordingMaxBytes      int64
+	recordingMinFreeBytes  = uint64(defaultRecordingMinFreeBytes)
+	recordingRetentionLock sync.RWMutex
+
+	// Set by the janitor when free space is below RECORDING_MIN_FREE_BYTES.
+	// Packets are dropped instead of written so live streaming keeps working
+	recordingsPaused atomic.Bool
+)
+
+func configureRecordingRetention() error {
+	var (
+		maxAge       time.Duration
+		maxBytes     int64
+		minFreeBytes = uint64(defaultRecordingMinFreeBytes)
+		err          error
+	)
+
+	if val := os.Getenv("RECORDING_MAX_AGE"); val != "" {
+		if maxAge, err = time.ParseDuration(val); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("RECORDING_MAX_BYTES"); val != "" {
+		if maxBytes, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("RECORDING_MIN_FREE_BYTES"); val != "" {
+		if minFreeBytes, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	recordingRetentionLock.Lock()
+	defer recordingRetentionLock.Unlock()
+
+	recordingMaxAge = maxAge
+	recordingMaxBytes = maxBytes
+	recordingMinFreeBytes = minFreeBytes
+	return nil
+}
+
+// hasFreeDiskSpace reports if dir is above RECORDING_MIN_FREE_BYTES. It is
+// always true on platforms where free space can't be read
+func hasFreeDiskSpace(dir string) bool {
+	recordingRetentionLock.RLock()
+	minFreeBytes := recordingMinFreeBytes
+	recordingRetentionLock.RUnlock()
+
+	free, ok := diskFreeBytes(dir)
+	return !ok || free >= minFreeBytes
+}
+
+func runRecordingJanitor() {
+	for range time.Tick(recordingJanitorInterval) {
+		pruneRecordings()
+
+		dir := recordingDirectory()
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+
+		hasFreeSpace := hasFreeDiskSpace(dir)
+		if wasPaused := recordingsPaused.Swap(!hasFreeSpace); wasPaused && hasFreeSpace {
+			log.Println("Free disk space recovered, resuming recordings")
+			requestRecordingKeyframes()
+		} else if !wasPaused && !hasFreeSpace {
+			log.Println("Disk is almost full, pausing recordings")
+		}
+	}
+}
+
+// requestRecordingKeyframes sends a PLI to every recorded stream so video
+// resumes on a keyframe
+func requestRecordingKeyframes() {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		if stream.activeRecording.Load() == nil {
+			continue
+		}
+
+		select {
+		case stream.pliChan <- true:
+		default:
+		}
+	}
+}
+
+// pruneRecordings deletes finished recordings older than RECORDING_MAX_AGE, then
+// the oldest ones until the directory is below RECORDING_MAX_BYTES
+func pruneRecordings() {
+	recordingRetentionLock.RLock()
+	maxAge, maxBytes := recordingMaxAge, recordingMaxBytes
+	recordingRetentionLock.RUnlock()
+
+	if maxAge <= 0 && maxBytes <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(recordingDirectory())
+	if err != nil {
+		return
+	}
+
+	type prunable struct {
+		metadata   RecordingMetadata
+		finishedAt time.Time
+		bytes      int64
+	}
+
+	finished := []prunable{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		metadata, err := GetRecordingMetadata(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !recordingIsPrunable(metadata) {
+			continue
+		}
+
+		p := prunable{metadata: metadata, finishedAt: time.Unix(metadata.StoppedAt, 0)}
+		if metadata.StoppedAt == 0 {
+			// Left behind by a crash
+			p.finishedAt = time.Unix(metadata.StartedAt, 0)
+		}
+		for _, file := range metadata.Files {
+			if info, err := os.Stat(file); err == nil {
+				p.bytes += info.Size()
+			}
+		}
+
+		finished = append(finished, p)
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].finishedAt.Before(finished[j].finishedAt)
+	})
+
+	totalBytes := int64(0)
+	for _, p := range finished {
+		totalBytes += p.bytes
+	}
+
+	for _, p := range finished {
+		expired := maxAge > 0 && time.Since(p.finishedAt) > maxAge
+		overQuota := maxBytes > 0 && totalBytes > maxBytes
+		if !expired && !overQuota {
+			continue
+		}
+
+		if err := deleteRecording(p.metadata); err != nil {
+			log.Println(err)
+			continue
+		}
+		totalBytes -= p.bytes
+	}
+}
+
+// recordingIsPrunable reports if a recording isn't being written or processed
+func recordingIsPrunable(metadata RecordingMetadata) bool {
+	recordingsLock.Lock()
+	r, ok := recordings[metadata.ID]
+	recordingsLock.Unlock()
+
+	if !ok {
+		return true
+	}
+
+	status := r.status()
+	return status.Status != RecordingStatusRecording && status.Processing != RecordingProcessingRunning
+}
+
+func deleteRecording(metadata RecordingMetadata) error {
+	log.Println("Deleting recording " + metadata.ID)
+
+	for _, file := range append(metadata.Files, filepath.Join(recordingDirectory(), metadata.ID+".json")) {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	recordingsLock.Lock()
+	delete(recordings, metadata.ID)
+	recordingsLock.Unlock()
+
+	return nil
+}
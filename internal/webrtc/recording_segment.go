@@ -0,0 +1,147 @@
+package webrtc
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+type RecordingSegment struct {
+	Index     int      `json:"index"`
+	StartedAt int64    `json:"startedAt"`
+	StoppedAt int64    `json:"stoppedAt,omitempty"`
+	Files     []string `json:"files"`
+}
+
+var (
+	recordingSegmentDuration     time.Duration
+	recordingSegmentDurationLock sync.RWMutex
+)
+
+func configureRecordingSegments() error {
+	var segmentDuration time.Duration
+	if val := os.Getenv("RECORDING_SEGMENT_DURATION"); val != "" {
+		var err error
+		if segmentDuration, err = time.ParseDuration(val); err != nil {
+			return err
+		}
+	}
+
+	recordingSegmentDurationLock.Lock()
+	defer recordingSegmentDurationLock.Unlock()
+
+	recordingSegmentDuration = segmentDuration
+	return nil
+}
+
+func getRecordingSegmentDuration() time.Duration {
+	recordingSegmentDurationLock.RLock()
+	defer recordingSegmentDurationLock.RUnlock()
+
+	return recordingSegmentDuration
+}
+
+// basePath is the path of the current files without an extension. It must be
+// called with lock held
+func (r *recording) basePath() string {
+	if len(r.segments) == 0 {
+		return filepath.Join(r.dir, r.id)
+	}
+
+	return filepath.Join(r.dir, r.id+"-"+strconv.Itoa(len(r.segments)-1))
+}
+
+// addFile must be called with lock held
+func (r *recording) addFile(path string) {
+	r.files = append(r.files, path)
+	if len(r.segments) != 0 {
+		segment := &r.segments[len(r.segments)-1]
+		segment.Files = append(segment.Files, path)
+	}
+}
+
+// openAudioWriter must be called with lock held
+func (r *recording) openAudioWriter() error {
+	audioPath := r.basePath() + ".ogg"
+	audioWriter, err := oggwriter.New(audioPath, 48000, 2)
+	if err != nil {
+		return err
+	}
+
+	r.audioWriter = audioWriter
+	r.addFile(audioPath)
+	return nil
+}
+
+// closeWriters closes every file of the current segment and returns the
+// first error. It must be called with lock held
+func (r *recording) closeWriters() error {
+	var err error
+	for _, w := range []media.Writer{r.videoWriter, r.audioWriter} {
+		if w == nil {
+			continue
+		}
+
+		if closeErr := w.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if r.webm != nil {
+		if closeErr := r.webm.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	r.videoWriter, r.audioWriter, r.webm = nil, nil, nil
+	return err
+}
+
+// startSegment opens the files of the next segment. The video file is opened
+// once the first packet arrives. It must be called with lock held
+func (r *recording) startSegment() error {
+	r.segmentStartedAt = time.Now()
+	r.segments = append(r.segments, RecordingSegment{
+		Index:     len(r.segments),
+		StartedAt: r.segmentStartedAt.Unix(),
+	})
+
+	return r.openAudioWriter()
+}
+
+// rotateSegmentIfDue closes the current segment once it is older than the
+// segment duration. It returns false if the recording failed. It must be
+// called with lock held
+func (r *recording) rotateSegmentIfDue() bool {
+	if r.segmentDuration <= 0 || time.Since(r.segmentStartedAt) < r.segmentDuration {
+		return true
+	}
+
+	if err := r.closeWriters(); err != nil {
+		r.finish(RecordingStatusFailed, err)
+		return false
+	}
+	r.segments[len(r.segments)-1].StoppedAt = time.Now().Unix()
+
+	if err := r.startSegment(); err != nil {
+		r.finish(RecordingStatusFailed, err)
+		return false
+	}
+
+	// The new video file can only start on a keyframe
+	select {
+	case r.pliChan <- true:
+	default:
+	}
+
+	if err := r.writeMetadata(); err != nil {
+		log.Println(err)
+	}
+
+	return true
+}
@@ -0,0 +1,588 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// Matroska element IDs, https://www.matroska.org/technical/elements.html
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+	ebmlIDVoid               = 0xEC
+
+	mkvIDSegment            = 0x18538067
+	mkvIDSeekHead           = 0x114D9B74
+	mkvIDSeek               = 0x4DBB
+	mkvIDSeekID             = 0x53AB
+	mkvIDSeekPosition       = 0x53AC
+	mkvIDInfo               = 0x1549A966
+	mkvIDTimecodeScale      = 0x2AD7B1
+	mkvIDMuxingApp          = 0x4D80
+	mkvIDWritingApp         = 0x5741
+	mkvIDDuration           = 0x4489
+	mkvIDTracks             = 0x1654AE6B
+	mkvIDTrackEntry         = 0xAE
+	mkvIDTrackNumber        = 0xD7
+	mkvIDTrackUID           = 0x73C5
+	mkvIDTrackType          = 0x83
+	mkvIDFlagLacing         = 0x9C
+	mkvIDCodecID            = 0x86
+	mkvIDCodecPrivate       = 0x63A2
+	mkvIDSeekPreRoll        = 0x56BB
+	mkvIDVideo              = 0xE0
+	mkvIDPixelWidth         = 0xB0
+	mkvIDPixelHeight        = 0xBA
+	mkvIDAudio              = 0xE1
+	mkvIDSamplingFrequency  = 0xB5
+	mkvIDChannels           = 0x9F
+	mkvIDCluster            = 0x1F43B675
+	mkvIDTimecode           = 0xE7
+	mkvIDSimpleBlock        = 0xA3
+	mkvIDCues               = 0x1C53BB6B
+	mkvIDCuePoint           = 0xBB
+	mkvIDCueTime            = 0xB3
+	mkvIDCueTrackPositions  = 0xB7
+	mkvIDCueTrack           = 0xF7
+	mkvIDCueClusterPosition = 0xF1
+
+	webmVideoTrack = 1
+	webmAudioTrack = 2
+
+	webmVideoClockRate = 90000
+	webmAudioClockRate = 48000
+
+	// Sizes of the elements that are only known once the file is closed, they
+	// are reserved with Void elements until then
+	webmSeekHeadSize = 68
+	webmDurationSize = 11
+)
+
+// ebmlUnknownSize marks the Segment and Cluster as unterminated until their
+// size is written, so a file cut off by a crash still plays
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+var errWebMCodec = errors.New("recording WebM only supports H264 and VP8")
+
+type (
+	// recordingWebM muxes the recorded layer and the audio into a WebM that
+	// browsers can play and seek. The file is created at the first keyframe,
+	// the duration, cues and element sizes are written when it is closed
+	recordingWebM struct {
+		path  string
+		codec videoTrackCodec
+
+		file     *os.File
+		offset   int64
+		openedAt time.Time
+
+		// Offsets of the Segment size, its data and the reserved elements
+		segmentSizeOffset, segmentDataOffset int64
+		seekHeadOffset, durationOffset       int64
+		infoOffset, tracksOffset             int64
+
+		clusterOffset    int64
+		clusterTimecode  int64
+		lastTimestampMs  int64
+		cues             []webmCue
+		h264Packet       codecs.H264Packet
+		lastSequence     uint16
+		sequenceSet      bool
+		waitForKeyframe  bool
+		video, audio     webmTrackClock
+		rebaseVideoClock bool
+
+		// Frame being collected, broken if it lost a packet
+		frame          []byte
+		frameTimestamp uint32
+		frameActive    bool
+		frameBroken    bool
+		frameKeyframe  bool
+	}
+
+	webmCue struct {
+		timestampMs, clusterPosition int64
+	}
+
+	// webmTrackClock converts the RTP timestamps of a track to milliseconds
+	// into the file, starting at baseMs
+	webmTrackClock struct {
+		set          bool
+		lastRTP      uint32
+		elapsedTicks int64
+		baseMs       int64
+	}
+)
+
+func newRecordingWebM(path string, codec videoTrackCodec) (*recordingWebM, error) {
+	if codec != videoTrackCodecH264 && codec != videoTrackCodecVP8 {
+		return nil, errWebMCodec
+	}
+
+	return &recordingWebM{
+		path:            path,
+		codec:           codec,
+		waitForKeyframe: true,
+		h264Packet:      codecs.H264Packet{IsAVC: true},
+	}, nil
+}
+
+// resume restarts the video clock after a publisher rejoined with new RTP
+// timestamps. Audio timestamps are already continued by the recording
+func (w *recordingWebM) resume() {
+	w.rebaseVideoClock = true
+	w.waitForKeyframe = true
+	w.sequenceSet = false
+	w.frameActive = false
+}
+
+// writeVideo collects the packets of a frame and writes it once complete.
+// After a lost packet frames are dropped until the next keyframe. It returns
+// true when the packet created the file
+func (w *recordingWebM) writeVideo(rtpPkt *rtp.Packet) (bool, error) {
+	lost := w.sequenceSet && rtpPkt.SequenceNumber != w.lastSequence+1
+	w.lastSequence, w.sequenceSet = rtpPkt.SequenceNumber, true
+	if lost {
+		// Fragments of the lost NALU must not be joined with the next one
+		w.h264Packet = codecs.H264Packet{IsAVC: true}
+		w.waitForKeyframe = true
+	}
+
+	var (
+		payload []byte
+		head    bool
+	)
+	switch w.codec {
+	case videoTrackCodecH264:
+		head = w.h264Packet.IsPartitionHead(rtpPkt.Payload)
+		data, err := w.h264Packet.Unmarshal(rtpPkt.Payload)
+		if err != nil {
+			// A malformed packet only drops its frame
+			w.frameBroken = true
+			return false, nil
+		}
+		payload = data
+	case videoTrackCodecVP8:
+		vp8Packet := codecs.VP8Packet{}
+		if _, err := vp8Packet.Unmarshal(rtpPkt.Payload); err != nil {
+			w.frameBroken = true
+			return false, nil
+		}
+		head = vp8Packet.S == 1 && vp8Packet.PID == 0
+		payload = vp8Packet.Payload
+	}
+
+	if !w.frameActive || rtpPkt.Timestamp != w.frameTimestamp {
+		if w.frameActive {
+			// The marker of the previous frame was lost
+			w.waitForKeyframe = true
+		}
+
+		w.frame = w.frame[:0]
+		w.frameTimestamp = rtpPkt.Timestamp
+		w.frameActive = true
+		w.frameBroken = !head
+		w.frameKeyframe = w.codec == videoTrackCodecVP8 && len(payload) > 0 && payload[0]&vp8InterframeBit == 0
+	} else if lost {
+		w.frameBroken = true
+	}
+	w.frame = append(w.frame, payload...)
+
+	if !rtpPkt.Marker {
+		return false, nil
+	}
+	w.frameActive = false
+
+	if w.codec == videoTrackCodecH264 {
+		w.frameKeyframe = h264FrameHasNALU(w.frame, h264NALUTypeIDR)
+	}
+	if w.frameBroken || (w.waitForKeyframe && !w.frameKeyframe) {
+		return false, nil
+	}
+
+	opened := false
+	if w.file == nil {
+		var err error
+		if opened, err = w.open(); err != nil || !opened {
+			return false, err
+		}
+	}
+	w.waitForKeyframe = false
+
+	if w.rebaseVideoClock {
+		w.video = webmTrackClock{}
+		w.rebaseVideoClock = false
+	}
+	timestampMs := w.video.timestampMs(w.frameTimestamp, webmVideoClockRate, w.lastTimestampMs)
+
+	return opened, w.writeBlock(webmVideoTrack, timestampMs, w.frameKeyframe, w.frame)
+}
+
+// writeAudio writes an Opus packet. Audio before the first video keyframe is dropped
+func (w *recordingWebM) writeAudio(rtpPkt *rtp.Packet) error {
+	if w.file == nil || len(rtpPkt.Payload) == 0 {
+		return nil
+	}
+
+	if !w.audio.set {
+		w.audio.baseMs = time.Since(w.openedAt).Milliseconds()
+	}
+	timestampMs := w.audio.timestampMs(rtpPkt.Timestamp, webmAudioClockRate, w.lastTimestampMs)
+
+	return w.writeBlock(webmAudioTrack, timestampMs, true, rtpPkt.Payload)
+}
+
+// timestampMs starts the clock at baseMs, or at the time already written
+// if the clock was reset
+func (c *webmTrackClock) timestampMs(timestamp uint32, clockRate int64, lastTimestampMs int64) int64 {
+	if !c.set {
+		if c.baseMs < lastTimestampMs {
+			c.baseMs = lastTimestampMs
+		}
+		c.set = true
+		c.lastRTP = timestamp
+	}
+
+	c.elapsedTicks += int64(int32(timestamp - c.lastRTP))
+	c.lastRTP = timestamp
+	return c.baseMs + c.elapsedTicks*1000/clockRate
+}
+
+// open writes everything up to the Tracks once the first keyframe carries the
+// resolution. It returns false while the keyframe doesn't
+func (w *recordingWebM) open() (bool, error) {
+	videoTrack, ok := w.videoTrackEntry()
+	if !ok {
+		return false, nil
+	}
+
+	file, err := os.Create(w.path)
+	if err != nil {
+		return false, err
+	}
+	w.file = file
+	w.openedAt = time.Now()
+
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+	if err = w.write(header, ebmlID(mkvIDSegment)); err != nil {
+		return false, err
+	}
+
+	w.segmentSizeOffset = w.offset
+	if err = w.write(ebmlUnknownSize); err != nil {
+		return false, err
+	}
+	w.segmentDataOffset = w.offset
+
+	w.seekHeadOffset = w.offset
+	if err = w.write(ebmlVoid(webmSeekHeadSize)); err != nil {
+		return false, err
+	}
+
+	w.infoOffset = w.offset
+	info := ebmlElement(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, uint64(time.Millisecond)),
+		ebmlString(mkvIDMuxingApp, "broadcast-box"),
+		ebmlString(mkvIDWritingApp, "broadcast-box"),
+		ebmlVoid(webmDurationSize),
+	)
+	w.durationOffset = w.infoOffset + int64(len(info)-webmDurationSize)
+	if err = w.write(info); err != nil {
+		return false, err
+	}
+
+	opusHead := append([]byte("OpusHead"), 1, 2, 0, 0)
+	opusHead = binary.LittleEndian.AppendUint32(opusHead, webmAudioClockRate)
+	opusHead = append(opusHead, 0, 0, 0)
+
+	w.tracksOffset = w.offset
+	tracks := ebmlElement(mkvIDTracks,
+		videoTrack,
+		ebmlElement(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackNumber, webmAudioTrack),
+			ebmlUint(mkvIDTrackUID, webmAudioTrack),
+			ebmlUint(mkvIDTrackType, 2),
+			ebmlUint(mkvIDFlagLacing, 0),
+			ebmlString(mkvIDCodecID, "A_OPUS"),
+			ebmlElement(mkvIDCodecPrivate, opusHead),
+			ebmlUint(mkvIDSeekPreRoll, uint64(80*time.Millisecond)),
+			ebmlElement(mkvIDAudio,
+				ebmlFloat(mkvIDSamplingFrequency, webmAudioClockRate),
+				ebmlUint(mkvIDChannels, 2),
+			),
+		),
+	)
+	return true, w.write(tracks)
+}
+
+// videoTrackEntry describes the video of the keyframe in w.frame
+func (w *recordingWebM) videoTrackEntry() ([]byte, bool) {
+	var (
+		codecID      string
+		codecPrivate []byte
+		width        int32
+		height       int32
+		ok           bool
+	)
+
+	switch w.codec {
+	case videoTrackCodecH264:
+		sps, pps := h264FrameNALU(w.frame, h264NALUTypeSPS), h264FrameNALU(w.frame, h264NALUTypePPS)
+		if sps == nil || pps == nil || len(sps) < 4 {
+			return nil, false
+		} else if width, height, ok = parseH264SPSResolution(sps); !ok {
+			return nil, false
+		}
+
+		// AVCDecoderConfigurationRecord, ISO/IEC 14496-15 5.3.3.1
+		codecID = "V_MPEG4/ISO/AVC"
+		codecPrivate = []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+		codecPrivate = binary.BigEndian.AppendUint16(codecPrivate, uint16(len(sps)))
+		codecPrivate = append(append(codecPrivate, sps...), 1)
+		codecPrivate = binary.BigEndian.AppendUint16(codecPrivate, uint16(len(pps)))
+		codecPrivate = append(codecPrivate, pps...)
+	case videoTrackCodecVP8:
+		if width, height, ok = parseVP8FrameResolution(w.frame); !ok {
+			return nil, false
+		}
+		codecID = "V_VP8"
+	}
+
+	trackEntry := [][]byte{
+		ebmlUint(mkvIDTrackNumber, webmVideoTrack),
+		ebmlUint(mkvIDTrackUID, webmVideoTrack),
+		ebmlUint(mkvIDTrackType, 1),
+		ebmlUint(mkvIDFlagLacing, 0),
+		ebmlString(mkvIDCodecID, codecID),
+	}
+	if codecPrivate != nil {
+		trackEntry = append(trackEntry, ebmlElement(mkvIDCodecPrivate, codecPrivate))
+	}
+	trackEntry = append(trackEntry, ebmlElement(mkvIDVideo,
+		ebmlUint(mkvIDPixelWidth, uint64(width)),
+		ebmlUint(mkvIDPixelHeight, uint64(height)),
+	))
+
+	return ebmlElement(mkvIDTrackEntry, trackEntry...), true
+}
+
+// writeBlock starts a new Cluster at video keyframes, or when the block is too
+// far from the Cluster for its 16 bit relative timestamp
+func (w *recordingWebM) writeBlock(track uint64, timestampMs int64, keyframe bool, data []byte) error {
+	if timestampMs < w.lastTimestampMs {
+		// Blocks are kept in order, the tracks only drift by a few milliseconds
+		timestampMs = w.lastTimestampMs
+	}
+	w.lastTimestampMs = timestampMs
+
+	videoKeyframe := track == webmVideoTrack && keyframe
+	if w.clusterOffset == 0 || videoKeyframe || timestampMs-w.clusterTimecode > math.MaxInt16 {
+		if err := w.closeCluster(); err != nil {
+			return err
+		}
+
+		w.clusterOffset = w.offset
+		w.clusterTimecode = timestampMs
+		if videoKeyframe {
+			w.cues = append(w.cues, webmCue{timestampMs: timestampMs, clusterPosition: w.clusterOffset - w.segmentDataOffset})
+		}
+		if err := w.write(ebmlID(mkvIDCluster), ebmlUnknownSize, ebmlUint(mkvIDTimecode, uint64(timestampMs))); err != nil {
+			return err
+		}
+	}
+
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+	blockHeader := []byte{0x80 | byte(track), 0, 0, flags}
+	binary.BigEndian.PutUint16(blockHeader[1:], uint16(int16(timestampMs-w.clusterTimecode)))
+
+	return w.write(ebmlID(mkvIDSimpleBlock), ebmlSize(uint64(len(blockHeader)+len(data))), blockHeader, data)
+}
+
+// closeCluster writes the size of the open Cluster
+func (w *recordingWebM) closeCluster() error {
+	if w.clusterOffset == 0 {
+		return nil
+	}
+
+	sizeOffset := w.clusterOffset + int64(len(ebmlID(mkvIDCluster)))
+	_, err := w.file.WriteAt(ebmlSize8(uint64(w.offset-sizeOffset-8)), sizeOffset)
+	return err
+}
+
+// Close writes the Cues, the SeekHead, the duration and the Segment size
+func (w *recordingWebM) Close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.finalize()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+
+	return err
+}
+
+func (w *recordingWebM) finalize() error {
+	if err := w.closeCluster(); err != nil {
+		return err
+	}
+
+	cuesOffset := w.offset
+	cuePoints := [][]byte{}
+	for _, cue := range w.cues {
+		cuePoints = append(cuePoints, ebmlElement(mkvIDCuePoint,
+			ebmlUint(mkvIDCueTime, uint64(cue.timestampMs)),
+			ebmlElement(mkvIDCueTrackPositions,
+				ebmlUint(mkvIDCueTrack, webmVideoTrack),
+				ebmlUint(mkvIDCueClusterPosition, uint64(cue.clusterPosition)),
+			),
+		))
+	}
+	if err := w.write(ebmlElement(mkvIDCues, cuePoints...)); err != nil {
+		return err
+	}
+
+	seeks := [][]byte{}
+	for _, seek := range []struct {
+		id     uint32
+		offset int64
+	}{{mkvIDInfo, w.infoOffset}, {mkvIDTracks, w.tracksOffset}, {mkvIDCues, cuesOffset}} {
+		seeks = append(seeks, ebmlElement(mkvIDSeek,
+			ebmlElement(mkvIDSeekID, ebmlID(seek.id)),
+			ebmlElement(mkvIDSeekPosition, ebmlUint64(uint64(seek.offset-w.segmentDataOffset))),
+		))
+	}
+
+	for _, patch := range []struct {
+		data   []byte
+		offset int64
+	}{
+		{ebmlElement(mkvIDSeekHead, seeks...), w.seekHeadOffset},
+		{ebmlFloat(mkvIDDuration, float64(w.lastTimestampMs)), w.durationOffset},
+		{ebmlSize8(uint64(w.offset - w.segmentDataOffset)), w.segmentSizeOffset},
+	} {
+		if _, err := w.file.WriteAt(patch.data, patch.offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *recordingWebM) write(data ...[]byte) error {
+	for _, d := range data {
+		n, err := w.file.Write(d)
+		w.offset += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// h264FrameNALU returns the first NALU of naluType in a frame of length prefixed NALUs
+func h264FrameNALU(frame []byte, naluType byte) []byte {
+	for offset := 0; offset+4 < len(frame); {
+		size := int(binary.BigEndian.Uint32(frame[offset:]))
+		offset += 4
+		if size == 0 || offset+size > len(frame) {
+			return nil
+		} else if frame[offset]&0x1f == naluType {
+			return frame[offset : offset+size]
+		}
+		offset += size
+	}
+
+	return nil
+}
+
+func h264FrameHasNALU(frame []byte, naluType byte) bool {
+	return h264FrameNALU(frame, naluType) != nil
+}
+
+func ebmlID(id uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	return bytes.TrimLeft(b, "\x00")
+}
+
+// ebmlSize is the shortest variable size integer for size
+func ebmlSize(size uint64) []byte {
+	length := 1
+	for ; length < 8 && size >= 1<<(7*length)-1; length++ {
+	}
+
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(size)
+		size >>= 8
+	}
+	b[0] |= 0x80 >> (length - 1)
+
+	return b
+}
+
+// ebmlSize8 is size as an 8 byte variable size integer, for sizes written over a reserved one
+func ebmlSize8(size uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, size)
+	b[0] = 0x01
+	return b
+}
+
+func ebmlElement(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	return append(append(ebmlID(id), ebmlSize(uint64(len(data)))...), data...)
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+
+	return ebmlElement(id, b)
+}
+
+// ebmlUint64 is the 8 byte data of an unsigned integer, for values written over a reserved one
+func ebmlUint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func ebmlString(id uint32, v string) []byte {
+	return ebmlElement(id, []byte(v))
+}
+
+// ebmlVoid reserves size bytes, including its own ID and size
+func ebmlVoid(size int) []byte {
+	return append([]byte{ebmlIDVoid, 0x80 | byte(size-2)}, make([]byte, size-2)...)
+}
@@ -0,0 +1,22 @@
+package webrtc
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrNoTURNServers = errors.New("relay only rooms need TURN_SERVERS")
+
+// stripNonRelayCandidates removes the host and server reflexive candidates
+// from sdp, so neither side learns the address of the other
+func stripNonRelayCandidates(sdp string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") && !strings.Contains(line, " typ relay") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "")
+}
@@ -0,0 +1,171 @@
+package webrtc
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+const (
+	ScheduleStateScheduled    = "scheduled"
+	ScheduleStateStartingSoon = "starting_soon"
+	ScheduleStateLive         = "live"
+	ScheduleStateEnded        = "ended"
+
+	// How long before startsAt a scheduled stream is starting soon
+	scheduleStartingSoonWindow = time.Minute * 15
+
+	// Ended schedules are kept this long so frontends can show that the stream happened
+	scheduleEndedRetention = time.Hour
+
+	scheduleCheckInterval = time.Second * 10
+)
+
+var ErrScheduleNoStart = errors.New("schedule has no start time")
+
+type Schedule struct {
+	StreamKey string `json:"streamKey"`
+	Title     string `json:"title"`
+	StartsAt  int64  `json:"startsAt"`
+	State     string `json:"state"`
+
+	// Unix times the publisher went live and stopped, 0 until they happen
+	LiveAt  int64 `json:"liveAt,omitempty"`
+	EndedAt int64 `json:"endedAt,omitempty"`
+
+	startingSoonSent bool
+}
+
+var (
+	schedules    = map[string]*Schedule{}
+	scheduleLock sync.Mutex
+)
+
+// state must be called with scheduleLock held
+func (sc *Schedule) state(now time.Time) string {
+	switch {
+	case sc.EndedAt != 0:
+		return ScheduleStateEnded
+	case sc.LiveAt != 0:
+		return ScheduleStateLive
+	case now.Add(scheduleStartingSoonWindow).Unix() >= sc.StartsAt:
+		return ScheduleStateStartingSoon
+	}
+
+	return ScheduleStateScheduled
+}
+
+// snapshot must be called with scheduleLock held
+func (sc *Schedule) snapshot() Schedule {
+	out := *sc
+	out.State = sc.state(time.Now())
+	return out
+}
+
+// SetSchedule announces an upcoming stream. It replaces the previous schedule
+// of the stream key, even one that is live
+func SetSchedule(streamKey, title string, startsAt int64) (Schedule, error) {
+	if startsAt == 0 {
+		return Schedule{}, ErrScheduleNoStart
+	}
+
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	sc := &Schedule{StreamKey: streamKey, Title: title, StartsAt: startsAt}
+	schedules[streamKey] = sc
+	saveState(schedulesStateKey, schedules)
+	emitEvent(webhook.EventStreamScheduled, streamKey, "")
+
+	return sc.snapshot(), nil
+}
+
+func GetSchedule(streamKey string) (Schedule, bool) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	sc, ok := schedules[streamKey]
+	if !ok {
+		return Schedule{}, false
+	}
+	return sc.snapshot(), true
+}
+
+// GetSchedules returns every schedule ordered by start time
+func GetSchedules() []Schedule {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	out := []Schedule{}
+	for _, sc := range schedules {
+		out = append(out, sc.snapshot())
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartsAt < out[j].StartsAt
+	})
+	return out
+}
+
+func DeleteSchedule(streamKey string) bool {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	_, ok := schedules[streamKey]
+	delete(schedules, streamKey)
+	saveState(schedulesStateKey, schedules)
+	return ok
+}
+
+// scheduleLive and scheduleEnded follow the publisher of a scheduled stream. A
+// publisher that rejoins after ending is live again
+func scheduleLive(streamKey string) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	if sc, ok := schedules[streamKey]; ok {
+		sc.LiveAt, sc.EndedAt = time.Now().Unix(), 0
+		saveState(schedulesStateKey, schedules)
+	}
+}
+
+func scheduleEnded(streamKey string) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	if sc, ok := schedules[streamKey]; ok && sc.LiveAt != 0 {
+		sc.EndedAt = time.Now().Unix()
+		saveState(schedulesStateKey, schedules)
+	}
+}
+
+// watchSchedules sends the starting soon event once per schedule and forgets
+// schedules that ended a while ago
+func watchSchedules() {
+	for now := range time.Tick(scheduleCheckInterval) {
+		scheduleLock.Lock()
+		forgotten := false
+		for streamKey, sc := range schedules {
+			switch sc.state(now) {
+			case ScheduleStateStartingSoon:
+				if !sc.startingSoonSent {
+					sc.startingSoonSent = true
+					emitEvent(webhook.EventStreamStartingSoon, streamKey, "")
+				}
+			case ScheduleStateEnded:
+				if now.Sub(time.Unix(sc.EndedAt, 0)) > scheduleEndedRetention {
+					delete(schedules, streamKey)
+					forgotten = true
+				}
+			}
+		}
+
+		if forgotten {
+			saveState(schedulesStateKey, schedules)
+		}
+		scheduleLock.Unlock()
+	}
+}
@@ -0,0 +1,176 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	senderReportInterval = time.Second
+
+	audioClockRate = 48000
+	videoClockRate = 90000
+)
+
+// senderReport is the NTP/RTP pair of the last Sender Report from the
+// publisher. WHEP sessions extrapolate from it so viewers sync audio and
+// video against the publisher's capture clock
+type senderReport struct {
+	ntpTime    uint64
+	rtpTime    uint32
+	receivedAt time.Time
+}
+
+// at returns the NTP and RTP time of the publisher's clock at now
+func (s *senderReport) at(now time.Time, clockRate uint32) (uint64, uint32) {
+	elapsed := now.Sub(s.receivedAt)
+	seconds, fraction := uint64(elapsed/time.Second), uint64(elapsed%time.Second)
+
+	ntpTime := s.ntpTime + seconds<<32 + fraction<<32/uint64(time.Second)
+	rtpTime := s.rtpTime + uint32(elapsed*time.Duration(clockRate)/time.Second)
+	return ntpTime, rtpTime
+}
+
+// newWHEPInterceptorRegistry has the default interceptors except the Sender
+// Report generator, writeSenderReports replaces it. The MediaEngine is already
+// configured by webrtc.RegisterDefaultInterceptors
+func newWHEPInterceptorRegistry() (*interceptor.Registry, error) {
+	interceptorRegistry := &interceptor.Registry{}
+
+	nackResponder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(nackResponder)
+
+	nackGenerator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(nackGenerator)
+
+	receiverReports, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(receiverReports)
+
+	twccSender, err := twcc.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(twccSender)
+
+	return interceptorRegistry, nil
+}
+
+// readSenderReports stores the Sender Reports the publisher sends for a track.
+// Reading RTCP also lets the interceptors process it
+func readSenderReports(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver, store func(*senderReport)) {
+	for {
+		var (
+			rtcpPackets []rtcp.Packet
+			err         error
+		)
+		if rid := remoteTrack.RID(); rid != "" {
+			rtcpPackets, _, err = rtpReceiver.ReadSimulcastRTCP(rid)
+		} else {
+			rtcpPackets, _, err = rtpReceiver.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+
+		for _, p := range rtcpPackets {
+			if sr, ok := p.(*rtcp.SenderReport); ok && sr.SSRC == uint32(remoteTrack.SSRC()) {
+				store(&senderReport{ntpTime: sr.NTPTime, rtpTime: sr.RTPTime, receivedAt: time.Now()})
+			}
+		}
+	}
+}
+
+// countAudioWritten counts a packet of the audio track for every connected
+// session, the track writes to all of them. Sender Reports carry what was sent
+// to the viewer, not what the publisher sent
+func (s *stream) countAudioWritten(payloadLen int) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for _, whepSession := range s.whepSessions {
+		if whepSession.peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			whepSession.audioPacketsWritten.Add(1)
+			whepSession.audioOctetsWritten.Add(uint64(payloadLen))
+		}
+	}
+}
+
+// writeSenderReports sends Sender Reports for the audio and rewritten video
+// track of a WHEP session until its PeerConnection is closed. WHEP
+// PeerConnections don't generate them with an interceptor because the
+// timestamps of the forwarded packets don't match the time they were sent
+func (w *whepSession) writeSenderReports(s *stream, audioSender, videoSender *webrtc.RTPSender) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		switch w.peerConnection.ConnectionState() {
+		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+			return
+		case webrtc.PeerConnectionStateConnected:
+		default:
+			continue
+		}
+
+		now := time.Now()
+		reports := []rtcp.Packet{}
+
+		if publisherReport := s.audioSenderReport.Load(); publisherReport != nil {
+			ntpTime, rtpTime := publisherReport.at(now, audioClockRate)
+
+			// Receiver Reports of voice rooms are for the audio track
+			if w.audioOnly {
+				w.lastSenderReportNTP.Store(uint32(ntpTime >> 16))
+				w.lastSenderReportAt.Store(now.UnixNano())
+			}
+			reports = append(reports, &rtcp.SenderReport{
+				SSRC:        uint32(audioSender.GetParameters().Encodings[0].SSRC),
+				NTPTime:     ntpTime,
+				RTPTime:     rtpTime,
+				PacketCount: uint32(w.audioPacketsWritten.Load()),
+				OctetCount:  uint32(w.audioOctetsWritten.Load()),
+			})
+		}
+
+		currentLayer, _ := w.currentLayer.Load().(string)
+		streamMapLock.Lock()
+		for _, videoTrack := range s.videoTracks {
+			if publisherReport := videoTrack.senderReport.Load(); !w.audioOnly && videoTrack.rid == currentLayer && publisherReport != nil {
+				ntpTime, rtpTime := publisherReport.at(now, videoClockRate)
+				w.lastSenderReportNTP.Store(uint32(ntpTime >> 16))
+				w.lastSenderReportAt.Store(now.UnixNano())
+				reports = append(reports, &rtcp.SenderReport{
+					SSRC:        uint32(videoSender.GetParameters().Encodings[0].SSRC),
+					NTPTime:     ntpTime,
+					RTPTime:     rtpTime + w.timestampOffset.Load(),
+					PacketCount: uint32(w.packetsWritten),
+					OctetCount:  uint32(w.octetsWritten),
+				})
+			}
+		}
+		streamMapLock.Unlock()
+
+		if len(reports) == 0 {
+			continue
+		}
+
+		if err := w.peerConnection.WriteRTCP(reports); err != nil {
+			w.logger.Println(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package webrtc
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// Encoder RIDs and the layer name they are published as
+	simulcastRIDMap map[string]string
+
+	// Layer names best first, layers that aren't listed come after them
+	simulcastLayerOrder []string
+
+	simulcastLayersLock sync.RWMutex
+)
+
+// ParseSimulcastRIDMap parses SIMULCAST_RID_MAP, `hi=high|mid=medium|lo=low`
+func ParseSimulcastRIDMap(val string) (map[string]string, error) {
+	ridMap := map[string]string{}
+	if val == "" {
+		return ridMap, nil
+	}
+
+	for _, entry := range strings.Split(val, "|") {
+		rid, layer, ok := strings.Cut(entry, "=")
+		if !ok || rid == "" || layer == "" {
+			return nil, fmt.Errorf("%q is not rid=layer", entry)
+		} else if _, ok = ridMap[rid]; ok {
+			return nil, fmt.Errorf("rid %q is mapped twice", rid)
+		}
+		ridMap[rid] = layer
+	}
+
+	return ridMap, nil
+}
+
+func configureSimulcastLayers() error {
+	ridMap, err := ParseSimulcastRIDMap(os.Getenv("SIMULCAST_RID_MAP"))
+	if err != nil {
+		return err
+	}
+
+	var order []string
+	if val := os.Getenv("SIMULCAST_LAYERS"); val != "" {
+		order = strings.Split(val, "|")
+	}
+
+	simulcastLayersLock.Lock()
+	defer simulcastLayersLock.Unlock()
+
+	simulcastRIDMap = ridMap
+	simulcastLayerOrder = order
+	return nil
+}
+
+// simulcastLayerName is the layer a RID the publisher sends is shown as
+func simulcastLayerName(rid string) string {
+	simulcastLayersLock.RLock()
+	defer simulcastLayersLock.RUnlock()
+
+	if layer, ok := simulcastRIDMap[rid]; ok {
+		return layer
+	}
+	return rid
+}
+
+// sortSimulcastLayers orders layers by SIMULCAST_LAYERS, the ones it doesn't
+// list keep the order they were published in
+func sortSimulcastLayers(layers []string) {
+	simulcastLayersLock.RLock()
+	defer simulcastLayersLock.RUnlock()
+
+	if len(simulcastLayerOrder) == 0 {
+		return
+	}
+
+	position := func(layer string) int {
+		for i, l := range simulcastLayerOrder {
+			if l == layer {
+				return i
+			}
+		}
+		return len(simulcastLayerOrder)
+	}
+
+	sort.SliceStable(layers, func(i, j int) bool {
+		return position(layers[i]) < position(layers[j])
+	})
+}
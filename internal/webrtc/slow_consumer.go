@@ -0,0 +1,197 @@
+package webrtc
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pion/rtcp"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+const (
+	slowConsumerPolicyDowngrade  = "downgrade"
+	slowConsumerPolicyDisconnect = "disconnect"
+
+	defaultSlowConsumerLossPercent = 10
+
+	// How many Receiver Reports in a row must be over the threshold
+	slowConsumerReportCount = 5
+
+	// How many Receiver Reports in a row must be under the threshold before a
+	// downgraded session is moved back up a layer
+	layerRecoveryReportCount = 10
+)
+
+var (
+	slowConsumerPolicy      string
+	slowConsumerLossPercent = defaultSlowConsumerLossPercent
+	slowConsumerConfigLock  sync.RWMutex
+)
+
+func configureSlowConsumer() error {
+	lossPercent := defaultSlowConsumerLossPercent
+	if val := os.Getenv("SLOW_CONSUMER_LOSS_PERCENT"); val != "" {
+		var err error
+		if lossPercent, err = strconv.Atoi(val); err != nil {
+			return err
+		}
+	}
+
+	slowConsumerConfigLock.Lock()
+	defer slowConsumerConfigLock.Unlock()
+
+	slowConsumerPolicy = os.Getenv("SLOW_CONSUMER_POLICY")
+	slowConsumerLossPercent = lossPercent
+	return nil
+}
+
+// handleReceptionReport tracks the loss a viewer reports for the video track.
+// A viewer that is over the threshold for multiple reports is marked slow and
+// the configured policy is applied once.
+func (w *whepSession) handleReceptionReport(s *stream, streamKey, whepSessionId string, report rtcp.ReceptionReport) {
+	ssrc := uint32(w.videoTrack.ssrc)
+	if w.audioOnly {
+		ssrc = uint32(w.audioSSRC)
+	}
+	if report.SSRC != ssrc {
+		return
+	}
+
+	slowConsumerConfigLock.RLock()
+	policy, threshold := slowConsumerPolicy, slowConsumerLossPercent
+	slowConsumerConfigLock.RUnlock()
+
+	lossPercent := int(report.FractionLost) * 100 / 256
+	w.packetLossPercent.Store(uint32(lossPercent))
+	w.jitter.Store(report.Jitter)
+	w.receptionReported.Store(true)
+	w.updateNetworkQuality(report)
+
+	if lossPercent < threshold {
+		w.slowReportCount = 0
+		w.isSlowConsumer.Store(false)
+
+		w.recoveredReportCount++
+		if policy != slowConsumerPolicyDowngrade {
+			return
+		}
+
+		if w.bandwidthProbeFinished() {
+			w.stopBandwidthProbe()
+			w.upgradeLayer(s)
+		} else if w.recoveredReportCount >= layerRecoveryReportCount && !w.isProbing() {
+			w.recoveredReportCount = 0
+			if !w.startBandwidthProbe(s) {
+				w.upgradeLayer(s)
+			}
+		}
+		return
+	}
+
+	// The viewer can't take the bitrate of the layer it was probing for
+	w.stopBandwidthProbe()
+	w.recoveredReportCount = 0
+	w.slowReportCount++
+	if w.slowReportCount%slowConsumerReportCount != 0 {
+		return
+	}
+
+	// Only report once, but keep downgrading while the loss continues
+	if w.slowReportCount == slowConsumerReportCount {
+		w.isSlowConsumer.Store(true)
+		emitEvent(webhook.EventViewerSlow, streamKey, whepSessionId)
+
+		if policy == slowConsumerPolicyDisconnect {
+			if err := w.peerConnection.Close(); err != nil {
+				w.logger.Println(err)
+			}
+		}
+	}
+
+	if policy == slowConsumerPolicyDowngrade {
+		w.downgradeLayer(s)
+	}
+}
+
+// downgradeLayer first drops the upper temporal layers of the current layer,
+// then moves the session to the layer with the next highest bitrate below the current one
+func (w *whepSession) downgradeLayer(s *stream) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	currentLayer, _ := w.currentLayer.Load().(string)
+
+	var current *videoTrack
+	for _, t := range s.videoTracks {
+		if t.rid == currentLayer {
+			current = t
+		}
+	}
+	if current == nil {
+		return
+	}
+
+	if w.maxTemporalLayerId.Load() == temporalLayerAll && current.maxTemporalLayerId.Load() > 0 {
+		w.downgradedFrom = append(w.downgradedFrom, layerSelection{rid: current.rid, maxTemporalLayerId: temporalLayerAll})
+		w.maxTemporalLayerId.Store(0)
+		return
+	}
+
+	// Layers are ranked by their current bitrate, a layer that was added late
+	// has received less in total without being lower
+	var (
+		lower        *videoTrack
+		lowerBitrate uint64
+	)
+	currentBitrate := s.videoBitrate(current.rid)
+	for _, t := range s.videoTracks {
+		if bitrate := s.videoBitrate(t.rid); bitrate != 0 && bitrate < currentBitrate && (lower == nil || bitrate > lowerBitrate) {
+			lower, lowerBitrate = t, bitrate
+		}
+	}
+	if lower == nil {
+		return
+	}
+
+	w.downgradedFrom = append(w.downgradedFrom, layerSelection{rid: current.rid, maxTemporalLayerId: w.maxTemporalLayerId.Load()})
+	w.currentLayer.Store(lower.rid)
+	w.maxTemporalLayerId.Store(temporalLayerAll)
+	select {
+	case s.pliChan <- true:
+	default:
+	}
+}
+
+// upgradeLayer moves a downgraded session back to the layer it was on before
+// its last downgrade
+func (w *whepSession) upgradeLayer(s *stream) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	if len(w.downgradedFrom) == 0 {
+		return
+	}
+
+	previous := w.downgradedFrom[len(w.downgradedFrom)-1]
+	w.downgradedFrom = w.downgradedFrom[:len(w.downgradedFrom)-1]
+	w.maxTemporalLayerId.Store(previous.maxTemporalLayerId)
+
+	currentLayer, _ := w.currentLayer.Load().(string)
+	if previous.rid == currentLayer {
+		return
+	}
+
+	// The publisher may have stopped sending the layer
+	for _, t := range s.videoTracks {
+		if t.rid == previous.rid {
+			w.currentLayer.Store(w.allowedLayer(s, previous.rid))
+			select {
+			case s.pliChan <- true:
+			default:
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package webrtc
+
+import (
+	"log"
+
+	"github.com/glimesh/broadcast-box/internal/store"
+)
+
+const (
+	roomPoliciesStateKey      = "roomPolicies"
+	playbackPasswordsStateKey = "playbackPasswords"
+	schedulesStateKey         = "schedules"
+	aliasesStateKey           = "aliases"
+)
+
+// RestoreState loads the room policies, playback passwords, schedules, aliases
+// and broadcast history saved before the last restart, and the viewer sessions
+// if they are kept in a database. It must be called after store.Configure
+func RestoreState() error {
+	recordingPolicyLock.Lock()
+	defer recordingPolicyLock.Unlock()
+	if err := store.Load(roomPoliciesStateKey, &roomPolicies); err != nil {
+		return err
+	}
+
+	playbackPasswordLock.Lock()
+	defer playbackPasswordLock.Unlock()
+	if err := store.Load(playbackPasswordsStateKey, &playbackPasswords); err != nil {
+		return err
+	}
+
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	if err := store.Load(schedulesStateKey, &schedules); err != nil {
+		return err
+	}
+
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+	if err := store.Load(aliasesStateKey, &aliases); err != nil {
+		return err
+	}
+
+	broadcastHistoryLock.Lock()
+	defer broadcastHistoryLock.Unlock()
+	if h, ok := store.History(); ok {
+		return restoreHistory(h)
+	}
+	return store.Load(broadcastHistoryStateKey, &broadcastHistory)
+}
+
+// restoreHistory loads the latest broadcasts and viewer sessions of the
+// database, oldest first. It must be called with broadcastHistoryLock held
+func restoreHistory(h store.HistoryBackend) error {
+	broadcasts, err := h.Broadcasts(store.HistoryFilter{Limit: broadcastHistoryLength})
+	if err != nil {
+		return err
+	}
+
+	sessions, err := h.ViewerSessions(store.HistoryFilter{Limit: viewerSessionHistoryLength})
+	if err != nil {
+		return err
+	}
+
+	broadcastHistory = make([]Broadcast, 0, len(broadcasts))
+	for i := len(broadcasts) - 1; i >= 0; i-- {
+		broadcastHistory = append(broadcastHistory, broadcasts[i])
+	}
+
+	viewerSessionHistory = make([]ViewerSession, 0, len(sessions))
+	for i := len(sessions) - 1; i >= 0; i-- {
+		viewerSessionHistory = append(viewerSessionHistory, sessions[i])
+	}
+	return nil
+}
+
+// saveState is called with the lock guarding v held, or a lock that orders
+// the saves of the key, so saves of the same key can't be reordered
+func saveState(key string, v any) {
+	if err := store.Save(key, v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"errors"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	viewerEventEnded = "ended"
+
+	// Why a publisher or viewer was disconnected. Viewers get it in the ended
+	// SSE event and webhooks carry it as reason
+	StreamEndedPublisherLeft         = "publisher_left"
+	StreamEndedPublisherDisconnected = "publisher_disconnected"
+	StreamEndedIngestPolicy          = "ingest_policy"
+	StreamEndedUploadQuota           = "upload_quota"
+	StreamEndedServerShutdown        = "server_shutdown"
+	StreamEndedMaintenance           = "maintenance"
+	StreamEndedSuspended             = "suspended"
+	StreamEndedKicked                = "kicked"
+	StreamEndedICEFailed             = "ice_failed"
+	StreamEndedViewerLeft            = "viewer_left"
+	StreamEndedAuthorizationExpired  = "authorization_expired"
+)
+
+var ErrNoPublisher = errors.New("stream has no publisher")
+
+// StreamEndedEvent tells viewers the publisher is gone and why. Sessions stay
+// open, so a publisher that comes back is picked up again
+type StreamEndedEvent struct {
+	Reason string `json:"reason"`
+}
+
+// WHIPDelete ends the WHIP session of a stream, for publishers that stop with
+// a DELETE instead of closing their PeerConnection
+func WHIPDelete(streamKey string) error {
+	return EndWHIP(streamKey, StreamEndedPublisherLeft)
+}
+
+// EndWHIP disconnects every publisher of a stream, viewers are sent reason
+func EndWHIP(streamKey, reason string) error {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok || len(stream.publishers) == 0 || stream.whipStartedEpochMs.Load() == 0 {
+		streamMapLock.Unlock()
+		return ErrNoPublisher
+	}
+
+	stream.endReason = reason
+	peerConnections := []*webrtc.PeerConnection{}
+	for peerConnection := range stream.publishers {
+		peerConnections = append(peerConnections, peerConnection)
+	}
+	streamMapLock.Unlock()
+
+	// Closing fires the ICE state callback, which takes streamMapLock
+	var err error
+	for _, peerConnection := range peerConnections {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// EndWHIPSession disconnects the publisher of the WHIP session with
+// whipSessionId, it must be publishing to streamKey
+func EndWHIPSession(streamKey, whipSessionId, reason string) error {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		streamMapLock.Unlock()
+		return ErrNoPublisher
+	}
+
+	var peerConnection *webrtc.PeerConnection
+	for p, publisher := range stream.publishers {
+		if publisher.whipSessionId == whipSessionId {
+			peerConnection = p
+		}
+	}
+	if peerConnection == nil {
+		streamMapLock.Unlock()
+		return ErrNoPublisher
+	} else if len(stream.publishers) == 1 {
+		// The stream only ends if this was its last publisher
+		stream.endReason = reason
+	}
+	streamMapLock.Unlock()
+
+	// Closing fires the ICE state callback, which takes streamMapLock
+	return peerConnection.Close()
+}
+
+// EndWHEP disconnects a viewer, its SSE connection is sent reason
+func EndWHEP(whepSessionId, reason string) error {
+	streamMapLock.Lock()
+	var session *whepSession
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		if w, ok := stream.whepSessions[whepSessionId]; ok {
+			session = w
+		}
+		stream.whepSessionsLock.RUnlock()
+	}
+	streamMapLock.Unlock()
+
+	if session == nil {
+		return ErrWHEPSessionNotFound
+	}
+
+	session.setEndReason(reason)
+	return session.peerConnection.Close()
+}
+
+// setEndReason keeps the first reason the session is ending for
+func (w *whepSession) setEndReason(reason string) {
+	w.endReason.CompareAndSwap("", reason)
+}
+
+// currentEndReason is why the viewer is leaving. Viewers that go away without
+// a reason left on their own
+func (w *whepSession) currentEndReason() string {
+	if reason, _ := w.endReason.Load().(string); reason != "" {
+		return reason
+	}
+	return StreamEndedViewerLeft
+}
+
+// currentEndReason is why the publisher is stopping. Publishers that go away
+// without a reason were disconnected. It must be called with streamMapLock held
+func (s *stream) currentEndReason() string {
+	if s.endReason == "" {
+		return StreamEndedPublisherDisconnected
+	}
+	return s.endReason
+}
+
+// endStream tells every viewer the publisher stopped and sends them an RTCP
+// BYE for the tracks they receive. It must be called with streamMapLock held
+func (s *stream) endStream() {
+	reason := s.currentEndReason()
+	s.endReason = ""
+
+	s.publishViewerEvent(viewerEventEnded, StreamEndedEvent{Reason: reason})
+
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+	for _, whepSession := range s.whepSessions {
+		if err := whepSession.peerConnection.WriteRTCP([]rtcp.Packet{
+			&rtcp.Goodbye{
+				Sources: []uint32{uint32(whepSession.audioSSRC), uint32(whepSession.videoTrack.ssrc)},
+				Reason:  reason,
+			},
+		}); err != nil {
+			whepSession.logger.Println(err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package webrtc
+
+import (
+	"errors"
+)
+
+const (
+	viewerEventStreamMetadata = "streamMetadata"
+
+	maxStreamMetadataLength = 1024
+)
+
+var ErrStreamMetadataTooLong = errors.New("stream metadata is too long")
+
+// StreamMetadata describes a live stream, it is set by the publisher and
+// kept until it is replaced
+type StreamMetadata struct {
+	Title       string `json:"title"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+}
+
+// SetStreamMetadata replaces the metadata of a live stream. Viewers are sent a
+// streamMetadata event if it changed
+func SetStreamMetadata(streamKey string, metadata StreamMetadata) (StreamMetadata, error) {
+	for _, val := range []string{metadata.Title, metadata.Category, metadata.Description} {
+		if len(val) > maxStreamMetadataLength {
+			return StreamMetadata{}, ErrStreamMetadataTooLong
+		}
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.whipStartedEpochMs.Load() == 0 {
+		return StreamMetadata{}, ErrStreamNotActive
+	}
+
+	if stream.metadata != metadata {
+		stream.metadata = metadata
+		stream.publishViewerEvent(viewerEventStreamMetadata, metadata)
+	}
+	return metadata, nil
+}
+
+// GetStreamMetadata returns the metadata of a live stream
+func GetStreamMetadata(streamKey string) (StreamMetadata, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.whipStartedEpochMs.Load() == 0 {
+		return StreamMetadata{}, ErrStreamNotActive
+	}
+	return stream.metadata, nil
+}
@@ -0,0 +1,57 @@
+package webrtc
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Track id viewers see for the system audio, the microphone is "audio"
+const systemAudioTrackId = "system-audio"
+
+// isSystemAudio reports if rtpReceiver isn't the first audio track of the
+// publisher. Browsers that share a screen or tab with audio send it next to
+// the microphone
+func isSystemAudio(peerConnection *webrtc.PeerConnection, rtpReceiver *webrtc.RTPReceiver) bool {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeAudio {
+			return transceiver.Receiver() != rtpReceiver
+		}
+	}
+
+	return false
+}
+
+// systemAudioWriter forwards the system audio. Unlike the microphone it isn't
+// recorded
+func systemAudioWriter(remoteTrack *webrtc.TrackRemote, stream *stream, logger *log.Logger) {
+	stream.hasSystemAudio.Store(true)
+	defer stream.hasSystemAudio.Store(false)
+
+	rtpBuf := make([]byte, 1500)
+	for {
+		rtpRead, _, err := remoteTrack.Read(rtpBuf)
+		switch {
+		case errors.Is(err, io.EOF):
+			return
+		case err != nil:
+			logger.Println(err)
+			return
+		}
+		nodeBytesReceived.Add(uint64(rtpRead))
+
+		if _, writeErr := stream.systemAudioTrack.Write(rtpBuf[:rtpRead]); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+			logger.Println(writeErr)
+			return
+		}
+		stream.countAudioSent(rtpRead)
+	}
+}
+
+// offersSystemAudio reports if a WHEP offer has room for the system audio
+func offersSystemAudio(offer string) bool {
+	return strings.Count(offer, "m=audio ") >= 2
+}
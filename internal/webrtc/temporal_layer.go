@@ -0,0 +1,67 @@
+package webrtc
+
+import (
+	"errors"
+
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	// Sessions with this max temporal layer receive every frame
+	temporalLayerAll = -1
+
+	// VP9 and AV1 carry the temporal layer in 3 bits
+	maxTemporalLayerId = 7
+
+	av1AggregationHeaderZ = 0b10000000
+	av1AggregationHeaderW = 0b00110000
+	av1OBUHeaderExtension = 0b00000100
+)
+
+var ErrInvalidTemporalLayer = errors.New("temporalLayerId must be between -1 and 7")
+
+// parseTemporalLayerId returns the temporal layer of a packet. H264 and
+// packets without layer information report false
+func parseTemporalLayerId(codec videoTrackCodec, payload []byte) (int32, bool) {
+	switch codec {
+	case videoTrackCodecVP8:
+		vp8Packet := codecs.VP8Packet{}
+		if _, err := vp8Packet.Unmarshal(payload); err != nil || vp8Packet.T != 1 {
+			return 0, false
+		}
+		return int32(vp8Packet.TID), true
+	case videoTrackCodecVP9:
+		vp9Packet := codecs.VP9Packet{}
+		if _, err := vp9Packet.Unmarshal(payload); err != nil || !vp9Packet.L {
+			return 0, false
+		}
+		return int32(vp9Packet.TID), true
+	case videoTrackCodecAV1:
+		return parseAV1TemporalLayerId(payload)
+	}
+
+	return 0, false
+}
+
+// parseAV1TemporalLayerId reads the extension header of the first OBU that
+// starts in the packet. Packets that continue an OBU carry no header
+func parseAV1TemporalLayerId(payload []byte) (int32, bool) {
+	if len(payload) < 2 || payload[0]&av1AggregationHeaderZ != 0 {
+		return 0, false
+	}
+
+	offset := 1
+	if payload[0]&av1AggregationHeaderW>>4 != 1 {
+		// Skip the leb128 length of the first OBU element
+		for offset < len(payload) && payload[offset]&0x80 != 0 {
+			offset++
+		}
+		offset++
+	}
+
+	if offset+1 >= len(payload) || payload[offset]&av1OBUHeaderExtension == 0 {
+		return 0, false
+	}
+
+	return int32(payload[offset+1] >> 5), true
+}
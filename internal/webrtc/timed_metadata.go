@@ -0,0 +1,39 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const viewerEventMetadata = "metadata"
+
+var ErrMetadataNoName = errors.New("metadata has no name")
+
+// TimedMetadata marks a point in a live stream, like an ad break, a chapter or
+// a score update. StreamTimeMs is how long the publisher had been live when it
+// was published, so players and recordings can line it up with the media
+type TimedMetadata struct {
+	Name         string          `json:"name"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+	StreamTimeMs int64           `json:"streamTimeMs"`
+}
+
+// PublishTimedMetadata sends metadata to every viewer of a live stream and
+// adds it to the sidecar of the active recording
+func PublishTimedMetadata(streamKey string, metadata TimedMetadata) (ViewerEvent, error) {
+	if metadata.Name == "" {
+		return ViewerEvent{}, ErrMetadataNoName
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok || stream.whipStartedEpochMs.Load() == 0 {
+		return ViewerEvent{}, ErrStreamNotActive
+	}
+
+	metadata.StreamTimeMs = time.Now().UnixMilli() - stream.whipStartedEpochMs.Load()
+	return stream.publishViewerEvent(viewerEventMetadata, metadata), nil
+}
@@ -0,0 +1,212 @@
+package webrtc
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrICERestartUnsupported = errors.New("ICE restarts are not supported")
+	ErrInvalidSDPFragment    = errors.New("SDP fragment has no candidates or ICE credentials")
+	ErrETagMismatch          = errors.New("If-Match doesn't match the ICE session")
+)
+
+// sdpAttribute returns the first a={name} of an SDP or SDP fragment, every
+// bundled media section shares the ICE credentials
+func sdpAttribute(sdp, name string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "a="+name+":") {
+			return strings.TrimPrefix(line, "a="+name+":")
+		}
+	}
+	return ""
+}
+
+// ICEETag identifies the ICE session of an SDP, it changes with every ICE restart
+func ICEETag(sdp string) string {
+	return `"` + sdpAttribute(sdp, "ice-ufrag") + `"`
+}
+
+// addTrickleCandidates adds the candidates of an RFC 8840 fragment PATCHed
+// to a session. Fragments with other ICE credentials than the offer ask for
+// an ICE restart and return ErrICERestartUnsupported
+func addTrickleCandidates(peerConnection *webrtc.PeerConnection, frag string) error {
+	remote := peerConnection.RemoteDescription()
+	if remote == nil {
+		return ErrInvalidSDPFragment
+	}
+
+	if ufrag := sdpAttribute(frag, "ice-ufrag"); ufrag != "" && ufrag != sdpAttribute(remote.SDP, "ice-ufrag") {
+		return ErrICERestartUnsupported
+	}
+
+	var (
+		mid        *string
+		candidates []webrtc.ICECandidateInit
+	)
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			val := strings.TrimPrefix(line, "a=mid:")
+			mid = &val
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+		}
+	}
+
+	if len(candidates) == 0 && !strings.Contains(frag, "a=end-of-candidates") {
+		return ErrInvalidSDPFragment
+	}
+
+	for _, candidate := range candidates {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddWHIPCandidates trickles the candidates of an SDP fragment to the WHIP
+// session with whipSessionId, it must be publishing to streamKey
+func AddWHIPCandidates(streamKey, whipSessionId, frag string) error {
+	streamMapLock.Lock()
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		streamMapLock.Unlock()
+		return ErrNoPublisher
+	}
+
+	var peerConnection *webrtc.PeerConnection
+	for p, publisher := range stream.publishers {
+		if publisher.whipSessionId == whipSessionId {
+			peerConnection = p
+		}
+	}
+	streamMapLock.Unlock()
+
+	if peerConnection == nil {
+		return ErrNoPublisher
+	}
+	return addTrickleCandidates(peerConnection, frag)
+}
+
+// PatchWHEP trickles the candidates of an SDP fragment to a WHEP session. A
+// fragment with new ICE credentials restarts ICE, the SDP fragment with the
+// new local credentials and candidates is returned for it. ifMatch is the
+// If-Match of the request, empty or * matches every ICE session
+func PatchWHEP(whepSessionId, frag, ifMatch string) (string, error) {
+	streamMapLock.Lock()
+	var (
+		session   *whepSession
+		relayOnly bool
+	)
+	for streamKey, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		if w, ok := stream.whepSessions[whepSessionId]; ok {
+			session, relayOnly = w, GetRoomPolicy(streamKey).RelayOnly
+		}
+		stream.whepSessionsLock.RUnlock()
+	}
+	streamMapLock.Unlock()
+
+	if session == nil {
+		return "", ErrWHEPSessionNotFound
+	}
+
+	peerConnection := session.peerConnection
+	remote, local := peerConnection.RemoteDescription(), peerConnection.LocalDescription()
+	if remote == nil || local == nil {
+		return "", ErrInvalidSDPFragment
+	} else if ifMatch != "" && ifMatch != "*" && ifMatch != ICEETag(local.SDP) {
+		return "", ErrETagMismatch
+	}
+
+	if relayOnly {
+		frag = stripNonRelayCandidates(frag)
+	}
+
+	ufrag, pwd := sdpAttribute(frag, "ice-ufrag"), sdpAttribute(frag, "ice-pwd")
+	if ufrag == "" || ufrag == sdpAttribute(remote.SDP, "ice-ufrag") {
+		return "", addTrickleCandidates(peerConnection, frag)
+	} else if pwd == "" {
+		return "", ErrInvalidSDPFragment
+	}
+
+	// The offer is renegotiated with the new credentials, which restarts ICE
+	// and gathers with new local credentials
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  replaceICECredentials(remote.SDP, ufrag, pwd),
+	}); err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatherComplete
+
+	if err = addTrickleCandidates(peerConnection, frag); err != nil && !errors.Is(err, ErrInvalidSDPFragment) {
+		return "", err
+	}
+
+	localSDP := peerConnection.LocalDescription().SDP
+	if relayOnly {
+		localSDP = stripNonRelayCandidates(localSDP)
+	}
+	return sdpFragment(localSDP), nil
+}
+
+// replaceICECredentials swaps the ICE credentials of an SDP and drops its
+// candidates, the fragment that restarts ICE brings new ones
+func replaceICECredentials(sdp, ufrag, pwd string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag + "\r\n"
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd + "\r\n"
+		case strings.HasPrefix(line, "a=candidate:"), strings.HasPrefix(line, "a=end-of-candidates"):
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "")
+}
+
+// sdpFragment is the RFC 8840 fragment with the ICE credentials and
+// candidates of the first media section of an SDP, the others are bundled on it
+func sdpFragment(sdp string) string {
+	frag := &strings.Builder{}
+	frag.WriteString("a=ice-ufrag:" + sdpAttribute(sdp, "ice-ufrag") + "\r\n")
+	frag.WriteString("a=ice-pwd:" + sdpAttribute(sdp, "ice-pwd") + "\r\n")
+
+	mediaSections := 0
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			if mediaSections++; mediaSections > 1 {
+				break
+			}
+		}
+
+		if mediaSections == 1 && (strings.HasPrefix(line, "m=") || strings.HasPrefix(line, "a=mid:") || strings.HasPrefix(line, "a=candidate:") || line == "a=end-of-candidates") {
+			frag.WriteString(line + "\r\n")
+		}
+	}
+	return frag.String()
+}
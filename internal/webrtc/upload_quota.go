@@ -0,0 +1,266 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webhook"
+)
+
+const (
+	viewerEventUploadQuota = "uploadQuota"
+
+	// Publishers are warned once when they used this much of a quota
+	uploadQuotaWarnPercent = 80
+
+	uploadQuotaHourly = "hourly"
+	uploadQuotaDaily  = "daily"
+
+	uploadQuotaScopeStream = "stream"
+	uploadQuotaScopeTenant = "tenant"
+)
+
+type (
+	// UploadQuotaEvent is sent to the viewers and publisher of a stream when
+	// it nears or goes over an upload quota
+	UploadQuotaEvent struct {
+		Type       string `json:"type"`
+		Scope      string `json:"scope"`
+		Window     string `json:"window"`
+		UsedBytes  uint64 `json:"usedBytes"`
+		LimitBytes uint64 `json:"limitBytes"`
+		Exceeded   bool   `json:"exceeded"`
+	}
+
+	// uploadUsage counts the bytes received in the current UTC hour and day
+	uploadUsage struct {
+		hour, day           int64
+		hourBytes, dayBytes uint64
+		hourWarned          bool
+		dayWarned           bool
+	}
+)
+
+var (
+	// Bytes a single stream key may upload, 0 is unlimited
+	uploadQuotaHourlyBytes, uploadQuotaDailyBytes uint64
+	uploadQuotaConfigLock                         sync.RWMutex
+
+	streamUploadUsage = map[string]*uploadUsage{}
+	tenantUploadUsage = map[string]*uploadUsage{}
+	uploadUsageLock   sync.Mutex
+
+	// Day the usage of earlier days was last deleted, guarded by uploadUsageLock
+	uploadUsagePrunedDay int64
+)
+
+func configureUploadQuota() error {
+	var (
+		hourly, daily uint64
+		err           error
+	)
+
+	if val := os.Getenv("UPLOAD_QUOTA_HOURLY"); val != "" {
+		if hourly, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	if val := os.Getenv("UPLOAD_QUOTA_DAILY"); val != "" {
+		if daily, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	uploadQuotaConfigLock.Lock()
+	defer uploadQuotaConfigLock.Unlock()
+
+	uploadQuotaHourlyBytes, uploadQuotaDailyBytes = hourly, daily
+	return nil
+}
+
+// roll starts new windows once the hour or day is over
+func (u *uploadUsage) roll(now time.Time) {
+	if hour := now.Unix() / 3600; hour != u.hour {
+		u.hour, u.hourBytes, u.hourWarned = hour, 0, false
+	}
+	if day := now.Unix() / 86400; day != u.day {
+		u.day, u.dayBytes, u.dayWarned = day, 0, false
+	}
+}
+
+// pruneUploadUsage deletes the usage of stream keys and tenants that uploaded
+// nothing today once a day, it would be reset by roll anyway. It must be
+// called with uploadUsageLock held
+func pruneUploadUsage(now time.Time) {
+	day := now.Unix() / 86400
+	if day == uploadUsagePrunedDay {
+		return
+	}
+	uploadUsagePrunedDay = day
+
+	for _, usages := range []map[string]*uploadUsage{streamUploadUsage, tenantUploadUsage} {
+		for key, usage := range usages {
+			if usage.day != day {
+				delete(usages, key)
+			}
+		}
+	}
+}
+
+// uploadQuotaUsage returns the usage of the stream key, and of its tenant if
+// the tenant has quotas, with their limits. It must be called with uploadUsageLock held
+func uploadQuotaUsage(streamKey string) (scopes []string, usages []*uploadUsage, limits [][2]uint64) {
+	uploadQuotaConfigLock.RLock()
+	hourly, daily := uploadQuotaHourlyBytes, uploadQuotaDailyBytes
+	uploadQuotaConfigLock.RUnlock()
+
+	pruneUploadUsage(time.Now())
+
+	if hourly != 0 || daily != 0 {
+		usage, ok := streamUploadUsage[streamKey]
+		if !ok {
+			usage = &uploadUsage{}
+			streamUploadUsage[streamKey] = usage
+		}
+		scopes, usages, limits = append(scopes, uploadQuotaScopeStream), append(usages, usage), append(limits, [2]uint64{hourly, daily})
+	}
+
+	if id, _, ok := strings.Cut(streamKey, tenant.Separator); ok {
+		if t, ok := tenant.ByID(id); ok && (t.MaxUploadBytesPerHour != 0 || t.MaxUploadBytesPerDay != 0) {
+			usage, ok := tenantUploadUsage[id]
+			if !ok {
+				usage = &uploadUsage{}
+				tenantUploadUsage[id] = usage
+			}
+			scopes, usages, limits = append(scopes, uploadQuotaScopeTenant), append(usages, usage), append(limits, [2]uint64{t.MaxUploadBytesPerHour, t.MaxUploadBytesPerDay})
+		}
+	}
+
+	return scopes, usages, limits
+}
+
+// UploadQuotaExceeded reports if the stream key, or its tenant, already used
+// up a quota in the current hour or day
+func UploadQuotaExceeded(streamKey string) bool {
+	uploadUsageLock.Lock()
+	defer uploadUsageLock.Unlock()
+
+	now := time.Now()
+	_, usages, limits := uploadQuotaUsage(streamKey)
+	for i, usage := range usages {
+		usage.roll(now)
+		if (limits[i][0] != 0 && usage.hourBytes >= limits[i][0]) || (limits[i][1] != 0 && usage.dayBytes >= limits[i][1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enforceUploadQuota counts the bytes of the sample against the quotas of
+// the stream key and its tenant. Publishers are warned near a quota and
+// disconnected over it. It must be called with streamMapLock held
+func (s *stream) enforceUploadQuota(streamKey string, sample BitrateSample) {
+	if s.whipPeerConnection == nil || s.whipStartedEpochMs.Load() == 0 || s.endReason == StreamEndedUploadQuota {
+		return
+	}
+
+	bitrate := sample.AudioBitrate
+	for _, videoBitrate := range sample.VideoBitrate {
+		bitrate += videoBitrate
+	}
+	bytes := bitrate / 8 * uint64(bitrateSampleInterval/time.Second)
+
+	uploadUsageLock.Lock()
+	now, events := time.Now(), []UploadQuotaEvent{}
+	scopes, usages, limits := uploadQuotaUsage(streamKey)
+	for i, usage := range usages {
+		usage.roll(now)
+		usage.hourBytes += bytes
+		usage.dayBytes += bytes
+
+		for _, w := range []struct {
+			window string
+			used   uint64
+			limit  uint64
+			warned *bool
+		}{
+			{uploadQuotaHourly, usage.hourBytes, limits[i][0], &usage.hourWarned},
+			{uploadQuotaDaily, usage.dayBytes, limits[i][1], &usage.dayWarned},
+		} {
+			if w.limit == 0 {
+				continue
+			}
+
+			exceeded := w.used >= w.limit
+			if !exceeded && (*w.warned || w.used < w.limit*uploadQuotaWarnPercent/100) {
+				continue
+			}
+			*w.warned = true
+
+			events = append(events, UploadQuotaEvent{
+				Type:       viewerEventUploadQuota,
+				Scope:      scopes[i],
+				Window:     w.window,
+				UsedBytes:  w.used,
+				LimitBytes: w.limit,
+				Exceeded:   exceeded,
+			})
+		}
+	}
+	uploadUsageLock.Unlock()
+
+	exceeded := false
+	for _, event := range events {
+		s.publishViewerEvent(viewerEventUploadQuota, event)
+		s.sendPublisherMessage(event)
+
+		if event.Exceeded {
+			exceeded = true
+		} else {
+			log.Printf("Publisher of %s used %d of %d bytes of its %s %s upload quota", streamKey, event.UsedBytes, event.LimitBytes, event.Scope, event.Window)
+			emitEvent(webhook.EventStreamUploadQuotaWarning, streamKey, "")
+		}
+	}
+
+	if !exceeded {
+		return
+	}
+
+	log.Printf("Publisher of %s is over its upload quota", streamKey)
+	emitEvent(webhook.EventStreamUploadQuotaExceeded, streamKey, "")
+	s.endReason = StreamEndedUploadQuota
+
+	// Closing fires the ICE state callback, which takes streamMapLock
+	go func(peerConnection *webrtc.PeerConnection) {
+		if err := peerConnection.Close(); err != nil {
+			log.Println(err)
+		}
+	}(s.whipPeerConnection)
+}
+
+// sendPublisherMessage must be called with streamMapLock held
+func (s *stream) sendPublisherMessage(message any) {
+	if s.whipStatsChannel == nil || s.whipStatsChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	msg, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err = s.whipStatsChannel.SendText(string(msg)); err != nil {
+		log.Println(err)
+	}
+}
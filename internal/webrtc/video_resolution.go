@@ -0,0 +1,239 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	h264NALUTypeSPS   = 7
+	h264NALUTypePPS   = 8
+	h264NALUTypeSTAPA = 24
+
+	vp8KeyframeStartCode = 0x9d012a
+)
+
+var errBitReaderEOF = errors.New("unexpected end of bitstream")
+
+// parseVideoHeight returns the height carried by H264 SPS and VP8 keyframe
+// packets. Everything else reports false
+func parseVideoHeight(codec videoTrackCodec, payload []byte) (int32, bool) {
+	switch codec {
+	case videoTrackCodecH264:
+		return parseH264Height(payload)
+	case videoTrackCodecVP8:
+		return parseVP8Height(payload)
+	}
+
+	return 0, false
+}
+
+func parseVP8Height(payload []byte) (int32, bool) {
+	vp8Packet := codecs.VP8Packet{}
+	if _, err := vp8Packet.Unmarshal(payload); err != nil || vp8Packet.S != 1 || vp8Packet.PID != 0 {
+		return 0, false
+	}
+
+	// A keyframe has a 3 byte frame tag with the lowest bit unset, then the start code
+	_, height, ok := parseVP8FrameResolution(vp8Packet.Payload)
+	return height, ok
+}
+
+// parseVP8FrameResolution reads the size of a VP8 keyframe, RFC 6386 9.1
+func parseVP8FrameResolution(frame []byte) (int32, int32, bool) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 {
+		return 0, 0, false
+	} else if uint32(frame[3])<<16|uint32(frame[4])<<8|uint32(frame[5]) != vp8KeyframeStartCode {
+		return 0, 0, false
+	}
+
+	return int32(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff), int32(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff), true
+}
+
+func parseH264Height(payload []byte) (int32, bool) {
+	if len(payload) < 1 {
+		return 0, false
+	}
+
+	switch payload[0] & 0x1f {
+	case h264NALUTypeSPS:
+		return parseH264SPSHeight(payload)
+	case h264NALUTypeSTAPA:
+		for offset := 1; offset+2 <= len(payload); {
+			naluSize := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if offset+naluSize > len(payload) || naluSize == 0 {
+				return 0, false
+			}
+
+			if payload[offset]&0x1f == h264NALUTypeSPS {
+				return parseH264SPSHeight(payload[offset : offset+naluSize])
+			}
+			offset += naluSize
+		}
+	}
+
+	return 0, false
+}
+
+func parseH264SPSHeight(nalu []byte) (int32, bool) {
+	_, height, ok := parseH264SPSResolution(nalu)
+	return height, ok
+}
+
+// parseH264SPSResolution reads the size in macroblocks and the frame cropping
+// of a sequence parameter set, ITU-T H.264 7.3.2.1.1
+func parseH264SPSResolution(nalu []byte) (int32, int32, bool) {
+	if len(nalu) < 4 {
+		return 0, 0, false
+	}
+
+	// Remove emulation prevention bytes
+	rbsp := make([]byte, 0, len(nalu))
+	for i := 1; i < len(nalu); i++ {
+		if i >= 3 && nalu[i] == 0x03 && nalu[i-1] == 0x00 && nalu[i-2] == 0x00 {
+			continue
+		}
+		rbsp = append(rbsp, nalu[i])
+	}
+
+	r := &bitReader{buf: rbsp}
+	profileIdc := r.bits(8)
+	r.bits(16) // constraint flags and level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIdc = r.ue(); chromaFormatIdc == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+
+		if r.bits(1) == 1 { // seq_scaling_matrix_present_flag
+			scalingLists := 8
+			if chromaFormatIdc == 3 {
+				scalingLists = 12
+			}
+
+			for i := 0; i < scalingLists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				lastScale, nextScale := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						nextScale = (lastScale + r.se() + 256) % 256
+					}
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for i := r.ue(); i > 0 && r.err == nil; i-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	picWidthInMbs := r.ue() + 1
+	picHeightInMapUnits := r.ue() + 1
+
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	cropLeft, cropRight, cropTop, cropBottom := uint32(0), uint32(0), uint32(0), uint32(0)
+	if r.bits(1) == 1 { // frame_cropping_flag
+		cropLeft = r.ue()
+		cropRight = r.ue()
+		cropTop = r.ue()
+		cropBottom = r.ue()
+	}
+
+	if r.err != nil {
+		return 0, 0, false
+	}
+
+	// Chroma subsampling of 4:2:0 and 4:2:2 crops in units of two pixels
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	if chromaFormatIdc == 1 || chromaFormatIdc == 2 {
+		cropUnitX = 2
+	}
+	if chromaFormatIdc == 1 {
+		cropUnitY *= 2
+	}
+
+	width := int32(picWidthInMbs*16) - int32((cropLeft+cropRight)*cropUnitX)
+	height := int32((2-frameMbsOnly)*picHeightInMapUnits*16) - int32((cropTop+cropBottom)*cropUnitY)
+	return width, height, width > 0 && height > 0
+}
+
+// bitReader reads Exp-Golomb coded values. After the first error every read returns 0
+type bitReader struct {
+	buf    []byte
+	offset int
+	err    error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		if r.offset >= len(r.buf)*8 {
+			r.err = errBitReaderEOF
+			return 0
+		}
+
+		v = v<<1 | uint32(r.buf[r.offset/8]>>(7-r.offset%8)&1)
+		r.offset++
+	}
+
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	leadingZeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || leadingZeros > 31 {
+			r.err = errBitReaderEOF
+			return 0
+		}
+		leadingZeros++
+	}
+
+	return (1 << leadingZeros) - 1 + r.bits(leadingZeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int32(v / 2)
+	}
+
+	return int32(v/2) + 1
+}
@@ -0,0 +1,160 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Publishers and players that want events pushed over WebRTC open a
+	// negotiated DataChannel with this label and id. Clients without an
+	// application section, like OBS, never open it
+	eventsChannelLabel = "broadcast-box"
+	eventsChannelId    = uint16(0)
+
+	// How many events are kept so SSE clients that reconnect can catch up
+	viewerEventHistoryLength = 50
+
+	// ViewerEventsVersion is the schema of ViewerEvent and its data. It is
+	// raised when an event changes in a way older clients can't handle
+	ViewerEventsVersion = 1
+)
+
+// ViewerEvent is pushed to every viewer of a stream on the SSE extension and
+// the WHEP DataChannel
+type ViewerEvent struct {
+	Version int    `json:"version"`
+	ID      uint64 `json:"id"`
+	Type    string `json:"type"`
+	EpochMs int64  `json:"epochMs"`
+	Data    any    `json:"data"`
+}
+
+// createEventsChannel must be called before the offer is applied so the
+// channel opens with the SCTP association
+func createEventsChannel(peerConnection *webrtc.PeerConnection) (*webrtc.DataChannel, error) {
+	negotiated, id := true, eventsChannelId
+	return peerConnection.CreateDataChannel(eventsChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+}
+
+// publishViewerEvent must be called with streamMapLock held
+func (s *stream) publishViewerEvent(eventType string, data any) ViewerEvent {
+	s.lastViewerEventId++
+	event := ViewerEvent{
+		Version: ViewerEventsVersion,
+		ID:      s.lastViewerEventId,
+		Type:    eventType,
+		EpochMs: time.Now().UnixMilli(),
+		Data:    data,
+	}
+
+	s.viewerEvents = append(s.viewerEvents, event)
+	if len(s.viewerEvents) > viewerEventHistoryLength {
+		s.viewerEvents = s.viewerEvents[len(s.viewerEvents)-viewerEventHistoryLength:]
+	}
+
+	close(s.viewerEventsChanged)
+	s.viewerEventsChanged = make(chan struct{})
+
+	if r := s.activeRecording.Load(); r != nil {
+		r.addEvent(event)
+	}
+
+	msg, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return event
+	}
+
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+	for _, whepSession := range s.whepSessions {
+		if whepSession.eventsChannel == nil || whepSession.eventsChannel.ReadyState() != webrtc.DataChannelStateOpen || !whepSession.acceptsEvent(eventType) {
+			continue
+		}
+
+		if err = whepSession.eventsChannel.SendText(string(msg)); err != nil {
+			whepSession.logger.Println(err)
+		}
+	}
+
+	return event
+}
+
+// WHEPViewerEvents returns the events of the stream a WHEP session is watching
+// that came after afterId, and a channel that is closed when the next one is
+// published or the stream ends
+func WHEPViewerEvents(whepSessionId string, afterId uint64) ([]ViewerEvent, <-chan struct{}, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		events := []ViewerEvent{}
+		for _, event := range stream.viewerEvents {
+			if event.ID > afterId && whepSession.acceptsEvent(event.Type) {
+				events = append(events, event)
+			}
+		}
+		return events, stream.viewerEventsChanged, nil
+	}
+
+	return nil, nil, ErrWHEPSessionNotFound
+}
+
+// RoomViewerEvents returns the events of the stream that came after afterId,
+// like WHEPViewerEvents for clients that aren't watching it
+func RoomViewerEvents(streamKey string, afterId uint64) ([]ViewerEvent, <-chan struct{}, error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	stream, ok := streamMap[streamKey]
+	if !ok {
+		return nil, nil, ErrStreamNotActive
+	}
+
+	events := []ViewerEvent{}
+	for _, event := range stream.viewerEvents {
+		if event.ID > afterId {
+			events = append(events, event)
+		}
+	}
+	return events, stream.viewerEventsChanged, nil
+}
+
+// acceptsEvent reports if the session negotiated events of eventType. ended
+// is always sent
+func (w *whepSession) acceptsEvent(eventType string) bool {
+	return w.eventTypes == nil || w.eventTypes[eventType] || eventType == viewerEventEnded
+}
+
+// WHEPAcceptsEvent reports if a WHEP session negotiated events of eventType
+func WHEPAcceptsEvent(whepSessionId, eventType string) bool {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for _, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			return whepSession.acceptsEvent(eventType)
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package webrtc
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/geoip"
+)
+
+var (
+	ErrViewerCountryBlocked = errors.New("stream can't be watched from this country")
+	ErrViewerSessionLimit   = errors.New("viewer has too many sessions for this stream")
+)
+
+// viewerToken identifies a viewer for MaxSessionsPerViewer by their IP. The
+// viewerId is chosen by the client, so a new one would bypass the limit
+func viewerToken(clientAddress string) string {
+	if host, _, err := net.SplitHostPort(clientAddress); err == nil {
+		return host
+	}
+	return clientAddress
+}
+
+// checkViewingPolicy enforces the viewing limits of the room for a new WHEP
+// session. Viewers whose country is unknown are never blocked. It must be
+// called with streamMapLock held
+func (s *stream) checkViewingPolicy(policy RoomPolicy, country, token string) error {
+	if country != geoip.Unknown {
+		for _, blockedCountry := range policy.BlockedCountries {
+			if strings.EqualFold(blockedCountry, country) {
+				return ErrViewerCountryBlocked
+			}
+		}
+	}
+
+	if policy.MaxSessionsPerViewer == 0 {
+		return nil
+	}
+
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	sessions := 0
+	for _, whepSession := range s.whepSessions {
+		if whepSession.viewerToken == token {
+			sessions++
+		}
+	}
+
+	if sessions >= policy.MaxSessionsPerViewer {
+		return ErrViewerSessionLimit
+	}
+	return nil
+}
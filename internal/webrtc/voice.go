@@ -0,0 +1,50 @@
+package webrtc
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// populateVoiceMediaEngine only registers Opus, video is rejected in the answer
+func populateVoiceMediaEngine(m *webrtc.MediaEngine) error {
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeOpus,
+			ClockRate:    48000,
+			Channels:     2,
+			SDPFmtpLine:  "minptime=10;useinbandfec=1;usedtx=1",
+			RTCPFeedback: nil,
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// enableOpusDTX adds usedtx=1 to the Opus parameters of an answer, asking
+// publishers to stop sending during silence. Pion answers with the parameters
+// of the offer, so this can't be done with the MediaEngine
+func enableOpusDTX(sdp string) string {
+	opusPayloadTypes := map[string]bool{}
+	lines := strings.Split(sdp, "\r\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+
+		if payloadType, codec, ok := strings.Cut(strings.TrimPrefix(line, "a=rtpmap:"), " "); ok && strings.HasPrefix(strings.ToLower(codec), "opus/") {
+			opusPayloadTypes[payloadType] = true
+		}
+	}
+
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "a=fmtp:") {
+			continue
+		}
+
+		if payloadType, params, _ := strings.Cut(strings.TrimPrefix(line, "a=fmtp:"), " "); opusPayloadTypes[payloadType] && !strings.Contains(params, "usedtx=") {
+			lines[i] = line + ";usedtx=1"
+		}
+	}
+
+	return strings.Join(lines, "\r\n")
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,6 +20,10 @@ import (
 	"github.com/pion/ice/v3"
 	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/eventlog"
+	"github.com/glimesh/broadcast-box/internal/geoip"
+	"github.com/glimesh/broadcast-box/internal/webhook"
 )
 
 const (
@@ -36,12 +41,61 @@ type (
 		// If stream was created by a WHEP request hasWHIPClient == false
 		hasWHIPClient atomic.Bool
 
+		whipICEConnectionState atomic.Value
+
+		// Guarded by streamMapLock
+		whipPeerConnection *webrtc.PeerConnection
+
+		// Every WHIP PeerConnection that hasn't disconnected, counted against
+		// RoomPolicy.MaxPublishers. Guarded by streamMapLock
+		publishers map[*webrtc.PeerConnection]*publisher
+
+		// Negotiated DataChannel the publisher receives its audience on, guarded by streamMapLock
+		whipStatsChannel *webrtc.DataChannel
+
+		// Negotiated DataChannel viewers' messages are relayed to, guarded by streamMapLock
+		whipRelayChannel *webrtc.DataChannel
+
+		// Bitrate samples in a row the publisher was over its ingest policy, guarded by streamMapLock
+		ingestViolationCount int
+
+		// Why the publisher is being disconnected, sent to viewers. Guarded by streamMapLock
+		endReason string
+
+		// Title and category the publisher set, guarded by streamMapLock
+		metadata StreamMetadata
+
 		firstSeenEpoch uint64
 
+		// Unix time in milliseconds the current WHIP session started, 0 if there is none
+		whipStartedEpochMs atomic.Int64
+
 		videoTracks []*videoTrack
 
+		// Layers that recently received packets and a channel closed when they
+		// change, both guarded by streamMapLock
+		activeLayers  []string
+		layersChanged chan struct{}
+
+		// Recent captions and metadata for viewers and a channel closed when
+		// one is published, guarded by streamMapLock
+		viewerEvents        []ViewerEvent
+		lastViewerEventId   uint64
+		viewerEventsChanged chan struct{}
+
 		audioTrack           *webrtc.TrackLocalStaticRTP
 		audioPacketsReceived atomic.Uint64
+		audioBytesReceived   atomic.Uint64
+		audioSenderReport    atomic.Pointer[senderReport]
+
+		// Audio of a shared screen or tab, sent as a second audio track.
+		// Viewers only receive it if they offer a second audio track
+		systemAudioTrack *webrtc.TrackLocalStaticRTP
+		hasSystemAudio   atomic.Bool
+
+		bitrateHistory bitrateHistory
+
+		activeRecording atomic.Pointer[recording]
 
 		pliChan chan any
 
@@ -50,11 +104,47 @@ type (
 
 		whepSessionsLock sync.RWMutex
 		whepSessions     map[string]*whepSession
+
+		// Total WHEP sessions by viewer location, guarded by whepSessionsLock
+		viewerCountries map[string]uint64
+		viewerASNs      map[string]uint64
+
+		// Watch time of WHEP sessions that have ended, guarded by whepSessionsLock
+		endedWatchDuration time.Duration
+
+		// Most concurrent WHEP sessions since the publisher connected, guarded by whepSessionsLock
+		peakViewerCount int
 	}
 
 	videoTrack struct {
-		rid             string
+		rid   string
+		codec atomic.Value
+		ssrc  atomic.Uint32
+
+		// Height of the last keyframe, 0 if the codec isn't parsed
+		height atomic.Int32
+
 		packetsReceived atomic.Uint64
+		bytesReceived   atomic.Uint64
+
+		// Gaps in the sequence numbers of the publisher
+		packetsLost atomic.Uint64
+
+		// UnixNano of the last keyframe and the time since the one before it
+		lastKeyframeReceived atomic.Int64
+		keyframeInterval     atomic.Int64
+
+		// UnixNano of the last packet, 0 if none arrived yet
+		lastPacketReceived atomic.Int64
+
+		senderReport atomic.Pointer[senderReport]
+
+		// Highest temporal layer seen, 0 if the layer isn't temporally scalable
+		maxTemporalLayerId atomic.Int32
+
+		// Packets/Bytes sent to WHEP sessions, counted once per session
+		packetsForwarded atomic.Uint64
+		bytesForwarded   atomic.Uint64
 	}
 
 	videoTrackCodec int
@@ -62,9 +152,16 @@ type (
 
 var (
 	streamMap        map[string]*stream
-	streamMapLock    sync.Mutex
+	streamMapLock    timedMutex
 	apiWhip, apiWhep *webrtc.API
 
+	// For rooms with RoomPolicy.AudioOnly
+	apiWhipVoice, apiWhepVoice *webrtc.API
+
+	// Closed once the pending IsHealthy attempt locked streamMapLock, nil if none is pending
+	healthCheck     chan struct{}
+	healthCheckLock sync.Mutex
+
 	// nolint
 	videoRTCPFeedback = []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
 )
@@ -93,12 +190,23 @@ func getStream(streamKey string, forWHIP bool) (*stream, error) {
 			return nil, err
 		}
 
+		systemAudioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, systemAudioTrackId, "pion")
+		if err != nil {
+			return nil, err
+		}
+
 		whipActiveContext, whipActiveContextCancel := context.WithCancel(context.Background())
 
 		foundStream = &stream{
 			audioTrack:              audioTrack,
+			systemAudioTrack:        systemAudioTrack,
 			pliChan:                 make(chan any, 50),
+			layersChanged:           make(chan struct{}),
+			viewerEventsChanged:     make(chan struct{}),
 			whepSessions:            map[string]*whepSession{},
+			publishers:              map[*webrtc.PeerConnection]*publisher{},
+			viewerCountries:         map[string]uint64{},
+			viewerASNs:              map[string]uint64{},
 			whipActiveContext:       whipActiveContext,
 			whipActiveContextCancel: whipActiveContextCancel,
 			firstSeenEpoch:          uint64(time.Now().Unix()),
@@ -113,6 +221,27 @@ func getStream(streamKey string, forWHIP bool) (*stream, error) {
 	return foundStream, nil
 }
 
+// Fan out lifecycle events to the configured webhooks and event log sinks
+func emitEvent(eventType, streamKey, whepSessionId string) {
+	emitReasonEvent(eventType, streamKey, whepSessionId, "")
+}
+
+// emitReasonEvent is emitEvent for sessions that ended, with why they did
+func emitReasonEvent(eventType, streamKey, whepSessionId, reason string) {
+	webhook.Send(eventType, streamKey, whepSessionId, reason)
+	eventlog.Write(eventType, streamKey, whepSessionId, reason)
+}
+
+// uptimeSeconds is how long the current WHIP session has been publishing
+func (s *stream) uptimeSeconds() int64 {
+	startedEpochMs := s.whipStartedEpochMs.Load()
+	if startedEpochMs == 0 {
+		return 0
+	}
+
+	return (time.Now().UnixMilli() - startedEpochMs) / 1000
+}
+
 func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
@@ -125,16 +254,53 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	if whepSessionId != "" {
 		stream.whepSessionsLock.Lock()
 		defer stream.whepSessionsLock.Unlock()
+		reason := StreamEndedViewerLeft
+		if whepSession, ok := stream.whepSessions[whepSessionId]; ok {
+			reason = whepSession.currentEndReason()
+			stream.endedWatchDuration += time.Since(whepSession.startedAt)
+			recordViewerSession(streamKey, whepSessionId, whepSession)
+			whepSession.endNetworkQuality()
+		}
 		delete(stream.whepSessions, whepSessionId)
+		if r := stream.activeRecording.Load(); r != nil {
+			r.participantLeft(recordingParticipantViewer, whepSessionId)
+		}
+		emitReasonEvent(webhook.EventViewerLeft, streamKey, whepSessionId, reason)
 
 		// Only delete stream if all WHEP Sessions are gone and have no WHIP Client
 		if len(stream.whepSessions) != 0 || stream.hasWHIPClient.Load() {
 			return
 		}
+	} else {
+		// The stream goes on while another publisher is still connected
+		if len(stream.publishers) != 0 {
+			return
+		}
+
+		reason := stream.currentEndReason()
+		stream.recordBroadcast(streamKey)
+		stream.whipStartedEpochMs.Store(0)
+		stopRecordingOnUnpublish(stream, streamKey)
+		scheduleEnded(streamKey)
+		stream.endStream()
+		emitReasonEvent(webhook.EventStreamStopped, streamKey, "", reason)
+
+		// Viewers that were told the stream ended wait for the publisher to
+		// come back, the room closes once the last of them leaves
+		stream.hasWHIPClient.Store(false)
+		stream.whepSessionsLock.RLock()
+		viewerCount := len(stream.whepSessions)
+		stream.whepSessionsLock.RUnlock()
+		if viewerCount != 0 {
+			return
+		}
 	}
 
 	stream.whipActiveContextCancel()
+	close(stream.layersChanged)
+	close(stream.viewerEventsChanged)
 	delete(streamMap, streamKey)
+	emitEvent(webhook.EventRoomClosed, streamKey, "")
 }
 
 func addTrack(stream *stream, rid string) (*videoTrack, error) {
@@ -148,6 +314,7 @@ func addTrack(stream *stream, rid string) (*videoTrack, error) {
 	}
 
 	t := &videoTrack{rid: rid}
+	t.codec.Store("")
 	stream.videoTracks = append(stream.videoTracks, t)
 	return t, nil
 }
@@ -325,22 +492,52 @@ func PopulateMediaEngine(m *webrtc.MediaEngine) error {
 	return nil
 }
 
-func newPeerConnection(api *webrtc.API) (*webrtc.PeerConnection, error) {
+// newPeerConnection only gathers relay candidates through TURN_SERVERS if relayOnly is set
+func newPeerConnection(api *webrtc.API, relayOnly bool) (*webrtc.PeerConnection, error) {
 	cfg := webrtc.Configuration{}
-
-	if stunServers := os.Getenv("STUN_SERVERS"); stunServers != "" {
-		for _, stunServer := range strings.Split(stunServers, "|") {
-			cfg.ICEServers = append(cfg.ICEServers, webrtc.ICEServer{
-				URLs: []string{"stun:" + stunServer},
-			})
+	if relayOnly {
+		if cfg.ICEServers = TURNServers(); len(cfg.ICEServers) == 0 {
+			return nil, ErrNoTURNServers
 		}
+		cfg.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+		return api.NewPeerConnection(cfg)
 	}
 
+	cfg.ICEServers = stunServers()
 	return api.NewPeerConnection(cfg)
 }
 
 func Configure() {
 	streamMap = map[string]*stream{}
+	if err := configureSlowConsumer(); err != nil {
+		log.Fatal(err)
+	} else if err := configureRecordingPolicy(); err != nil {
+		log.Fatal(err)
+	} else if err := configureRecordingHook(); err != nil {
+		log.Fatal(err)
+	} else if err := configureRecordingRetention(); err != nil {
+		log.Fatal(err)
+	} else if err := configureRecordingSegments(); err != nil {
+		log.Fatal(err)
+	} else if err := configureIngestPolicy(); err != nil {
+		log.Fatal(err)
+	} else if err := configureKeyframeInterval(); err != nil {
+		log.Fatal(err)
+	} else if err := configureSimulcastLayers(); err != nil {
+		log.Fatal(err)
+	} else if err := configureNode(); err != nil {
+		log.Fatal(err)
+	} else if err := configureUploadQuota(); err != nil {
+		log.Fatal(err)
+	}
+	configureICEServers()
+	configureBandwidthProbing()
+	go sampleBitrates()
+	go watchLayerAvailability()
+	go watchSchedules()
+	go watchMaintenance()
+	go sampleNode()
+	go runRecordingJanitor()
 
 	mediaEngine := &webrtc.MediaEngine{}
 	if err := PopulateMediaEngine(mediaEngine); err != nil {
@@ -352,6 +549,11 @@ func Configure() {
 		log.Fatal(err)
 	}
 
+	whepInterceptorRegistry, err := newWHEPInterceptorRegistry()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	udpMuxCache := map[int]*ice.MultiUDPMuxDefault{}
 	tcpMuxCache := map[string]ice.TCPMux{}
 
@@ -363,22 +565,204 @@ func Configure() {
 
 	apiWhep = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithInterceptorRegistry(whepInterceptorRegistry),
+		webrtc.WithSettingEngine(createSettingEngine(false, udpMuxCache, tcpMuxCache)),
+	)
+
+	voiceMediaEngine := &webrtc.MediaEngine{}
+	if err := populateVoiceMediaEngine(voiceMediaEngine); err != nil {
+		panic(err)
+	}
+
+	voiceInterceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(voiceMediaEngine, voiceInterceptorRegistry); err != nil {
+		log.Fatal(err)
+	}
+
+	apiWhipVoice = webrtc.NewAPI(
+		webrtc.WithMediaEngine(voiceMediaEngine),
+		webrtc.WithInterceptorRegistry(voiceInterceptorRegistry),
+		webrtc.WithSettingEngine(createSettingEngine(true, udpMuxCache, tcpMuxCache)),
+	)
+
+	apiWhepVoice = webrtc.NewAPI(
+		webrtc.WithMediaEngine(voiceMediaEngine),
+		webrtc.WithInterceptorRegistry(whepInterceptorRegistry),
 		webrtc.WithSettingEngine(createSettingEngine(false, udpMuxCache, tcpMuxCache)),
 	)
 }
 
+// IsHealthy reports if the stream state can be locked within timeout. A
+// wedged media path holds streamMapLock indefinitely. Checks that overlap wait
+// on the same attempt, so a wedged lock only ever has one goroutine waiting on it
+func IsHealthy(timeout time.Duration) bool {
+	healthCheckLock.Lock()
+	locked := healthCheck
+	if locked == nil {
+		locked = make(chan struct{})
+		healthCheck = locked
+
+		go func() {
+			streamMapLock.Lock()
+			streamMapLock.Unlock() //nolint
+
+			healthCheckLock.Lock()
+			healthCheck = nil
+			healthCheckLock.Unlock()
+			close(locked)
+		}()
+	}
+	healthCheckLock.Unlock()
+
+	select {
+	case <-locked:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// SessionCount is the number of connected publishers and viewers
+func SessionCount() int {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	count := 0
+	for _, s := range streamMap {
+		if s.whipPeerConnection != nil && s.whipStartedEpochMs.Load() != 0 {
+			count++
+		}
+
+		s.whepSessionsLock.RLock()
+		count += len(s.whepSessions)
+		s.whepSessionsLock.RUnlock()
+	}
+
+	return count
+}
+
+// IsLive reports if a publisher is connected to streamKey
+func IsLive(streamKey string) bool {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	s, ok := streamMap[streamKey]
+	return ok && s.whipStartedEpochMs.Load() != 0
+}
+
+// Reload re-reads the settings that can change without restarting PeerConnections
+func Reload() error {
+	if err := configureSlowConsumer(); err != nil {
+		return err
+	}
+
+	if err := configureRecordingPolicy(); err != nil {
+		return err
+	}
+
+	if err := configureRecordingHook(); err != nil {
+		return err
+	}
+
+	if err := configureRecordingRetention(); err != nil {
+		return err
+	}
+
+	if err := configureRecordingSegments(); err != nil {
+		return err
+	}
+
+	if err := configureIngestPolicy(); err != nil {
+		return err
+	}
+
+	if err := configureKeyframeInterval(); err != nil {
+		return err
+	}
+
+	if err := configureSimulcastLayers(); err != nil {
+		return err
+	}
+
+	if err := configureNode(); err != nil {
+		return err
+	}
+
+	if err := configureUploadQuota(); err != nil {
+		return err
+	}
+
+	configureBandwidthProbing()
+	configureICEServers()
+	return nil
+}
+
+// Shutdown finishes every recording and closes every WHIP and WHEP PeerConnection. Callers should stop
+// accepting new signaling requests first
+func Shutdown() {
+	peerConnections := []*webrtc.PeerConnection{}
+
+	streamMapLock.Lock()
+	for _, s := range streamMap {
+		if len(s.publishers) != 0 {
+			s.endReason = StreamEndedServerShutdown
+		}
+		for peerConnection := range s.publishers {
+			peerConnections = append(peerConnections, peerConnection)
+		}
+
+		s.whepSessionsLock.RLock()
+		for _, w := range s.whepSessions {
+			w.setEndReason(StreamEndedServerShutdown)
+			peerConnections = append(peerConnections, w.peerConnection)
+		}
+		s.whepSessionsLock.RUnlock()
+	}
+	streamMapLock.Unlock()
+
+	recordingsLock.Lock()
+	for _, r := range recordings {
+		r.stop()
+	}
+	recordingsLock.Unlock()
+
+	for _, p := range peerConnections {
+		if err := p.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 type StreamStatusVideo struct {
-	RID             string `json:"rid"`
-	PacketsReceived uint64 `json:"packetsReceived"`
+	RID              string `json:"rid"`
+	Codec            string `json:"codec"`
+	PacketsReceived  uint64 `json:"packetsReceived"`
+	BytesReceived    uint64 `json:"bytesReceived"`
+	PacketsForwarded uint64 `json:"packetsForwarded"`
+	BytesForwarded   uint64 `json:"bytesForwarded"`
+	Viewers          int    `json:"viewers"`
+	TemporalLayers   int32  `json:"temporalLayers"`
+	Height           int32  `json:"height,omitempty"`
 }
 
 type StreamStatus struct {
 	StreamKey            string              `json:"streamKey"`
+	IsStreaming          bool                `json:"isStreaming"`
+	ViewerCount          int                 `json:"viewerCount"`
 	FirstSeenEpoch       uint64              `json:"firstSeenEpoch"`
+	UptimeSeconds        int64               `json:"uptimeSeconds"`
+	WatchHours           float64             `json:"watchHours"`
 	AudioPacketsReceived uint64              `json:"audioPacketsReceived"`
 	VideoStreams         []StreamStatusVideo `json:"videoStreams"`
 	WHEPSessions         []whepSessionStatus `json:"whepSessions"`
+	ViewerCountries      map[string]uint64   `json:"viewerCountries,omitempty"`
+	ViewerASNs           map[string]uint64   `json:"viewerASNs,omitempty"`
+	Schedule             *Schedule           `json:"schedule,omitempty"`
+	Metadata             StreamMetadata      `json:"metadata"`
+	PasswordProtected    bool                `json:"passwordProtected"`
+	SystemAudio          bool                `json:"systemAudio"`
+	PublisherCount       int                 `json:"publisherCount"`
+	Maintenance          *Maintenance        `json:"maintenance,omitempty"`
 }
 
 type whepSessionStatus struct {
@@ -387,6 +771,120 @@ type whepSessionStatus struct {
 	SequenceNumber uint16 `json:"sequenceNumber"`
 	Timestamp      uint32 `json:"timestamp"`
 	PacketsWritten uint64 `json:"packetsWritten"`
+	Country        string `json:"country,omitempty"`
+	ASN            string `json:"asn,omitempty"`
+	SlowConsumer   bool   `json:"slowConsumer"`
+
+	// From the last Receiver Report of the viewer, nil until one arrives
+	PacketLossPercent *uint32  `json:"packetLossPercent,omitempty"`
+	JitterMs          *float64 `json:"jitterMs,omitempty"`
+
+	// Score from 1 to 5, 0 until the first Receiver Report
+	NetworkQuality int `json:"networkQuality"`
+
+	MaxTemporalLayerId int32 `json:"maxTemporalLayerId"`
+
+	WatchDurationSeconds int64 `json:"watchDurationSeconds"`
+}
+
+// status must be called with streamMapLock held
+func (s *stream) status(streamKey string) StreamStatus {
+	whepSessions := []whepSessionStatus{}
+	viewersByLayer := map[string]int{}
+	s.whepSessionsLock.Lock()
+	watchDuration := s.endedWatchDuration
+	for id, whepSession := range s.whepSessions {
+		currentLayer, ok := whepSession.currentLayer.Load().(string)
+		if !ok {
+			continue
+		}
+		viewersByLayer[currentLayer]++
+		watchDuration += time.Since(whepSession.startedAt)
+
+		var packetLossPercent *uint32
+		var jitterMs *float64
+		if whepSession.receptionReported.Load() {
+			loss, jitter := whepSession.packetLossPercent.Load(), whepSession.jitterMs()
+			packetLossPercent, jitterMs = &loss, &jitter
+		}
+
+		var networkQuality int
+		if quality := whepSession.networkQuality.Load(); quality != nil {
+			networkQuality = quality.Score
+		}
+
+		whepSessions = append(whepSessions, whepSessionStatus{
+			ID:             id,
+			CurrentLayer:   currentLayer,
+			SequenceNumber: whepSession.sequenceNumber,
+			Timestamp:      whepSession.timestamp,
+			PacketsWritten: whepSession.packetsWritten,
+			Country:        whepSession.country,
+			ASN:            whepSession.asn,
+			SlowConsumer:   whepSession.isSlowConsumer.Load(),
+
+			PacketLossPercent: packetLossPercent,
+			JitterMs:          jitterMs,
+			NetworkQuality:    networkQuality,
+
+			MaxTemporalLayerId: whepSession.maxTemporalLayerId.Load(),
+
+			WatchDurationSeconds: int64(time.Since(whepSession.startedAt).Seconds()),
+		})
+	}
+
+	var viewerCountries, viewerASNs map[string]uint64
+	if geoip.Enabled() {
+		viewerCountries, viewerASNs = map[string]uint64{}, map[string]uint64{}
+		for country, count := range s.viewerCountries {
+			viewerCountries[country] = count
+		}
+		for asn, count := range s.viewerASNs {
+			viewerASNs[asn] = count
+		}
+	}
+	s.whepSessionsLock.Unlock()
+
+	streamStatusVideo := []StreamStatusVideo{}
+	for _, videoTrack := range s.videoTracks {
+		codec, _ := videoTrack.codec.Load().(string)
+		streamStatusVideo = append(streamStatusVideo, StreamStatusVideo{
+			RID:              videoTrack.rid,
+			Codec:            codec,
+			PacketsReceived:  videoTrack.packetsReceived.Load(),
+			BytesReceived:    videoTrack.bytesReceived.Load(),
+			PacketsForwarded: videoTrack.packetsForwarded.Load(),
+			BytesForwarded:   videoTrack.bytesForwarded.Load(),
+			Viewers:          viewersByLayer[videoTrack.rid],
+			TemporalLayers:   videoTrack.maxTemporalLayerId.Load() + 1,
+			Height:           videoTrack.height.Load(),
+		})
+	}
+
+	var schedule *Schedule
+	if sc, ok := GetSchedule(streamKey); ok {
+		schedule = &sc
+	}
+
+	return StreamStatus{
+		StreamKey:            streamKey,
+		IsStreaming:          s.whipStartedEpochMs.Load() != 0,
+		ViewerCount:          len(whepSessions),
+		FirstSeenEpoch:       s.firstSeenEpoch,
+		UptimeSeconds:        s.uptimeSeconds(),
+		WatchHours:           watchDuration.Hours(),
+		AudioPacketsReceived: s.audioPacketsReceived.Load(),
+		VideoStreams:         streamStatusVideo,
+		WHEPSessions:         whepSessions,
+		ViewerCountries:      viewerCountries,
+		ViewerASNs:           viewerASNs,
+		Schedule:             schedule,
+		Metadata:             s.metadata,
+		PasswordProtected:    HasPlaybackPassword(streamKey),
+		SystemAudio:          s.hasSystemAudio.Load(),
+		PublisherCount:       len(s.publishers),
+		Maintenance:          GetMaintenance(),
+	}
 }
 
 func GetStreamStatuses() []StreamStatus {
@@ -396,40 +894,29 @@ func GetStreamStatuses() []StreamStatus {
 	out := []StreamStatus{}
 
 	for streamKey, stream := range streamMap {
-		whepSessions := []whepSessionStatus{}
-		stream.whepSessionsLock.Lock()
-		for id, whepSession := range stream.whepSessions {
-			currentLayer, ok := whepSession.currentLayer.Load().(string)
-			if !ok {
-				continue
-			}
+		out = append(out, stream.status(streamKey))
+	}
 
-			whepSessions = append(whepSessions, whepSessionStatus{
-				ID:             id,
-				CurrentLayer:   currentLayer,
-				SequenceNumber: whepSession.sequenceNumber,
-				Timestamp:      whepSession.timestamp,
-				PacketsWritten: whepSession.packetsWritten,
-			})
-		}
-		stream.whepSessionsLock.Unlock()
-
-		streamStatusVideo := []StreamStatusVideo{}
-		for _, videoTrack := range stream.videoTracks {
-			streamStatusVideo = append(streamStatusVideo, StreamStatusVideo{
-				RID:             videoTrack.rid,
-				PacketsReceived: videoTrack.packetsReceived.Load(),
-			})
+	// Scheduled streams are listed before anyone connects to them
+	for _, schedule := range GetSchedules() {
+		if _, ok := streamMap[schedule.StreamKey]; ok {
+			continue
 		}
 
+		schedule := schedule
 		out = append(out, StreamStatus{
-			StreamKey:            streamKey,
-			FirstSeenEpoch:       stream.firstSeenEpoch,
-			AudioPacketsReceived: stream.audioPacketsReceived.Load(),
-			VideoStreams:         streamStatusVideo,
-			WHEPSessions:         whepSessions,
+			StreamKey:         schedule.StreamKey,
+			VideoStreams:      []StreamStatusVideo{},
+			WHEPSessions:      []whepSessionStatus{},
+			Schedule:          &schedule,
+			PasswordProtected: HasPlaybackPassword(schedule.StreamKey),
+			Maintenance:       GetMaintenance(),
 		})
 	}
 
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StreamKey < out[j].StreamKey
+	})
+
 	return out
 }
@@ -1,32 +1,159 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"io"
 	"log"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/geoip"
+	"github.com/glimesh/broadcast-box/internal/requestid"
+	"github.com/glimesh/broadcast-box/internal/webhook"
 )
 
 type (
 	whepSession struct {
 		videoTrack     *trackMultiCodec
+		audioSSRC      webrtc.SSRC
 		currentLayer   atomic.Value
 		sequenceNumber uint16
 		timestamp      uint32
 		packetsWritten uint64
+		octetsWritten  uint64
+
+		// Audio packets and payload octets the audio track wrote to this session
+		audioPacketsWritten atomic.Uint64
+		audioOctetsWritten  atomic.Uint64
+
+		// Guards the rewriting state, every layer's videoWriter calls sendVideoPacket
+		packetLock sync.Mutex
+
+		// The layer being forwarded trails currentLayer until the new layer
+		// sends a keyframe. Guarded by packetLock
+		forwardingLayer string
+		switchStartedAt time.Time
+		lastWrittenAt   time.Time
+
+		// Rewritten minus the publisher's timestamp of the current layer
+		timestampOffset atomic.Uint32
+
+		country, asn string
+
+		// Optional id the client sends to keep its layer selection across reconnects
+		viewerId string
+
+		// Sessions of voice rooms have no video track
+		audioOnly bool
+
+		// IP of the client, counted against MaxSessionsPerViewer
+		viewerToken string
+
+		// Best layer the session may watch, empty allows every layer
+		maxLayer string
+
+		// Event types the client negotiated, nil if it handles every event
+		eventTypes map[string]bool
+
+		iceConnectionState atomic.Value
+		peerConnection     *webrtc.PeerConnection
+
+		// Negotiated DataChannel captions and metadata are pushed on
+		eventsChannel *webrtc.DataChannel
+
+		// Negotiated DataChannel messages of the publisher are relayed on
+		relayChannel *webrtc.DataChannel
+
+		// From the last Receiver Report for the video track, packetLossPercent
+		// is only meaningful once receptionReported is set
+		receptionReported atomic.Bool
+		packetLossPercent atomic.Uint32
+		jitter            atomic.Uint32
+
+		// The middle 32 bits of the NTP time and UnixNano the last Sender
+		// Report was sent at, Receiver Reports refer to it to measure the round trip
+		lastSenderReportNTP atomic.Uint32
+		lastSenderReportAt  atomic.Int64
+
+		// -1 until it is measured
+		roundTripTimeMs atomic.Int64
+
+		// Guards networkQualityChanged, which is closed every time the score
+		// changes and once the session ended
+		networkQualityLock    sync.Mutex
+		networkQuality        atomic.Pointer[NetworkQuality]
+		networkQualityChanged chan struct{}
+		ended                 bool
+
+		// Why the session is ending, empty if the viewer left on its own
+		endReason atomic.Value
+
+		// Artificial latency, jitter and loss added to the video, nil if none
+		impairment atomic.Pointer[Impairment]
+
+		isSlowConsumer       atomic.Bool
+		slowReportCount      int
+		recoveredReportCount int
+
+		// Frames above this temporal layer are dropped, temporalLayerAll forwards everything
+		maxTemporalLayerId atomic.Int32
+
+		// Layers the session was automatically moved down from, guarded by streamMapLock
+		downgradedFrom []layerSelection
+
+		// Extra bits per second of padding sent until probeUntil (UnixNano) before
+		// an upgrade, 0 if the session isn't probing
+		probeBitrate atomic.Uint64
+		probeUntil   atomic.Int64
+
+		// Guarded by packetLock
+		lastPaddingAt time.Time
+		paddingBudget float64
+
+		logger *log.Logger
+
+		startedAt time.Time
+	}
+
+	layerSelection struct {
+		rid                string
+		maxTemporalLayerId int32
 	}
 
 	simulcastLayerResponse struct {
 		EncodingId string `json:"encodingId"`
 	}
+
+	// videoPacketInfo is what videoWriter learned about a packet, shared by every WHEP session
+	videoPacketInfo struct {
+		layer string
+		codec videoTrackCodec
+
+		// The publisher's timestamp, sessions rewrite the packet itself
+		timestamp uint32
+
+		// Relative to the previous packet of the layer
+		timeDiff     int64
+		sequenceDiff int
+
+		temporalLayerId int32
+		isKeyframeStart bool
+
+		// First packet since the publisher connected, the diffs are meaningless
+		discontinuous bool
+	}
 )
 
+// How long a session waits for a keyframe of the layer it is switching to
+// before it switches anyway
+const layerSwitchTimeout = time.Second * 2
+
 func WHEPLayers(whepSessionId string) ([]byte, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
@@ -37,8 +164,8 @@ func WHEPLayers(whepSessionId string) ([]byte, error) {
 		defer streamMap[streamKey].whepSessionsLock.Unlock()
 
 		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			for i := range streamMap[streamKey].videoTracks {
-				layers = append(layers, simulcastLayerResponse{EncodingId: streamMap[streamKey].videoTracks[i].rid})
+			for _, rid := range streamMap[streamKey].activeLayers {
+				layers = append(layers, simulcastLayerResponse{EncodingId: rid})
 			}
 
 			break
@@ -54,24 +181,83 @@ func WHEPLayers(whepSessionId string) ([]byte, error) {
 	return json.Marshal(resp)
 }
 
+// WHEPStreamKey returns the stream key a WHEP session is watching
+func WHEPStreamKey(whepSessionId string) (string, bool) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for streamKey, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		_, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			return streamKey, true
+		}
+	}
+
+	return "", false
+}
+
 func WHEPChangeLayer(whepSessionId, layer string) error {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+	for streamKey, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			// A layer chosen by the viewer isn't undone by automatic upgrades.
+			// The preference is the layer the viewer got, so a viewer held to a
+			// lower layer doesn't ask for one it can't use when it reconnects
+			allowed := whepSession.allowedLayer(stream, layer)
+			whepSession.downgradedFrom = nil
+			whepSession.currentLayer.Store(allowed)
+			saveLayerPreference(streamKey, whepSession.viewerId, layerSelection{rid: allowed, maxTemporalLayerId: whepSession.maxTemporalLayerId.Load()})
+
+			select {
+			case stream.pliChan <- true:
+			default:
+			}
+			return nil
+		}
+	}
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			streamMap[streamKey].whepSessions[whepSessionId].currentLayer.Store(layer)
-			streamMap[streamKey].pliChan <- true
+	return ErrWHEPSessionNotFound
+}
+
+// WHEPChangeTemporalLayer drops frames above temporalLayerId, -1 forwards every frame
+func WHEPChangeTemporalLayer(whepSessionId string, temporalLayerId int32) error {
+	if temporalLayerId < temporalLayerAll || temporalLayerId > maxTemporalLayerId {
+		return ErrInvalidTemporalLayer
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for streamKey, stream := range streamMap {
+		stream.whepSessionsLock.RLock()
+		whepSession, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if ok {
+			whepSession.downgradedFrom = nil
+			whepSession.maxTemporalLayerId.Store(temporalLayerId)
+
+			currentLayer, _ := whepSession.currentLayer.Load().(string)
+			saveLayerPreference(streamKey, whepSession.viewerId, layerSelection{rid: currentLayer, maxTemporalLayerId: temporalLayerId})
+			return nil
 		}
 	}
 
-	return nil
+	return ErrWHEPSessionNotFound
 }
 
-func WHEP(offer, streamKey string) (string, string, error) {
+// WHEP starts a session watching streamKey. If viewerId is set the session
+// resumes on the layer the viewer last selected
+func WHEP(ctx context.Context, offer, streamKey, clientAddress, viewerId string, constraints WHEPConstraints) (string, string, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 	stream, err := getStream(streamKey, false)
@@ -79,33 +265,129 @@ func WHEP(offer, streamKey string) (string, string, error) {
 		return "", "", err
 	}
 
+	country, asn := geoip.Unknown, geoip.Unknown
+	if geoip.Enabled() {
+		country, asn = geoip.Lookup(clientAddress)
+	}
+
+	token := viewerToken(clientAddress)
+	policy := GetRoomPolicy(streamKey)
+	if err = stream.checkViewingPolicy(policy, country, token); err != nil {
+		return "", "", err
+	}
+
 	whepSessionId := uuid.New().String()
 
 	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
+	session := &whepSession{
+		videoTrack:  videoTrack,
+		timestamp:   50000,
+		logger:      requestid.Logger(ctx),
+		viewerId:    viewerId,
+		viewerToken: token,
+		country:     country,
+		asn:         asn,
+		audioOnly:   policy.AudioOnly,
+		maxLayer:    constraints.MaxLayer,
+		eventTypes:  constraints.EventTypes,
+
+		networkQualityChanged: make(chan struct{}),
+	}
+	session.roundTripTimeMs.Store(-1)
+	session.endReason.Store("")
+	session.currentLayer.Store("")
+	session.maxTemporalLayerId.Store(temporalLayerAll)
+	if preference, ok := loadLayerPreference(streamKey, viewerId); ok {
+		for _, t := range stream.videoTracks {
+			if t.rid == preference.rid {
+				session.currentLayer.Store(preference.rid)
+			}
+		}
+		session.maxTemporalLayerId.Store(preference.maxTemporalLayerId)
+	}
+	if session.maxLayer != "" {
+		currentLayer, _ := session.currentLayer.Load().(string)
+		session.currentLayer.Store(session.allowedLayer(stream, currentLayer))
+	}
+	session.iceConnectionState.Store(webrtc.ICEConnectionStateNew.String())
+	session.inheritImpairment(streamKey)
+
+	api := apiWhep
+	if session.audioOnly {
+		api = apiWhepVoice
+	}
 
-	peerConnection, err := newPeerConnection(apiWhep)
+	if policy.RelayOnly {
+		offer = stripNonRelayCandidates(offer)
+	}
+
+	peerConnection, err := newPeerConnection(api, policy.RelayOnly)
 	if err != nil {
 		return "", "", err
 	}
+	session.peerConnection = peerConnection
+
+	if session.eventsChannel, err = createEventsChannel(peerConnection); err != nil {
+		return "", "", err
+	}
+
+	if session.relayChannel, err = createRelayChannel(peerConnection); err != nil {
+		return "", "", err
+	}
+	session.relayChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := stream.relayToPublisher(streamKey, msg); err != nil {
+			session.logger.Println(err)
+		}
+	})
 
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		session.iceConnectionState.Store(i.String())
+
+		if i == webrtc.ICEConnectionStateFailed {
+			session.setEndReason(StreamEndedICEFailed)
+		}
+
 		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
 			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
+				session.logger.Println(err)
 			}
 
 			peerConnectionDisconnected(streamKey, whepSessionId)
 		}
 	})
 
-	if _, err = peerConnection.AddTrack(stream.audioTrack); err != nil {
-		return "", "", err
-	}
+	// Request a keyframe once media can flow instead of waiting for the next
+	// natural one. Packets written before DTLS completes are dropped
+	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		if p == webrtc.PeerConnectionStateConnected {
+			select {
+			case stream.pliChan <- true:
+			default:
+			}
+		}
+	})
 
-	rtpSender, err := peerConnection.AddTrack(videoTrack)
+	audioRtpSender, err := peerConnection.AddTrack(stream.audioTrack)
 	if err != nil {
 		return "", "", err
 	}
+	session.audioSSRC = audioRtpSender.GetParameters().Encodings[0].SSRC
+
+	// The system audio goes to the second audio track of the offer
+	if offersSystemAudio(offer) {
+		if _, err = peerConnection.AddTrack(stream.systemAudioTrack); err != nil {
+			return "", "", err
+		}
+	}
+
+	// Receiver Reports of voice rooms are read from the audio sender
+	rtpSender := audioRtpSender
+	if !session.audioOnly {
+		if rtpSender, err = peerConnection.AddTrack(videoTrack); err != nil {
+			return "", "", err
+		}
+	}
+	go session.writeSenderReports(stream, audioRtpSender, rtpSender)
 
 	go func() {
 		for {
@@ -115,11 +397,16 @@ func WHEP(offer, streamKey string) (string, string, error) {
 			}
 
 			for _, r := range rtcpPackets {
-				if _, isPLI := r.(*rtcp.PictureLossIndication); isPLI {
+				switch r := r.(type) {
+				case *rtcp.PictureLossIndication:
 					select {
 					case stream.pliChan <- true:
 					default:
 					}
+				case *rtcp.ReceiverReport:
+					for _, report := range r.Reports {
+						session.handleReceptionReport(stream, streamKey, whepSessionId, report)
+					}
 				}
 			}
 		}
@@ -146,29 +433,100 @@ func WHEP(offer, streamKey string) (string, string, error) {
 	stream.whepSessionsLock.Lock()
 	defer stream.whepSessionsLock.Unlock()
 
-	stream.whepSessions[whepSessionId] = &whepSession{
-		videoTrack: videoTrack,
-		timestamp:  50000,
+	if geoip.Enabled() {
+		stream.viewerCountries[session.country]++
+		stream.viewerASNs[session.asn]++
+	}
+
+	session.startedAt = time.Now()
+	stream.whepSessions[whepSessionId] = session
+	if len(stream.whepSessions) > stream.peakViewerCount {
+		stream.peakViewerCount = len(stream.whepSessions)
+	}
+	if r := stream.activeRecording.Load(); r != nil {
+		r.participantJoined(recordingParticipantViewer, whepSessionId, session.country)
+	}
+	emitEvent(webhook.EventViewerJoined, streamKey, whepSessionId)
+	if !constraints.ExpiresAt.IsZero() {
+		session.expireAt(whepSessionId, constraints.ExpiresAt)
+	}
+
+	if policy.RelayOnly {
+		return stripNonRelayCandidates(peerConnection.LocalDescription().SDP), whepSessionId, nil
 	}
-	stream.whepSessions[whepSessionId].currentLayer.Store("")
 	return peerConnection.LocalDescription().SDP, whepSessionId, nil
 }
 
-func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff int64, sequenceDiff int, codec videoTrackCodec) {
-	if w.currentLayer.Load() == "" {
-		w.currentLayer.Store(layer)
-	} else if layer != w.currentLayer.Load() {
-		return
+// sendVideoPacket writes the packet if it belongs to the layer the session is
+// forwarding and reports if it did. A new layer is only forwarded from its next
+// keyframe, until then the session stays on the old one
+func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, p videoPacketInfo) bool {
+	if w.audioOnly {
+		return false
+	}
+
+	w.packetLock.Lock()
+	defer w.packetLock.Unlock()
+
+	targetLayer, _ := w.currentLayer.Load().(string)
+	if targetLayer == "" && w.currentLayer.CompareAndSwap("", p.layer) {
+		targetLayer = p.layer
+	}
+
+	// A reconnected publisher starts a new picture sequence on the same layer
+	if p.discontinuous && p.layer == w.forwardingLayer {
+		w.forwardingLayer = ""
+	}
+
+	timeDiff, sequenceDiff := p.timeDiff, p.sequenceDiff
+	if p.layer != w.forwardingLayer {
+		if p.layer != targetLayer {
+			return false
+		}
+
+		if w.switchStartedAt.IsZero() {
+			w.switchStartedAt = time.Now()
+		}
+		if !p.isKeyframeStart && time.Since(w.switchStartedAt) < layerSwitchTimeout {
+			return false
+		}
+		w.forwardingLayer, w.switchStartedAt = p.layer, time.Time{}
+
+		// The diffs are relative to packets the viewer never got. Continue right
+		// after the last packet it did, advancing the timestamp by the time passed
+		timeDiff, sequenceDiff = 0, 1
+		if !w.lastWrittenAt.IsZero() {
+			timeDiff = int64(time.Since(w.lastWrittenAt) * videoClockRate / time.Second)
+			if timeDiff < 1 {
+				timeDiff = 1
+			}
+		}
+	} else if p.layer == targetLayer {
+		// The viewer switched back before the new layer sent a keyframe
+		w.switchStartedAt = time.Time{}
+	}
+
+	// Dropped frames still advance the timestamp, but not the sequence number so the viewer doesn't see loss
+	if maxTemporalLayerId := w.maxTemporalLayerId.Load(); maxTemporalLayerId != temporalLayerAll && p.temporalLayerId > maxTemporalLayerId {
+		w.timestamp = uint32(int64(w.timestamp) + timeDiff)
+		return false
 	}
 
 	w.packetsWritten += 1
+	w.octetsWritten += uint64(len(rtpPkt.Payload))
 	w.sequenceNumber = uint16(int(w.sequenceNumber) + sequenceDiff)
 	w.timestamp = uint32(int64(w.timestamp) + timeDiff)
+	w.timestampOffset.Store(w.timestamp - p.timestamp)
+	w.lastWrittenAt = time.Now()
 
 	rtpPkt.SequenceNumber = w.sequenceNumber
 	rtpPkt.Timestamp = w.timestamp
 
-	if err := w.videoTrack.WriteRTP(rtpPkt, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
-		log.Println(err)
+	w.writeVideoRTP(rtpPkt, p.codec)
+
+	if rtpPkt.Marker {
+		w.sendProbePadding(p.codec)
 	}
+
+	return true
 }
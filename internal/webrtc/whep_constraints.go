@@ -0,0 +1,61 @@
+package webrtc
+
+import (
+	"errors"
+	"time"
+)
+
+// WHEPConstraints limit what a viewer may watch and which events it is sent.
+// The WHEP authorization webhook and the client set them per session
+type WHEPConstraints struct {
+	// Best layer the viewer is sent, empty allows every layer
+	MaxLayer string
+
+	// The session is ended once it expires, zero never expires it
+	ExpiresAt time.Time
+
+	// Event types the client handles, nil sends every event
+	EventTypes map[string]bool
+}
+
+// allowedLayer returns layer if the session may watch it, otherwise MaxLayer.
+// Layers are ranked by bitrate like automatic downgrades. If MaxLayer isn't
+// published the lowest layer is used. It must be called with streamMapLock held
+func (w *whepSession) allowedLayer(s *stream, layer string) string {
+	if w.maxLayer == "" {
+		return layer
+	}
+
+	var maxTrack, lowest *videoTrack
+	for _, t := range s.videoTracks {
+		if t.rid == w.maxLayer {
+			maxTrack = t
+		}
+		if lowest == nil || t.bytesReceived.Load() < lowest.bytesReceived.Load() {
+			lowest = t
+		}
+	}
+
+	switch {
+	case maxTrack == nil && lowest == nil:
+		return w.maxLayer
+	case maxTrack == nil:
+		return lowest.rid
+	}
+
+	for _, t := range s.videoTracks {
+		if t.rid == layer && t.bytesReceived.Load() <= maxTrack.bytesReceived.Load() {
+			return layer
+		}
+	}
+	return maxTrack.rid
+}
+
+// expireAt ends the session once its authorization expires
+func (w *whepSession) expireAt(whepSessionId string, expiresAt time.Time) {
+	time.AfterFunc(time.Until(expiresAt), func() {
+		if err := EndWHEP(whepSessionId, StreamEndedAuthorizationExpired); err != nil && !errors.Is(err, ErrWHEPSessionNotFound) {
+			w.logger.Println(err)
+		}
+	})
+}
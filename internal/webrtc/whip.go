@@ -1,69 +1,107 @@
 package webrtc
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
 	"math"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+
+	"github.com/glimesh/broadcast-box/internal/requestid"
+	"github.com/glimesh/broadcast-box/internal/webhook"
 )
 
-func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream) {
+func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream, logger *log.Logger) {
 	rtpBuf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
 		case errors.Is(err, io.EOF):
 			return
 		case err != nil:
-			log.Println(err)
+			logger.Println(err)
 			return
 		}
 
 		stream.audioPacketsReceived.Add(1)
+		stream.audioBytesReceived.Add(uint64(rtpRead))
+		nodeBytesReceived.Add(uint64(rtpRead))
+
+		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
+			logger.Println(err)
+			continue
+		}
+
+		if r := stream.activeRecording.Load(); r != nil {
+			r.writeAudio(rtpPkt)
+		}
+
 		if _, writeErr := stream.audioTrack.Write(rtpBuf[:rtpRead]); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
-			log.Println(writeErr)
+			logger.Println(writeErr)
 			return
 		}
+		stream.countAudioSent(rtpRead)
+		stream.countAudioWritten(len(rtpPkt.Payload))
 	}
 }
 
-func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection *webrtc.PeerConnection, s *stream) {
-	id := remoteTrack.RID()
+func videoWriter(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver, stream *stream, peerConnection *webrtc.PeerConnection, s *stream, logger *log.Logger) {
+	id := simulcastLayerName(remoteTrack.RID())
 	if id == "" {
 		id = videoTrackLabelDefault
 	}
 
 	videoTrack, err := addTrack(s, id)
 	if err != nil {
-		log.Println(err)
+		logger.Println(err)
 		return
 	}
 
+	// A reconnected publisher uses a different clock
+	videoTrack.senderReport.Store(nil)
+	go readSenderReports(remoteTrack, rtpReceiver, videoTrack.senderReport.Store)
+
 	go func() {
+		keyframeTicker := time.NewTicker(keyframeIntervalCheck)
+		defer keyframeTicker.Stop()
+
+		lastKeyframeRequest := time.Now()
 		for {
 			select {
 			case <-stream.whipActiveContext.Done():
 				return
 			case <-stream.pliChan:
-				if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{
-						MediaSSRC: uint32(remoteTrack.SSRC()),
-					},
-				}); sendErr != nil {
-					return
+			case <-keyframeTicker.C:
+				// Viewers requesting keyframes reset the interval
+				if !keyframeDue(lastKeyframeRequest) {
+					continue
 				}
 			}
+
+			if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{
+					MediaSSRC: uint32(remoteTrack.SSRC()),
+				},
+			}); sendErr != nil {
+				return
+			}
+			lastKeyframeRequest = time.Now()
 		}
 	}()
 
 	rtpBuf := make([]byte, 1500)
 	rtpPkt := &rtp.Packet{}
 	codec := getVideoTrackCodec(remoteTrack.Codec().RTPCodecCapability.MimeType)
+	videoTrack.codec.Store(remoteTrack.Codec().RTPCodecCapability.MimeType)
+	videoTrack.ssrc.Store(uint32(remoteTrack.SSRC()))
 
 	lastTimestamp := uint32(0)
 	lastTimestampSet := false
@@ -71,26 +109,36 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 	lastSequenceNumber := uint16(0)
 	lastSequenceNumberSet := false
 
+	lastKeyframeTimestamp := uint32(0)
+
+	// Only the first packet of a frame carries the temporal layer for some codecs
+	lastTemporalLayerId := int32(0)
+	lastTemporalLayerTimestamp := uint32(0)
+
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
 		case errors.Is(err, io.EOF):
 			return
 		case err != nil:
-			log.Println(err)
+			logger.Println(err)
 			return
 		}
 
 		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
-			log.Println(err)
+			logger.Println(err)
 			return
 		}
 
 		videoTrack.packetsReceived.Add(1)
+		videoTrack.bytesReceived.Add(uint64(rtpRead))
+		nodeBytesReceived.Add(uint64(rtpRead))
+		videoTrack.lastPacketReceived.Store(time.Now().UnixNano())
 
 		rtpPkt.Extension = false
 		rtpPkt.Extensions = nil
 
+		discontinuous := !lastTimestampSet
 		timeDiff := int64(rtpPkt.Timestamp) - int64(lastTimestamp)
 		switch {
 		case !lastTimestampSet:
@@ -108,46 +156,151 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 		case sequenceDiff < -(math.MaxUint16 / 10):
 			sequenceDiff += (math.MaxUint16 + 1)
 		}
+		if sequenceDiff > 1 {
+			videoTrack.packetsLost.Add(uint64(sequenceDiff - 1))
+		}
 
 		lastTimestamp = rtpPkt.Timestamp
 		lastSequenceNumber = rtpPkt.SequenceNumber
 
+		temporalLayerId, ok := parseTemporalLayerId(codec, rtpPkt.Payload)
+		switch {
+		case ok:
+			lastTemporalLayerId, lastTemporalLayerTimestamp = temporalLayerId, rtpPkt.Timestamp
+		case rtpPkt.Timestamp == lastTemporalLayerTimestamp:
+			temporalLayerId = lastTemporalLayerId
+		}
+		if temporalLayerId > videoTrack.maxTemporalLayerId.Load() {
+			videoTrack.maxTemporalLayerId.Store(temporalLayerId)
+		}
+
+		if height, ok := parseVideoHeight(codec, rtpPkt.Payload); ok {
+			videoTrack.height.Store(height)
+		}
+
+		// Recorded before WHEP sessions rewrite the timestamp and sequence number
+		if r := s.activeRecording.Load(); r != nil {
+			r.writeVideo(rtpPkt, id, codec)
+		}
+
+		keyframeStart := isKeyframeStart(codec, rtpPkt.Payload)
+		if keyframeStart && rtpPkt.Timestamp != lastKeyframeTimestamp {
+			// H264 parameter sets and the IDR both start the same keyframe
+			lastKeyframeTimestamp = rtpPkt.Timestamp
+			videoTrack.keyframeReceived()
+		}
+
+		packet := videoPacketInfo{
+			layer:           id,
+			codec:           codec,
+			timestamp:       rtpPkt.Timestamp,
+			timeDiff:        timeDiff,
+			sequenceDiff:    sequenceDiff,
+			temporalLayerId: temporalLayerId,
+			isKeyframeStart: keyframeStart,
+			discontinuous:   discontinuous,
+		}
+
 		s.whepSessionsLock.RLock()
 		for i := range s.whepSessions {
-			s.whepSessions[i].sendVideoPacket(rtpPkt, id, timeDiff, sequenceDiff, codec)
+			if s.whepSessions[i].sendVideoPacket(rtpPkt, packet) {
+				videoTrack.packetsForwarded.Add(1)
+				videoTrack.bytesForwarded.Add(uint64(rtpRead))
+				nodeBytesSent.Add(uint64(rtpRead))
+			}
 		}
 		s.whepSessionsLock.RUnlock()
 
 	}
 }
 
-func WHIP(offer, streamKey string) (string, error) {
-	peerConnection, err := newPeerConnection(apiWhip)
+// WHIP answers the offer of a publisher and returns the id of its session
+func WHIP(ctx context.Context, offer, streamKey string) (string, string, error) {
+	logger := requestid.Logger(ctx)
+
+	policy := GetRoomPolicy(streamKey)
+	api, audioOnly := apiWhip, policy.AudioOnly
+	if audioOnly {
+		api = apiWhipVoice
+	}
+	if policy.RelayOnly {
+		offer = stripNonRelayCandidates(offer)
+	}
+
+	peerConnection, err := newPeerConnection(api, policy.RelayOnly)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 	stream, err := getStream(streamKey, true)
 	if err != nil {
-		return "", err
+		return "", "", err
+	} else if err = stream.checkPublisherLimit(policy); err != nil {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			logger.Println(closeErr)
+		}
+		return "", "", err
 	}
 
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
 		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
-			audioWriter(remoteTrack, stream)
+			if isSystemAudio(peerConnection, rtpReceiver) {
+				systemAudioWriter(remoteTrack, stream, logger)
+				return
+			}
+
+			stream.audioSenderReport.Store(nil)
+			go readSenderReports(remoteTrack, rtpReceiver, stream.audioSenderReport.Store)
+			audioWriter(remoteTrack, stream, logger)
 		} else {
-			videoWriter(remoteTrack, stream, peerConnection, stream)
+			videoWriter(remoteTrack, rtpReceiver, stream, peerConnection, stream, logger)
 
 		}
 	})
 
+	statsChannel, err := createEventsChannel(peerConnection)
+	if err != nil {
+		return "", "", err
+	}
+	statsChannel.OnOpen(func() {
+		streamMapLock.Lock()
+		defer streamMapLock.Unlock()
+		stream.sendPublisherStats(streamKey)
+	})
+
+	relayChannel, err := createRelayChannel(peerConnection)
+	if err != nil {
+		return "", "", err
+	}
+	relayChannel.OnMessage(stream.relayToViewers)
+
+	stream.whipPeerConnection = peerConnection
+	stream.whipStatsChannel = statsChannel
+	stream.whipRelayChannel = relayChannel
+	stream.ingestViolationCount = 0
+	stream.endReason = ""
+	stream.whipICEConnectionState.Store(webrtc.ICEConnectionStateNew.String())
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		stream.whipICEConnectionState.Store(i.String())
+
+		if i == webrtc.ICEConnectionStateFailed {
+			streamMapLock.Lock()
+			if stream.endReason == "" && len(stream.publishers) <= 1 {
+				stream.endReason = StreamEndedICEFailed
+			}
+			streamMapLock.Unlock()
+		}
+
 		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
 			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
+				logger.Println(err)
 			}
+
+			streamMapLock.Lock()
+			stream.removePublisher(streamKey, peerConnection)
+			streamMapLock.Unlock()
 			peerConnectionDisconnected(streamKey, "")
 		}
 	})
@@ -156,18 +309,37 @@ func WHIP(offer, streamKey string) (string, error) {
 		SDP:  string(offer),
 		Type: webrtc.SDPTypeOffer,
 	}); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
 	answer, err := peerConnection.CreateAnswer(nil)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	<-gatherComplete
-	return peerConnection.LocalDescription().SDP, nil
+	whipSessionId := uuid.New().String()
+	stream.publishers[peerConnection] = &publisher{whipSessionId: whipSessionId, statsChannel: statsChannel, relayChannel: relayChannel}
+	stream.whipStartedEpochMs.Store(time.Now().UnixMilli())
+	stream.whepSessionsLock.Lock()
+	stream.peakViewerCount = len(stream.whepSessions)
+	stream.whepSessionsLock.Unlock()
+	scheduleLive(streamKey)
+	if err := autoRecordOnPublish(stream, streamKey); err != nil {
+		logger.Println(err)
+	}
+	emitEvent(webhook.EventStreamStarted, streamKey, "")
+
+	answerSDP := peerConnection.LocalDescription().SDP
+	if policy.RelayOnly {
+		answerSDP = stripNonRelayCandidates(answerSDP)
+	}
+	if audioOnly {
+		return enableOpusDTX(answerSDP), whipSessionId, nil
+	}
+	return answerSDP, whipSessionId, nil
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const unixSocketPrefix = "unix:"
+
+// unixSocketPath returns the socket path if address is `unix:/path` or an absolute path
+func unixSocketPath(address string) (string, bool) {
+	if strings.HasPrefix(address, unixSocketPrefix) {
+		return strings.TrimPrefix(address, unixSocketPrefix), true
+	} else if strings.HasPrefix(address, "/") {
+		return address, true
+	}
+
+	return "", false
+}
+
+// listen binds a TCP address or unix socket. An empty address uses the default
+// HTTP or HTTPS port
+func listen(address string, useTLS bool) (net.Listener, error) {
+	if socketPath, ok := unixSocketPath(address); ok {
+		// Remove a socket left behind by a previous run, other files are kept
+		// and fail the bind
+		if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(socketPath); err != nil {
+				return nil, err
+			}
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		return net.Listen("unix", socketPath)
+	}
+
+	if address == "" && useTLS {
+		address = ":https"
+	} else if address == "" {
+		address = ":http"
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// httpListener is one of the addresses the HTTP server is available on
+type httpListener struct {
+	address   string
+	handler   http.Handler
+	tlsConfig *tls.Config
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// bind opens the listener. All listeners are bound before any are served so a
+// bad address fails at startup
+func (h *httpListener) bind(http2Server *http2.Server) (err error) {
+	h.server = &http.Server{Handler: h.handler}
+	configureHTTPTimeouts(h.server)
+	if h.tlsConfig != nil {
+		h.server.TLSConfig = h.tlsConfig.Clone()
+	}
+
+	if err = http2.ConfigureServer(h.server, http2Server); err != nil {
+		return err
+	}
+
+	if h.tlsConfig == nil && os.Getenv("ENABLE_H2C") != "" {
+		h.server.Handler = h2c.NewHandler(h.server.Handler, http2Server)
+	}
+
+	h.listener, err = listen(h.address, h.tlsConfig != nil)
+	return err
+}
+
+func (h *httpListener) serve() error {
+	if h.tlsConfig != nil {
+		log.Println("Running HTTPS Server at `" + h.address + "`")
+		return h.server.ServeTLS(h.listener, "", "")
+	}
+
+	log.Println("Running HTTP Server at `" + h.address + "`")
+	return h.server.Serve(h.listener)
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,9 +19,19 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/glimesh/broadcast-box/internal/eventlog"
+	"github.com/glimesh/broadcast-box/internal/geoip"
+	"github.com/glimesh/broadcast-box/internal/metrics"
+	"github.com/glimesh/broadcast-box/internal/moderation"
 	"github.com/glimesh/broadcast-box/internal/networktest"
+	"github.com/glimesh/broadcast-box/internal/requestid"
+	"github.com/glimesh/broadcast-box/internal/store"
+	"github.com/glimesh/broadcast-box/internal/systemd"
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webhook"
 	"github.com/glimesh/broadcast-box/internal/webrtc"
 	"github.com/joho/godotenv"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -27,24 +41,108 @@ const (
 	networkTestIntroMessage   = "\033[0;33mNETWORK_TEST_ON_START is enabled. If the test fails Broadcast Box will exit.\nSee the README for how to debug or disable NETWORK_TEST_ON_START\033[0m"
 	networkTestSuccessMessage = "\033[0;32mNetwork Test passed.\nHave fun using Broadcast Box.\033[0m"
 	networkTestFailedMessage  = "\033[0;31mNetwork Test failed.\n%s\nPlease see the README and join Discord for help\033[0m"
+
+	// Every API route is served under both prefixes. apiPathLegacy is kept so
+	// existing clients continue to work
+	apiPathV1     = "/api/v1"
+	apiPathLegacy = "/api"
+
+	// Sent by viewers that want their layer selection kept when they reconnect
+	viewerIdHeader = "X-Viewer-ID"
+
+	// Sent by viewers of a stream with a playback password, ?password= works as well
+	playbackPasswordHeader = "X-Playback-Password"
+
+	// Sent with WHIP and WHEP refusals so clients know if retrying can succeed,
+	// it has the same values as the reason of the ended SSE event
+	disconnectReasonHeader = "X-Disconnect-Reason"
+
+	// Sent by publishers to set the metadata of their stream when they connect
+	streamTitleHeader       = "X-Stream-Title"
+	streamCategoryHeader    = "X-Stream-Category"
+	streamDescriptionHeader = "X-Stream-Description"
+
+	sdpContentType        = "application/sdp"
+	trickleICEContentType = "application/trickle-ice-sdpfrag"
+
+	whepExtensionServerSentEvents = "urn:ietf:params:whep:ext:core:server-sent-events"
+	whepExtensionLayer            = "urn:ietf:params:whep:ext:core:layer"
+
+	// How long clients wait before reconnecting to the event stream, and how
+	// long before the write timeout the stream is ended
+	sseRetry              = time.Second
+	sseWriteTimeoutMargin = time.Second * 5
+
+	// Comments sent on quiet event streams so proxies don't close them as idle
+	defaultSSEKeepaliveInterval = time.Second * 15
 )
 
-var noBuildDirectoryErr = errors.New("\033[0;31mBuild directory does not exist, run `npm install` and `npm run build` in the web directory.\033[0m")
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var (
+	noBuildDirectoryErr = errors.New("\033[0;31mBuild directory does not exist, run `npm install` and `npm run build` in the web directory.\033[0m")
+	errEnvFileNotFound  = errors.New("env file not found")
+)
 
 type (
 	whepLayerRequestJSON struct {
-		MediaId    string `json:"mediaId"`
-		EncodingId string `json:"encodingId"`
+		MediaId         string `json:"mediaId"`
+		EncodingId      string `json:"encodingId"`
+		TemporalLayerId *int32 `json:"temporalLayerId"`
+	}
+
+	disconnectedEventJSON struct {
+		Reason string `json:"reason"`
+	}
+
+	versionResponseJSON struct {
+		Version        string   `json:"version"`
+		APIVersions    []string `json:"apiVersions"`
+		WHIPExtensions []string `json:"whipExtensions"`
+		WHEPExtensions []string `json:"whepExtensions"`
 	}
 )
 
 func logHTTPError(w http.ResponseWriter, err string, code int) {
-	log.Println(err)
+	if id := w.Header().Get(requestid.Header); id != "" {
+		log.Println("[" + id + "] " + err)
+	} else {
+		log.Println(err)
+	}
 	http.Error(w, err, code)
 }
 
+func writeJSON(res http.ResponseWriter, code int, v any) {
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(code)
+
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// addICEServerLinks tells clients of relay only rooms which TURN servers to
+// use, so they can reconnect without revealing their address
+func addICEServerLinks(res http.ResponseWriter, streamKey string) {
+	if !webrtc.GetRoomPolicy(streamKey).RelayOnly {
+		return
+	}
+
+	for _, iceServer := range webrtc.TURNServers() {
+		link := `<` + iceServer.URLs[0] + `>; rel="ice-server"`
+		if iceServer.Username != "" {
+			link += `; username="` + iceServer.Username + `"; credential="` + fmt.Sprint(iceServer.Credential) + `"; credential-type="password"`
+		}
+		res.Header().Add("Link", link)
+	}
+}
+
+// whipHandler answers offers POSTed as application/sdp with 201 and the
+// Location of the session. DELETE on the Location, or on the endpoint with the
+// stream key, ends it
 func whipHandler(res http.ResponseWriter, r *http.Request) {
-	if r.Method == "DELETE" {
+	if r.Method != http.MethodDelete && refuseWhileDraining(res) {
 		return
 	}
 
@@ -54,26 +152,176 @@ func whipHandler(res http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodDelete {
+		whipDeleteHandler(res, r, streamKey, "")
+		return
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != sdpContentType {
+		res.Header().Set("Accept-Post", sdpContentType)
+		logHTTPError(res, "Content-Type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Encoders like OBS send the offer chunked, without a Content-Length
 	offer, err := io.ReadAll(r.Body)
 	if err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
+	} else if len(bytes.TrimSpace(offer)) == 0 {
+		logHTTPError(res, "Offer was empty", http.StatusBadRequest)
+		return
 	}
 
-	answer, err := webrtc.WHIP(string(offer), streamKey)
-	if err != nil {
+	if streamSuspended(r, streamKey) {
+		res.Header().Set(disconnectReasonHeader, webrtc.StreamEndedSuspended)
+		logHTTPError(res, "Stream is suspended pending moderator review", http.StatusForbidden)
+		return
+	} else if streamKey, err = tenantStreamKey(r, streamKey, false); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if webrtc.UploadQuotaExceeded(streamKey) {
+		res.Header().Set(disconnectReasonHeader, webrtc.StreamEndedUploadQuota)
+		logHTTPError(res, "Upload quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	answer, whipSessionId, err := webrtc.WHIP(r.Context(), string(offer), streamKey)
+	switch {
+	case errors.Is(err, webrtc.ErrRoomFull):
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	res.Header().Add("Location", "/api/whip")
-	res.Header().Add("Content-Type", "application/sdp")
+	if metadata := (webrtc.StreamMetadata{
+		Title:       r.Header.Get(streamTitleHeader),
+		Category:    r.Header.Get(streamCategoryHeader),
+		Description: r.Header.Get(streamDescriptionHeader),
+	}); metadata != (webrtc.StreamMetadata{}) {
+		if _, err = webrtc.SetStreamMetadata(streamKey, metadata); err != nil {
+			log.Println(err)
+		}
+	}
+
+	addICEServerLinks(res, streamKey)
+	res.Header().Add("Location", path.Join(r.URL.Path, whipSessionId))
+	res.Header().Add("Accept-Patch", trickleICEContentType)
+	res.Header().Add("Content-Type", sdpContentType)
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer)
 }
 
+// whipSessionHandler serves the Location of a WHIP session. DELETE with the
+// stream key in Authorization ends it, PATCH trickles candidates to it
+func whipSessionHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey := req.Header.Get("Authorization")
+	if streamKey == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+		return
+	}
+
+	if req.Method == http.MethodPatch {
+		whipPatchHandler(res, req, streamKey, path.Base(req.URL.Path))
+		return
+	}
+
+	whipDeleteHandler(res, req, streamKey, path.Base(req.URL.Path))
+}
+
+// whipPatchHandler adds the candidates of an application/trickle-ice-sdpfrag
+// body to the WHIP session. ICE restarts are refused with 422
+func whipPatchHandler(res http.ResponseWriter, req *http.Request, streamKey, whipSessionId string) {
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mediaType != trickleICEContentType {
+		res.Header().Set("Accept-Patch", trickleICEContentType)
+		logHTTPError(res, "Content-Type must be "+trickleICEContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	frag, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if streamKey, err = namespacedStreamKey(t, streamKey); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	err = webrtc.AddWHIPCandidates(streamKey, whipSessionId, string(frag))
+	switch {
+	case errors.Is(err, webrtc.ErrNoPublisher):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case errors.Is(err, webrtc.ErrICERestartUnsupported):
+		logHTTPError(res, err.Error(), http.StatusUnprocessableEntity)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	default:
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// whipDeleteHandler ends the WHIP session of the stream key, or only the one
+// with whipSessionId if it is set. Viewers are told the publisher left
+func whipDeleteHandler(res http.ResponseWriter, req *http.Request, streamKey, whipSessionId string) {
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if streamKey, err = namespacedStreamKey(t, streamKey); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if whipSessionId == "" {
+		err = webrtc.WHIPDelete(streamKey)
+	} else {
+		err = webrtc.EndWHIPSession(streamKey, whipSessionId, webrtc.StreamEndedPublisherLeft)
+	}
+	switch {
+	case errors.Is(err, webrtc.ErrNoPublisher):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	default:
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// whepHandler answers offers for the stream key or alias in Authorization, or
+// in the path with `/api/whep/{streamKeyOrAlias}`. PATCH on the Location of a
+// session, `/api/whep/{whepSessionId}`, trickles candidates to it and DELETE
+// ends it
 func whepHandler(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPatch:
+		whepPatchHandler(res, req, path.Base(req.URL.Path))
+		return
+	case http.MethodDelete:
+		whepDeleteHandler(res, path.Base(req.URL.Path))
+		return
+	}
+
+	if refuseWhileDraining(res) {
+		return
+	}
+
 	streamKey := req.Header.Get("Authorization")
+	if _, val, ok := strings.Cut(req.URL.Path, "/whep/"); ok && val != "" {
+		// Publishers like OBS and the web UI send their stream key as a bearer
+		// token, which is what the stream is registered under
+		streamKey = val
+		if !strings.HasPrefix(val, bearerPrefix) {
+			streamKey = bearerPrefix + val
+		}
+	}
 	if streamKey == "" {
 		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
 		return
@@ -85,38 +333,340 @@ func whepHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	answer, whepSessionId, err := webrtc.WHEP(string(offer), streamKey)
+	if streamKey, err = viewerStreamKey(req, streamKey); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	password := req.Header.Get(playbackPasswordHeader)
+	if password == "" {
+		password = req.URL.Query().Get("password")
+	}
+	if !webrtc.CheckPlaybackPassword(streamKey, password) {
+		logHTTPError(res, "Playback password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	eventTypes, err := negotiateViewerEvents(req)
 	if err != nil {
+		res.Header().Set(eventVersionHeader, strconv.Itoa(webrtc.ViewerEventsVersion))
+		logHTTPError(res, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	constraints, err := authorizeWHEP(req, streamKey)
+	switch {
+	case errors.Is(err, errWHEPAuthExpired):
+		res.Header().Set(disconnectReasonHeader, webrtc.StreamEndedAuthorizationExpired)
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errWHEPAuthDenied):
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		logHTTPError(res, "Playback authorization failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	constraints.EventTypes = eventTypes
+	answer, whepSessionId, err := webrtc.WHEP(req.Context(), string(offer), streamKey, clientIP(req), req.Header.Get(viewerIdHeader), constraints)
+	switch {
+	case errors.Is(err, webrtc.ErrViewerCountryBlocked):
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, webrtc.ErrViewerSessionLimit):
+		logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	apiPath := req.Host + strings.TrimSuffix(req.URL.RequestURI(), "whep")
-	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
-	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
-	res.Header().Add("Location", "/api/whep")
-	res.Header().Add("Content-Type", "application/sdp")
+	apiPath := req.Host + req.URL.Path[:strings.Index(req.URL.Path, "/whep")+1]
+	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="`+whepExtensionServerSentEvents+`"; events="`+sseEventsLink(eventTypes)+`"`)
+	res.Header().Set(eventVersionHeader, strconv.Itoa(webrtc.ViewerEventsVersion))
+	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="`+whepExtensionLayer+`"`)
+	addICEServerLinks(res, streamKey)
+	res.Header().Add("Location", path.Join(req.URL.Path[:strings.Index(req.URL.Path, "/whep")], "whep", whepSessionId))
+	res.Header().Add("Accept-Patch", trickleICEContentType)
+	res.Header().Set("ETag", webrtc.ICEETag(answer))
+	res.Header().Add("Content-Type", sdpContentType)
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer)
 }
 
+// whepDeleteHandler ends a WHEP session for viewers that leave with a DELETE
+// instead of waiting for ICE to time out
+func whepDeleteHandler(res http.ResponseWriter, whepSessionId string) {
+	err := webrtc.EndWHEP(whepSessionId, webrtc.StreamEndedViewerLeft)
+	switch {
+	case errors.Is(err, webrtc.ErrWHEPSessionNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	default:
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// whepPatchHandler adds the candidates of an application/trickle-ice-sdpfrag
+// body to a WHEP session. A fragment with new ICE credentials restarts ICE and
+// is answered with the new credentials and candidates of the server
+func whepPatchHandler(res http.ResponseWriter, req *http.Request, whepSessionId string) {
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mediaType != trickleICEContentType {
+		res.Header().Set("Accept-Patch", trickleICEContentType)
+		logHTTPError(res, "Content-Type must be "+trickleICEContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	frag, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answerFrag, err := webrtc.PatchWHEP(whepSessionId, string(frag), req.Header.Get("If-Match"))
+	switch {
+	case errors.Is(err, webrtc.ErrWHEPSessionNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case errors.Is(err, webrtc.ErrETagMismatch):
+		logHTTPError(res, err.Error(), http.StatusPreconditionFailed)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	case answerFrag == "":
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		res.Header().Set("ETag", webrtc.ICEETag(answerFrag))
+		res.Header().Set("Content-Type", trickleICEContentType)
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprint(res, answerFrag)
+	}
+}
+
+// whepServerSentEventsHandler sends the layers of the stream and again every
+// time they change, followed by captions and timed metadata as they are published
+// and the network quality of the session every time its score changes.
+// The response ends before HTTP_WRITE_TIMEOUT would cut it off and the client
+// reconnects after sseRetry, resuming after Last-Event-ID
 func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	streamKey, _ := webrtc.WHEPStreamKey(whepSessionId)
+	metrics.SSEConnections.Inc(streamKey)
+	defer metrics.SSEConnections.Dec(streamKey)
+
+	if _, err := webrtc.WHEPLayersChanged(whepSessionId); err != nil {
+		metrics.SSEEventsDropped.Inc(streamKey)
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// New clients only receive events published after they connected
+	lastEventId, err := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil {
+		lastEventId = latestViewerEventId(streamKey, whepSessionId)
+	}
+
 	res.Header().Set("Content-Type", "text/event-stream")
 	res.Header().Set("Cache-Control", "no-cache")
 	res.Header().Set("Connection", "keep-alive")
 
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
+	ctx := req.Context()
+	if writeTimeout := durationFromEnv("HTTP_WRITE_TIMEOUT", defaultHTTPWriteTimeout); writeTimeout > sseWriteTimeoutMargin {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, writeTimeout-sseWriteTimeoutMargin)
+		defer cancel()
+	}
+
+	if !writeServerSentEvent(res, streamKey, "retry: "+strconv.FormatInt(sseRetry.Milliseconds(), 10)+"\n\n") {
+		return
+	}
+
+	writeViewerEvents(sseEventWriter{res: res, streamKey: streamKey}, streamKey, whepSessionId, lastEventId, ctx.Done())
+}
+
+// viewerEventWriter sends the events of a WHEP session or room in the format
+// of a transport. The methods return false once the client is gone
+type viewerEventWriter interface {
+	writeNetworkQuality(networkQuality *webrtc.NetworkQuality) bool
+	writeLayers(layers []byte) bool
+	writeViewerEvent(event webrtc.ViewerEvent) bool
+	writeKeepalive() bool
+	writeClosing()
+	writeDisconnected(reason string)
+}
+
+// viewerEvents returns the events of the WHEP session after afterId, or of the
+// room if whepSessionId is empty
+func viewerEvents(streamKey, whepSessionId string, afterId uint64) ([]webrtc.ViewerEvent, <-chan struct{}, error) {
+	if whepSessionId == "" {
+		return webrtc.RoomViewerEvents(streamKey, afterId)
+	}
+	return webrtc.WHEPViewerEvents(whepSessionId, afterId)
+}
+
+// latestViewerEventId is the id of the last event published so far, so new
+// clients only receive events published after they connected
+func latestViewerEventId(streamKey, whepSessionId string) (lastEventId uint64) {
+	events, _, _ := viewerEvents(streamKey, whepSessionId, 0)
+	for _, event := range events {
+		lastEventId = event.ID
+	}
+	return lastEventId
+}
+
+// writeViewerEvents sends the events published after lastEventId until done
+// is closed or the client is gone. With a WHEP session the layers of the stream
+// and the network quality of the session are sent as well, without one only
+// the events of the room are
+func writeViewerEvents(w viewerEventWriter, streamKey, whepSessionId string, lastEventId uint64, done <-chan struct{}) {
+	var keepalive <-chan time.Time
+	if interval := durationFromEnv("SSE_KEEPALIVE_INTERVAL", defaultSSEKeepaliveInterval); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	var (
+		layersChanged, networkQualityChanged <-chan struct{}
+		err                                  error
+	)
+	if whepSessionId != "" {
+		if layersChanged, err = webrtc.WHEPLayersChanged(whepSessionId); err != nil {
+			return
+		}
+	}
+
+	acceptsNetworkQuality := whepSessionId != "" && webrtc.WHEPAcceptsEvent(whepSessionId, "networkQuality")
+	sendLayers, sendNetworkQuality := whepSessionId != "", acceptsNetworkQuality
+	for {
+		if whepSessionId != "" {
+			var networkQuality *webrtc.NetworkQuality
+			if networkQuality, networkQualityChanged, err = webrtc.WHEPNetworkQuality(whepSessionId); err != nil {
+				writeDisconnectedEvent(w, whepSessionId)
+				return
+			}
+
+			if sendNetworkQuality && networkQuality != nil && !w.writeNetworkQuality(networkQuality) {
+				return
+			}
+
+			if sendLayers {
+				layers, err := webrtc.WHEPLayers(whepSessionId)
+				if err != nil {
+					metrics.SSEEventsDropped.Inc(streamKey)
+					return
+				} else if !w.writeLayers(layers) {
+					return
+				}
+			}
+		}
+
+		events, eventsChanged, err := viewerEvents(streamKey, whepSessionId, lastEventId)
+		if err != nil {
+			return
+		}
 
-	layers, err := webrtc.WHEPLayers(whepSessionId)
+		for _, event := range events {
+			if !w.writeViewerEvent(event) {
+				return
+			}
+			lastEventId = event.ID
+		}
+
+		select {
+		case <-layersChanged:
+			sendLayers, sendNetworkQuality = true, false
+		case <-eventsChanged:
+			sendLayers, sendNetworkQuality = false, false
+		case <-networkQualityChanged:
+			sendLayers, sendNetworkQuality = false, acceptsNetworkQuality
+		case <-keepalive:
+			if !w.writeKeepalive() {
+				return
+			}
+			sendLayers, sendNetworkQuality = false, false
+		case <-serverClosing:
+			w.writeClosing()
+			return
+		case <-done:
+			return
+		}
+
+		// The session or the stream is gone once the session can't be found anymore
+		if whepSessionId == "" {
+			continue
+		} else if layersChanged, err = webrtc.WHEPLayersChanged(whepSessionId); err != nil {
+			writeDisconnectedEvent(w, whepSessionId)
+			return
+		}
+	}
+}
+
+// writeDisconnectedEvent tells the viewer why its session ended, if it did
+func writeDisconnectedEvent(w viewerEventWriter, whepSessionId string) {
+	if reason, ok := webrtc.WHEPEndReason(whepSessionId); ok {
+		w.writeDisconnected(reason)
+	}
+}
+
+// sseEventWriter writes the events of writeViewerEvents as Server-Sent Events
+type sseEventWriter struct {
+	res       http.ResponseWriter
+	streamKey string
+}
+
+func (s sseEventWriter) writeNetworkQuality(networkQuality *webrtc.NetworkQuality) bool {
+	data, err := json.Marshal(networkQuality)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		metrics.SSEEventsDropped.Inc(s.streamKey)
+		return true
+	}
+	return writeServerSentEvent(s.res, s.streamKey, "event: networkQuality\ndata: "+string(data)+"\n\n")
+}
+
+func (s sseEventWriter) writeLayers(layers []byte) bool {
+	return writeServerSentEvent(s.res, s.streamKey, "event: layers\ndata: "+string(layers)+"\n\n")
+}
+
+func (s sseEventWriter) writeViewerEvent(event webrtc.ViewerEvent) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		metrics.SSEEventsDropped.Inc(s.streamKey)
+		return true
+	}
+	return writeServerSentEvent(s.res, s.streamKey, "event: "+event.Type+"\nid: "+strconv.FormatUint(event.ID, 10)+"\ndata: "+string(data)+"\n\n")
+}
+
+func (s sseEventWriter) writeKeepalive() bool {
+	return writeServerSentEvent(s.res, s.streamKey, ": keepalive\n\n")
+}
+
+func (s sseEventWriter) writeClosing() {
+	writeServerSentEvent(s.res, s.streamKey, "event: closing\ndata: server closing\n\n")
+}
+
+func (s sseEventWriter) writeDisconnected(reason string) {
+	data, err := json.Marshal(disconnectedEventJSON{Reason: reason})
+	if err != nil {
+		metrics.SSEEventsDropped.Inc(s.streamKey)
 		return
 	}
+	writeServerSentEvent(s.res, s.streamKey, "event: disconnected\ndata: "+string(data)+"\n\n")
+}
+
+func writeServerSentEvent(res http.ResponseWriter, streamKey, event string) bool {
+	if _, err := fmt.Fprint(res, event); err != nil {
+		metrics.SSEWriteErrors.Inc(streamKey)
+		metrics.SSEEventsDropped.Inc(streamKey)
+		return false
+	}
 
-	fmt.Fprint(res, "event: layers\n")
-	fmt.Fprintf(res, "data: %s\n", string(layers))
-	fmt.Fprint(res, "\n\n")
+	if flusher, ok := res.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return true
 }
 
 func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
@@ -129,34 +679,205 @@ func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
 	vals := strings.Split(req.URL.RequestURI(), "/")
 	whepSessionId := vals[len(vals)-1]
 
+	if r.TemporalLayerId != nil {
+		if err := webrtc.WHEPChangeTemporalLayer(whepSessionId, *r.TemporalLayerId); err != nil {
+			logHTTPError(res, err.Error(), whepLayerErrorStatus(err))
+			return
+		}
+	}
+
+	// Only changing the temporal layer keeps the current encoding
+	if r.EncodingId == "" && r.TemporalLayerId != nil {
+		return
+	}
+
 	if err := webrtc.WHEPChangeLayer(whepSessionId, r.EncodingId); err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		logHTTPError(res, err.Error(), whepLayerErrorStatus(err))
 		return
 	}
 }
 
+func whepLayerErrorStatus(err error) int {
+	if errors.Is(err, webrtc.ErrWHEPSessionNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func versionHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(res).Encode(versionResponseJSON{
+		Version:        version,
+		APIVersions:    []string{"v1"},
+		WHIPExtensions: []string{},
+		WHEPExtensions: []string{whepExtensionServerSentEvents, whepExtensionLayer},
+	}); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// statusHandler supports filtering by ?streamKey= and ?streaming=true and
+// pagination with ?limit= and ?offset=
 func statusHandler(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	limit, offset := -1, 0
+	if val := query.Get("limit"); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit < 0 {
+			logHTTPError(res, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if val := query.Get("offset"); val != "" {
+		var err error
+		if offset, err = strconv.Atoi(val); err != nil || offset < 0 {
+			logHTTPError(res, "offset must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	statuses := []webrtc.StreamStatus{}
+	for _, status := range visibleStatuses(t, webrtc.GetStreamStatuses()) {
+		if streamKey := query.Get("streamKey"); streamKey != "" && status.StreamKey != streamKey {
+			continue
+		} else if query.Get("streaming") == "true" && !status.IsStreaming {
+			continue
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	if offset > len(statuses) {
+		offset = len(statuses)
+	}
+	statuses = statuses[offset:]
+	if limit >= 0 && limit < len(statuses) {
+		statuses = statuses[:limit]
+	}
+
 	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(statuses); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func streamStatusHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.Path, "/")
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
 
-	if err := json.NewEncoder(res).Encode(webrtc.GetStreamStatuses()); err != nil {
+	streamKey, err := namespacedStreamKey(t, vals[len(vals)-1])
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	detail, ok := webrtc.GetStreamDetail(streamKey)
+	if !ok {
+		logHTTPError(res, "Stream not found", http.StatusNotFound)
+		return
+	}
+	if t != nil {
+		detail.StreamKey = t.StripNamespace(detail.StreamKey)
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(detail); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// ingestHealthHandler reports the ingest quality of the stream whose stream key
+// is in Authorization, so publishers can check their connection before going live
+func ingestHealthHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey := req.Header.Get("Authorization")
+	if streamKey == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+		return
+	}
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if streamKey, err = namespacedStreamKey(t, streamKey); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(webrtc.GetIngestHealth(streamKey)); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 	}
 }
 
 func indexHTMLWhenNotFound(fs http.FileSystem) http.Handler {
 	fileServer := http.FileServer(fs)
+	spaFallback := os.Getenv("DISABLE_SPA_FALLBACK") == ""
 
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		_, err := fs.Open(path.Clean(req.URL.Path)) // Do not allow path traversals.
-		if errors.Is(err, os.ErrNotExist) {
-			http.ServeFile(resp, req, "./web/build/index.html")
+		cleanPath := path.Clean(req.URL.Path) // Do not allow path traversals.
+		f, err := fs.Open(cleanPath)
+		if errors.Is(err, os.ErrNotExist) && spaFallback {
+			serveIndexHTML(fs, resp, req)
 
 			return
+		} else if err == nil {
+			_ = f.Close()
+		}
+
+		// The frontend build puts a content hash in the name of everything in /static/
+		switch {
+		case strings.HasPrefix(cleanPath, "/static/"):
+			resp.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		case cleanPath == "/" || cleanPath == "/index.html":
+			resp.Header().Set("Cache-Control", "no-cache")
 		}
 		fileServer.ServeHTTP(resp, req)
 	})
 }
 
+func serveIndexHTML(fs http.FileSystem, resp http.ResponseWriter, req *http.Request) {
+	index, err := fs.Open("/index.html")
+	if err != nil {
+		logHTTPError(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer index.Close()
+
+	stat, err := index.Stat()
+	if err != nil {
+		logHTTPError(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(resp, req, "index.html", stat.ModTime(), index)
+}
+
+// webBuild returns the frontend to serve. WEB_BUILD_PATH takes precedence over
+// a frontend embedded in the binary, otherwise ./web/build is used
+func webBuild() http.FileSystem {
+	if buildPath := os.Getenv("WEB_BUILD_PATH"); buildPath != "" {
+		return http.Dir(buildPath)
+	} else if embedded, ok := embeddedWebBuild(); ok {
+		return http.FS(embedded)
+	}
+
+	return http.Dir("./web/build")
+}
+
 func corsHandler(next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Access-Control-Allow-Origin", "*")
@@ -171,22 +892,39 @@ func corsHandler(next func(w http.ResponseWriter, r *http.Request)) http.Handler
 }
 
 func main() {
+	args, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Print(flagsUsage)
+		log.Fatal(err)
+	}
+
 	loadConfigs := func() error {
+		envFile := envFileProd
 		if os.Getenv("APP_ENV") == "development" {
-			log.Println("Loading `" + envFileDev + "`")
-			return godotenv.Load(envFileDev)
+			envFile = envFileDev
 		} else {
-			if _, err := os.Stat("./web/build"); os.IsNotExist(err) {
+			_, hasEmbeddedWebBuild := embeddedWebBuild()
+			needsWebBuild := !hasEmbeddedWebBuild && os.Getenv("WEB_BUILD_PATH") == "" && os.Getenv("DISABLE_FRONTEND") == ""
+			if _, err := os.Stat("./web/build"); os.IsNotExist(err) && needsWebBuild {
 				return noBuildDirectoryErr
 			}
+		}
 
-			log.Println("Loading `" + envFileProd + "`")
-			return godotenv.Load(envFileProd)
-
+		if _, err := os.Stat(envFile); os.IsNotExist(err) {
+			return errEnvFileNotFound
 		}
+
+		log.Println("Loading `" + envFile + "`")
+		return godotenv.Load(envFile)
 	}
 
 	if err := loadConfigs(); err != nil {
+		cwdErr := err
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		log.Println("Failed to find config in CWD, changing CWD to executable path")
 
 		exePath, err := os.Executable()
@@ -198,12 +936,46 @@ func main() {
 			log.Fatal(err)
 		}
 
+		// Containers and systemd units usually set the environment directly
 		if err = loadConfigs(); err != nil {
-			log.Fatal(err)
+			switch {
+			case errors.Is(cwdErr, errEnvFileNotFound):
+				if err = os.Chdir(cwd); err != nil {
+					log.Fatal(err)
+				}
+				log.Println("No env file found, using the environment only")
+			case errors.Is(err, errEnvFileNotFound):
+				log.Println("No env file found, using the environment only")
+			default:
+				log.Fatal(err)
+			}
 		}
 	}
 
+	if len(args) > 0 && args[0] == "check" {
+		os.Exit(runConfigCheck())
+	}
+
+	if err := store.Configure(); err != nil {
+		log.Fatal(err)
+	}
+
 	webrtc.Configure()
+	if err := webhook.Configure(); err != nil {
+		log.Fatal(err)
+	} else if err := tenant.Configure(); err != nil {
+		log.Fatal(err)
+	} else if err := moderation.Configure(); err != nil {
+		log.Fatal(err)
+	} else if err := webrtc.RestoreState(); err != nil {
+		log.Fatal(err)
+	} else if err := moderation.Restore(); err != nil {
+		log.Fatal(err)
+	}
+	eventlog.Configure()
+	geoip.Configure()
+
+	reloadOnSIGHUP()
 
 	if os.Getenv("NETWORK_TEST_ON_START") == "true" {
 		fmt.Println(networkTestIntroMessage) //nolint
@@ -234,6 +1006,8 @@ func main() {
 				}),
 			}
 
+			configureHTTPTimeouts(redirectServer)
+
 			log.Println("Running HTTP->HTTPS redirect Server at :" + httpsRedirectPort)
 			log.Fatal(redirectServer.ListenAndServe())
 		}()
@@ -241,26 +1015,69 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/", indexHTMLWhenNotFound(http.Dir("./web/build")))
-	mux.HandleFunc("/api/whip", corsHandler(whipHandler))
-	mux.HandleFunc("/api/whep", corsHandler(whepHandler))
-	mux.HandleFunc("/api/sse/", corsHandler(whepServerSentEventsHandler))
-	mux.HandleFunc("/api/layer/", corsHandler(whepLayerHandler))
+	if os.Getenv("DISABLE_FRONTEND") == "" {
+		mux.Handle("/", indexHTMLWhenNotFound(webBuild()))
+	}
+
+	// Metrics and admin routes are only served on INTERNAL_HTTP_ADDRESS if it is set
+	internalMux := mux
+	if os.Getenv("INTERNAL_HTTP_ADDRESS") != "" {
+		internalMux = http.NewServeMux()
+	}
+
+	handleAPI := func(mux *http.ServeMux, pattern string, handler http.HandlerFunc, methods ...string) {
+		handler = corsHandler(methodHandler(handler, methods...))
+		mux.HandleFunc(apiPathV1+pattern, handler)
+		mux.HandleFunc(apiPathLegacy+pattern, handler)
+	}
+
+	handleAPI(mux, "/whip", whipHandler, http.MethodPost, http.MethodDelete)
+	handleAPI(mux, "/whip/", whipSessionHandler, http.MethodPatch, http.MethodDelete)
+	handleAPI(mux, "/whep", whepHandler, http.MethodPost)
+	handleAPI(mux, "/whep/", whepHandler, http.MethodPost, http.MethodPatch, http.MethodDelete)
+	handleAPI(mux, "/alias/", aliasHandler, http.MethodPut, http.MethodDelete)
+	handleAPI(mux, "/sse/", whepServerSentEventsHandler, http.MethodGet)
+	handleAPI(mux, "/ws/room/", roomEventsWebSocketHandler, http.MethodGet)
+	handleAPI(mux, "/layer/", whepLayerHandler, http.MethodPost)
+	handleAPI(mux, "/version", versionHandler, http.MethodGet)
+	handleAPI(mux, "/healthz", healthzHandler, http.MethodGet)
+	handleAPI(mux, "/node", nodeHandler, http.MethodGet)
+	handleAPI(mux, "/recordings", recordingsHandler, http.MethodGet, http.MethodPost)
+	handleAPI(mux, "/recordings/", recordingHandler, http.MethodGet, http.MethodDelete)
+	handleAPI(mux, "/rooms/", roomHandler, http.MethodGet, http.MethodPut)
+	handleAPI(mux, "/schedule/", scheduleHandler, http.MethodGet, http.MethodPut, http.MethodDelete)
+	handleAPI(mux, "/playback-password/", playbackPasswordHandler, http.MethodPut, http.MethodDelete)
+	handleAPI(mux, "/captions/", captionsHandler, http.MethodPost)
+	handleAPI(mux, "/metadata/", timedMetadataHandler, http.MethodPost)
+	handleAPI(mux, "/stream-metadata/", streamMetadataHandler, http.MethodGet, http.MethodPut)
+	handleAPI(mux, "/ingest/health", ingestHealthHandler, http.MethodGet)
+	handleAPI(mux, "/report", reportHandler, http.MethodPost)
+	handleAPI(mux, "/history", historyHandler, http.MethodGet)
+	handleAPI(mux, "/vod/", vodHandler, http.MethodGet, http.MethodHead)
 
 	if os.Getenv("DISABLE_STATUS") == "" {
-		mux.HandleFunc("/api/status", corsHandler(statusHandler))
+		handleAPI(mux, "/status", statusHandler, http.MethodGet)
+		handleAPI(mux, "/status/", streamStatusHandler, http.MethodGet)
+		handleAPI(mux, "/stats/ws", statsWebSocketHandler, http.MethodGet)
+	}
+
+	if os.Getenv("ENABLE_METRICS") != "" {
+		internalMux.HandleFunc("/metrics", methodHandler(metrics.Handler, http.MethodGet))
 	}
 
-	server := &http.Server{
-		Handler: mux,
-		Addr:    os.Getenv("HTTP_ADDRESS"),
+	if adminEnabled() {
+		admin := adminHandler()
+		for _, prefix := range []string{apiPathV1, apiPathLegacy} {
+			internalMux.Handle(prefix+"/admin/", corsHandler(http.StripPrefix(prefix+"/admin", admin).ServeHTTP))
+		}
 	}
 
+	var tlsConfig *tls.Config
 	tlsKey := os.Getenv("SSL_KEY")
 	tlsCert := os.Getenv("SSL_CERT")
 
 	if tlsKey != "" && tlsCert != "" {
-		server.TLSConfig = &tls.Config{
+		tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{},
 		}
 
@@ -269,13 +1086,47 @@ func main() {
 			log.Fatal(err)
 		}
 
-		server.TLSConfig.Certificates = append(server.TLSConfig.Certificates, cert)
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
 
-		log.Println("Running HTTPS Server at `" + os.Getenv("HTTP_ADDRESS") + "`")
-		log.Fatal(server.ListenAndServeTLS("", ""))
-	} else {
-		log.Println("Running HTTP Server at `" + os.Getenv("HTTP_ADDRESS") + "`")
-		log.Fatal(server.ListenAndServe())
+	// Browsers limit HTTP/1.1 to six connections per host, which SSE quickly exhausts.
+	// HTTP/2 is negotiated over TLS, ENABLE_H2C allows it in plaintext behind a proxy
+	http2Server := &http2.Server{}
+	if val := os.Getenv("HTTP2_MAX_CONCURRENT_STREAMS"); val != "" {
+		maxConcurrentStreams, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			log.Fatal(err)
+		}
+		http2Server.MaxConcurrentStreams = uint32(maxConcurrentStreams)
+	}
+
+	httpListeners := []*httpListener{}
+	for _, address := range strings.Split(os.Getenv("HTTP_ADDRESS"), "|") {
+		httpListeners = append(httpListeners, &httpListener{address: address, handler: requestLogHandler(compressHandler(maxBodySizeHandler(mux))), tlsConfig: tlsConfig})
+	}
+
+	if addresses := os.Getenv("INTERNAL_HTTP_ADDRESS"); addresses != "" {
+		for _, address := range strings.Split(addresses, "|") {
+			httpListeners = append(httpListeners, &httpListener{address: address, handler: requestLogHandler(compressHandler(maxBodySizeHandler(internalMux)))})
+		}
 	}
 
+	for _, h := range httpListeners {
+		if err := h.bind(http2Server); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if address := os.Getenv("GRPC_ADDRESS"); address != "" {
+		if _, err := serveGRPC(address, tlsConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	systemd.Ready()
+	systemd.Watchdog(func() bool {
+		return webrtc.IsHealthy(healthCheckTimeout)
+	})
+
+	serveUntilSignal(httpListeners)
 }
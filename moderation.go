@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/moderation"
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+type (
+	reportRequestJSON struct {
+		StreamKey string `json:"streamKey"`
+		Reason    string `json:"reason"`
+	}
+
+	resolveReportRequestJSON struct {
+		Action string `json:"action"`
+	}
+)
+
+// reportHandler lets viewers flag a stream for moderators. Once enough viewers
+// flagged it the stream is suspended until a moderator resolves the reports
+func reportHandler(res http.ResponseWriter, req *http.Request) {
+	var r reportRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := viewingTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	streamKey, err := reportedStreamKey(t, r.StreamKey)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if streamKey == "" {
+		logHTTPError(res, "Stream not found", http.StatusNotFound)
+		return
+	}
+	r.StreamKey = streamKey
+
+	report, suspended, err := moderation.Submit(r.StreamKey, reporterAddress(clientIP(req)), r.Reason)
+	switch {
+	case errors.Is(err, moderation.ErrAlreadyReported):
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, moderation.ErrTooManyReports):
+		logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if suspended {
+		log.Printf("Suspending %s after it was reported", r.StreamKey)
+		endSuspendedStream(r.StreamKey)
+	}
+
+	writeJSON(res, http.StatusCreated, report)
+}
+
+func adminReportsHandler(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, http.StatusOK, moderation.Reports(req.URL.Query().Get("status")))
+}
+
+// adminReportHandler resolves a report and every other open report of the
+// same stream with `{"action": "dismiss"}` or `{"action": "uphold"}`
+func adminReportHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.Path, "/")
+
+	var r resolveReportRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := moderation.Resolve(vals[len(vals)-1], r.Action)
+	switch {
+	case errors.Is(err, moderation.ErrReportNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, moderation.ErrReportResolved):
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Action == moderation.ActionUphold {
+		endSuspendedStream(report.StreamKey)
+	}
+
+	writeJSON(res, http.StatusOK, report)
+}
+
+// adminSuspensionHandler lifts the suspension of a stream with DELETE
+func adminSuspensionHandler(res http.ResponseWriter, req *http.Request) {
+	// Stream keys of tenants contain a slash
+	if !moderation.Unsuspend(strings.TrimPrefix(req.URL.Path, "/suspensions/")) {
+		logHTTPError(res, "Stream is not suspended", http.StatusNotFound)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// reportedStreamKey namespaces the stream key a viewer reported and matches it
+// with or without the Bearer prefix, like viewers match stream keys. It is
+// empty if neither form is live or was broadcast before
+func reportedStreamKey(t *tenant.Tenant, streamKey string) (string, error) {
+	for _, candidate := range []string{streamKey, otherBearerForm(streamKey)} {
+		namespaced, err := namespacedStreamKey(t, candidate)
+		if err != nil {
+			return "", err
+		} else if webrtc.StreamExists(namespaced) {
+			return namespaced, nil
+		}
+	}
+
+	return "", nil
+}
+
+// reporterAddress tells reporters apart by IP. IPv6 clients usually get a
+// whole /64, so its addresses count as one reporter
+func reporterAddress(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+
+	network := net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return network.String()
+}
+
+// streamSuspended reports if the publisher's stream key is suspended with or
+// without the Bearer prefix, so a suspended stream can't come back under the
+// other form
+func streamSuspended(req *http.Request, streamKey string) bool {
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		return false
+	}
+
+	for _, candidate := range []string{streamKey, otherBearerForm(streamKey)} {
+		if namespaced, err := namespacedStreamKey(t, candidate); err == nil && moderation.IsSuspended(namespaced) {
+			return true
+		}
+	}
+	return false
+}
+
+func endSuspendedStream(streamKey string) {
+	if err := webrtc.EndWHIP(streamKey, webrtc.StreamEndedSuspended); err != nil && !errors.Is(err, webrtc.ErrNoPublisher) {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,63 @@
+package testclient
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	videoFrameDuration = time.Second / 30
+	audioFrameDuration = time.Millisecond * 20
+
+	// Every 30th frame is a keyframe, one a second
+	videoKeyframeInterval = 30
+)
+
+var (
+	videoCodec = webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}
+	audioCodec = webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: 48000,
+		Channels:  2,
+	}
+
+	annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+	// Constrained baseline parameter sets of a 1280x720 stream
+	h264SPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0f, 0x23, 0xc6, 0x0c, 0xa8}
+	h264PPS = []byte{0x68, 0xce, 0x3c, 0x80}
+
+	// opusSilence is a valid Opus frame that decodes to 20ms of silence
+	opusSilence = []byte{0xf8, 0xff, 0xfe}
+)
+
+// syntheticH264Frame is shaped like an H264 access unit so Broadcast Box finds
+// the keyframes and their resolution. The slices are filler and can't be decoded
+func syntheticH264Frame(index int) media.Sample {
+	frame := &bytes.Buffer{}
+	if index%videoKeyframeInterval == 0 {
+		for _, nalu := range [][]byte{h264SPS, h264PPS, syntheticSlice(0x65, 1000)} {
+			frame.Write(annexBStartCode)
+			frame.Write(nalu)
+		}
+	} else {
+		frame.Write(annexBStartCode)
+		frame.Write(syntheticSlice(0x41, 200))
+	}
+
+	return media.Sample{Data: frame.Bytes(), Duration: videoFrameDuration}
+}
+
+// syntheticSlice is filled with a byte that never forms a start code
+func syntheticSlice(header byte, size int) []byte {
+	slice := bytes.Repeat([]byte{0xaa}, size)
+	slice[0] = header
+	return slice
+}
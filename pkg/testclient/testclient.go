@@ -0,0 +1,190 @@
+// Package testclient publishes and watches Broadcast Box streams from Go with
+// synthetic media, for integration tests that exercise the server end to end
+package testclient
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/pkg/whepclient"
+	"github.com/glimesh/broadcast-box/pkg/whipclient"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+var errICEFailed = errors.New("ICE failed to connect")
+
+// Publisher is a WHIP client that sends synthetic H264 video and Opus silence
+type Publisher struct {
+	client *whipclient.Client
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Viewer is a WHEP client that counts the packets it receives
+type Viewer struct {
+	client *whepclient.Client
+
+	audioPacketsReceived atomic.Uint64
+	videoPacketsReceived atomic.Uint64
+}
+
+// Publish connects to whipURL, like http://localhost:8080/api/whip, and sends
+// media until ctx is done or Close is called. It returns once ICE connected
+func Publish(ctx context.Context, whipURL, streamKey string) (*Publisher, error) {
+	videoTrack, err := webrtc.NewTrackLocalStaticSample(videoCodec, "video", "testclient")
+	if err != nil {
+		return nil, err
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(audioCodec, "audio", "testclient")
+	if err != nil {
+		return nil, err
+	}
+
+	connected, onICEConnectionStateChange := waitForICE()
+	client, err := whipclient.Publish(ctx, whipclient.Config{
+		URL:                        whipURL,
+		StreamKey:                  streamKey,
+		OnICEConnectionStateChange: onICEConnectionStateChange,
+	}, videoTrack, audioTrack)
+	if err != nil {
+		return nil, err
+	} else if err = connected(ctx); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	sendCtx, cancel := context.WithCancel(context.Background())
+	p := &Publisher{client: client, cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(p.done)
+
+		videoTicker, audioTicker := time.NewTicker(videoFrameDuration), time.NewTicker(audioFrameDuration)
+		defer videoTicker.Stop()
+		defer audioTicker.Stop()
+
+		for frame := 0; ; {
+			var err error
+			select {
+			case <-ctx.Done():
+				return
+			case <-sendCtx.Done():
+				return
+			case <-videoTicker.C:
+				err = videoTrack.WriteSample(syntheticH264Frame(frame))
+				frame++
+			case <-audioTicker.C:
+				err = audioTrack.WriteSample(media.Sample{Data: opusSilence, Duration: audioFrameDuration})
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// Close stops sending and ends the WHIP session
+func (p *Publisher) Close() error {
+	p.cancel()
+	<-p.done
+
+	return p.client.Close()
+}
+
+// View connects to whepURL, like http://localhost:8080/api/whep, and receives
+// the stream until Close is called. It returns once ICE connected
+func View(ctx context.Context, whepURL, streamKey string) (*Viewer, error) {
+	v := &Viewer{}
+
+	connected, onICEConnectionStateChange := waitForICE()
+	client, err := whepclient.View(ctx, whepclient.Config{
+		URL:                        whepURL,
+		StreamKey:                  streamKey,
+		OnICEConnectionStateChange: onICEConnectionStateChange,
+	}, func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		counter := &v.videoPacketsReceived
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			counter = &v.audioPacketsReceived
+		}
+
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+			counter.Add(1)
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if err = connected(ctx); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	v.client = client
+	return v, nil
+}
+
+// PacketsReceived is how many audio and video packets arrived so far
+func (v *Viewer) PacketsReceived() (audio, video uint64) {
+	return v.audioPacketsReceived.Load(), v.videoPacketsReceived.Load()
+}
+
+// WaitForMedia blocks until both audio and video packets arrived
+func (v *Viewer) WaitForMedia(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+
+	for {
+		if audio, video := v.PacketsReceived(); audio != 0 && video != 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (v *Viewer) Close() error {
+	return v.client.Close()
+}
+
+// waitForICE returns a function that blocks until the ICE state reported to
+// the callback is connected or failed
+func waitForICE() (func(context.Context) error, func(webrtc.ICEConnectionState)) {
+	connected, connectedCancel := context.WithCancel(context.Background())
+	failed, failedCancel := context.WithCancel(context.Background())
+
+	wait := func(ctx context.Context) error {
+		defer connectedCancel()
+		defer failedCancel()
+
+		select {
+		case <-connected.Done():
+			return nil
+		case <-failed.Done():
+			return errICEFailed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return wait, func(s webrtc.ICEConnectionState) {
+		switch s {
+		case webrtc.ICEConnectionStateConnected:
+			connectedCancel()
+		case webrtc.ICEConnectionStateFailed:
+			failedCancel()
+		}
+	}
+}
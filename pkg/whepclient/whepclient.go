@@ -0,0 +1,105 @@
+// Package whepclient watches a WHEP endpoint like Broadcast Box's /api/whep
+package whepclient
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+// Sent with the offer of password protected streams
+const playbackPasswordHeader = "X-Playback-Password"
+
+type Config struct {
+	// WHEP endpoint, like http://localhost:8080/api/whep
+	URL       string
+	StreamKey string
+
+	// Password of streams that have a playback password
+	Password string
+
+	// Also receive the audio of a shared screen or tab. It arrives as a
+	// second audio track with the id "system-audio"
+	SystemAudio bool
+
+	// Added to every request, like X-Viewer-ID
+	Header http.Header
+
+	// http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// ICE servers and other settings for the PeerConnection
+	WebRTC webrtc.Configuration
+
+	// PATCH candidates as they are found instead of waiting for gathering
+	Trickle bool
+
+	// Watch again when the connection fails, ReconnectDelay defaults to 2 seconds
+	Reconnect      bool
+	ReconnectDelay time.Duration
+
+	OnICEConnectionStateChange func(webrtc.ICEConnectionState)
+}
+
+// ResponseError is returned when the server refuses playback. Reconnecting
+// stops once the server answers 403, like for a blocked country
+type ResponseError = signaling.ResponseError
+
+// Client receives the audio and video of a stream
+type Client struct {
+	connection *signaling.Connection
+}
+
+// View negotiates a WHEP session. onTrack is called with the audio and video
+// tracks of every PeerConnection, so again after a reconnect
+func View(ctx context.Context, config Config, onTrack func(*webrtc.TrackRemote, *webrtc.RTPReceiver)) (*Client, error) {
+	header := config.Header.Clone()
+	if config.Password != "" {
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set(playbackPasswordHeader, config.Password)
+	}
+
+	connection, err := signaling.Connect(ctx, signaling.ConnectionConfig{
+		Config: signaling.Config{
+			URL:        config.URL,
+			Token:      config.StreamKey,
+			Header:     header,
+			HTTPClient: config.HTTPClient,
+			Trickle:    config.Trickle,
+		},
+		WebRTC:                     config.WebRTC,
+		Reconnect:                  config.Reconnect,
+		ReconnectDelay:             config.ReconnectDelay,
+		OnICEConnectionStateChange: config.OnICEConnectionStateChange,
+	}, func(peerConnection *webrtc.PeerConnection) error {
+		kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+		if config.SystemAudio {
+			kinds = append(kinds, webrtc.RTPCodecTypeAudio)
+		}
+
+		for _, kind := range kinds {
+			if _, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				return err
+			}
+		}
+
+		peerConnection.OnTrack(onTrack)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{connection: connection}, nil
+}
+
+func (c *Client) Close() error {
+	return c.connection.Close()
+}
@@ -0,0 +1,81 @@
+// Package whipclient publishes to a WHIP endpoint like Broadcast Box's /api/whip
+package whipclient
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+type Config struct {
+	// WHIP endpoint, like http://localhost:8080/api/whip
+	URL       string
+	StreamKey string
+
+	// Added to every request, like X-API-Key for tenants
+	Header http.Header
+
+	// http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// ICE servers and other settings for the PeerConnection
+	WebRTC webrtc.Configuration
+
+	// PATCH candidates as they are found instead of waiting for gathering
+	Trickle bool
+
+	// Publish again when the connection fails, ReconnectDelay defaults to 2 seconds
+	Reconnect      bool
+	ReconnectDelay time.Duration
+
+	OnICEConnectionStateChange func(webrtc.ICEConnectionState)
+}
+
+// ResponseError is returned when the server refuses to publish. Reconnecting
+// stops once the server answers 403, like for a suspended stream
+type ResponseError = signaling.ResponseError
+
+// Client publishes the tracks it was given. Samples written to them are sent
+// on whichever PeerConnection is current, across reconnects
+type Client struct {
+	connection *signaling.Connection
+}
+
+// Publish negotiates a WHIP session that sends tracks
+func Publish(ctx context.Context, config Config, tracks ...webrtc.TrackLocal) (*Client, error) {
+	connection, err := signaling.Connect(ctx, signaling.ConnectionConfig{
+		Config: signaling.Config{
+			URL:        config.URL,
+			Token:      config.StreamKey,
+			Header:     config.Header,
+			HTTPClient: config.HTTPClient,
+			Trickle:    config.Trickle,
+		},
+		WebRTC:                     config.WebRTC,
+		Reconnect:                  config.Reconnect,
+		ReconnectDelay:             config.ReconnectDelay,
+		OnICEConnectionStateChange: config.OnICEConnectionStateChange,
+	}, func(peerConnection *webrtc.PeerConnection) error {
+		for _, track := range tracks {
+			if _, err := peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionSendonly,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{connection: connection}, nil
+}
+
+// Close stops publishing, viewers are told the publisher left
+func (c *Client) Close() error {
+	return c.connection.Close()
+}
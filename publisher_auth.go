@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Sent by streamers to manage their stream. Viewers send the stream key as
+// well, so it doesn't prove that the request comes from the streamer
+const publishTokenHeader = "X-Publish-Token"
+
+type publishTokenJSON struct {
+	StreamKey    string `json:"streamKey"`
+	PublishToken string `json:"publishToken"`
+}
+
+// publishToken is the HMAC of the stream key with PUBLISH_SECRET, empty if
+// PUBLISH_SECRET isn't set. streamKey is namespaced if it belongs to a tenant
+func publishToken(streamKey string) string {
+	secret := os.Getenv("PUBLISH_SECRET")
+	if secret == "" || streamKey == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(streamKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// publisherAuthorized allows admins, the tenant that owns the stream with its
+// API key, or the streamer with the publish token of the stream. streamKey is
+// namespaced if it belongs to a tenant
+func publisherAuthorized(req *http.Request, streamKey string) bool {
+	if streamKey == "" {
+		return false
+	} else if adminEnabled() && adminAuthorized(req) {
+		return true
+	}
+
+	if t, err := authenticatedTenant(req); err == nil && t != nil && t.Owns(streamKey) {
+		return true
+	}
+
+	token := publishToken(streamKey)
+	given := req.Header.Get(publishTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// adminPublishTokenHandler returns the publish token of the stream key in
+// `/publish-token/{streamKey}`, for admins to hand to the streamer
+func adminPublishTokenHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey := strings.TrimPrefix(req.URL.Path, "/publish-token/")
+
+	token := publishToken(streamKey)
+	if token == "" {
+		logHTTPError(res, "PUBLISH_SECRET is not set", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, publishTokenJSON{StreamKey: streamKey, PublishToken: token})
+}
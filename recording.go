@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+type (
+	recordingRequestJSON struct {
+		StreamKey string `json:"streamKey"`
+		Layer     string `json:"layer"`
+	}
+
+	scheduleRequestJSON struct {
+		Title    string `json:"title"`
+		StartsAt int64  `json:"startsAt"`
+	}
+
+	playbackPasswordRequestJSON struct {
+		Password string `json:"password"`
+	}
+
+	roomPolicyRequestJSON struct {
+		AutoRecord       bool   `json:"autoRecord"`
+		MaxIngestBitrate uint64 `json:"maxIngestBitrate"`
+		MaxIngestHeight  int32  `json:"maxIngestHeight"`
+		IngestPolicy     string `json:"ingestPolicy"`
+
+		MaxSessionsPerViewer int      `json:"maxSessionsPerViewer"`
+		BlockedCountries     []string `json:"blockedCountries"`
+
+		AudioOnly bool `json:"audioOnly"`
+		RelayOnly bool `json:"relayOnly"`
+
+		MaxPublishers int `json:"maxPublishers"`
+
+		ViewerDataRelay bool `json:"viewerDataRelay"`
+	}
+)
+
+// recordingsHandler starts a recording with POST and lists every recording with GET.
+// If streamKey is omitted the Authorization header is used as the stream key
+func recordingsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		if !adminEnabled() || !adminAuthorized(req) {
+			logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, webrtc.GetRecordings())
+		return
+	}
+
+	var r recordingRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.StreamKey == "" {
+		r.StreamKey = req.Header.Get("Authorization")
+	}
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	} else if r.StreamKey, err = namespacedStreamKey(t, r.StreamKey); err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if !publisherAuthorized(req, r.StreamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status, err := webrtc.StartRecording(r.StreamKey, r.Layer)
+	switch {
+	case errors.Is(err, webrtc.ErrStreamNotActive):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case errors.Is(err, webrtc.ErrAlreadyRecording):
+		logHTTPError(res, err.Error(), http.StatusConflict)
+	case errors.Is(err, webrtc.ErrRecordingDiskFull):
+		logHTTPError(res, err.Error(), http.StatusInsufficientStorage)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(res, http.StatusCreated, status)
+	}
+}
+
+// recordingHandler returns the status of a recording with GET and stops it with DELETE
+func recordingHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.Path, "/")
+	recordingId := vals[len(vals)-1]
+
+	status, ok := webrtc.GetRecording(recordingId)
+	if !ok {
+		logHTTPError(res, webrtc.ErrRecordingNotFound.Error(), http.StatusNotFound)
+		return
+	} else if !publisherAuthorized(req, status.StreamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		var err error
+		if status, err = webrtc.StopRecording(recordingId); err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(res, http.StatusOK, status)
+}
+
+// roomHandler returns the policy of a room with GET and replaces it with PUT
+func roomHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.Path, "/")
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	streamKey, err := namespacedStreamKey(t, vals[len(vals)-1])
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if !publisherAuthorized(req, streamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Method == http.MethodPut {
+		var r roomPolicyRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		policy, err := roomPolicyFromRequest(streamKey, r)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		webrtc.SetRoomPolicy(policy)
+	}
+
+	writeJSON(res, http.StatusOK, webrtc.GetRoomPolicy(streamKey))
+}
+
+// roomPolicyFromRequest validates a room policy, filling in the defaults of omitted fields
+func roomPolicyFromRequest(streamKey string, r roomPolicyRequestJSON) (webrtc.RoomPolicy, error) {
+	switch r.IngestPolicy {
+	case "":
+		r.IngestPolicy = "warn"
+	case "warn", "terminate":
+	default:
+		return webrtc.RoomPolicy{}, errors.New("ingestPolicy must be warn or terminate")
+	}
+
+	if r.MaxSessionsPerViewer < 0 {
+		return webrtc.RoomPolicy{}, errors.New("maxSessionsPerViewer can't be negative")
+	} else if r.MaxPublishers < 0 {
+		return webrtc.RoomPolicy{}, errors.New("maxPublishers can't be negative")
+	} else if r.RelayOnly && len(webrtc.TURNServers()) == 0 {
+		return webrtc.RoomPolicy{}, webrtc.ErrNoTURNServers
+	} else if r.BlockedCountries == nil {
+		r.BlockedCountries = []string{}
+	}
+
+	return webrtc.RoomPolicy{
+		StreamKey:            streamKey,
+		AutoRecord:           r.AutoRecord,
+		MaxIngestBitrate:     r.MaxIngestBitrate,
+		MaxIngestHeight:      r.MaxIngestHeight,
+		IngestPolicy:         r.IngestPolicy,
+		MaxSessionsPerViewer: r.MaxSessionsPerViewer,
+		BlockedCountries:     r.BlockedCountries,
+		AudioOnly:            r.AudioOnly,
+		RelayOnly:            r.RelayOnly,
+		MaxPublishers:        r.MaxPublishers,
+		ViewerDataRelay:      r.ViewerDataRelay,
+	}, nil
+}
+
+// scheduleHandler returns the schedule of a stream with GET, announces it with
+// PUT and cancels it with DELETE
+func scheduleHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.Path, "/")
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	streamKey, err := namespacedStreamKey(t, vals[len(vals)-1])
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if !publisherAuthorized(req, streamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		var r scheduleRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		schedule, err := webrtc.SetSchedule(streamKey, r.Title, r.StartsAt)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(res, http.StatusOK, schedule)
+	case http.MethodDelete:
+		if !webrtc.DeleteSchedule(streamKey) {
+			logHTTPError(res, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		schedule, ok := webrtc.GetSchedule(streamKey)
+		if !ok {
+			logHTTPError(res, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(res, http.StatusOK, schedule)
+	}
+}
+
+// playbackPasswordHandler sets the password viewers need to watch a stream
+// with PUT and removes it with DELETE
+func playbackPasswordHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.Path, "/")
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	streamKey, err := namespacedStreamKey(t, vals[len(vals)-1])
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	if !publisherAuthorized(req, streamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var r playbackPasswordRequestJSON
+	if req.Method == http.MethodPut {
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	webrtc.SetPlaybackPassword(streamKey, r.Password)
+	res.WriteHeader(http.StatusNoContent)
+}
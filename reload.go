@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/glimesh/broadcast-box/internal/moderation"
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webhook"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/joho/godotenv"
+)
+
+// reloadConfigs re-reads the env file, overriding values loaded at startup except
+// flags, and applies the settings that can change without dropping PeerConnections.
+func reloadConfigs() error {
+	envFile := envFileProd
+	if os.Getenv("APP_ENV") == "development" {
+		envFile = envFileDev
+	}
+
+	if _, err := os.Stat(envFile); err == nil {
+		log.Println("Reloading `" + envFile + "`")
+		if err = godotenv.Overload(envFile); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := applyFlags(); err != nil {
+		return err
+	}
+
+	if err := webhook.Configure(); err != nil {
+		return err
+	}
+
+	if err := tenant.Configure(); err != nil {
+		return err
+	}
+
+	if err := moderation.Configure(); err != nil {
+		return err
+	}
+
+	return webrtc.Reload()
+}
+
+func reloadOnSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			if err := reloadConfigs(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+func adminReloadHandler(res http.ResponseWriter, req *http.Request) {
+	if err := reloadConfigs(); err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	}
+}
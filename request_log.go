@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/requestid"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket handlers take over the connection
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// requestLogHandler assigns every request an ID, or reuses the one sent by the
+// client, and logs the request once it completes
+func requestLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestid.Header)
+		if id == "" {
+			id = requestid.New()
+		}
+
+		res.Header().Set(requestid.Header, id)
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, req.WithContext(requestid.NewContext(req.Context(), id)))
+
+		log.Printf("[%s] %s %s %d %s %s\n", id, req.Method, req.URL.Path, recorder.status, time.Since(start), req.RemoteAddr)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/systemd"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultShutdownTimeout = time.Second * 10
+
+	drainCheckInterval = time.Second
+	healthCheckTimeout = time.Second * 5
+
+	// Sent with 503s while draining so clients retry against another instance
+	drainRetryAfterSeconds = "5"
+)
+
+var (
+	// serverDraining is closed on the first SIGINT/SIGTERM. New WHIP and WHEP
+	// sessions are refused while existing ones continue for SHUTDOWN_GRACE_PERIOD
+	serverDraining = make(chan struct{})
+
+	// serverClosing is closed once shutdown starts. Open SSE responses send a
+	// closing event so clients don't reconnect
+	serverClosing = make(chan struct{})
+)
+
+// isServerDraining reports if the server is shutting down or a maintenance
+// window started
+func isServerDraining() bool {
+	select {
+	case <-serverDraining:
+		return true
+	default:
+		return webrtc.InMaintenance()
+	}
+}
+
+// refuseWhileDraining answers with 503 and reports true if the server is draining
+func refuseWhileDraining(res http.ResponseWriter) bool {
+	if !isServerDraining() {
+		return false
+	}
+
+	res.Header().Set("Retry-After", drainRetryAfterSeconds)
+	if webrtc.InMaintenance() {
+		res.Header().Set(disconnectReasonHeader, webrtc.StreamEndedMaintenance)
+		logHTTPError(res, "Server is in maintenance", http.StatusServiceUnavailable)
+	} else {
+		res.Header().Set(disconnectReasonHeader, webrtc.StreamEndedServerShutdown)
+		logHTTPError(res, "Server is shutting down", http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+// healthzHandler is meant for load balancer and Kubernetes readiness probes. It
+// fails while draining so new viewers are sent to other instances
+func healthzHandler(res http.ResponseWriter, req *http.Request) {
+	if isServerDraining() {
+		logHTTPError(res, "Server is shutting down", http.StatusServiceUnavailable)
+	} else if !webrtc.IsHealthy(healthCheckTimeout) {
+		logHTTPError(res, "Stream state is locked", http.StatusServiceUnavailable)
+	}
+}
+
+// nodeHandler reports the load of the server so load balancers can send new
+// sessions to the instance with the highest effectiveWeight
+func nodeHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(res).Encode(webrtc.GetNodeStatus(isServerDraining())); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// serveUntilSignal serves every listener until one fails or SIGINT/SIGTERM is
+// received, then drains and shuts down gracefully. A second signal skips the drain
+func serveUntilSignal(httpListeners []*httpListener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	serveErr := make(chan error, len(httpListeners))
+	for _, h := range httpListeners {
+		go func(h *httpListener) {
+			serveErr <- h.serve()
+		}(h)
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Println("Received " + sig.String() + ", shutting down")
+	}
+
+	if err := systemd.Notify("STOPPING=1"); err != nil {
+		log.Println(err)
+	}
+	drain(durationFromEnv("SHUTDOWN_GRACE_PERIOD", 0), signals)
+
+	shutdown(httpListeners)
+}
+
+// drain refuses new sessions and waits up to gracePeriod for the existing ones
+// to end on their own
+func drain(gracePeriod time.Duration, signals <-chan os.Signal) {
+	close(serverDraining)
+	if gracePeriod <= 0 {
+		return
+	}
+
+	log.Printf("Draining, waiting up to %s for %d sessions to end", gracePeriod, webrtc.SessionCount())
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	deadline := time.After(gracePeriod)
+	for webrtc.SessionCount() != 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case sig := <-signals:
+			log.Println("Received " + sig.String() + " while draining")
+			return
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits up to SHUTDOWN_TIMEOUT for
+// in-flight requests. PeerConnections are closed after signaling has finished
+func shutdown(httpListeners []*httpListener) {
+	close(serverClosing)
+
+	ctx, cancel := context.WithTimeout(context.Background(), durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, h := range httpListeners {
+		wg.Add(1)
+		go func(h *httpListener) {
+			defer wg.Done()
+			if err := h.server.Shutdown(ctx); err != nil {
+				log.Println(err)
+			}
+		}(h)
+	}
+	wg.Wait()
+
+	webrtc.Shutdown()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultStatsWSInterval = time.Second
+
+	// Dashboards can't ask for snapshots more often than this with ?interval=
+	minStatsWSInterval = time.Millisecond * 250
+
+	statsWSWriteTimeout = time.Second * 10
+)
+
+type statsSnapshotJSON struct {
+	Epoch   int64                 `json:"epoch"`
+	Node    webrtc.NodeStatus     `json:"node"`
+	Streams []webrtc.StreamStatus `json:"streams"`
+}
+
+// statsWebSocketHandler sends a snapshot of every stream and the node every
+// STATS_WS_INTERVAL, or ?interval=. Streams are filtered by tenant like /api/status
+func statsWebSocketHandler(res http.ResponseWriter, req *http.Request) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		res.Header().Set("Upgrade", "websocket")
+		logHTTPError(res, "Expected a WebSocket upgrade", http.StatusUpgradeRequired)
+		return
+	}
+
+	interval := durationFromEnv("STATS_WS_INTERVAL", defaultStatsWSInterval)
+	if val := req.URL.Query().Get("interval"); val != "" {
+		var err error
+		if interval, err = time.ParseDuration(val); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if interval < minStatsWSInterval {
+		interval = minStatsWSInterval
+	}
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return
+	}
+
+	websocket.Server{
+		// CORS allows every origin, so does the WebSocket
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			// The connection keeps the deadlines of the HTTP server
+			if err := ws.SetDeadline(time.Time{}); err != nil {
+				return
+			}
+
+			// Dashboards don't send anything, reading only notices they left
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				snapshot := statsSnapshotJSON{
+					Epoch:   time.Now().UnixMilli(),
+					Node:    webrtc.GetNodeStatus(isServerDraining()),
+					Streams: visibleStatuses(t, webrtc.GetStreamStatuses()),
+				}
+				if err := ws.SetWriteDeadline(time.Now().Add(statsWSWriteTimeout)); err != nil {
+					return
+				} else if err := websocket.JSON.Send(ws, snapshot); err != nil {
+					return
+				}
+
+				select {
+				case <-ticker.C:
+				case <-closed:
+					return
+				case <-serverClosing:
+					return
+				}
+			}
+		},
+	}.ServeHTTP(res, req)
+}
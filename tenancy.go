@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/glimesh/broadcast-box/internal/tenant"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const tenantAPIKeyHeader = "X-API-Key"
+
+var (
+	errInvalidAPIKey     = errors.New("invalid API key")
+	errTenantNotFound    = errors.New("tenant not found")
+	errReservedStreamKey = errors.New("stream keys can't contain " + tenant.Separator)
+	errTenantStreamQuota = errors.New("tenant has reached its stream quota")
+	errTenantViewerQuota = errors.New("tenant has reached its viewer quota")
+)
+
+// authenticatedTenant is the tenant whose API key the request carries in
+// X-API-Key or ?apiKey=. OBS can only set the URL and a bearer token for WHIP,
+// so the query parameter is accepted as well. It is nil if no key was sent
+func authenticatedTenant(req *http.Request) (*tenant.Tenant, error) {
+	if !tenant.Enabled() {
+		return nil, nil
+	}
+
+	apiKey := req.Header.Get(tenantAPIKeyHeader)
+	if apiKey == "" {
+		apiKey = req.URL.Query().Get("apiKey")
+	}
+	if apiKey == "" {
+		return nil, nil
+	}
+
+	t, ok := tenant.ByAPIKey(apiKey)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	return &t, nil
+}
+
+// viewingTenant also accepts ?tenant= so viewers can watch without the API key
+func viewingTenant(req *http.Request) (*tenant.Tenant, error) {
+	if t, err := authenticatedTenant(req); t != nil || err != nil {
+		return t, err
+	}
+
+	id := req.URL.Query().Get("tenant")
+	if id == "" {
+		return nil, nil
+	}
+
+	t, ok := tenant.ByID(id)
+	if !ok {
+		return nil, errTenantNotFound
+	}
+	return &t, nil
+}
+
+// namespacedStreamKey is the stream key used internally. Stream keys outside a
+// tenant may not look like they belong to one
+func namespacedStreamKey(t *tenant.Tenant, streamKey string) (string, error) {
+	if t != nil {
+		return t.StreamKey(streamKey), nil
+	} else if tenant.Enabled() && tenant.IsNamespaced(streamKey) {
+		return "", errReservedStreamKey
+	}
+
+	return streamKey, nil
+}
+
+// visibleStatuses are the streams of the tenant with their stream keys as the
+// tenant knows them. Without a tenant only streams outside every tenant are returned
+func visibleStatuses(t *tenant.Tenant, statuses []webrtc.StreamStatus) []webrtc.StreamStatus {
+	if !tenant.Enabled() {
+		return statuses
+	}
+
+	visible := []webrtc.StreamStatus{}
+	for _, status := range statuses {
+		if t == nil && !tenant.IsNamespaced(status.StreamKey) {
+			visible = append(visible, status)
+		} else if t != nil && t.Owns(status.StreamKey) {
+			status.StreamKey = t.StripNamespace(status.StreamKey)
+			visible = append(visible, status)
+		}
+	}
+
+	return visible
+}
+
+// checkTenantQuota returns an error if starting a stream or viewer session
+// would take the tenant over its quota. A publisher reconnecting to a stream
+// that is already live doesn't count again
+func checkTenantQuota(t *tenant.Tenant, streamKey string, isViewer bool) error {
+	if t == nil || (isViewer && t.MaxViewers == 0) || (!isViewer && t.MaxStreams == 0) {
+		return nil
+	}
+
+	streams, viewers := 0, 0
+	for _, status := range webrtc.GetStreamStatuses() {
+		if !t.Owns(status.StreamKey) {
+			continue
+		}
+
+		viewers += status.ViewerCount
+		if status.IsStreaming && status.StreamKey != streamKey {
+			streams++
+		}
+	}
+
+	if isViewer && viewers >= t.MaxViewers {
+		return errTenantViewerQuota
+	} else if !isViewer && streams >= t.MaxStreams {
+		return errTenantStreamQuota
+	}
+	return nil
+}
+
+// tenantStreamKey namespaces the stream key of a WHIP or WHEP request and
+// enforces the quota of its tenant
+func tenantStreamKey(req *http.Request, streamKey string, isViewer bool) (string, error) {
+	resolveTenant := authenticatedTenant
+	if isViewer {
+		resolveTenant = viewingTenant
+	}
+
+	t, err := resolveTenant(req)
+	if err != nil {
+		return "", err
+	}
+
+	if streamKey, err = namespacedStreamKey(t, streamKey); err != nil {
+		return "", err
+	}
+
+	return streamKey, checkTenantQuota(t, streamKey, isViewer)
+}
+
+// tenantErrorStatus maps the errors above to a HTTP status code
+func tenantErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTenantStreamQuota), errors.Is(err, errTenantViewerQuota):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errInvalidAPIKey):
+		return http.StatusUnauthorized
+	case errors.Is(err, errTenantNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	contentTypeWebVTT = "text/vtt"
+
+	// Sent by WHEP clients with the event versions and types they handle,
+	// delineated by ','. Without them every event of the current version is sent
+	eventVersionsHeader = "X-Event-Versions"
+	eventTypesHeader    = "X-Event-Types"
+
+	// Answered with the event version the session was sent
+	eventVersionHeader = "X-Event-Version"
+)
+
+var (
+	errWebVTTCueTiming         = errors.New("WebVTT cue has no valid timing line")
+	errUnsupportedEventVersion = errors.New("none of the event versions are supported")
+
+	// Every event the SSE extension sends, layers and disconnected can't be
+	// negotiated away
+	sseEventTypes = []string{"layers", "caption", "metadata", "ended", "networkQuality", "disconnected", "maintenance", "uploadQuota", "streamMetadata"}
+)
+
+// negotiateViewerEvents picks the events a WHEP session is sent from
+// X-Event-Versions and X-Event-Types. Clients that don't support the current
+// version are refused, unknown types are ignored so clients can list events of
+// newer servers
+func negotiateViewerEvents(req *http.Request) (map[string]bool, error) {
+	if val := req.Header.Get(eventVersionsHeader); val != "" {
+		supported := false
+		for _, version := range strings.Split(val, ",") {
+			if v, err := strconv.Atoi(strings.TrimSpace(version)); err == nil && v == webrtc.ViewerEventsVersion {
+				supported = true
+			}
+		}
+
+		if !supported {
+			return nil, errUnsupportedEventVersion
+		}
+	}
+
+	val := req.Header.Get(eventTypesHeader)
+	if val == "" {
+		return nil, nil
+	}
+
+	eventTypes := map[string]bool{}
+	for _, eventType := range strings.Split(val, ",") {
+		eventTypes[strings.TrimSpace(eventType)] = true
+	}
+	return eventTypes, nil
+}
+
+// sseEventsLink lists the events a WHEP session is sent for its Link header
+func sseEventsLink(eventTypes map[string]bool) string {
+	events := []string{}
+	for _, eventType := range sseEventTypes {
+		if eventTypes == nil || eventTypes[eventType] || eventType == "layers" || eventType == "ended" || eventType == "disconnected" {
+			events = append(events, eventType)
+		}
+	}
+	return strings.Join(events, ",")
+}
+
+// captionsHandler sends a caption cue to every viewer of a stream. The body is
+// either JSON or a single WebVTT cue, whose timing sets the duration
+func captionsHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey, ok := viewerEventStreamKey(res, req)
+	if !ok {
+		return
+	}
+
+	var caption webrtc.Caption
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == contentTypeWebVTT {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if caption, err = parseWebVTTCue(string(body)); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		caption.Language = req.URL.Query().Get("language")
+	} else if err := json.NewDecoder(req.Body).Decode(&caption); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	event, err := webrtc.PublishCaption(streamKey, caption)
+	writeViewerEvent(res, event, err)
+}
+
+// timedMetadataHandler sends timed metadata to every viewer of a stream and
+// records it into the sidecar of the active recording
+func timedMetadataHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey, ok := viewerEventStreamKey(res, req)
+	if !ok {
+		return
+	}
+
+	var metadata webrtc.TimedMetadata
+	if err := json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	event, err := webrtc.PublishTimedMetadata(streamKey, metadata)
+	writeViewerEvent(res, event, err)
+}
+
+// streamMetadataHandler returns the metadata of a live stream with GET and
+// replaces it with PUT
+func streamMetadataHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey, ok := viewerEventStreamKey(res, req)
+	if !ok {
+		return
+	}
+
+	var (
+		metadata webrtc.StreamMetadata
+		err      error
+	)
+	if req.Method == http.MethodPut {
+		if err = json.NewDecoder(req.Body).Decode(&metadata); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metadata, err = webrtc.SetStreamMetadata(streamKey, metadata)
+	} else {
+		metadata, err = webrtc.GetStreamMetadata(streamKey)
+	}
+
+	switch {
+	case errors.Is(err, webrtc.ErrStreamNotActive):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	default:
+		writeJSON(res, http.StatusOK, metadata)
+	}
+}
+
+// viewerEventStreamKey is the stream key at the end of the path, if the
+// request is allowed to publish events to it
+func viewerEventStreamKey(res http.ResponseWriter, req *http.Request) (string, bool) {
+	vals := strings.Split(req.URL.Path, "/")
+
+	t, err := authenticatedTenant(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return "", false
+	}
+
+	streamKey, err := namespacedStreamKey(t, vals[len(vals)-1])
+	if err != nil {
+		logHTTPError(res, err.Error(), tenantErrorStatus(err))
+		return "", false
+	}
+
+	if !publisherAuthorized(req, streamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	return streamKey, true
+}
+
+func writeViewerEvent(res http.ResponseWriter, event webrtc.ViewerEvent, err error) {
+	switch {
+	case errors.Is(err, webrtc.ErrStreamNotActive):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	default:
+		writeJSON(res, http.StatusCreated, event)
+	}
+}
+
+// parseWebVTTCue reads one cue, optionally preceded by the WEBVTT header and a
+// cue identifier. Cue settings after the end time are ignored
+func parseWebVTTCue(body string) (webrtc.Caption, error) {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		start, rest, ok := strings.Cut(line, "-->")
+		if !ok {
+			continue
+		}
+
+		end := strings.Fields(rest)
+		if len(end) == 0 {
+			return webrtc.Caption{}, errWebVTTCueTiming
+		}
+
+		startTime, startErr := parseWebVTTTimestamp(strings.TrimSpace(start))
+		endTime, endErr := parseWebVTTTimestamp(end[0])
+		if startErr != nil || endErr != nil || endTime <= startTime {
+			return webrtc.Caption{}, errWebVTTCueTiming
+		}
+
+		return webrtc.Caption{
+			Text:       strings.Join(lines[i+1:], "\n"),
+			DurationMs: (endTime - startTime).Milliseconds(),
+		}, nil
+	}
+
+	return webrtc.Caption{}, errWebVTTCueTiming
+}
+
+// parseWebVTTTimestamp parses `hh:mm:ss.ttt` or `mm:ss.ttt`
+func parseWebVTTTimestamp(timestamp string) (time.Duration, error) {
+	clock, millis, ok := strings.Cut(timestamp, ".")
+	if !ok || len(millis) != 3 {
+		return 0, errWebVTTCueTiming
+	}
+
+	parts := strings.Split(clock, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, errWebVTTCueTiming
+	}
+
+	seconds := uint64(0)
+	for _, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, errWebVTTCueTiming
+		}
+		seconds = seconds*60 + n
+	}
+
+	ms, err := strconv.ParseUint(millis, 10, 32)
+	if err != nil {
+		return 0, errWebVTTCueTiming
+	}
+
+	return time.Duration(seconds)*time.Second + time.Duration(ms)*time.Millisecond, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+var vodContentTypes = map[string]string{
+	".webm": "video/webm",
+	".h264": "video/h264",
+	".ivf":  "video/x-ivf",
+	".ogg":  "audio/ogg",
+}
+
+// vodHandler serves finished recordings. `/vod/{recordingId}` is the WebM of
+// the video and audio, or the audio of recordings without video.
+// `/vod/{recordingId}/video` and `/vod/{recordingId}/audio` are the streams as
+// recorded and `/vod/{recordingId}/metadata` the sidecar. Segmented recordings
+// select a segment with ?segment=. Media is served with http.ServeContent so
+// Range requests are supported
+func vodHandler(res http.ResponseWriter, req *http.Request) {
+	_, rest, _ := strings.Cut(req.URL.Path, "/vod/")
+	recordingId, part, _ := strings.Cut(rest, "/")
+
+	metadata, err := webrtc.GetRecordingMetadata(recordingId)
+	if errors.Is(err, webrtc.ErrRecordingNotFound) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Video elements can't send headers, so the publish token may be in ?token=
+	if token := req.URL.Query().Get("token"); token != "" && req.Header.Get(publishTokenHeader) == "" {
+		req.Header.Set(publishTokenHeader, token)
+	}
+
+	if !publisherAuthorized(req, metadata.StreamKey) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	} else if metadata.Status == webrtc.RecordingStatusRecording {
+		logHTTPError(res, "Recording has not finished", http.StatusConflict)
+		return
+	}
+
+	var wanted []string
+	switch part {
+	case "":
+		wanted = []string{".webm"}
+		if metadata.VideoCodec == "" {
+			wanted = []string{".ogg"}
+		}
+	case "video":
+		wanted = []string{".h264", ".ivf"}
+	case "audio":
+		wanted = []string{".ogg"}
+	case "metadata":
+		res.Header().Add("Content-Type", "application/json")
+		if err = json.NewEncoder(res).Encode(metadata); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+		return
+	default:
+		logHTTPError(res, "Not found", http.StatusNotFound)
+		return
+	}
+
+	files := metadata.Files
+	if val := req.URL.Query().Get("segment"); val != "" {
+		segment, err := strconv.Atoi(val)
+		if err != nil || segment < 0 || segment >= len(metadata.Segments) {
+			logHTTPError(res, "Segment not found", http.StatusNotFound)
+			return
+		}
+		files = metadata.Segments[segment].Files
+	}
+
+	for _, file := range files {
+		for _, extension := range wanted {
+			if filepath.Ext(file) == extension {
+				serveVODFile(res, req, file)
+				return
+			}
+		}
+	}
+
+	logHTTPError(res, "Recording has no "+strings.Join(wanted, " or ")+" file", http.StatusNotFound)
+}
+
+func serveVODFile(res http.ResponseWriter, req *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The elementary streams can't be played, only downloaded
+	disposition := "inline"
+	if extension := filepath.Ext(path); extension == ".h264" || extension == ".ivf" {
+		disposition = "attachment"
+	}
+
+	// Recordings are only served to their publisher, so caches must not keep them
+	res.Header().Set("Content-Type", vodContentTypes[filepath.Ext(path)])
+	res.Header().Set("Content-Disposition", disposition+`; filename="`+filepath.Base(path)+`"`)
+	res.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(res, req, filepath.Base(path), stat.ModTime(), f)
+}
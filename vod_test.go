@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/glimesh/broadcast-box/pkg/testclient"
+)
+
+// readEBMLElement splits the first element off b
+func readEBMLElement(t *testing.T, b []byte) (id uint32, data, rest []byte) {
+	readVint := func(keepMarker bool) uint64 {
+		if len(b) == 0 || b[0] == 0 {
+			t.Fatalf("invalid EBML at %x", b)
+		}
+
+		length := bits.LeadingZeros8(b[0]) + 1
+		v := uint64(b[0])
+		if !keepMarker {
+			v &= 0xff >> length
+		}
+		for i := 1; i < length; i++ {
+			v = v<<8 | uint64(b[i])
+		}
+		b = b[length:]
+		return v
+	}
+
+	id = uint32(readVint(true))
+	size := readVint(false)
+	if size > uint64(len(b)) {
+		t.Fatalf("element %x has size %d, only %d bytes left", id, size, len(b))
+	}
+
+	return id, b[:size], b[size:]
+}
+
+func TestVODServesPlayableWebM(t *testing.T) {
+	t.Setenv("PUBLISH_SECRET", "secret")
+	t.Setenv("RECORDING_DIRECTORY", t.TempDir())
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	publisher, err := testclient.Publish(ctx, server.URL+"/api/whip", "vod-webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close() //nolint
+
+	viewer, err := testclient.View(ctx, server.URL+"/api/whep", "vod-webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close() //nolint
+
+	if err = viewer.WaitForMedia(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	recording, err := webrtc.StartRecording("Bearer vod-webm", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test client sends a keyframe every second
+	time.Sleep(time.Millisecond * 2500)
+	if _, err = webrtc.StopRecording(recording.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A video element can only authenticate with ?token=
+	res := httptest.NewRecorder()
+	vodHandler(res, httptest.NewRequest(http.MethodGet, "/api/vod/"+recording.ID+"?token="+publishToken("Bearer vod-webm"), nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", res.Code, res.Body)
+	} else if contentType := res.Header().Get("Content-Type"); contentType != "video/webm" {
+		t.Fatalf("expected video/webm, got %s", contentType)
+	}
+
+	id, _, rest := readEBMLElement(t, res.Body.Bytes())
+	if id != 0x1A45DFA3 {
+		t.Fatalf("expected the EBML header, got %x", id)
+	}
+
+	// The Segment size is written once the recording stops
+	id, segment, rest := readEBMLElement(t, rest)
+	if id != 0x18538067 || len(rest) != 0 {
+		t.Fatalf("expected one Segment, got %x with %d bytes after it", id, len(rest))
+	}
+
+	elements := map[uint32]int{}
+	var duration float64
+	for len(segment) != 0 {
+		var data []byte
+		id, data, segment = readEBMLElement(t, segment)
+		elements[id]++
+
+		if id == 0x1549A966 { // Info
+			for len(data) != 0 {
+				var infoData []byte
+				if id, infoData, data = readEBMLElement(t, data); id == 0x4489 {
+					duration = math.Float64frombits(binary.BigEndian.Uint64(infoData))
+				}
+			}
+		}
+	}
+
+	if elements[0x114D9B74] != 1 || elements[0x1654AE6B] != 1 || elements[0x1C53BB6B] != 1 {
+		t.Fatalf("expected a SeekHead, Tracks and Cues, got %v", elements)
+	} else if elements[0x1F43B675] < 2 {
+		t.Fatalf("expected a Cluster per keyframe, got %v", elements)
+	} else if duration < 1000 {
+		t.Fatalf("expected over a second of video, got %fms", duration)
+	}
+
+	res = httptest.NewRecorder()
+	vodHandler(res, httptest.NewRequest(http.MethodGet, "/api/vod/"+recording.ID+"?token=wrong", nil))
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", res.Code)
+	}
+}
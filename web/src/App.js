@@ -5,6 +5,7 @@ import Header from './components/header'
 import Selection from './components/selection'
 import PlayerPage from './components/player'
 import Publish from './components/publish'
+import VOD from './components/vod'
 
 function App() {
   return (
@@ -13,6 +14,7 @@ function App() {
         <Route path='/' element={<Header />}>
           <Route index element={<Selection />} />
           <Route path='/publish/*' element={<Publish />} />
+          <Route path='/vod/:recordingId' element={<VOD />} />
           <Route path='/*' element={<PlayerPage />} />
         </Route>
       </Routes>
@@ -4,6 +4,16 @@ import { useLocation } from 'react-router-dom'
 
 export const CinemaModeContext = React.createContext(null);
 
+// Lets the server resume on the same layer if this viewer reconnects
+function getViewerId() {
+  let viewerId = localStorage.getItem("viewer-id");
+  if (!viewerId) {
+    viewerId = crypto.randomUUID();
+    localStorage.setItem("viewer-id", viewerId);
+  }
+  return viewerId;
+}
+
 export function CinemaModeProvider({ children }) {
   const [cinemaMode, setCinemaMode] = useState(() => localStorage.getItem("cinema-mode") === "true");
   const state = useMemo(() => ({
@@ -38,6 +48,14 @@ function Player({ cinemaMode }) {
   const [videoLayers, setVideoLayers] = React.useState([]);
   const [mediaSrcObject, setMediaSrcObject] = React.useState(null);
   const [layerEndpoint, setLayerEndpoint] = React.useState('');
+  const [caption, setCaption] = React.useState(null);
+  const [networkQuality, setNetworkQuality] = React.useState(null);
+  const [streamEnded, setStreamEnded] = React.useState(false);
+  const [disconnectReason, setDisconnectReason] = React.useState(null);
+  const [maintenance, setMaintenance] = React.useState(null);
+  const [password, setPassword] = React.useState('');
+  const [passwordRequired, setPasswordRequired] = React.useState(false);
+  const [systemAudio, setSystemAudio] = React.useState(() => localStorage.getItem("system-audio") !== "false");
 
   const onLayerChange = event => {
     fetch(layerEndpoint, {
@@ -57,6 +75,8 @@ function Player({ cinemaMode }) {
 
   React.useEffect(() => {
     const peerConnection = new RTCPeerConnection() // eslint-disable-line
+    let evtSource = null
+    let captionTimeout = null
 
     peerConnection.ontrack = function (event) {
       setMediaSrcObject(event.streams[0])
@@ -65,6 +85,11 @@ function Player({ cinemaMode }) {
     peerConnection.addTransceiver('audio', { direction: 'recvonly' })
     peerConnection.addTransceiver('video', { direction: 'recvonly' })
 
+    // A second audio track receives the audio of a shared screen or tab
+    if (systemAudio) {
+      peerConnection.addTransceiver('audio', { direction: 'recvonly' })
+    }
+
     peerConnection.createOffer().then(offer => {
       offer["sdp"] = offer["sdp"].replace("useinbandfec=1", "useinbandfec=1;stereo=1")
       peerConnection.setLocalDescription(offer)
@@ -74,20 +99,49 @@ function Player({ cinemaMode }) {
         body: offer.sdp,
         headers: {
           Authorization: `Bearer ${location.pathname.substring(1)}`,
-          'Content-Type': 'application/sdp'
+          'Content-Type': 'application/sdp',
+          'X-Viewer-ID': getViewerId(),
+          'X-Event-Versions': '1',
+          'X-Playback-Password': password,
+          'X-Playback-Token': new URLSearchParams(location.search).get('token') || ''
         }
       }).then(r => {
+        if (r.status === 401) {
+          setPasswordRequired(true)
+          return Promise.reject(new Error('Playback password is incorrect'))
+        }
+        setPasswordRequired(false)
+
         const parsedLinkHeader = parseLinkHeader(r.headers.get('Link'))
         setLayerEndpoint(`${window.location.protocol}//${parsedLinkHeader['urn:ietf:params:whep:ext:core:layer'].url}`)
 
-        const evtSource = new EventSource(`${window.location.protocol}//${parsedLinkHeader['urn:ietf:params:whep:ext:core:server-sent-events'].url}`)
-        evtSource.onerror = err => evtSource.close();
+        // The server ends the event stream periodically, EventSource reconnects on its own
+        evtSource = new EventSource(`${window.location.protocol}//${parsedLinkHeader['urn:ietf:params:whep:ext:core:server-sent-events'].url}`)
 
         evtSource.addEventListener("layers", event => {
           const parsed = JSON.parse(event.data)
           setVideoLayers(parsed['1']['layers'].map(l => l.encodingId))
+          if (parsed['1']['layers'].length !== 0) {
+            setStreamEnded(false)
+          }
         })
-
+        evtSource.addEventListener("ended", () => setStreamEnded(true))
+        evtSource.addEventListener("caption", event => {
+          const parsed = JSON.parse(event.data)
+          setCaption(parsed.data.text)
+          clearTimeout(captionTimeout)
+          captionTimeout = setTimeout(() => setCaption(null), parsed.data.durationMs)
+        })
+        evtSource.addEventListener("networkQuality", event => setNetworkQuality(JSON.parse(event.data).score))
+        evtSource.addEventListener("disconnected", event => {
+          setDisconnectReason(JSON.parse(event.data).reason)
+          evtSource.close()
+        })
+        evtSource.addEventListener("maintenance", event => {
+          const parsed = JSON.parse(event.data).data
+          setMaintenance(parsed.active || parsed.secondsRemaining > 0 ? parsed : null)
+        })
+        evtSource.addEventListener("closing", () => evtSource.close())
 
         return r.text()
       }).then(answer => {
@@ -100,8 +154,29 @@ function Player({ cinemaMode }) {
 
     return function cleanup() {
       peerConnection.close()
+      clearTimeout(captionTimeout)
+      setCaption(null)
+      setStreamEnded(false)
+      if (evtSource) {
+        evtSource.close()
+      }
     }
-  }, [location.pathname])
+  }, [location.pathname, password, systemAudio])
+
+  useEffect(() => localStorage.setItem("system-audio", systemAudio), [systemAudio]);
+
+  const onPasswordSubmit = event => {
+    event.preventDefault()
+    setPassword(event.target.elements.password.value)
+  }
+
+  if (passwordRequired) {
+    return (
+      <form onSubmit={onPasswordSubmit} className="w-full">
+        <input type="password" name="password" placeholder="This stream needs a password" className="appearance-none border w-full py-2 px-3 leading-tight focus:outline-none focus:shadow-outline bg-gray-700 border-gray-700 text-white rounded shadow-md placeholder-gray-200" />
+      </form>
+    )
+  }
 
   return (
     <>
@@ -114,6 +189,33 @@ function Player({ cinemaMode }) {
         className={`bg-black w-full ${cinemaMode && "min-h-screen"}`}
       />
 
+      {disconnectReason !== null &&
+        <p className='bg-gray-700 text-white text-lg text-center w-full p-5'>
+          {disconnectReason === 'kicked' ? 'You were removed from the stream' : `You were disconnected (${disconnectReason})`}
+        </p>
+      }
+
+      {maintenance !== null &&
+        <p className='bg-yellow-700 text-white text-lg text-center w-full p-5'>
+          {maintenance.active ? 'Maintenance has started' : `Maintenance starts ${new Date(maintenance.startsAt * 1000).toLocaleTimeString()}`}
+          {maintenance.message && `: ${maintenance.message}`}
+        </p>
+      }
+
+      {streamEnded &&
+        <p className='bg-gray-700 text-white text-lg text-center w-full p-5'>The stream has ended</p>
+      }
+
+      {networkQuality !== null &&
+        <p className={`text-sm text-right w-full px-3 ${networkQuality >= 4 ? 'text-green-400' : networkQuality >= 3 ? 'text-yellow-400' : 'text-red-400'}`}>
+          Connection quality {networkQuality}/5
+        </p>
+      }
+
+      {caption !== null &&
+        <p className='bg-black text-white text-lg text-center w-full py-2 px-3 whitespace-pre-wrap'>{caption}</p>
+      }
+
       {videoLayers.length >= 2 &&
         <select defaultValue="disabled" onChange={onLayerChange} className="appearance-none border w-full py-2 px-3 leading-tight focus:outline-none focus:shadow-outline bg-gray-700 border-gray-700 text-white rounded shadow-md placeholder-gray-200">
           <option value="disabled" disabled={true}>Choose Quality Level</option>
@@ -122,6 +224,11 @@ function Player({ cinemaMode }) {
           })}
         </select>
       }
+
+      <label className='text-white mt-2 self-start'>
+        <input type='checkbox' checked={systemAudio} onChange={e => setSystemAudio(e.target.checked)} className='mr-2' />
+        Play the audio of shared screens
+      </label>
     </>
   )
 }
@@ -12,13 +12,31 @@ function Player(props) {
   const [mediaAccessError, setMediaAccessError] = React.useState(null);
   const [publishSuccess, setPublishSuccess] = React.useState(false);
   const [useDisplayMedia, setUseDisplayMedia] = React.useState(false);
+  const [viewerCount, setViewerCount] = React.useState(null);
 
   React.useEffect(() => {
     const peerConnection = new RTCPeerConnection() // eslint-disable-line
     let stream = null
 
+    // The server pushes the audience of the stream on this channel
+    const statsChannel = peerConnection.createDataChannel('broadcast-box', { negotiated: true, id: 0 })
+    statsChannel.onmessage = e => {
+      const stats = JSON.parse(e.data)
+      if (stats.type === 'viewers') {
+        setViewerCount(stats.viewerCount)
+      }
+    }
+
+    // The microphone is sent first when sharing a screen, the server treats
+    // the audio of the screen or tab as a second audio track
     const mediaPromise = useDisplayMedia ?
-      navigator.mediaDevices.getDisplayMedia(mediaOptions) :
+      Promise.all([
+        navigator.mediaDevices.getUserMedia({ audio: true }).catch(() => null),
+        navigator.mediaDevices.getDisplayMedia(mediaOptions)
+      ]).then(([microphone, display]) => new MediaStream([
+        ...(microphone ? microphone.getTracks() : []),
+        ...display.getTracks()
+      ])) :
       navigator.mediaDevices.getUserMedia(mediaOptions)
 
     mediaPromise.then(s => {
@@ -76,6 +94,7 @@ function Player(props) {
     }, setMediaAccessError)
 
     return function cleanup() {
+      setViewerCount(null)
       peerConnection.close()
       if (stream !== null) {
         stream.getTracks().forEach(t => t.stop())
@@ -86,7 +105,7 @@ function Player(props) {
   return (
     <div className='container mx-auto'>
       {mediaAccessError != null && <MediaAccessError>{mediaAccessError}</MediaAccessError>}
-      {publishSuccess === true && <PublishSuccess />}
+      {publishSuccess === true && <PublishSuccess viewerCount={viewerCount} />}
       <video
         ref={videoRef}
         autoPlay
@@ -122,7 +141,7 @@ function MediaAccessError({ children: error }) {
   )
 }
 
-function PublishSuccess() {
+function PublishSuccess({ viewerCount }) {
   const subscribeUrl = window.location.href.replace('publish/', '')
 
   return (
@@ -130,6 +149,7 @@ function PublishSuccess() {
       'text-center p-5 rounded-t-lg whitespace-pre-wrap'
     }>
       Live: Currently streaming to <a href={subscribeUrl} target="_blank" rel="noreferrer" className="hover:underline">{subscribeUrl}</a>
+      {viewerCount !== null && <>{'\n'}Viewers: {viewerCount}</>}
     </p>
   )
 }
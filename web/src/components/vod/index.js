@@ -0,0 +1,100 @@
+import React from 'react'
+import { useParams, useSearchParams } from 'react-router-dom'
+
+const inputClassName = 'appearance-none border w-full py-2 px-3 leading-tight focus:outline-none focus:shadow-outline bg-gray-700 border-gray-700 text-white rounded shadow-md placeholder-gray-200'
+
+// Plays a finished recording. Recordings are only served to their publisher,
+// the publish token is sent in ?token= as video elements can't send headers
+function VOD() {
+  const { recordingId } = useParams()
+  const [searchParams] = useSearchParams()
+  const [token, setToken] = React.useState(() => searchParams.get('token') || '')
+  const [metadata, setMetadata] = React.useState(null)
+  const [error, setError] = React.useState(null)
+  const [segment, setSegment] = React.useState(0)
+
+  React.useEffect(() => {
+    setMetadata(null)
+    setError(null)
+    if (token === '') {
+      return
+    }
+
+    fetch(`${process.env.REACT_APP_API_PATH}/vod/${recordingId}/metadata`, {
+      headers: { 'X-Publish-Token': token }
+    }).then(res => {
+      if (res.status === 401) {
+        throw new Error('The publish token is not valid for this recording')
+      } else if (res.status === 404) {
+        throw new Error('The recording was not found')
+      } else if (res.status === 409) {
+        throw new Error('The recording has not finished')
+      } else if (!res.ok) {
+        throw new Error(`The recording could not be loaded (${res.status})`)
+      }
+
+      return res.json()
+    }).then(setMetadata).catch(err => setError(err.message))
+  }, [recordingId, token])
+
+  const onTokenSubmit = event => {
+    event.preventDefault()
+    setToken(event.target.elements.token.value)
+  }
+
+  if (token === '' || error !== null) {
+    return (
+      <form onSubmit={onTokenSubmit} className='mx-auto max-w-2xl rounded-md bg-gray-800 shadow-md p-8'>
+        {error !== null && <p className='text-red-400 mb-4'>{error}</p>}
+        <label className='block text-sm font-bold mb-2' htmlFor='token'>Publish Token</label>
+        <input className={inputClassName} id='token' name='token' type='password' placeholder='Publish Token' autoFocus />
+      </form>
+    )
+  }
+
+  if (metadata === null) {
+    return <p className='text-center'>Loading recording</p>
+  }
+
+  const segmented = metadata.segments && metadata.segments.length > 0
+  const files = segmented ? metadata.segments[segment].files : metadata.files
+  const query = new URLSearchParams({ token, ...(segmented && { segment }) }).toString()
+  const mediaURL = part => `${process.env.REACT_APP_API_PATH}/vod/${recordingId}${part}?${query}`
+
+  const hasWebM = files.some(f => f.endsWith('.webm'))
+  const hasRawVideo = files.some(f => f.endsWith('.h264') || f.endsWith('.ivf'))
+
+  return (
+    <div className='flex flex-col items-center mx-auto px-2 py-2 container space-y-4'>
+      {hasWebM &&
+        <video key={mediaURL('')} src={mediaURL('')} controls playsInline className='bg-black w-full' />
+      }
+
+      {!hasWebM && !metadata.videoCodec &&
+        <audio key={mediaURL('')} src={mediaURL('')} controls className='w-full' />
+      }
+
+      {!hasWebM && metadata.videoCodec &&
+        <p className='bg-gray-700 text-white text-lg text-center w-full p-5'>
+          {metadata.videoCodec} recordings can't be played in the browser, download them below
+        </p>
+      }
+
+      {segmented &&
+        <select value={segment} onChange={e => setSegment(Number(e.target.value))} className={inputClassName}>
+          {metadata.segments.map(s => {
+            return <option key={s.index} value={s.index}>Segment {s.index + 1}, {new Date(s.startedAt * 1000).toLocaleTimeString()}</option>
+          })}
+        </select>
+      }
+
+      <p className='self-start'>
+        Recorded {new Date(metadata.startedAt * 1000).toLocaleString()}.
+        Download the {hasRawVideo && <><a href={mediaURL('/video')} className='underline'>video</a> or </>}
+        <a href={mediaURL('/audio')} className='underline'>audio</a> as recorded
+      </p>
+    </div>
+  )
+}
+
+export default VOD
@@ -0,0 +1,21 @@
+//go:build embedweb
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:web/build
+var embeddedWeb embed.FS
+
+// embeddedWebBuild returns the frontend compiled into the binary with `-tags embedweb`
+func embeddedWebBuild() (fs.FS, bool) {
+	build, err := fs.Sub(embeddedWeb, "web/build")
+	if err != nil {
+		panic(err)
+	}
+
+	return build, true
+}
@@ -0,0 +1,10 @@
+//go:build !embedweb
+
+package main
+
+import "io/fs"
+
+// embeddedWebBuild returns false, build with `-tags embedweb` to include the frontend
+func embeddedWebBuild() (fs.FS, bool) {
+	return nil, false
+}
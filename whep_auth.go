@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webhook"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	defaultWHEPAuthTimeout = time.Second * 5
+
+	// Sent by viewers for the WHEP authorization webhook, ?token= works as well
+	playbackTokenHeader = "X-Playback-Token"
+)
+
+type (
+	whepAuthRequestJSON struct {
+		StreamKey string `json:"streamKey"`
+		Token     string `json:"token"`
+		ClientIP  string `json:"clientIp"`
+		ViewerID  string `json:"viewerId,omitempty"`
+	}
+
+	whepAuthResponseJSON struct {
+		Allow    bool   `json:"allow"`
+		MaxLayer string `json:"maxLayer"`
+
+		// Unix timestamp in seconds the session is ended at, 0 never ends it
+		ExpiresAt int64 `json:"expiresAt"`
+	}
+)
+
+var (
+	errWHEPAuthDenied  = errors.New("playback was not authorized")
+	errWHEPAuthExpired = errors.New("playback authorization has expired")
+)
+
+// authorizeWHEP asks WHEP_AUTH_URL if the viewer may watch streamKey and
+// which constraints its session has. Without WHEP_AUTH_URL every viewer is
+// allowed. Viewers are refused if the webhook fails
+func authorizeWHEP(req *http.Request, streamKey string) (webrtc.WHEPConstraints, error) {
+	url := os.Getenv("WHEP_AUTH_URL")
+	if url == "" {
+		return webrtc.WHEPConstraints{}, nil
+	}
+
+	token := req.Header.Get(playbackTokenHeader)
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+
+	body, err := json.Marshal(whepAuthRequestJSON{
+		StreamKey: streamKey,
+		Token:     token,
+		ClientIP:  clientIP(req),
+		ViewerID:  req.Header.Get(viewerIdHeader),
+	})
+	if err != nil {
+		return webrtc.WHEPConstraints{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), durationFromEnv("WHEP_AUTH_TIMEOUT", defaultWHEPAuthTimeout))
+	defer cancel()
+
+	resBody, err := webhook.Call(ctx, url, body)
+	if err != nil {
+		return webrtc.WHEPConstraints{}, err
+	}
+
+	var r whepAuthResponseJSON
+	if err = json.Unmarshal(resBody, &r); err != nil {
+		return webrtc.WHEPConstraints{}, err
+	} else if !r.Allow {
+		return webrtc.WHEPConstraints{}, errWHEPAuthDenied
+	}
+
+	constraints := webrtc.WHEPConstraints{MaxLayer: r.MaxLayer}
+	if r.ExpiresAt != 0 {
+		if constraints.ExpiresAt = time.Unix(r.ExpiresAt, 0); time.Now().After(constraints.ExpiresAt) {
+			return webrtc.WHEPConstraints{}, errWHEPAuthExpired
+		}
+	}
+	return constraints, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/glimesh/broadcast-box/pkg/testclient"
+)
+
+func TestMain(m *testing.M) {
+	webrtc.Configure()
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the WHIP and WHEP endpoints like main does
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/whip", whipHandler)
+	mux.HandleFunc("/api/whip/", whipSessionHandler)
+	mux.HandleFunc("/api/whep", whepHandler)
+	mux.HandleFunc("/api/whep/", whepHandler)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWHEPByPathKey(t *testing.T) {
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// The publisher sends the key as a bearer token, viewers only put the key in the path
+	publisher, err := testclient.Publish(ctx, server.URL+"/api/whip", "path-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close() //nolint
+
+	viewer, err := testclient.View(ctx, server.URL+"/api/whep/path-key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close() //nolint
+
+	if err = viewer.WaitForMedia(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishAndView(t *testing.T) {
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	publisher, err := testclient.Publish(ctx, server.URL+"/api/whip", "publish-and-view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close() //nolint
+
+	// Every viewer gets the audio and video of the publisher
+	for i := 0; i < 2; i++ {
+		viewer, err := testclient.View(ctx, server.URL+"/api/whep", "publish-and-view")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer viewer.Close() //nolint
+
+		if err = viewer.WaitForMedia(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
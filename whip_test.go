@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/glimesh/broadcast-box/pkg/testclient"
+)
+
+func TestPublisherLeavesMultiPublisherRoom(t *testing.T) {
+	server := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	first, err := testclient.Publish(ctx, server.URL+"/api/whip", "two-publishers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := testclient.Publish(ctx, server.URL+"/api/whip", "two-publishers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close() //nolint
+
+	viewer, err := testclient.View(ctx, server.URL+"/api/whep", "two-publishers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close() //nolint
+
+	if err = viewer.WaitForMedia(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the disconnect time to be handled, the remaining publisher keeps the stream live
+	time.Sleep(time.Second)
+	if !webrtc.IsLive("Bearer two-publishers") {
+		t.Fatal("stream ended while a publisher was still connected")
+	}
+
+	_, videoBefore := viewer.PacketsReceived()
+	time.Sleep(time.Second)
+	if _, videoAfter := viewer.PacketsReceived(); videoAfter == videoBefore {
+		t.Fatal("viewer stopped receiving video after one publisher left")
+	}
+}